@@ -1 +1,191 @@
-package kg
+// Command kg receives the GitLab webhooks of the projects tracked by the knowledge graph and forwards them to its
+// services with the access token of the project. Projects are activated with PUT /projects/<id> and deactivated with
+// DELETE /projects/<id>, which registers or removes their webhook in GitLab. The requests to
+// /knowledge-graph/projects/<id> are proxied to the knowledge graph API anonymously for public projects and with the
+// project token for the projects the caller can see in GitLab. The proxy reads the sessions served by the login
+// command, with -session-binding the sessions used by another client than the one that logged in are reported or
+// revoked.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/auditlog"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/boltadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlabwebhooks"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/httpapi"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/kgclient"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/kgproxy"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/redisadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/tokenrevoker"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/kgaccess"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/kgevents"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projecttokenmgr"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projectwebhookmgr"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/sessionmgr"
+	"github.com/go-redis/redis/v9"
+)
+
+func main() {
+	listenAddr := flag.String("listen-addr", ":8080", "address the webhook receiver listens on")
+	gitlabURL := flag.String("gitlab-url", "", "address of the GitLab instance")
+	gitlabToken := flag.String("gitlab-token", os.Getenv("GITLAB_TOKEN"),
+		"GitLab token allowed to manage project access tokens, defaults to $GITLAB_TOKEN")
+	systemHookSecret := flag.String("system-hook-secret", os.Getenv("GITLAB_SYSTEM_HOOK_SECRET"),
+		"secret token of the GitLab system hook, defaults to $GITLAB_SYSTEM_HOOK_SECRET")
+	hookURL := flag.String("hook-url", "", "public address of the webhook receiver registered in GitLab")
+	adminToken := flag.String("admin-token", os.Getenv("KG_ADMIN_TOKEN"),
+		"bearer token of the project activation endpoint, defaults to $KG_ADMIN_TOKEN")
+	targets := flag.String("targets", "", "comma separated addresses of the knowledge graph services")
+	kgURL := flag.String("kg-url", "", "address of the knowledge graph API, the proxy is disabled when it is empty")
+	sendTimeout := flag.Duration("send-timeout", 30*time.Second,
+		"maximum duration of the delivery of an event to a knowledge graph service")
+	queuePath := flag.String("queue-path", "kg-deliveries.db", "file of the queue of deliveries to retry")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "address of the Redis server")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"),
+		"Redis password, defaults to $REDIS_PASSWORD")
+	redisDB := flag.Int("redis-db", 0, "Redis logical database")
+	redisNamespace := flag.String("redis-namespace", "", "namespace prefixed to every key of the gateway")
+	keyDir := flag.String("key-dir", "", "directory containing the encryption key ring of the token values")
+	sessionBinding := flag.String("session-binding", sessionmgr.BindingModeOff,
+		"what to do when a session is used by another client than the one that logged in: off, report or enforce")
+	bindingAttributes := flag.String("session-binding-attributes", "user-agent,ip-prefix",
+		"comma separated attributes of the client a session is bound to: user-agent, ip-prefix and device-key")
+	clientIPHeader := flag.String("client-ip-header", "",
+		"header in which the trusted proxy in front of the gateway sets the client IP, like X-Forwarded-For")
+	clientID := flag.String("oauth-client-id", os.Getenv("OAUTH_CLIENT_ID"),
+		"oauth client ID of the gateway used to revoke the tokens of sessions, defaults to $OAUTH_CLIENT_ID")
+	clientSecret := flag.String("oauth-client-secret", os.Getenv("OAUTH_CLIENT_SECRET"),
+		"oauth client secret of the gateway used to revoke the tokens of sessions, defaults to $OAUTH_CLIENT_SECRET")
+	cookieDomain := flag.String("cookie-domain", "", "domain of the session cookie, defaults to the host of the gateway")
+	cookiePath := flag.String("cookie-path", "/", "path of the session cookie")
+	flag.Parse()
+	if *gitlabURL == "" || *targets == "" || *hookURL == "" {
+		log.Fatalf("the -gitlab-url, -hook-url and -targets flags are required\n")
+	}
+	// The session cookies are encrypted with the key ring
+	if *kgURL != "" && *keyDir == "" {
+		log.Fatalf("the -key-dir flag is required by the knowledge graph proxy\n")
+	}
+	binding, err := sessionmgr.NewBindingConfig(*sessionBinding, *bindingAttributes)
+	if err != nil {
+		log.Fatalf("Parsing the session binding failed: %s\n", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := redis.NewClient(&redis.Options{Addr: *redisAddr, Password: *redisPassword, DB: *redisDB})
+	defer client.Close()
+	store := &redisadapters.RedisAdapter{Rdb: *client, Namespace: *redisNamespace}
+	var encryptor *encryption.Encryptor
+	if *keyDir != "" {
+		keyRing, err := encryption.NewFileKeyRing(*keyDir)
+		if err != nil {
+			log.Fatalf("Loading the key ring failed: %s\n", err)
+		}
+		encryptor = &encryption.Encryptor{Keys: keyRing}
+		store.Encryptor = encryptor
+	}
+
+	queue, err := boltadapters.NewDeliveryQueue(*queuePath)
+	if err != nil {
+		log.Fatalf("Opening the delivery queue failed: %s\n", err)
+	}
+	defer queue.Close()
+
+	gitlabClient := &gitlab.Client{URL: *gitlabURL, Token: *gitlabToken}
+	tokens, err := projecttokenmgr.NewProjectTokenManager(
+		store,
+		gitlabClient,
+		projecttokenmgr.Config{GitlabURL: *gitlabURL},
+	)
+	if err != nil {
+		log.Fatalf("Creating the project token manager failed: %s\n", err)
+	}
+	webhooks, err := projectwebhookmgr.NewProjectWebhookManager(
+		store,
+		gitlabClient,
+		tokens,
+		projectwebhookmgr.Config{HookURL: *hookURL},
+	)
+	if err != nil {
+		log.Fatalf("Creating the project webhook manager failed: %s\n", err)
+	}
+	sender := &kgclient.Sender{Client: &http.Client{Timeout: *sendTimeout}}
+	forwarder := kgevents.NewForwarder(tokens, sender, queue, kgevents.Config{
+		Targets: strings.Split(*targets, ","),
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhooks/gitlab", gitlabwebhooks.Handler(store, forwarder, *systemHookSecret))
+	mux.Handle("/projects/", httpapi.ProjectActivationHandler(webhooks, *adminToken))
+	if *kgURL != "" {
+		target, err := url.Parse(*kgURL)
+		if err != nil {
+			log.Fatalf("Parsing the knowledge graph URL failed: %s\n", err)
+		}
+		// The proxy reads the session cookies, which are encrypted with the key ring
+		cookies := httpapi.NewSessionCookies(encryptor, httpapi.CookieConfig{
+			Domain: *cookieDomain,
+			Path:   *cookiePath,
+		})
+		authorizer := kgaccess.NewAuthorizer(store, tokens, gitlabClient, kgaccess.Config{GitlabURL: *gitlabURL})
+		var proxy http.Handler = http.StripPrefix("/knowledge-graph", kgproxy.Handler(authorizer, cookies, target))
+		if binding.Mode != sessionmgr.BindingModeOff {
+			sessions, err := sessionmgr.NewUserSessionManager(
+				store,
+				&tokenrevoker.Revoker{ClientID: *clientID, ClientSecret: *clientSecret},
+				&auditlog.LogAuditor{},
+				sessionmgr.Config{Binding: binding},
+			)
+			if err != nil {
+				log.Fatalf("Creating the session manager failed: %s\n", err)
+			}
+			proxy = httpapi.SessionBinding(sessions, cookies, *clientIPHeader, proxy)
+		}
+		mux.Handle("/knowledge-graph/", proxy)
+	}
+	server := &http.Server{Addr: *listenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	var wg sync.WaitGroup
+	for _, run := range []func(context.Context) error{tokens.Run, forwarder.Run, webhooks.Run} {
+		wg.Add(1)
+		go func(run func(context.Context) error) {
+			defer wg.Done()
+			err := run(ctx)
+			if err != nil {
+				log.Printf("Background task failed: %s\n", err)
+			}
+		}(run)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Stopping the server failed: %s\n", err)
+		}
+	}()
+
+	log.Printf("Receiving GitLab webhooks on %s\n", *listenAddr)
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Serving failed: %s\n", err)
+	}
+	wg.Wait()
+}
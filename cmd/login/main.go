@@ -1 +1,177 @@
-package login
+// Command login serves the sessions of the gateway. GET /login?redirect_url=<url> sends the browser to the identity
+// provider, whose callback GET /token stores the tokens of the user with a new session; when the browser had an
+// anonymous session it is replaced by the new one, which gets another ID. With -max-sessions, the number of
+// sessions of a user is limited according to -session-limit-policy. GET /session/status reports whether the session
+// of the caller has to log in again soon, the users are also notified before their refresh tokens expire. GET
+// /sessions lists the sessions of the user of the caller and DELETE /sessions[/<id>] revokes them. /auth answers
+// the forward-auth requests of the ingress of the notebooks, the clients that did not log in get an anonymous
+// session from POST /auth/anonymous first. POST /tokens/refresh exchanges a refresh token for its access token and
+// revokes the token family of a superseded refresh token. With -session-binding, the sessions used by another
+// client than the one that logged in are reported or revoked.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/auditlog"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/httpapi"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/notifiers"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/oidcprovider"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/redisadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/tokenrevoker"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/sessionmgr"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/tokenmgr"
+	"github.com/go-redis/redis/v9"
+)
+
+func main() {
+	listenAddr := flag.String("listen-addr", ":8080", "address the session endpoints listen on")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "address of the Redis server")
+	redisPassword := flag.String("redis-password", os.Getenv("REDIS_PASSWORD"),
+		"Redis password, defaults to $REDIS_PASSWORD")
+	redisDB := flag.Int("redis-db", 0, "Redis logical database")
+	redisNamespace := flag.String("redis-namespace", "", "namespace prefixed to every key of the gateway")
+	keyDir := flag.String("key-dir", "", "directory containing the encryption key ring of the session cookies and tokens")
+	sessionBinding := flag.String("session-binding", sessionmgr.BindingModeOff,
+		"what to do when a session is used by another client than the one that logged in: off, report or enforce")
+	bindingAttributes := flag.String("session-binding-attributes", "user-agent,ip-prefix",
+		"comma separated attributes of the client a session is bound to: user-agent, ip-prefix and device-key")
+	clientIPHeader := flag.String("client-ip-header", "",
+		"header in which the trusted proxy in front of the gateway sets the client IP, like X-Forwarded-For")
+	clientID := flag.String("oauth-client-id", os.Getenv("OAUTH_CLIENT_ID"),
+		"oauth client ID of the gateway used to log in and to revoke the tokens of sessions, defaults to $OAUTH_CLIENT_ID")
+	clientSecret := flag.String("oauth-client-secret", os.Getenv("OAUTH_CLIENT_SECRET"),
+		"oauth client secret of the gateway used to log in and to revoke the tokens, defaults to $OAUTH_CLIENT_SECRET")
+	providerID := flag.String("oauth-provider-id", "renku", "ID of the identity provider the users log in at")
+	authorizationURL := flag.String("oauth-authorization-url", "", "authorization endpoint of the identity provider")
+	tokenURL := flag.String("oauth-token-url", "", "token endpoint of the identity provider")
+	redirectURL := flag.String("oauth-redirect-url", "",
+		"address of the /token callback of the gateway that the identity provider redirects to")
+	scopes := flag.String("oauth-scopes", "profile email", "space separated scopes requested at login besides openid")
+	maxSessions := flag.Int("max-sessions", 0, "number of sessions a user can have at the same time, 0 for no limit")
+	limitPolicy := flag.String("session-limit-policy", sessionmgr.LimitPolicyEvictOldest,
+		"what to do when a login exceeds -max-sessions: evict_oldest revokes the oldest sessions, reject refuses it")
+	cookieDomain := flag.String("cookie-domain", "", "domain of the session cookie, defaults to the host of the gateway")
+	cookiePath := flag.String("cookie-path", "/", "path of the session cookie")
+	reauthWarning := flag.Duration("reauth-warning", 24*time.Hour,
+		"how long before a refresh token expires the user is asked to log in again")
+	anonymousSessionTTL := flag.Duration("anonymous-session-ttl", time.Hour,
+		"how long an anonymous session lasts without being used, every use extends it")
+	anonymousSessionsPerHour := flag.Int("anonymous-sessions-per-hour", 20,
+		"number of anonymous sessions a client IP can create per hour on each replica")
+	reauthWebhookURL := flag.String("reauth-webhook-url", "",
+		"address the re-authentication notices are posted to, they are logged when it is empty")
+	flag.Parse()
+	// The session cookies are encrypted with the key ring
+	if *keyDir == "" {
+		log.Fatalf("the -key-dir flag is required\n")
+	}
+	if *authorizationURL == "" || *tokenURL == "" || *redirectURL == "" {
+		log.Fatalf("the -oauth-authorization-url, -oauth-token-url and -oauth-redirect-url flags are required\n")
+	}
+	binding, err := sessionmgr.NewBindingConfig(*sessionBinding, *bindingAttributes)
+	if err != nil {
+		log.Fatalf("Parsing the session binding failed: %s\n", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	keyRing, err := encryption.NewFileKeyRing(*keyDir)
+	if err != nil {
+		log.Fatalf("Loading the key ring failed: %s\n", err)
+	}
+	encryptor := &encryption.Encryptor{Keys: keyRing}
+	client := redis.NewClient(&redis.Options{Addr: *redisAddr, Password: *redisPassword, DB: *redisDB})
+	defer client.Close()
+	store := &redisadapters.RedisAdapter{Rdb: *client, Namespace: *redisNamespace, Encryptor: encryptor}
+
+	cookies := httpapi.NewSessionCookies(encryptor, httpapi.CookieConfig{Domain: *cookieDomain, Path: *cookiePath})
+	sessions, err := sessionmgr.NewUserSessionManager(
+		store,
+		&tokenrevoker.Revoker{ClientID: *clientID, ClientSecret: *clientSecret},
+		&auditlog.LogAuditor{},
+		sessionmgr.Config{
+			MaxSessions:              *maxSessions,
+			LimitPolicy:              *limitPolicy,
+			Binding:                  binding,
+			AnonymousSessionTTL:      *anonymousSessionTTL,
+			AnonymousSessionsPerHour: *anonymousSessionsPerHour,
+		},
+	)
+	if err != nil {
+		log.Fatalf("Creating the session manager failed: %s\n", err)
+	}
+	bind := func(handler http.Handler) http.Handler { return handler }
+	if binding.Mode != sessionmgr.BindingModeOff {
+		bind = func(handler http.Handler) http.Handler {
+			return httpapi.SessionBinding(sessions, cookies, *clientIPHeader, handler)
+		}
+	}
+
+	provider := &oidcprovider.Provider{
+		ID:               *providerID,
+		AuthorizationURL: *authorizationURL,
+		TokenURL:         *tokenURL,
+		ClientID:         *clientID,
+		ClientSecret:     *clientSecret,
+		RedirectURL:      *redirectURL,
+		Scopes:           strings.Fields(*scopes),
+		Client:           &http.Client{Timeout: 10 * time.Second},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/login", httpapi.LoginHandler(provider, cookies))
+	mux.Handle("/token", httpapi.LoginCallbackHandler(sessions, provider, cookies, *clientIPHeader))
+	refreshTokens := tokenmgr.NewRefreshTokenManager(store, &auditlog.LogAuditor{})
+	mux.Handle("/tokens/refresh", httpapi.RefreshTokenHandler(refreshTokens))
+	status := &sessionmgr.SessionManager{StatusStore: store, ReauthWarning: *reauthWarning}
+	mux.Handle("/session/status", bind(httpapi.SessionStatusHandler(status, cookies)))
+	userSessions := bind(httpapi.UserSessionsHandler(sessions, cookies))
+	mux.Handle("/sessions", userSessions)
+	mux.Handle("/sessions/", userSessions)
+	mux.Handle("/auth", bind(httpapi.ForwardAuthHandler(sessions, cookies)))
+	mux.Handle("/auth/anonymous", bind(httpapi.AnonymousSessionHandler(sessions, cookies, *clientIPHeader)))
+	server := &http.Server{Addr: *listenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	var notifier sessionmgr.ReauthNotifier = notifiers.LogNotifier{}
+	if *reauthWebhookURL != "" {
+		notifier = &notifiers.WebhookNotifier{URL: *reauthWebhookURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	reauth := sessionmgr.NewReauthWatcher(store, notifier, sessionmgr.ReauthConfig{Warning: *reauthWarning})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := reauth.Run(ctx)
+		if err != nil {
+			log.Printf("Background task failed: %s\n", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Stopping the server failed: %s\n", err)
+		}
+	}()
+
+	log.Printf("Serving the sessions on %s\n", *listenAddr)
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Serving failed: %s\n", err)
+	}
+	<-done
+}
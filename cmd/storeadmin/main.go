@@ -0,0 +1,237 @@
+// Command storeadmin runs maintenance tasks against the token store of the gateway while it is online, except for
+// the bbolt store, which can only be opened by one process and is re-encrypted while the gateway is stopped
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/boltadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/postgresadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/redisadapters"
+	"github.com/go-redis/redis/v9"
+)
+
+const usage = `Usage: storeadmin <command> [flags]
+
+Commands:
+  reencrypt   encrypt every token value and webhook secret again with the active key of the key ring
+  migrate     upgrade every record to the current schema version
+  list        list the keys of a namespace
+  purge       remove every key of a namespace
+
+Run storeadmin <command> -h to list the flags of a command.
+`
+
+// redisFlags are the flags used to connect to Redis, shared by every command
+type redisFlags struct {
+	addr      *string
+	password  *string
+	db        *int
+	namespace *string
+}
+
+func addRedisFlags(flags *flag.FlagSet) redisFlags {
+	return redisFlags{
+		addr:      flags.String("redis-addr", "localhost:6379", "address of the Redis server"),
+		password:  flags.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password, defaults to $REDIS_PASSWORD"),
+		db:        flags.Int("redis-db", 0, "Redis logical database"),
+		namespace: flags.String("redis-namespace", "", "namespace prefixed to every key of the gateway"),
+	}
+}
+
+func (r redisFlags) client() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: *r.addr, Password: *r.password, DB: *r.db})
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "reencrypt":
+		err = reencrypt(ctx, os.Args[2:])
+	case "migrate":
+		err = migrate(ctx, os.Args[2:])
+	case "list":
+		err = list(ctx, os.Args[2:])
+	case "purge":
+		err = purge(ctx, os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s\n", os.Args[1], err)
+	}
+}
+
+// reencrypt encrypts the stored token values with the active key so that older keys can be removed from the key ring,
+// the values stored in PostgreSQL are re-encrypted instead of the ones in Redis when -postgres-dsn is set and the ones
+// stored in a bbolt file when -bolt-path is set
+func reencrypt(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	redisConfig := addRedisFlags(flags)
+	postgresDSN := flags.String("postgres-dsn", os.Getenv("POSTGRES_DSN"),
+		"DSN of the PostgreSQL database of the gateway, defaults to $POSTGRES_DSN")
+	boltPath := flags.String("bolt-path", "",
+		"path of the bbolt store file of the gateway, the gateway has to be stopped since the file is locked while open")
+	keyDir := flags.String("key-dir", "", "directory containing the encryption key ring")
+	batchSize := flags.Int64("batch-size", 100, "number of keys scanned per batch")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *keyDir == "" {
+		return fmt.Errorf("the -key-dir flag is required")
+	}
+
+	keyRing, err := encryption.NewFileKeyRing(*keyDir)
+	if err != nil {
+		return err
+	}
+	encryptor := &encryption.Encryptor{Keys: keyRing}
+	progress := func(scanned int, rewritten int) {
+		log.Printf("%v token values scanned, %v re-encrypted\n", scanned, rewritten)
+	}
+
+	var rewritten int
+	if *boltPath != "" {
+		adapter, err := boltadapters.NewBoltAdapter(*boltPath)
+		if err != nil {
+			return fmt.Errorf("cannot open %s, is the gateway still running: %w", *boltPath, err)
+		}
+		defer adapter.Close()
+		adapter.Encryptor = encryptor
+		rewritten, err = adapter.ReencryptTokens(ctx, int(*batchSize), progress)
+		if err != nil {
+			return err
+		}
+	} else if *postgresDSN != "" {
+		adapter, err := postgresadapters.NewPostgresAdapter(ctx, *postgresDSN)
+		if err != nil {
+			return err
+		}
+		defer adapter.Close()
+		adapter.Encryptor = encryptor
+		rewritten, err = adapter.ReencryptTokens(ctx, *batchSize, progress)
+		if err != nil {
+			return err
+		}
+	} else {
+		client := redisConfig.client()
+		defer client.Close()
+
+		adapter := redisadapters.RedisAdapter{
+			Rdb:       *client,
+			Encryptor: encryptor,
+			Namespace: *redisConfig.namespace,
+		}
+		rewritten, err = adapter.ReencryptTokens(ctx, *batchSize, progress)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Re-encryption finished, %v token values re-encrypted\n", rewritten)
+	return nil
+}
+
+// migrate upgrades the records written by older versions of the gateway to the current schema version
+func migrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	redisConfig := addRedisFlags(flags)
+	batchSize := flags.Int64("batch-size", 100, "number of keys scanned per batch")
+	dryRun := flags.Bool("dry-run", false, "only count the records that would be upgraded")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client := redisConfig.client()
+	defer client.Close()
+
+	adapter := redisadapters.RedisAdapter{Rdb: *client, Namespace: *redisConfig.namespace}
+	version, err := adapter.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("The store has schema version %v\n", version)
+
+	upgraded, err := adapter.MigrateSchema(ctx, *batchSize, *dryRun, func(scanned int, upgraded int) {
+		log.Printf("%v records scanned, %v upgraded\n", scanned, upgraded)
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("Dry run finished, %v records would be upgraded\n", upgraded)
+		return nil
+	}
+	log.Printf("Migration finished, %v records upgraded\n", upgraded)
+	return nil
+}
+
+// list prints the keys written by the gateway in a namespace, one per line
+func list(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	redisConfig := addRedisFlags(flags)
+	batchSize := flags.Int64("batch-size", 100, "number of keys scanned per batch")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client := redisConfig.client()
+	defer client.Close()
+
+	adapter := redisadapters.RedisAdapter{Rdb: *client, Namespace: *redisConfig.namespace}
+	return adapter.NamespaceKeys(ctx, *batchSize, func(keys []string) error {
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return nil
+	})
+}
+
+// purge removes the keys written by the gateway in a namespace, e.g. when an environment sharing Redis is removed
+func purge(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	redisConfig := addRedisFlags(flags)
+	batchSize := flags.Int64("batch-size", 100, "number of keys scanned per batch")
+	dryRun := flags.Bool("dry-run", false, "only count the keys that would be removed")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *redisConfig.namespace == "" {
+		return fmt.Errorf("the -redis-namespace flag is required")
+	}
+
+	client := redisConfig.client()
+	defer client.Close()
+
+	adapter := redisadapters.RedisAdapter{Rdb: *client, Namespace: *redisConfig.namespace}
+	removed, err := adapter.PurgeNamespace(ctx, *batchSize, *dryRun, func(removed int) {
+		log.Printf("%v keys processed\n", removed)
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("Dry run finished, %v keys would be removed\n", removed)
+		return nil
+	}
+	log.Printf("Purge finished, %v keys removed\n", removed)
+	return nil
+}
@@ -3,16 +3,20 @@ module github.com/SwissDataScienceCenter/renku-gateway-v2
 go 1.19
 
 require (
-	github.com/go-co-op/gocron v1.18.0
+	github.com/alicebob/miniredis/v2 v2.30.4
 	github.com/go-redis/redis/v9 v9.0.0-rc.2
 	github.com/go-redis/redismock/v9 v9.0.0-rc.2
+	github.com/lib/pq v1.10.9
 	github.com/oklog/ulid/v2 v2.1.0
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/net v0.5.0
+	golang.org/x/time v0.3.0
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
-	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
@@ -0,0 +1,56 @@
+// Package auditlog writes security audit events to the log
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// auditRecord is the JSON representation of an audit event, the session is identified by its handle because the
+// session ID is a credential
+type auditRecord struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	SessionHandle string    `json:"sessionHandle,omitempty"`
+	UserID        string    `json:"userId,omitempty"`
+	TokenIDs      []string  `json:"tokenIds,omitempty"`
+	Message       string    `json:"message,omitempty"`
+}
+
+// LogAuditor writes every audit event as a single JSON line prefixed with AUDIT, it uses the standard logger when
+// Logger is nil
+type LogAuditor struct {
+	Logger *log.Logger
+}
+
+// Audit writes an audit event to the log
+func (l *LogAuditor) Audit(_ context.Context, event models.AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	record := auditRecord{
+		Type:     event.Type,
+		Time:     event.Time,
+		UserID:   event.UserID,
+		TokenIDs: event.TokenIDs,
+		Message:  event.Message,
+	}
+	if event.SessionID != "" {
+		record.SessionHandle = models.SessionHandle(event.SessionID)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	logger := l.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("AUDIT %s\n", line)
+	return nil
+}
@@ -0,0 +1,43 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func TestAudit(t *testing.T) {
+	var output bytes.Buffer
+	auditor := LogAuditor{Logger: log.New(&output, "", 0)}
+
+	err := auditor.Audit(context.Background(), models.AuditEvent{
+		Type:      models.AuditEventRefreshTokenReuse,
+		SessionID: "12345",
+		TokenIDs:  []string{"6789"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.TrimSpace(output.String())
+	if !strings.HasPrefix(line, "AUDIT ") {
+		t.Fatalf("The audit line does NOT have the AUDIT prefix, got %v\n", line)
+	}
+	var record auditRecord
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "AUDIT ")), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(line, "12345") {
+		t.Errorf("The audit line contains the session ID, got %v\n", line)
+	}
+	if record.Type != models.AuditEventRefreshTokenReuse || record.SessionHandle != models.SessionHandle("12345") ||
+		record.Time.IsZero() {
+		t.Errorf("The audit record is NOT correct, got %+v\n", record)
+	}
+}
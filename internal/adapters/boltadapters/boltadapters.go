@@ -0,0 +1,1128 @@
+// Package boltadapters contains an embedded on-disk store for single gateway deployments. It is backed by bbolt so
+// every write is a transaction that is synced to disk before it returns.
+package boltadapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ repository.Repository = (*BoltAdapter)(nil)
+
+var (
+	sessionsBucket                   = []byte("sessions")
+	indexExpiringSessionsBucket      = []byte("indexExpiringSessions")
+	tokenSessionsBucket              = []byte("tokenSessions")
+	userSessionsBucket               = []byte("userSessions")
+	accessTokensBucket               = []byte("accessTokens")
+	indexExpiringTokensBucket        = []byte("indexExpiringTokens")
+	refreshTokensBucket              = []byte("refreshTokens")
+	indexExpiringRefreshTokensBucket = []byte("indexExpiringRefreshTokens")
+	refreshTokenHistoryBucket        = []byte("refreshTokenHistory")
+	reauthNoticesBucket              = []byte("reauthNotices")
+	projectTokensBucket              = []byte("projectTokens")
+	projectWebhookSecretsBucket      = []byte("projectWebhookSecrets")
+)
+
+// Default settings of the expiry sweep
+const (
+	defaultSweepInterval   = time.Minute
+	defaultCompactInterval = 24 * time.Hour
+	// compactTxMaxSize is the number of bytes copied per transaction by a compaction
+	compactTxMaxSize = 64 * 1024
+)
+
+// BoltAdapter stores sessions and tokens in a bbolt file. Like in Redis, expirations are stored with a precision of
+// one second, expired sessions are never returned and indexes are ordered by expiration and then by ID. Token values
+// and webhook secrets are encrypted when an Encryptor is set.
+type BoltAdapter struct {
+	Encryptor encryption.ValueEncryptor
+	// CompactInterval is how often RunExpirySweep compacts the store file, it defaults to a day
+	CompactInterval time.Duration
+
+	// path is the path of the store file, db.Path() is the path of the copy after a compaction
+	path string
+	// dbMu is held for writing while the store file is replaced by its compacted copy
+	dbMu        sync.RWMutex
+	db          *bolt.DB
+	mu          sync.Mutex
+	subscribers map[chan time.Time]struct{}
+}
+
+type sessionRecord struct {
+	Type          string   `json:"type"`
+	ExpiresAt     int64    `json:"expiresAt"`
+	TokenIDs      []string `json:"tokenIds"`
+	UserID        string   `json:"userId,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	CreatedAt     int64    `json:"createdAt,omitempty"`
+	LastSeenAt    int64    `json:"lastSeenAt,omitempty"`
+	LoginMethod   string   `json:"loginMethod,omitempty"`
+	ClientIP      string   `json:"clientIp,omitempty"`
+	UserAgent     string   `json:"userAgent,omitempty"`
+	IDPSessionID  string   `json:"idpSessionId,omitempty"`
+	DeviceKeyHash string   `json:"deviceKeyHash,omitempty"`
+}
+
+type accessTokenRecord struct {
+	Value     string   `json:"accessToken"`
+	ExpiresAt int64    `json:"expiresAt"`
+	URL       string   `json:"URL"`
+	Type      string   `json:"type"`
+	Provider  string   `json:"provider,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	Audience  []string `json:"audience,omitempty"`
+	IssuedAt  int64    `json:"issuedAt,omitempty"`
+}
+
+type refreshTokenRecord struct {
+	Value     string `json:"refreshToken"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// NewBoltAdapter opens or creates the store at path, only one process can open the file at a time
+func NewBoltAdapter(path string) (*BoltAdapter, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			sessionsBucket,
+			indexExpiringSessionsBucket,
+			tokenSessionsBucket,
+			userSessionsBucket,
+			accessTokensBucket,
+			indexExpiringTokensBucket,
+			refreshTokensBucket,
+			indexExpiringRefreshTokensBucket,
+			refreshTokenHistoryBucket,
+			reauthNoticesBucket,
+			projectTokensBucket,
+			projectWebhookSecretsBucket,
+		} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltAdapter{db: db, path: path, subscribers: map[chan time.Time]struct{}{}}, nil
+}
+
+// renameFile replaces the store file with its compacted copy, tests replace it to simulate failures
+var renameFile = os.Rename
+
+func openDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+// Close closes the store file
+func (b *BoltAdapter) Close() error {
+	b.dbMu.Lock()
+	defer b.dbMu.Unlock()
+	return b.db.Close()
+}
+
+// view runs fn in a read transaction
+func (b *BoltAdapter) view(fn func(tx *bolt.Tx) error) error {
+	b.dbMu.RLock()
+	defer b.dbMu.RUnlock()
+	return b.db.View(fn)
+}
+
+// dbUpdate runs fn in a write transaction
+func (b *BoltAdapter) dbUpdate(fn func(tx *bolt.Tx) error) error {
+	b.dbMu.RLock()
+	defer b.dbMu.RUnlock()
+	return b.db.Update(fn)
+}
+
+// boltWriter is the repository.Writer of a bbolt write transaction
+type boltWriter struct {
+	tx        *bolt.Tx
+	encryptor encryption.ValueEncryptor
+	// expirations are published to the subscribers once the transaction is committed
+	expirations []time.Time
+}
+
+// update runs fn in a write transaction and notifies the subscribers of the access tokens written once it is
+// committed
+func (b *BoltAdapter) update(fn func(w *boltWriter) error) error {
+	w := &boltWriter{encryptor: b.Encryptor}
+	err := b.dbUpdate(func(tx *bolt.Tx) error {
+		w.tx = tx
+		return fn(w)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, expiresAt := range w.expirations {
+		b.publish(expiresAt)
+	}
+	return nil
+}
+
+// Update runs fn in a single write transaction that is rolled back if fn fails
+func (b *BoltAdapter) Update(_ context.Context, fn func(tx repository.Writer) error) error {
+	return b.update(func(w *boltWriter) error {
+		return fn(w)
+	})
+}
+
+// Set/write functions
+
+// SetSession writes a session and the session of its tokens
+func (b *BoltAdapter) SetSession(ctx context.Context, session models.Session) error {
+	return b.update(func(w *boltWriter) error {
+		return w.SetSession(ctx, session)
+	})
+}
+
+// SetAccessToken writes an access token, adds it to the expiring tokens index and notifies the subscribers once the
+// write is on disk
+func (b *BoltAdapter) SetAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.SetAccessToken(ctx, accessToken)
+	})
+}
+
+// SetRefreshToken writes a refresh token and adds it to the expiring refresh tokens index if it expires
+func (b *BoltAdapter) SetRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.SetRefreshToken(ctx, refreshToken)
+	})
+}
+
+// AddSupersededRefreshToken adds a hash of a refresh token value that was replaced by a rotation to the history of
+// its token ID, only the latest values are kept
+func (b *BoltAdapter) AddSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.AddSupersededRefreshToken(ctx, refreshToken)
+	})
+}
+
+// SetProjectToken adds a token ID to the tokens of a project
+func (b *BoltAdapter) SetProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.SetProjectToken(ctx, projectID, accessToken)
+	})
+}
+
+// SetProjectWebhookSecret writes the secret of the GitLab webhook of a project
+func (b *BoltAdapter) SetProjectWebhookSecret(ctx context.Context, projectID int, secret string) error {
+	return b.update(func(w *boltWriter) error {
+		return w.SetProjectWebhookSecret(ctx, projectID, secret)
+	})
+}
+
+// Remove/delete functions
+
+// RemoveSession removes a session and the session of its tokens
+func (b *BoltAdapter) RemoveSession(ctx context.Context, sessionID string) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveSession(ctx, sessionID)
+	})
+}
+
+// RemoveAccessToken removes an access token and its entry in the expiring tokens index
+func (b *BoltAdapter) RemoveAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveAccessToken(ctx, accessToken)
+	})
+}
+
+// RemoveRefreshToken removes a refresh token and its entry in the expiring refresh tokens index
+func (b *BoltAdapter) RemoveRefreshToken(ctx context.Context, refreshTokenID string) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveRefreshToken(ctx, refreshTokenID)
+	})
+}
+
+// RemoveSupersededRefreshTokens removes the refresh token history of a token ID
+func (b *BoltAdapter) RemoveSupersededRefreshTokens(ctx context.Context, refreshTokenID string) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveSupersededRefreshTokens(ctx, refreshTokenID)
+	})
+}
+
+// RemoveProjectToken removes a token ID from the tokens of a project
+func (b *BoltAdapter) RemoveProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveProjectToken(ctx, projectID, accessToken)
+	})
+}
+
+// DeactivateProjectWebhook removes the secret of the GitLab webhook of a project and keeps the project as inactive
+func (b *BoltAdapter) DeactivateProjectWebhook(ctx context.Context, projectID int) error {
+	return b.update(func(w *boltWriter) error {
+		return w.DeactivateProjectWebhook(ctx, projectID)
+	})
+}
+
+// RemoveProjectWebhookSecret removes the secret of the GitLab webhook of a project
+func (b *BoltAdapter) RemoveProjectWebhookSecret(ctx context.Context, projectID int) error {
+	return b.update(func(w *boltWriter) error {
+		return w.RemoveProjectWebhookSecret(ctx, projectID)
+	})
+}
+
+// RemoveExpiredSessions removes the sessions that have expired and the session of their tokens, it returns the
+// number of sessions removed
+func (b *BoltAdapter) RemoveExpiredSessions(_ context.Context) (int, error) {
+	removed := 0
+	err := b.dbUpdate(func(tx *bolt.Tx) error {
+		removed = 0
+		var expired []string
+		now := time.Now().Unix()
+		cursor := tx.Bucket(indexExpiringSessionsBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && indexScore(key) <= now; key, _ = cursor.Next() {
+			expired = append(expired, indexID(key))
+		}
+		for _, sessionID := range expired {
+			err := removeSession(tx, sessionID)
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// TouchSession sets the last seen time of a session that has not expired and extends its expiration
+func (b *BoltAdapter) TouchSession(
+	ctx context.Context,
+	sessionID string,
+	lastSeenAt time.Time,
+	expiresAt time.Time,
+) (bool, error) {
+	touched := false
+	err := b.update(func(w *boltWriter) error {
+		var record sessionRecord
+		found, err := getRecord(w.tx.Bucket(sessionsBucket), sessionID, &record)
+		if err != nil || !found || (record.ExpiresAt > 0 && record.ExpiresAt <= time.Now().Unix()) {
+			return err
+		}
+		session := record.session(sessionID)
+		session.LastSeenAt = lastSeenAt
+		if !expiresAt.IsZero() {
+			session.ExpiresAt = expiresAt
+		}
+		touched = true
+		return w.SetSession(ctx, session)
+	})
+	return touched, err
+}
+
+// ClaimReauthNotice claims the re-authentication notice of a refresh token expiration
+func (b *BoltAdapter) ClaimReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	claimed := false
+	err := b.dbUpdate(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reauthNoticesBucket)
+		if bytes.Equal(bucket.Get([]byte(tokenID)), scoreKey(expiresAt.Unix())) {
+			return nil
+		}
+		claimed = true
+		return bucket.Put([]byte(tokenID), scoreKey(expiresAt.Unix()))
+	})
+	return claimed, err
+}
+
+// ReleaseReauthNotice removes the claim of the re-authentication notice of a refresh token expiration
+func (b *BoltAdapter) ReleaseReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) error {
+	return b.dbUpdate(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reauthNoticesBucket)
+		if !bytes.Equal(bucket.Get([]byte(tokenID)), scoreKey(expiresAt.Unix())) {
+			return nil
+		}
+		return bucket.Delete([]byte(tokenID))
+	})
+}
+
+// RemoveExpiredReauthNotices removes the re-authentication notice claims of the expirations that have passed
+func (b *BoltAdapter) RemoveExpiredReauthNotices(_ context.Context) (int64, error) {
+	var removed int64
+	err := b.dbUpdate(func(tx *bolt.Tx) error {
+		now := scoreKey(time.Now().Unix())
+		bucket := tx.Bucket(reauthNoticesBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			if bytes.Compare(value, now) <= 0 {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			err := bucket.Delete(key)
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// RunExpirySweep removes the expired sessions and re-authentication notice claims at every interval until the
+// context is done, expired sessions are never returned even without the sweep. The pages freed by the sweep are
+// reused by later writes, the store file is compacted every CompactInterval to give them back to the file system.
+func (b *BoltAdapter) RunExpirySweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	compactInterval := b.CompactInterval
+	if compactInterval <= 0 {
+		compactInterval = defaultCompactInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	compactTicker := time.NewTicker(compactInterval)
+	defer compactTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := b.RemoveExpiredSessions(ctx)
+			if err != nil {
+				log.Printf("RemoveExpiredSessions failed: %s\n", err)
+			}
+			_, err = b.RemoveExpiredReauthNotices(ctx)
+			if err != nil {
+				log.Printf("RemoveExpiredReauthNotices failed: %s\n", err)
+			}
+		case <-compactTicker.C:
+			err := b.Compact()
+			if err != nil {
+				log.Printf("Compacting the store failed: %s\n", err)
+			}
+		}
+	}
+}
+
+// Compact copies the store into a new file without the free pages and replaces the store file with it, the reads
+// and writes wait until it is done. The store keeps using the original file if the copy cannot be written or cannot
+// replace the store file.
+func (b *BoltAdapter) Compact() error {
+	b.dbMu.Lock()
+	defer b.dbMu.Unlock()
+
+	compactPath := b.path + ".compact"
+	err := os.Remove(compactPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	compacted, err := openDB(compactPath)
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(compacted, b.db, compactTxMaxSize)
+	if err != nil {
+		compacted.Close()
+		os.Remove(compactPath)
+		return err
+	}
+
+	// The copy stays open while it replaces the store file, so the original file is only closed once the copy is in
+	// place and no other process can open the store in between
+	err = renameFile(compactPath, b.path)
+	if err != nil {
+		compacted.Close()
+		os.Remove(compactPath)
+		return err
+	}
+	err = b.db.Close()
+	if err != nil {
+		log.Printf("Closing the store file replaced by its compacted copy failed: %s\n", err)
+	}
+	b.db = compacted
+	return nil
+}
+
+// Get functions
+
+// GetSession reads a session, it returns models.ErrNotFound if the session does not exist or has expired
+func (b *BoltAdapter) GetSession(_ context.Context, sessionID string) (models.Session, error) {
+
+	var record sessionRecord
+	err := b.view(func(tx *bolt.Tx) error {
+		found, err := getRecord(tx.Bucket(sessionsBucket), sessionID, &record)
+		if err != nil {
+			return err
+		}
+		if !found || (record.ExpiresAt > 0 && record.ExpiresAt <= time.Now().Unix()) {
+			return models.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Session{}, err
+	}
+	return record.session(sessionID), nil
+}
+
+// session returns the session stored in a record
+func (record sessionRecord) session(sessionID string) models.Session {
+	return models.Session{
+		ID:            sessionID,
+		Type:          record.Type,
+		ExpiresAt:     time.Unix(record.ExpiresAt, 0),
+		TokenIDs:      record.TokenIDs,
+		UserID:        record.UserID,
+		Username:      record.Username,
+		CreatedAt:     models.TimeOrZero(record.CreatedAt),
+		LastSeenAt:    models.TimeOrZero(record.LastSeenAt),
+		LoginMethod:   record.LoginMethod,
+		ClientIP:      record.ClientIP,
+		UserAgent:     record.UserAgent,
+		IDPSessionID:  record.IDPSessionID,
+		DeviceKeyHash: record.DeviceKeyHash,
+	}
+}
+
+// GetAccessToken reads an access token, it returns models.ErrNotFound if the token does not exist
+func (b *BoltAdapter) GetAccessToken(_ context.Context, tokenID string) (models.AccessToken, error) {
+
+	var record accessTokenRecord
+	err := b.view(func(tx *bolt.Tx) error {
+		return getExistingRecord(tx.Bucket(accessTokensBucket), tokenID, &record)
+	})
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	value, err := b.decryptValue(record.Value, encryption.AccessTokenAssociatedData(tokenID))
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	return models.AccessToken{
+		ID:        tokenID,
+		Value:     value,
+		ExpiresAt: time.Unix(record.ExpiresAt, 0),
+		URL:       record.URL,
+		Type:      record.Type,
+		Provider:  record.Provider,
+		Subject:   record.Subject,
+		Scopes:    record.Scopes,
+		Audience:  record.Audience,
+		IssuedAt:  models.TimeOrZero(record.IssuedAt),
+	}, nil
+}
+
+// GetRefreshToken reads a refresh token, it returns models.ErrNotFound if the token does not exist
+func (b *BoltAdapter) GetRefreshToken(_ context.Context, tokenID string) (models.RefreshToken, error) {
+
+	var record refreshTokenRecord
+	err := b.view(func(tx *bolt.Tx) error {
+		return getExistingRecord(tx.Bucket(refreshTokensBucket), tokenID, &record)
+	})
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	value, err := b.decryptValue(record.Value, encryption.RefreshTokenAssociatedData(tokenID))
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	return models.RefreshToken{
+		ID:        tokenID,
+		Value:     value,
+		ExpiresAt: time.Unix(record.ExpiresAt, 0),
+	}, nil
+}
+
+// IsSupersededRefreshToken checks whether a refresh token value is in the refresh token history of its token ID
+func (b *BoltAdapter) IsSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) (bool, error) {
+
+	var history []string
+	err := b.view(func(tx *bolt.Tx) error {
+		_, err := getRecord(tx.Bucket(refreshTokenHistoryBucket), refreshToken.ID, &history)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	hash := repository.HashTokenValue(refreshToken.Value)
+	for _, superseded := range history {
+		if superseded == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetExpiringAccessTokenIDs reads the IDs of the access tokens expiring between startTime and stopTime
+func (b *BoltAdapter) GetExpiringAccessTokenIDs(
+	_ context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+
+	return b.rangeByScore(indexExpiringTokensBucket, startTime.Unix(), stopTime.Unix())
+}
+
+// GetExpiringRefreshTokenIDs reads the IDs of the refresh tokens expiring between startTime and stopTime
+func (b *BoltAdapter) GetExpiringRefreshTokenIDs(
+	_ context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+
+	return b.rangeByScore(indexExpiringRefreshTokensBucket, startTime.Unix(), stopTime.Unix())
+}
+
+// GetTokenSessionID reads the ID of the session a token belongs to, it returns an empty ID if the token does not
+// belong to a session
+func (b *BoltAdapter) GetTokenSessionID(_ context.Context, tokenID string) (string, error) {
+
+	var sessionID string
+	err := b.view(func(tx *bolt.Tx) error {
+		sessionID = string(tx.Bucket(tokenSessionsBucket).Get([]byte(tokenID)))
+		return nil
+	})
+	return sessionID, err
+}
+
+// GetUserSessionIDs reads the IDs of the sessions of a user that have not expired, ordered by expiration
+func (b *BoltAdapter) GetUserSessionIDs(_ context.Context, userID string) ([]string, error) {
+
+	var sessionIDs []string
+	err := b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(userSessionsBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now().Unix()
+		// Expired sessions stay in the index until they are removed
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(indexKey(now+1, "")); key != nil; key, _ = cursor.Next() {
+			sessionIDs = append(sessionIDs, indexID(key))
+		}
+		return nil
+	})
+	return sessionIDs, err
+}
+
+// GetProjectTokens reads the token IDs of a project ordered by expiration
+func (b *BoltAdapter) GetProjectTokens(_ context.Context, projectID int) ([]string, error) {
+
+	var projectTokens []string
+	err := b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(projectTokensBucket).Bucket(projectKey(projectID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, _ []byte) error {
+			projectTokens = append(projectTokens, indexID(key))
+			return nil
+		})
+	})
+	return projectTokens, err
+}
+
+// ListProjectTokens reads a page of the tokens of a project with their expiration
+func (b *BoltAdapter) ListProjectTokens(
+	_ context.Context,
+	projectID int,
+	query models.ProjectTokenQuery,
+) (models.ProjectTokenPage, error) {
+
+	tokenRange, err := repository.NewProjectTokenRange(query)
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+
+	var tokens []models.ProjectToken
+	err = b.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(projectTokensBucket).Bucket(projectKey(projectID))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(scoreKey(tokenRange.Min)); key != nil; key, _ = cursor.Next() {
+			token := models.ProjectToken{ID: indexID(key), ExpiresAt: time.Unix(indexScore(key), 0)}
+			if indexScore(key) > tokenRange.Max || len(tokens) > tokenRange.Limit {
+				break
+			}
+			if tokenRange.Includes(token) {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+	return tokenRange.Page(tokens), nil
+}
+
+// GetProjectWebhookSecret reads the secret of the GitLab webhook of a project
+func (b *BoltAdapter) GetProjectWebhookSecret(_ context.Context, projectID int) (string, error) {
+
+	var secret string
+	found := false
+	err := b.view(func(tx *bolt.Tx) error {
+		value := tx.Bucket(projectWebhookSecretsBucket).Get(projectKey(projectID))
+		// Deactivated projects are stored with an empty secret
+		secret, found = string(value), len(value) > 0
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", models.ErrNotFound
+	}
+	return b.decryptValue(secret, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+}
+
+// ListProjectWebhooks reads the projects with a webhook secret and the deactivated ones
+func (b *BoltAdapter) ListProjectWebhooks(_ context.Context) ([]models.ProjectWebhook, error) {
+
+	webhooks := []models.ProjectWebhook{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectWebhookSecretsBucket).ForEach(func(key []byte, value []byte) error {
+			projectID, err := strconv.Atoi(string(key))
+			if err != nil {
+				return err
+			}
+			webhooks = append(webhooks, models.ProjectWebhook{ProjectID: projectID, Active: len(value) > 0})
+			return nil
+		})
+	})
+	// The keys are ordered as strings
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ProjectID < webhooks[j].ProjectID
+	})
+	return webhooks, err
+}
+
+// GetEarliestAccessTokenExpiry reads the earliest access token expiration that is later than the given time, found
+// is false if there is no such expiration
+func (b *BoltAdapter) GetEarliestAccessTokenExpiry(
+	_ context.Context,
+	after time.Time,
+) (expiresAt time.Time, found bool, err error) {
+
+	err = b.view(func(tx *bolt.Tx) error {
+		key, _ := tx.Bucket(indexExpiringTokensBucket).Cursor().Seek(scoreKey(after.Unix() + 1))
+		if key != nil {
+			expiresAt, found = time.Unix(indexScore(key), 0), true
+		}
+		return nil
+	})
+	return expiresAt, found, err
+}
+
+// SubscribeExpiringAccessTokens returns a channel that receives the expiration of every access token written, the
+// channel is closed when the context is done
+func (b *BoltAdapter) SubscribeExpiringAccessTokens(ctx context.Context) (<-chan time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscriber := make(chan time.Time, 100)
+	b.subscribers[subscriber] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}()
+	return subscriber, nil
+}
+
+// publish sends an expiration to the subscribers, like Redis pub/sub it drops it for subscribers that do not keep up
+func (b *BoltAdapter) publish(expiresAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- expiresAt:
+		default:
+		}
+	}
+}
+
+// rangeByScore returns the IDs of an index with a score between start and stop included
+func (b *BoltAdapter) rangeByScore(bucket []byte, start int64, stop int64) ([]string, error) {
+	var ids []string
+	err := b.view(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucket).Cursor()
+		for key, _ := cursor.Seek(scoreKey(start)); key != nil && indexScore(key) <= stop; key, _ = cursor.Next() {
+			ids = append(ids, indexID(key))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Writes within a transaction
+
+func (w *boltWriter) SetSession(_ context.Context, session models.Session) error {
+	sessions := w.tx.Bucket(sessionsBucket)
+	index := w.tx.Bucket(indexExpiringSessionsBucket)
+
+	var previous sessionRecord
+	found, err := getRecord(sessions, session.ID, &previous)
+	if err != nil {
+		return err
+	}
+	if found {
+		err = index.Delete(indexKey(previous.ExpiresAt, session.ID))
+		if err != nil {
+			return err
+		}
+		err = removeUserSession(w.tx, previous, session.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	record := sessionRecord{
+		Type:          session.Type,
+		ExpiresAt:     session.ExpiresAt.Unix(),
+		TokenIDs:      session.TokenIDs,
+		UserID:        session.UserID,
+		Username:      session.Username,
+		CreatedAt:     models.UnixOrZero(session.CreatedAt),
+		LastSeenAt:    models.UnixOrZero(session.LastSeenAt),
+		LoginMethod:   session.LoginMethod,
+		ClientIP:      session.ClientIP,
+		UserAgent:     session.UserAgent,
+		IDPSessionID:  session.IDPSessionID,
+		DeviceKeyHash: session.DeviceKeyHash,
+	}
+	err = putRecord(sessions, session.ID, record)
+	if err != nil {
+		return err
+	}
+	if record.ExpiresAt > 0 {
+		err = index.Put(indexKey(record.ExpiresAt, session.ID), nil)
+		if err != nil {
+			return err
+		}
+	}
+	if record.UserID != "" && record.Type != models.SessionTypeAnonymous {
+		userSessions, err := w.tx.Bucket(userSessionsBucket).CreateBucketIfNotExists([]byte(record.UserID))
+		if err != nil {
+			return err
+		}
+		err = userSessions.Put(indexKey(userSessionScore(record.ExpiresAt), session.ID), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	tokenSessions := w.tx.Bucket(tokenSessionsBucket)
+	for _, tokenID := range session.TokenIDs {
+		err = tokenSessions.Put([]byte(tokenID), []byte(session.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *boltWriter) SetAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	value, err := w.encryptValue(accessToken.Value, encryption.AccessTokenAssociatedData(accessToken.ID))
+	if err != nil {
+		return err
+	}
+	record := accessTokenRecord{
+		Value:     value,
+		ExpiresAt: accessToken.ExpiresAt.Unix(),
+		URL:       accessToken.URL,
+		Type:      accessToken.Type,
+		Provider:  accessToken.Provider,
+		Subject:   accessToken.Subject,
+		Scopes:    accessToken.Scopes,
+		Audience:  accessToken.Audience,
+		IssuedAt:  models.UnixOrZero(accessToken.IssuedAt),
+	}
+	err = removeAccessToken(w.tx, accessToken.ID)
+	if err != nil {
+		return err
+	}
+	err = putRecord(w.tx.Bucket(accessTokensBucket), accessToken.ID, record)
+	if err != nil {
+		return err
+	}
+	err = w.tx.Bucket(indexExpiringTokensBucket).Put(indexKey(record.ExpiresAt, accessToken.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	w.expirations = append(w.expirations, time.Unix(record.ExpiresAt, 0))
+	return nil
+}
+
+func (w *boltWriter) SetRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	value, err := w.encryptValue(refreshToken.Value, encryption.RefreshTokenAssociatedData(refreshToken.ID))
+	if err != nil {
+		return err
+	}
+	record := refreshTokenRecord{Value: value, ExpiresAt: refreshToken.ExpiresAt.Unix()}
+	err = removeRefreshToken(w.tx, refreshToken.ID)
+	if err != nil {
+		return err
+	}
+	err = putRecord(w.tx.Bucket(refreshTokensBucket), refreshToken.ID, record)
+	if err != nil || record.ExpiresAt <= 0 {
+		return err
+	}
+	return w.tx.Bucket(indexExpiringRefreshTokensBucket).Put(indexKey(record.ExpiresAt, refreshToken.ID), nil)
+}
+
+func (w *boltWriter) AddSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	bucket := w.tx.Bucket(refreshTokenHistoryBucket)
+	var history []string
+	_, err := getRecord(bucket, refreshToken.ID, &history)
+	if err != nil {
+		return err
+	}
+	history = append([]string{repository.HashTokenValue(refreshToken.Value)}, history...)
+	if len(history) > repository.RefreshTokenHistoryLength {
+		history = history[:repository.RefreshTokenHistoryLength]
+	}
+	return putRecord(bucket, refreshToken.ID, history)
+}
+
+func (w *boltWriter) SetProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	bucket, err := w.tx.Bucket(projectTokensBucket).CreateBucketIfNotExists(projectKey(projectID))
+	if err != nil {
+		return err
+	}
+	err = removeFromIndex(bucket, accessToken.ID)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(indexKey(accessToken.ExpiresAt.Unix(), accessToken.ID), nil)
+}
+
+func (w *boltWriter) SetProjectWebhookSecret(_ context.Context, projectID int, secret string) error {
+	value, err := w.encryptValue(secret, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+	if err != nil {
+		return err
+	}
+	return w.tx.Bucket(projectWebhookSecretsBucket).Put(projectKey(projectID), []byte(value))
+}
+
+func (w *boltWriter) RemoveSession(_ context.Context, sessionID string) error {
+	return removeSession(w.tx, sessionID)
+}
+
+func (w *boltWriter) RemoveAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	return removeAccessToken(w.tx, accessToken.ID)
+}
+
+func (w *boltWriter) RemoveRefreshToken(_ context.Context, refreshTokenID string) error {
+	return removeRefreshToken(w.tx, refreshTokenID)
+}
+
+func (w *boltWriter) RemoveSupersededRefreshTokens(_ context.Context, refreshTokenID string) error {
+	return w.tx.Bucket(refreshTokenHistoryBucket).Delete([]byte(refreshTokenID))
+}
+
+func (w *boltWriter) RemoveProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	projects := w.tx.Bucket(projectTokensBucket)
+	bucket := projects.Bucket(projectKey(projectID))
+	if bucket == nil {
+		return nil
+	}
+	err := removeFromIndex(bucket, accessToken.ID)
+	if err != nil {
+		return err
+	}
+	if bucket.Stats().KeyN == 0 {
+		return projects.DeleteBucket(projectKey(projectID))
+	}
+	return nil
+}
+
+func (w *boltWriter) DeactivateProjectWebhook(_ context.Context, projectID int) error {
+	return w.tx.Bucket(projectWebhookSecretsBucket).Put(projectKey(projectID), []byte{})
+}
+
+func (w *boltWriter) RemoveProjectWebhookSecret(_ context.Context, projectID int) error {
+	return w.tx.Bucket(projectWebhookSecretsBucket).Delete(projectKey(projectID))
+}
+
+// removeSession removes a session, its entry in the expiring sessions index and the session of its tokens
+func removeSession(tx *bolt.Tx, sessionID string) error {
+	sessions := tx.Bucket(sessionsBucket)
+	var record sessionRecord
+	found, err := getRecord(sessions, sessionID, &record)
+	if err != nil || !found {
+		return err
+	}
+
+	tokenSessions := tx.Bucket(tokenSessionsBucket)
+	for _, tokenID := range record.TokenIDs {
+		err = tokenSessions.Delete([]byte(tokenID))
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Bucket(indexExpiringSessionsBucket).Delete(indexKey(record.ExpiresAt, sessionID))
+	if err != nil {
+		return err
+	}
+	err = removeUserSession(tx, record, sessionID)
+	if err != nil {
+		return err
+	}
+	return sessions.Delete([]byte(sessionID))
+}
+
+// removeUserSession removes a session from the sessions of its user
+func removeUserSession(tx *bolt.Tx, record sessionRecord, sessionID string) error {
+	users := tx.Bucket(userSessionsBucket)
+	bucket := users.Bucket([]byte(record.UserID))
+	if record.UserID == "" || bucket == nil {
+		return nil
+	}
+	err := bucket.Delete(indexKey(userSessionScore(record.ExpiresAt), sessionID))
+	if err != nil {
+		return err
+	}
+	if bucket.Stats().KeyN == 0 {
+		return users.DeleteBucket([]byte(record.UserID))
+	}
+	return nil
+}
+
+// userSessionScore orders the sessions of a user by expiration, the sessions without an expiration come last
+func userSessionScore(expiresAt int64) int64 {
+	if expiresAt <= 0 {
+		return math.MaxInt64
+	}
+	return expiresAt
+}
+
+// removeAccessToken removes an access token and its entry in the expiring tokens index
+func removeAccessToken(tx *bolt.Tx, tokenID string) error {
+	accessTokens := tx.Bucket(accessTokensBucket)
+	var record accessTokenRecord
+	found, err := getRecord(accessTokens, tokenID, &record)
+	if err != nil || !found {
+		return err
+	}
+
+	err = tx.Bucket(indexExpiringTokensBucket).Delete(indexKey(record.ExpiresAt, tokenID))
+	if err != nil {
+		return err
+	}
+	return accessTokens.Delete([]byte(tokenID))
+}
+
+// removeRefreshToken removes a refresh token and its entry in the expiring refresh tokens index
+func removeRefreshToken(tx *bolt.Tx, tokenID string) error {
+	refreshTokens := tx.Bucket(refreshTokensBucket)
+	var record refreshTokenRecord
+	found, err := getRecord(refreshTokens, tokenID, &record)
+	if err != nil || !found {
+		return err
+	}
+
+	err = tx.Bucket(indexExpiringRefreshTokensBucket).Delete(indexKey(record.ExpiresAt, tokenID))
+	if err != nil {
+		return err
+	}
+	return refreshTokens.Delete([]byte(tokenID))
+}
+
+// removeFromIndex removes the entry of an ID from an index whatever its score, the whole index is scanned so it is
+// only used for the small per project indexes
+func removeFromIndex(bucket *bolt.Bucket, id string) error {
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		if indexID(key) == id {
+			return cursor.Delete()
+		}
+	}
+	return nil
+}
+
+// getRecord reads a JSON record, found is false if there is no record for the key
+func getRecord(bucket *bolt.Bucket, key string, record interface{}) (found bool, err error) {
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, record)
+}
+
+// getExistingRecord reads a JSON record, it returns models.ErrNotFound if there is no record for the key
+func getExistingRecord(bucket *bolt.Bucket, key string, record interface{}) error {
+	found, err := getRecord(bucket, key, record)
+	if err == nil && !found {
+		return models.ErrNotFound
+	}
+	return err
+}
+
+func putRecord(bucket *bolt.Bucket, key string, record interface{}) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+// scoreKey encodes a score so that the byte order of the keys is the numeric order of the scores, negative scores
+// included
+func scoreKey(score int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(score)^(1<<63))
+	return key
+}
+
+// indexKey returns the key of an index entry, entries are ordered by score and then by ID like a Redis sorted set
+func indexKey(score int64, id string) []byte {
+	return append(scoreKey(score), id...)
+}
+
+func indexScore(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]) ^ (1 << 63))
+}
+
+func indexID(key []byte) string {
+	return string(key[8:])
+}
+
+func projectKey(projectID int) []byte {
+	return []byte(strconv.Itoa(projectID))
+}
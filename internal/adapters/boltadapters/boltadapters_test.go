@@ -0,0 +1,193 @@
+package boltadapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+func newTestAdapter(t *testing.T, path string) *BoltAdapter {
+	adapter, err := NewBoltAdapter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { adapter.Close() })
+	return adapter
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		return newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+	})
+}
+
+func TestScoreKeyOrder(t *testing.T) {
+	scores := []int64{-62135596800, -1, 0, 1, 1700000000}
+	for i := 1; i < len(scores); i++ {
+		previous, current := string(scoreKey(scores[i-1])), string(scoreKey(scores[i]))
+		if previous >= current {
+			t.Errorf("key of %v is NOT ordered before the key of %v\n", scores[i-1], scores[i])
+		}
+		if score := indexScore(indexKey(scores[i], "id")); score != scores[i] {
+			t.Errorf("decoded score is NOT the correct value, got %v want %v\n", score, scores[i])
+		}
+	}
+}
+
+func TestDataSurvivesReopening(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	expiresAt := time.Unix(time.Now().Unix()+60, 0)
+
+	adapter := newTestAdapter(t, path)
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.Close()
+
+	adapter = newTestAdapter(t, path)
+	ids, err := adapter.GetExpiringAccessTokenIDs(ctx, expiresAt, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "gitlab" {
+		t.Errorf("expiring token IDs are NOT the correct value, got %v want %v\n", ids, []string{"gitlab"})
+	}
+}
+
+func TestRemoveExpiredSessions(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+	now := time.Now()
+	sessions := []models.Session{
+		{ID: "expired", ExpiresAt: now.Add(-time.Minute), TokenIDs: []string{"old"}},
+		{ID: "active", ExpiresAt: now.Add(time.Hour), TokenIDs: []string{"new"}},
+	}
+	for _, session := range sessions {
+		err := adapter.SetSession(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := adapter.RemoveExpiredSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("number of removed sessions is NOT the correct value, got %v want %v\n", removed, 1)
+	}
+	if sessionID, _ := adapter.GetTokenSessionID(ctx, "old"); sessionID != "" {
+		t.Errorf("token session ID is NOT the correct value, got %v want %v\n", sessionID, "")
+	}
+	if _, err := adapter.GetSession(ctx, "active"); errors.Is(err, models.ErrNotFound) {
+		t.Errorf("active session error is NOT the correct value, got %v want %v\n", err, nil)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	adapter := newTestAdapter(t, path)
+	expiresAt := time.Unix(time.Now().Unix()+60, 0)
+	for i := 0; i < 1000; i++ {
+		session := models.Session{ID: fmt.Sprintf("session-%d", i), ExpiresAt: time.Now().Add(-time.Minute)}
+		err := adapter.SetSession(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = adapter.RemoveExpiredSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = adapter.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("The store file did NOT shrink, got %v bytes want less than %v\n", after.Size(), before.Size())
+	}
+	accessToken, err := adapter.GetAccessToken(ctx, "gitlab")
+	if err != nil || accessToken.Value != "access" {
+		t.Errorf("The access token was NOT kept, got %v, %v\n", accessToken.Value, err)
+	}
+	err = adapter.SetAccessToken(ctx, models.AccessToken{ID: "keycloak", Value: "access", ExpiresAt: expiresAt})
+	if err != nil {
+		t.Errorf("Writing to the compacted store failed: %s\n", err)
+	}
+
+	// The writes after the compaction are in the store file
+	err = adapter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := newTestAdapter(t, path)
+	accessToken, err = reopened.GetAccessToken(ctx, "keycloak")
+	if err != nil || accessToken.Value != "access" {
+		t.Errorf("The access token written after the compaction was NOT stored, got %v, %v\n", accessToken.Value, err)
+	}
+}
+
+func TestCompactKeepsStoreWhenFileCannotBeReplaced(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gateway.db")
+	adapter := newTestAdapter(t, path)
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renameFile = func(string, string) error { return os.ErrPermission }
+	defer func() { renameFile = os.Rename }()
+	err = adapter.Compact()
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("The error is NOT correct, got %v want %v\n", err, os.ErrPermission)
+	}
+	if _, err := os.Stat(path + ".compact"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("The compacted copy was NOT removed, got %v\n", err)
+	}
+
+	accessToken, err := adapter.GetAccessToken(ctx, "gitlab")
+	if err != nil || accessToken.Value != "access" {
+		t.Errorf("The access token was NOT kept, got %v, %v\n", accessToken.Value, err)
+	}
+	err = adapter.SetAccessToken(ctx, models.AccessToken{ID: "keycloak", Value: "access", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Errorf("Writing to the store failed after a failed compaction: %s\n", err)
+	}
+}
+
+func TestRunExpirySweepWithoutInterval(t *testing.T) {
+	adapter := newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		adapter.RunExpirySweep(ctx, 0)
+	}()
+	cancel()
+	<-done
+}
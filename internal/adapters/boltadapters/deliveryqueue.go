@@ -0,0 +1,186 @@
+package boltadapters
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	deliveriesBucket         = []byte("kgDeliveries")
+	indexDueDeliveriesBucket = []byte("indexDueDeliveries")
+	deadDeliveriesBucket     = []byte("kgDeadDeliveries")
+)
+
+// DeliveryQueue keeps the knowledge graph deliveries that have to be retried in a bbolt file so that they survive a
+// restart. Deliveries are ordered by their next attempt, with a precision of one second, and then by ID.
+type DeliveryQueue struct {
+	db *bolt.DB
+}
+
+// NewDeliveryQueue opens or creates the queue at path, only one process can open the file at a time
+func NewDeliveryQueue(path string) (*DeliveryQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{deliveriesBucket, indexDueDeliveriesBucket, deadDeliveriesBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DeliveryQueue{db: db}, nil
+}
+
+// Close closes the queue file
+func (q *DeliveryQueue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue adds a delivery to the queue or replaces the queued delivery with the same ID
+func (q *DeliveryQueue) Enqueue(_ context.Context, delivery models.KGDelivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		err := removeDelivery(tx, delivery.ID)
+		if err != nil {
+			return err
+		}
+		err = putRecord(tx.Bucket(deliveriesBucket), delivery.ID, delivery)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(indexDueDeliveriesBucket).Put(indexKey(delivery.NextAttemptAt.Unix(), delivery.ID), nil)
+	})
+}
+
+// DueDeliveries returns up to limit deliveries whose next attempt is at or before now, the ones due first come first
+func (q *DeliveryQueue) DueDeliveries(_ context.Context, now time.Time, limit int) ([]models.KGDelivery, error) {
+	deliveries := []models.KGDelivery{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(deliveriesBucket)
+		c := tx.Bucket(indexDueDeliveriesBucket).Cursor()
+		for key, _ := c.First(); key != nil && len(deliveries) < limit; key, _ = c.Next() {
+			if indexScore(key) > now.Unix() {
+				break
+			}
+			var delivery models.KGDelivery
+			err := getExistingRecord(records, indexID(key), &delivery)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// ClaimDueDeliveries returns up to limit deliveries whose next attempt is at or before now like DueDeliveries and
+// postpones their next attempt by claimFor in the same transaction, so that concurrent retries never send a delivery
+// twice. The returned deliveries keep their original next attempt, a claimed delivery that is neither removed nor
+// enqueued again is retried once the claim has passed.
+func (q *DeliveryQueue) ClaimDueDeliveries(
+	_ context.Context,
+	now time.Time,
+	limit int,
+	claimFor time.Duration,
+) ([]models.KGDelivery, error) {
+	deliveries := []models.KGDelivery{}
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(deliveriesBucket)
+		index := tx.Bucket(indexDueDeliveriesBucket)
+		c := index.Cursor()
+		for key, _ := c.First(); key != nil && len(deliveries) < limit; key, _ = c.Next() {
+			if indexScore(key) > now.Unix() {
+				break
+			}
+			var delivery models.KGDelivery
+			err := getExistingRecord(records, indexID(key), &delivery)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+
+		// The index is changed after the iteration since a cursor must not be used while its bucket changes
+		claimedUntil := now.Add(claimFor)
+		for _, delivery := range deliveries {
+			err := index.Delete(indexKey(delivery.NextAttemptAt.Unix(), delivery.ID))
+			if err != nil {
+				return err
+			}
+			claimed := delivery
+			claimed.NextAttemptAt = claimedUntil
+			err = putRecord(records, delivery.ID, claimed)
+			if err != nil {
+				return err
+			}
+			err = index.Put(indexKey(claimedUntil.Unix(), delivery.ID), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// Remove removes a delivery from the queue, removing a delivery that is not queued is not an error
+func (q *DeliveryQueue) Remove(_ context.Context, id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return removeDelivery(tx, id)
+	})
+}
+
+// DeadLetter moves a delivery that will not be retried anymore out of the queue, it is kept for inspection
+func (q *DeliveryQueue) DeadLetter(_ context.Context, delivery models.KGDelivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		err := removeDelivery(tx, delivery.ID)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx.Bucket(deadDeliveriesBucket), delivery.ID, delivery)
+	})
+}
+
+// DeadDeliveries returns the deliveries that were given up, ordered by ID
+func (q *DeliveryQueue) DeadDeliveries(_ context.Context) ([]models.KGDelivery, error) {
+	deliveries := []models.KGDelivery{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadDeliveriesBucket).ForEach(func(_ []byte, value []byte) error {
+			var delivery models.KGDelivery
+			err := json.Unmarshal(value, &delivery)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+func removeDelivery(tx *bolt.Tx, id string) error {
+	records := tx.Bucket(deliveriesBucket)
+	var delivery models.KGDelivery
+	found, err := getRecord(records, id, &delivery)
+	if err != nil || !found {
+		return err
+	}
+	err = tx.Bucket(indexDueDeliveriesBucket).Delete(indexKey(delivery.NextAttemptAt.Unix(), id))
+	if err != nil {
+		return err
+	}
+	return records.Delete([]byte(id))
+}
@@ -0,0 +1,145 @@
+package boltadapters
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func TestDeliveryQueue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "deliveries.db")
+	queue, err := NewDeliveryQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	for _, delivery := range []models.KGDelivery{
+		{ID: "b", Target: "http://kg", NextAttemptAt: now.Add(-time.Minute)},
+		{ID: "a", Target: "http://kg", NextAttemptAt: now},
+		{ID: "c", Target: "http://kg", NextAttemptAt: now.Add(time.Minute)},
+	} {
+		err = queue.Enqueue(ctx, delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, err := queue.DueDeliveries(ctx, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].ID != "b" || due[1].ID != "a" {
+		t.Errorf("due deliveries are NOT the correct value, got %v\n", due)
+	}
+	if due, _ := queue.DueDeliveries(ctx, now, 1); len(due) != 1 {
+		t.Errorf("due deliveries are NOT limited, got %v\n", due)
+	}
+
+	// Rescheduling replaces the queued delivery
+	err = queue.Enqueue(ctx, models.KGDelivery{ID: "b", Attempts: 2, NextAttemptAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queue.Remove(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queue.Remove(ctx, "a")
+	if err != nil {
+		t.Errorf("removing a delivery twice failed: %s\n", err)
+	}
+	if due, _ := queue.DueDeliveries(ctx, now, 10); len(due) != 0 {
+		t.Errorf("rescheduled or removed deliveries are still due, got %v\n", due)
+	}
+
+	// The queue survives a restart
+	queue.Close()
+	queue, err = NewDeliveryQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	due, err = queue.DueDeliveries(ctx, now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].ID != "c" || due[1].ID != "b" || due[1].Attempts != 2 {
+		t.Errorf("due deliveries after a restart are NOT the correct value, got %v\n", due)
+	}
+
+	err = queue.DeadLetter(ctx, due[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := queue.DeadDeliveries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != "b" {
+		t.Errorf("dead deliveries are NOT the correct value, got %v\n", dead)
+	}
+	if due, _ := queue.DueDeliveries(ctx, now.Add(time.Hour), 10); len(due) != 1 {
+		t.Errorf("a dead delivery is still due, got %v\n", due)
+	}
+}
+
+func TestClaimDueDeliveries(t *testing.T) {
+	ctx := context.Background()
+	queue, err := NewDeliveryQueue(filepath.Join(t.TempDir(), "deliveries.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	now := time.Unix(1700000000, 0)
+
+	for _, delivery := range []models.KGDelivery{
+		{ID: "a", Target: "http://kg", NextAttemptAt: now.Add(-time.Minute)},
+		{ID: "b", Target: "http://kg", NextAttemptAt: now},
+	} {
+		err = queue.Enqueue(ctx, delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := queue.ClaimDueDeliveries(ctx, now, 1, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != "a" || !claimed[0].NextAttemptAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("The claimed deliveries are NOT the correct value, got %v\n", claimed)
+	}
+
+	// A claimed delivery is not returned again until its claim has passed
+	claimed, err = queue.ClaimDueDeliveries(ctx, now, 10, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != "b" {
+		t.Errorf("The second claim is NOT the correct value, got %v\n", claimed)
+	}
+	if claimed, _ := queue.ClaimDueDeliveries(ctx, now.Add(4*time.Minute), 10, 5*time.Minute); len(claimed) != 0 {
+		t.Errorf("Claimed deliveries were claimed again, got %v\n", claimed)
+	}
+	claimed, err = queue.ClaimDueDeliveries(ctx, now.Add(5*time.Minute), 10, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 2 {
+		t.Errorf("The deliveries whose claim has passed were NOT claimed again, got %v\n", claimed)
+	}
+
+	// A claimed delivery can be removed
+	err = queue.Remove(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := queue.DueDeliveries(ctx, now.Add(time.Hour), 10); len(due) != 1 || due[0].ID != "b" {
+		t.Errorf("The removed delivery is still queued, got %v\n", due)
+	}
+}
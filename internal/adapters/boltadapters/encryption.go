@@ -0,0 +1,170 @@
+package boltadapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	bolt "go.etcd.io/bbolt"
+)
+
+func (w *boltWriter) encryptValue(value string, associatedData string) (string, error) {
+	if w.encryptor == nil {
+		return value, nil
+	}
+	return w.encryptor.Encrypt(value, associatedData)
+}
+
+func (b *BoltAdapter) decryptValue(value string, associatedData string) (string, error) {
+	if b.Encryptor == nil {
+		return value, nil
+	}
+	return b.Encryptor.Decrypt(value, associatedData)
+}
+
+// encryptedBucket is a bucket holding encrypted values, reencrypt returns the new stored value of a key or nil when
+// the stored value is already encrypted with the active key
+type encryptedBucket struct {
+	name      []byte
+	reencrypt func(encryptor encryption.ValueEncryptor, key []byte, value []byte) ([]byte, error)
+}
+
+var encryptedBuckets = []encryptedBucket{
+	{name: accessTokensBucket, reencrypt: reencryptAccessToken},
+	{name: refreshTokensBucket, reencrypt: reencryptRefreshToken},
+	{name: projectWebhookSecretsBucket, reencrypt: reencryptWebhookSecret},
+}
+
+// ReencryptTokens encrypts every access and refresh token value and every webhook secret that is not encrypted with
+// the active key again, plaintext values included. It rewrites the values in transactions of batchSize keys and calls
+// progress after every batch with the number of values scanned and rewritten so far. Only one process can open the
+// store file, so the gateway has to be stopped while the values are re-encrypted.
+func (b *BoltAdapter) ReencryptTokens(
+	ctx context.Context,
+	batchSize int,
+	progress func(scanned int, rewritten int),
+) (int, error) {
+	if b.Encryptor == nil {
+		return 0, fmt.Errorf("no encryptor is configured")
+	}
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("the batch size must be positive")
+	}
+
+	scanned, rewritten := 0, 0
+	for _, bucket := range encryptedBuckets {
+		var after []byte
+		for {
+			if err := ctx.Err(); err != nil {
+				return rewritten, err
+			}
+			batchScanned, batchRewritten := 0, 0
+			err := b.dbUpdate(func(tx *bolt.Tx) error {
+				batchScanned, batchRewritten = 0, 0
+				values := map[string][]byte{}
+				cursor := tx.Bucket(bucket.name).Cursor()
+				key, value := cursor.First()
+				if after != nil {
+					key, value = cursor.Seek(after)
+					if key != nil && bytes.Equal(key, after) {
+						key, value = cursor.Next()
+					}
+				}
+				var last []byte
+				for ; key != nil && batchScanned < batchSize; key, value = cursor.Next() {
+					batchScanned++
+					last = append([]byte{}, key...)
+					newValue, err := bucket.reencrypt(b.Encryptor, key, value)
+					if err != nil {
+						return err
+					}
+					if newValue != nil {
+						values[string(key)] = newValue
+					}
+				}
+				// The values are written after the iteration since a cursor must not be used while its bucket changes
+				for key, value := range values {
+					err := tx.Bucket(bucket.name).Put([]byte(key), value)
+					if err != nil {
+						return err
+					}
+				}
+				batchRewritten = len(values)
+				after = last
+				return nil
+			})
+			if err != nil {
+				return rewritten, err
+			}
+			scanned += batchScanned
+			rewritten += batchRewritten
+			if progress != nil {
+				progress(scanned, rewritten)
+			}
+			if batchScanned < batchSize {
+				break
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptValue decrypts a value with its key and encrypts it with the active one, changed is false when the value
+// is already encrypted with the active key
+func reencryptValue(
+	encryptor encryption.ValueEncryptor,
+	value string,
+	associatedData string,
+) (newValue string, changed bool, err error) {
+	if encryptor.IsCurrent(value) {
+		return value, false, nil
+	}
+	plaintext, err := encryptor.Decrypt(value, associatedData)
+	if err != nil {
+		return "", false, err
+	}
+	newValue, err = encryptor.Encrypt(plaintext, associatedData)
+	return newValue, err == nil, err
+}
+
+func reencryptAccessToken(encryptor encryption.ValueEncryptor, key []byte, value []byte) ([]byte, error) {
+	var record accessTokenRecord
+	err := json.Unmarshal(value, &record)
+	if err != nil {
+		return nil, err
+	}
+	newValue, changed, err := reencryptValue(encryptor, record.Value, encryption.AccessTokenAssociatedData(string(key)))
+	if err != nil || !changed {
+		return nil, err
+	}
+	record.Value = newValue
+	return json.Marshal(record)
+}
+
+func reencryptRefreshToken(encryptor encryption.ValueEncryptor, key []byte, value []byte) ([]byte, error) {
+	var record refreshTokenRecord
+	err := json.Unmarshal(value, &record)
+	if err != nil {
+		return nil, err
+	}
+	newValue, changed, err := reencryptValue(encryptor, record.Value, encryption.RefreshTokenAssociatedData(string(key)))
+	if err != nil || !changed {
+		return nil, err
+	}
+	record.Value = newValue
+	return json.Marshal(record)
+}
+
+func reencryptWebhookSecret(encryptor encryption.ValueEncryptor, key []byte, value []byte) ([]byte, error) {
+	// Deactivated projects are stored with an empty secret
+	if len(value) == 0 {
+		return nil, nil
+	}
+	newValue, changed, err := reencryptValue(encryptor, string(value), encryption.WebhookSecretAssociatedData(string(key)))
+	if err != nil || !changed {
+		return nil, err
+	}
+	return []byte(newValue), nil
+}
@@ -0,0 +1,173 @@
+package boltadapters
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DummyEncryptor "encrypts" values by prefixing them with its key ID and the associated data
+type DummyEncryptor struct {
+	keyID string
+}
+
+func (d *DummyEncryptor) Encrypt(plaintext string, associatedData string) (string, error) {
+	return d.keyID + "|" + associatedData + "|" + plaintext, nil
+}
+func (d *DummyEncryptor) Decrypt(value string, associatedData string) (string, error) {
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 || parts[1] != associatedData {
+		return value, nil
+	}
+	return parts[2], nil
+}
+func (d *DummyEncryptor) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, d.keyID+"|")
+}
+
+func TestConformanceWithEncryption(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		adapter := newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+		adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+		return adapter
+	})
+}
+
+func TestTokenValuesAreEncrypted(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+	adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "12345", Value: "6789", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "12345", Value: "abcd", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetProjectWebhookSecret(ctx, 42, "efgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accessTokenRecord accessTokenRecord
+	var refreshTokenRecord refreshTokenRecord
+	var secret string
+	err = adapter.view(func(tx *bolt.Tx) error {
+		_, err := getRecord(tx.Bucket(accessTokensBucket), "12345", &accessTokenRecord)
+		if err != nil {
+			return err
+		}
+		_, err = getRecord(tx.Bucket(refreshTokensBucket), "12345", &refreshTokenRecord)
+		secret = string(tx.Bucket(projectWebhookSecretsBucket).Get(projectKey(42)))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessTokenRecord.Value != "key1|accessToken:12345|6789" {
+		t.Errorf("The stored access token is NOT encrypted, got %v\n", accessTokenRecord.Value)
+	}
+	if refreshTokenRecord.Value != "key1|refreshToken:12345|abcd" {
+		t.Errorf("The stored refresh token is NOT encrypted, got %v\n", refreshTokenRecord.Value)
+	}
+	if secret != "key1|webhookSecret:42|efgh" {
+		t.Errorf("The stored webhook secret is NOT encrypted, got %v\n", secret)
+	}
+
+	accessToken, err := adapter.GetAccessToken(ctx, "12345")
+	if err != nil || accessToken.Value != "6789" {
+		t.Errorf("The access token was NOT decrypted, got %v, %v\n", accessToken.Value, err)
+	}
+	refreshToken, err := adapter.GetRefreshToken(ctx, "12345")
+	if err != nil || refreshToken.Value != "abcd" {
+		t.Errorf("The refresh token was NOT decrypted, got %v, %v\n", refreshToken.Value, err)
+	}
+	secret, err = adapter.GetProjectWebhookSecret(ctx, 42)
+	if err != nil || secret != "efgh" {
+		t.Errorf("The webhook secret was NOT decrypted, got %v, %v\n", secret, err)
+	}
+}
+
+func TestReencryptTokens(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t, filepath.Join(t.TempDir(), "gateway.db"))
+
+	// One plaintext value written before encryption was enabled and one encrypted with a previous key
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "plain", Value: "6789", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.DeactivateProjectWebhook(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+	err = adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "old", Value: "abcd", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetProjectWebhookSecret(ctx, 42, "ijkl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter.Encryptor = &DummyEncryptor{keyID: "key2"}
+	err = adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "current", Value: "efgh", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	rewritten, err := adapter.ReencryptTokens(ctx, 1, func(int, int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != 3 || calls == 0 {
+		t.Errorf("The number of rewritten values is NOT correct, got %v want %v\n", rewritten, 3)
+	}
+
+	var accessToken accessTokenRecord
+	var oldRefreshToken, currentRefreshToken refreshTokenRecord
+	var secret, deactivated []byte
+	err = adapter.view(func(tx *bolt.Tx) error {
+		_, err := getRecord(tx.Bucket(accessTokensBucket), "plain", &accessToken)
+		if err != nil {
+			return err
+		}
+		_, err = getRecord(tx.Bucket(refreshTokensBucket), "old", &oldRefreshToken)
+		if err != nil {
+			return err
+		}
+		_, err = getRecord(tx.Bucket(refreshTokensBucket), "current", &currentRefreshToken)
+		secret = tx.Bucket(projectWebhookSecretsBucket).Get(projectKey(42))
+		deactivated = tx.Bucket(projectWebhookSecretsBucket).Get(projectKey(7))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken.Value != "key2|accessToken:plain|6789" {
+		t.Errorf("The plaintext access token was NOT encrypted, got %v\n", accessToken.Value)
+	}
+	if oldRefreshToken.Value != "key2|refreshToken:old|abcd" {
+		t.Errorf("The refresh token was NOT encrypted with the active key, got %v\n", oldRefreshToken.Value)
+	}
+	if currentRefreshToken.Value != "key2|refreshToken:current|efgh" {
+		t.Errorf("The current refresh token was changed, got %v\n", currentRefreshToken.Value)
+	}
+	if string(secret) != "key2|webhookSecret:42|ijkl" {
+		t.Errorf("The webhook secret was NOT encrypted with the active key, got %s\n", secret)
+	}
+	if deactivated == nil || len(deactivated) != 0 {
+		t.Errorf("The deactivated webhook was changed, got %q\n", deactivated)
+	}
+}
@@ -0,0 +1,19 @@
+package encryption
+
+// The associated data of the stored values binds them to their record, so that an encrypted value copied to another
+// record cannot be decrypted. Every store uses the same associated data so that values can be moved between stores.
+
+// AccessTokenAssociatedData binds an encrypted access token value to its token ID
+func AccessTokenAssociatedData(tokenID string) string {
+	return "accessToken:" + tokenID
+}
+
+// RefreshTokenAssociatedData binds an encrypted refresh token value to its token ID
+func RefreshTokenAssociatedData(tokenID string) string {
+	return "refreshToken:" + tokenID
+}
+
+// WebhookSecretAssociatedData binds an encrypted webhook secret to its project ID
+func WebhookSecretAssociatedData(projectID string) string {
+	return "webhookSecret:" + projectID
+}
@@ -0,0 +1,132 @@
+// Package encryption encrypts token values with AES-GCM using data keys from a key provider
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks values encrypted by this package, values without it are treated as plaintext so that
+// existing plaintext values can still be read and are encrypted the next time they are written
+const encryptedPrefix = "enc:v1:"
+
+var (
+	ErrUnknownKey       = errors.New("the encryption key is not in the key ring")
+	ErrMalformedValue   = errors.New("the encrypted value is malformed")
+	ErrInvalidKeyLength = errors.New("encryption keys must be 16, 24 or 32 bytes long")
+)
+
+// KeyProvider provides the data keys used to encrypt and decrypt values
+type KeyProvider interface {
+	// ActiveKey returns the key used to encrypt new values
+	ActiveKey() (keyID string, key []byte, err error)
+	// Key returns the key with the given ID, it is used to decrypt values encrypted with older keys
+	Key(keyID string) ([]byte, error)
+}
+
+// ValueEncryptor is what the stores need to encrypt the values they write and to re-encrypt them with the active key
+type ValueEncryptor interface {
+	Encrypt(plaintext string, associatedData string) (string, error)
+	Decrypt(value string, associatedData string) (string, error)
+	// IsCurrent reports whether a stored value is encrypted with the active key
+	IsCurrent(value string) bool
+}
+
+var _ ValueEncryptor = (*Encryptor)(nil)
+
+// Encryptor encrypts values with the active key of a key provider and decrypts values with the key they were
+// encrypted with. Encrypted values have the form enc:v1:<key ID>:<base64 of nonce and ciphertext>.
+type Encryptor struct {
+	Keys KeyProvider
+}
+
+// Encrypt encrypts a value with the active key, the associated data is authenticated but not stored, it binds the
+// ciphertext to the record it belongs to
+func (e *Encryptor) Encrypt(plaintext string, associatedData string) (string, error) {
+	keyID, key, err := e.Keys.ActiveKey()
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(associatedData))
+	return encryptedPrefix + keyID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value with the key it was encrypted with, values that are not encrypted are returned as is
+func (e *Encryptor) Decrypt(value string, associatedData string) (string, error) {
+	keyID, sealed, encrypted, err := parse(value)
+	if err != nil || !encrypted {
+		return value, err
+	}
+	key, err := e.Keys.Key(keyID)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrMalformedValue
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(associatedData))
+	if err != nil {
+		return "", fmt.Errorf("decrypting with key %s failed: %w", keyID, err)
+	}
+	return string(plaintext), nil
+}
+
+// IsCurrent reports whether a value is encrypted with the active key, plaintext values are never current
+func (e *Encryptor) IsCurrent(value string) bool {
+	keyID, _, encrypted, err := parse(value)
+	if err != nil || !encrypted {
+		return false
+	}
+	activeKeyID, _, err := e.Keys.ActiveKey()
+	return err == nil && keyID == activeKeyID
+}
+
+// IsEncrypted reports whether a value was encrypted by this package, it lets callers refuse plaintext values that
+// Decrypt would return as is
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// parse splits an encrypted value into its key ID and sealed bytes, encrypted is false for plaintext values
+func parse(value string) (keyID string, sealed []byte, encrypted bool, err error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", nil, false, nil
+	}
+	keyID, encoded, found := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !found || keyID == "" {
+		return "", nil, true, ErrMalformedValue
+	}
+	sealed, err = base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, true, ErrMalformedValue
+	}
+	return keyID, sealed, true, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidKeyLength
+	}
+	return cipher.NewGCM(block)
+}
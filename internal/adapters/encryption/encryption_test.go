@@ -0,0 +1,137 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyRing writes a key ring directory with the given key IDs and active key and returns its path
+func writeKeyRing(t *testing.T, activeKeyID string, keyIDs ...string) string {
+	dir := t.TempDir()
+	for _, keyID := range keyIDs {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, keyID), []byte(base64.StdEncoding.EncodeToString(key)), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(dir, activeKeyFile), []byte(activeKeyID+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func setActiveKey(t *testing.T, dir string, keyID string) {
+	err := os.WriteFile(filepath.Join(dir, activeKeyFile), []byte(keyID), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keyRing, err := NewFileKeyRing(writeKeyRing(t, "key1", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := Encryptor{Keys: keyRing}
+
+	ciphertext, err := encryptor.Encrypt("6789", "accessToken:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ciphertext, "enc:v1:key1:") || strings.Contains(ciphertext, "6789") {
+		t.Errorf("The encrypted value does NOT have the expected form, got %v\n", ciphertext)
+	}
+
+	plaintext, err := encryptor.Decrypt(ciphertext, "accessToken:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "6789" {
+		t.Errorf("The decrypted value is NOT correct, got %v want %v\n", plaintext, "6789")
+	}
+
+	// The ciphertext is bound to the record it was written for
+	_, err = encryptor.Decrypt(ciphertext, "accessToken:other")
+	if err == nil {
+		t.Errorf("Decrypting with the wrong associated data did NOT fail\n")
+	}
+}
+
+func TestDecryptPlaintext(t *testing.T) {
+	keyRing, err := NewFileKeyRing(writeKeyRing(t, "key1", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := Encryptor{Keys: keyRing}
+
+	plaintext, err := encryptor.Decrypt("6789", "accessToken:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "6789" || encryptor.IsCurrent("6789") {
+		t.Errorf("Plaintext values must be returned as is and never be current, got %v\n", plaintext)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := writeKeyRing(t, "key1", "key1", "key2")
+	keyRing, err := NewFileKeyRing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := Encryptor{Keys: keyRing}
+
+	oldCiphertext, err := encryptor.Encrypt("6789", "refreshToken:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setActiveKey(t, dir, "key2")
+	err = keyRing.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encryptor.IsCurrent(oldCiphertext) {
+		t.Errorf("A value encrypted with a previous key is reported as current\n")
+	}
+	plaintext, err := encryptor.Decrypt(oldCiphertext, "refreshToken:12345")
+	if err != nil || plaintext != "6789" {
+		t.Errorf("Decrypting with a previous key failed, got %v, %v\n", plaintext, err)
+	}
+	newCiphertext, err := encryptor.Encrypt(plaintext, "refreshToken:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(newCiphertext, "enc:v1:key2:") || !encryptor.IsCurrent(newCiphertext) {
+		t.Errorf("The value was NOT encrypted with the active key, got %v\n", newCiphertext)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	_, err := NewFileKeyRing(writeKeyRing(t, "missing", "key1"))
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Loading a key ring without the active key did NOT fail, got %v\n", err)
+	}
+
+	keyRing, err := NewFileKeyRing(writeKeyRing(t, "key1", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := Encryptor{Keys: keyRing}
+	_, err = encryptor.Decrypt("enc:v1:removed:AAAA", "accessToken:12345")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypting with a removed key did NOT fail, got %v\n", err)
+	}
+}
@@ -0,0 +1,94 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// activeKeyFile is the file in a key ring directory that contains the ID of the active key
+const activeKeyFile = "active"
+
+// FileKeyRing is a key provider that reads its keys from a directory, for example a mounted Kubernetes secret. Every
+// file in the directory contains a base64 encoded key named after the file, except for the file named active which
+// contains the ID of the key used to encrypt new values.
+type FileKeyRing struct {
+	dir string
+
+	mu          sync.RWMutex
+	activeKeyID string
+	keys        map[string][]byte
+}
+
+// NewFileKeyRing loads a key ring from a directory
+func NewFileKeyRing(dir string) (*FileKeyRing, error) {
+	keyRing := FileKeyRing{dir: dir}
+	err := keyRing.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return &keyRing, nil
+}
+
+// Reload reads the keys from the directory again, so that a rotated secret can be picked up without a restart
+func (f *FileKeyRing) Reload() error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string][]byte{}
+	activeKeyID := ""
+	for _, entry := range entries {
+		// Kubernetes secret mounts contain hidden symlinks such as ..data that must be skipped
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(f.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if entry.Name() == activeKeyFile {
+			activeKeyID = strings.TrimSpace(string(content))
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("key %s is not base64 encoded: %w", entry.Name(), err)
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return fmt.Errorf("key %s: %w", entry.Name(), ErrInvalidKeyLength)
+		}
+		keys[entry.Name()] = key
+	}
+	if _, found := keys[activeKeyID]; !found {
+		return fmt.Errorf("active key %q: %w", activeKeyID, ErrUnknownKey)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys = keys
+	f.activeKeyID = activeKeyID
+	return nil
+}
+
+// ActiveKey returns the key used to encrypt new values
+func (f *FileKeyRing) ActiveKey() (keyID string, key []byte, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.activeKeyID, f.keys[f.activeKeyID], nil
+}
+
+// Key returns the key with the given ID
+func (f *FileKeyRing) Key(keyID string) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	key, found := f.keys[keyID]
+	if !found {
+		return nil, fmt.Errorf("key %q: %w", keyID, ErrUnknownKey)
+	}
+	return key, nil
+}
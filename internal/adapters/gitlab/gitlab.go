@@ -0,0 +1,257 @@
+// Package gitlab contains a client for the parts of the GitLab REST API used by the gateway
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// expiresAtLayout is the format of the expiration dates of the GitLab API
+const expiresAtLayout = "2006-01-02"
+
+// Client calls the GitLab API, it uses http.DefaultClient when HTTPClient is nil
+type Client struct {
+	// URL is the address of the GitLab instance, e.g. https://gitlab.com
+	URL string
+	// Token authenticates the requests, creating project access tokens requires the maintainer role
+	Token      string
+	HTTPClient *http.Client
+
+	oauthToken string
+	anonymous  bool
+}
+
+// projectAccessToken is the JSON representation of a project access token
+type projectAccessToken struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	AccessLevel int      `json:"access_level"`
+	ExpiresAt   string   `json:"expires_at"`
+	Token       string   `json:"token,omitempty"`
+	UserID      int      `json:"user_id,omitempty"`
+}
+
+// CreateProjectAccessToken creates a project access token
+func (c *Client) CreateProjectAccessToken(
+	ctx context.Context,
+	projectID int,
+	request models.GitlabProjectAccessTokenRequest,
+) (models.GitlabProjectAccessToken, error) {
+	body := projectAccessToken{
+		Name:        request.Name,
+		Scopes:      request.Scopes,
+		AccessLevel: request.AccessLevel,
+		ExpiresAt:   request.ExpiresAt.UTC().Format(expiresAtLayout),
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, projectPath(projectID)+"/access_tokens", body)
+	if err != nil {
+		return models.GitlabProjectAccessToken{}, err
+	}
+	var created projectAccessToken
+	err = c.send(req, &created)
+	if err != nil {
+		return models.GitlabProjectAccessToken{}, err
+	}
+
+	expiresAt, err := time.Parse(expiresAtLayout, created.ExpiresAt)
+	if err != nil {
+		return models.GitlabProjectAccessToken{}, err
+	}
+	return models.GitlabProjectAccessToken{
+		ID:        created.ID,
+		Value:     created.Token,
+		ExpiresAt: expiresAt,
+		UserID:    created.UserID,
+	}, nil
+}
+
+// RevokeProjectAccessToken revokes a project access token, it returns models.ErrNotFound if there is no such token
+func (c *Client) RevokeProjectAccessToken(ctx context.Context, projectID int, tokenID int) error {
+	path := projectPath(projectID) + "/access_tokens/" + strconv.Itoa(tokenID)
+	req, err := c.newRequest(ctx, http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	return c.send(req, nil)
+}
+
+// project is the JSON representation of a project
+type project struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	Visibility        string `json:"visibility"`
+}
+
+// withOAuthToken returns a copy of the client that authenticates with the OAuth token of a user instead of Token, an
+// empty token makes anonymous requests
+func (c *Client) withOAuthToken(token string) *Client {
+	return &Client{URL: c.URL, HTTPClient: c.HTTPClient, oauthToken: token, anonymous: token == ""}
+}
+
+// GetProject reads a project, it returns models.ErrNotFound if there is no such project or if it is not visible with
+// the token of the client
+func (c *Client) GetProject(ctx context.Context, projectID int) (models.GitlabProject, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, projectPath(projectID), nil)
+	if err != nil {
+		return models.GitlabProject{}, err
+	}
+	var read project
+	err = c.send(req, &read)
+	if err != nil {
+		return models.GitlabProject{}, err
+	}
+	return models.GitlabProject{
+		ID:                read.ID,
+		PathWithNamespace: read.PathWithNamespace,
+		Visibility:        read.Visibility,
+	}, nil
+}
+
+// GetProjectAsUser reads a project with the OAuth token of a user, or anonymously when token is empty. It returns
+// models.ErrNotFound if there is no such project or if the user cannot see it.
+func (c *Client) GetProjectAsUser(ctx context.Context, token string, projectID int) (models.GitlabProject, error) {
+	return c.withOAuthToken(token).GetProject(ctx, projectID)
+}
+
+// projectHook is the JSON representation of a project webhook
+type projectHook struct {
+	ID                    int    `json:"id,omitempty"`
+	URL                   string `json:"url"`
+	Token                 string `json:"token,omitempty"`
+	PushEvents            bool   `json:"push_events"`
+	TagPushEvents         bool   `json:"tag_push_events"`
+	EnableSSLVerification bool   `json:"enable_ssl_verification"`
+}
+
+// hooksPerPage is the size of the pages requested when listing the webhooks of a project
+const hooksPerPage = 100
+
+// ListProjectHooks returns every webhook of a project, it returns models.ErrNotFound if there is no such project
+func (c *Client) ListProjectHooks(ctx context.Context, projectID int) ([]models.GitlabProjectHook, error) {
+	hooks := []models.GitlabProjectHook{}
+	for page := 1; ; page++ {
+		path := fmt.Sprintf("%s/hooks?per_page=%d&page=%d", projectPath(projectID), hooksPerPage, page)
+		req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		var listed []projectHook
+		err = c.send(req, &listed)
+		if err != nil {
+			return nil, err
+		}
+		for _, hook := range listed {
+			hooks = append(hooks, models.GitlabProjectHook{
+				ID:            hook.ID,
+				URL:           hook.URL,
+				PushEvents:    hook.PushEvents,
+				TagPushEvents: hook.TagPushEvents,
+			})
+		}
+		if len(listed) < hooksPerPage {
+			return hooks, nil
+		}
+	}
+}
+
+// AddProjectHook creates a webhook with SSL verification enabled and returns its ID
+func (c *Client) AddProjectHook(
+	ctx context.Context,
+	projectID int,
+	request models.GitlabProjectHookRequest,
+) (int, error) {
+	body := projectHook{
+		URL:                   request.URL,
+		Token:                 request.Token,
+		PushEvents:            request.PushEvents,
+		TagPushEvents:         request.TagPushEvents,
+		EnableSSLVerification: true,
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, projectPath(projectID)+"/hooks", body)
+	if err != nil {
+		return 0, err
+	}
+	var created projectHook
+	err = c.send(req, &created)
+	return created.ID, err
+}
+
+// DeleteProjectHook deletes a webhook, it returns models.ErrNotFound if there is no such hook
+func (c *Client) DeleteProjectHook(ctx context.Context, projectID int, hookID int) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, projectPath(projectID)+"/hooks/"+strconv.Itoa(hookID), nil)
+	if err != nil {
+		return err
+	}
+	return c.send(req, nil)
+}
+
+func projectPath(projectID int) string {
+	return "/projects/" + strconv.Itoa(projectID)
+}
+
+// newRequest creates a request to the API with body encoded as JSON when it is not nil
+func (c *Client) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.URL, "/")+"/api/v4"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.oauthToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.oauthToken)
+	case !c.anonymous:
+		req.Header.Set("PRIVATE-TOKEN", c.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// send sends a request to the API and decodes the response into result when it is not nil, a 404 response is
+// reported as models.ErrNotFound and a 401 or 403 response as models.ErrForbidden
+func (c *Client) send(req *http.Request, result interface{}) error {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("GitLab %s %s: %w", req.Method, req.URL.Path, models.ErrNotFound)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("GitLab %s %s responded with status %d: %w", req.Method, req.URL.Path, resp.StatusCode,
+			models.ErrForbidden)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GitLab %s %s responded with status %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
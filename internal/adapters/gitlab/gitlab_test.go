@@ -0,0 +1,162 @@
+package gitlab
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab/gitlabtest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+var ctx = context.Background()
+
+func TestCreateProjectAccessToken(t *testing.T) {
+	server := gitlabtest.NewServer(t)
+	client := &Client{URL: server.URL, Token: server.Token}
+
+	expiresAt := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	token, err := client.CreateProjectAccessToken(ctx, 42, models.GitlabProjectAccessTokenRequest{
+		Name:        "kg",
+		Scopes:      []string{"read_api"},
+		AccessLevel: 20,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Value == "" || token.UserID == 0 || !token.ExpiresAt.Equal(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("The created token is NOT the correct value, got %v\n", token)
+	}
+
+	created := server.ActiveProjectAccessTokens(42)
+	if len(created) != 1 || created[0].ExpiresAt != "2030-01-02" || created[0].AccessLevel != 20 {
+		t.Errorf("The token created in GitLab is NOT the correct value, got %v\n", created)
+	}
+}
+
+func TestRevokeProjectAccessToken(t *testing.T) {
+	server := gitlabtest.NewServer(t)
+	client := &Client{URL: server.URL, Token: server.Token}
+
+	token, err := client.CreateProjectAccessToken(ctx, 42, models.GitlabProjectAccessTokenRequest{
+		Name:      "kg",
+		Scopes:    []string{"read_api"},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RevokeProjectAccessToken(ctx, 42, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := server.ActiveProjectAccessTokens(42); len(active) != 0 {
+		t.Errorf("The token was NOT revoked, got %v\n", active)
+	}
+
+	err = client.RevokeProjectAccessToken(ctx, 42, token.ID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Revoking a revoked token did NOT return ErrNotFound, got %v\n", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	server := gitlabtest.NewServer(t)
+
+	client := &Client{URL: server.URL, Token: "wrong"}
+	err := client.RevokeProjectAccessToken(ctx, 42, 1)
+	if err == nil || errors.Is(err, models.ErrNotFound) {
+		t.Errorf("An unauthorized request did NOT fail, got %v\n", err)
+	}
+
+	client.Token = server.Token
+	server.FailNext(http.MethodPost, "/projects/42/access_tokens", http.StatusInternalServerError)
+	_, err = client.CreateProjectAccessToken(ctx, 42, models.GitlabProjectAccessTokenRequest{
+		Name:   "kg",
+		Scopes: []string{"read_api"},
+	})
+	if err == nil {
+		t.Errorf("A failed request did NOT return an error\n")
+	}
+}
+
+func TestProjectHooks(t *testing.T) {
+	server := gitlabtest.NewServer(t)
+	client := &Client{URL: server.URL, Token: server.Token}
+
+	hookID, err := client.AddProjectHook(ctx, 42, models.GitlabProjectHookRequest{
+		URL:        "https://kg.example.org/webhooks/gitlab",
+		Token:      "secret",
+		PushEvents: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := server.ProjectHooks(42)
+	if len(created) != 1 || created[0].ID != hookID || created[0].Token != "secret" || !created[0].PushEvents {
+		t.Errorf("The hook created in GitLab is NOT the correct value, got %v\n", created)
+	}
+
+	// Listing goes through every page
+	for i := 0; i < hooksPerPage; i++ {
+		server.AddProjectHook(42, gitlabtest.Hook{URL: "https://ci.example.org"})
+	}
+	hooks, err := client.ListProjectHooks(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != hooksPerPage+1 || hooks[0].ID != hookID || hooks[0].URL != "https://kg.example.org/webhooks/gitlab" {
+		t.Errorf("The listed hooks are NOT the correct value, got %v hooks, first %v\n", len(hooks), hooks[0])
+	}
+
+	err = client.DeleteProjectHook(ctx, 42, hookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.DeleteProjectHook(ctx, 42, hookID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Deleting a deleted hook did NOT return ErrNotFound, got %v\n", err)
+	}
+
+	server.RemoveProject(42)
+	_, err = client.ListProjectHooks(ctx, 42)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Listing the hooks of a removed project did NOT return ErrNotFound, got %v\n", err)
+	}
+}
+
+func TestGetProject(t *testing.T) {
+	server := gitlabtest.NewServer(t)
+	server.AddProject(gitlabtest.Project{ID: 42, PathWithNamespace: "group/private", Visibility: "private"})
+	server.AddUser("member-token", 42)
+	server.AddUser("other-token")
+	client := &Client{URL: server.URL, Token: server.Token}
+
+	project, err := client.GetProject(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.GitlabProject{ID: 42, PathWithNamespace: "group/private", Visibility: models.GitlabVisibilityPrivate}
+	if project != want {
+		t.Errorf("The project is NOT the correct value, got %v want %v\n", project, want)
+	}
+
+	project, err = client.GetProjectAsUser(ctx, "member-token", 42)
+	if err != nil || project != want {
+		t.Errorf("The project read by a member is NOT the correct value, got %v, %v\n", project, err)
+	}
+	for _, token := range []string{"other-token", ""} {
+		_, err = client.GetProjectAsUser(ctx, token, 42)
+		if !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("A private project was visible to %q, got %v\n", token, err)
+		}
+	}
+	_, err = client.GetProjectAsUser(ctx, "unknown-token", 42)
+	if !errors.Is(err, models.ErrForbidden) {
+		t.Errorf("An unknown user token did NOT return ErrForbidden, got %v\n", err)
+	}
+}
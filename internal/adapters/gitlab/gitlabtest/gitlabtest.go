@@ -0,0 +1,357 @@
+// Package gitlabtest provides a local stand-in for the parts of the GitLab API used by the gateway
+package gitlabtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// botUserIDOffset is added to the ID of a project access token to get the ID of its bot user
+const botUserIDOffset = 1000
+
+// AccessToken is a project access token held by the server
+type AccessToken struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	AccessLevel int      `json:"access_level"`
+	ExpiresAt   string   `json:"expires_at"`
+	Revoked     bool     `json:"revoked"`
+	Token       string   `json:"token,omitempty"`
+	UserID      int      `json:"user_id"`
+}
+
+// Hook is a project webhook held by the server
+type Hook struct {
+	ID            int    `json:"id"`
+	URL           string `json:"url"`
+	Token         string `json:"token,omitempty"`
+	PushEvents    bool   `json:"push_events"`
+	TagPushEvents bool   `json:"tag_push_events"`
+}
+
+// Project is a project held by the server
+type Project struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	Visibility        string `json:"visibility"`
+}
+
+// Server is a GitLab API stand-in. Administration requests must carry Token in the PRIVATE-TOKEN header, the projects
+// can also be read anonymously or with the OAuth token of a user in the Authorization header.
+type Server struct {
+	*httptest.Server
+	Token string
+
+	mu           sync.Mutex
+	nextID       int
+	accessTokens map[int][]*AccessToken
+	hooks        map[int][]Hook
+	projects     map[int]Project
+	// members maps the OAuth token of every user to the projects the user is a member of
+	members map[string]map[int]bool
+	// requests counts the requests per method and path
+	requests map[string]int
+	// removedProjects respond with 404 to every request
+	removedProjects map[int]bool
+	// failures makes the next requests matching a method and path prefix fail with a status
+	failures map[string]int
+}
+
+// NewServer starts a server that is closed when the test completes
+func NewServer(t *testing.T) *Server {
+	s := &Server{
+		Token:           "admin-token",
+		nextID:          1,
+		accessTokens:    map[int][]*AccessToken{},
+		hooks:           map[int][]Hook{},
+		projects:        map[int]Project{},
+		members:         map[string]map[int]bool{},
+		requests:        map[string]int{},
+		removedProjects: map[int]bool{},
+		failures:        map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ProjectAccessTokens returns a copy of the access tokens of a project, revoked tokens included
+func (s *Server) ProjectAccessTokens(projectID int) []AccessToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tokens []AccessToken
+	for _, token := range s.accessTokens[projectID] {
+		tokens = append(tokens, *token)
+	}
+	return tokens
+}
+
+// ActiveProjectAccessTokens returns a copy of the access tokens of a project that are not revoked
+func (s *Server) ActiveProjectAccessTokens(projectID int) []AccessToken {
+	var active []AccessToken
+	for _, token := range s.ProjectAccessTokens(projectID) {
+		if !token.Revoked {
+			active = append(active, token)
+		}
+	}
+	return active
+}
+
+// ProjectHooks returns a copy of the webhooks of a project, secret tokens included
+func (s *Server) ProjectHooks(projectID int) []Hook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Hook(nil), s.hooks[projectID]...)
+}
+
+// AddProjectHook adds a webhook to a project as if it was created by a user and returns its ID
+func (s *Server) AddProjectHook(projectID int, hook Hook) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook.ID = s.nextID
+	s.nextID++
+	s.hooks[projectID] = append(s.hooks[projectID], hook)
+	return hook.ID
+}
+
+// RemoveProject makes every request about a project fail with 404 as if it was deleted
+func (s *Server) RemoveProject(projectID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removedProjects[projectID] = true
+}
+
+// AddProject adds a project that can be read through the API
+func (s *Server) AddProject(project Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.projects[project.ID] = project
+}
+
+// AddUser adds a user authenticated by an OAuth token who is a member of the given projects
+func (s *Server) AddUser(token string, projectIDs ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members[token] = map[int]bool{}
+	for _, projectID := range projectIDs {
+		s.members[token][projectID] = true
+	}
+}
+
+// Requests returns the number of requests received with a method and a path (after /api/v4)
+func (s *Server) Requests(method string, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method+" "+path]
+}
+
+// FailNext makes the next request with the given method and a path starting with prefix (after /api/v4) fail
+func (s *Server) FailNext(method string, prefix string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method+" "+prefix] = status
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+	s.countRequest(r.Method, path)
+	userToken := ""
+	isUser := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if isUser {
+		userToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	isAdmin := r.Header.Get("PRIVATE-TOKEN") == s.Token
+	if !isAdmin && (r.Header.Get("PRIVATE-TOKEN") != "" || (isUser && !s.isUser(userToken))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if status, failed := s.takeFailure(r.Method, path); failed {
+		w.WriteHeader(status)
+		return
+	}
+
+	// Paths look like /projects/<id>[/<collection>[/<item id>[/...]]]
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "projects" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	projectID, err := strconv.Atoi(parts[1])
+	if err != nil || s.isRemoved(projectID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 && r.Method == http.MethodGet {
+		s.serveProject(w, projectID, isAdmin, userToken)
+		return
+	}
+	if !isAdmin || len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch parts[2] {
+	case "access_tokens":
+		s.serveAccessTokens(w, r, projectID, parts[3:])
+	case "hooks":
+		s.serveHooks(w, r, projectID, parts[3:])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) takeFailure(method string, path string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, status := range s.failures {
+		failedMethod, prefix, _ := strings.Cut(key, " ")
+		if failedMethod == method && strings.HasPrefix(path, prefix) {
+			delete(s.failures, key)
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) countRequest(method string, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[method+" "+path]++
+}
+
+func (s *Server) isUser(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.members[token]
+	return found
+}
+
+// serveProject returns a project if it is visible to the caller, userToken is empty for anonymous callers
+func (s *Server) serveProject(w http.ResponseWriter, projectID int, isAdmin bool, userToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	project, found := s.projects[projectID]
+	visible := isAdmin ||
+		project.Visibility == "public" ||
+		(userToken != "" && (project.Visibility == "internal" || s.members[userToken][projectID]))
+	if !found || !visible {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, project)
+}
+
+func (s *Server) isRemoved(projectID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removedProjects[projectID]
+}
+
+func (s *Server) serveHooks(w http.ResponseWriter, r *http.Request, projectID int, rest []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+		if err != nil || perPage <= 0 {
+			perPage = 20
+		}
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+		hooks := []Hook{}
+		for i, hook := range s.hooks[projectID] {
+			if i >= (page-1)*perPage && i < page*perPage {
+				hook.Token = ""
+				hooks = append(hooks, hook)
+			}
+		}
+		writeJSON(w, http.StatusOK, hooks)
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var hook Hook
+		if json.NewDecoder(r.Body).Decode(&hook) != nil || hook.URL == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hook.ID = s.nextID
+		s.nextID++
+		s.hooks[projectID] = append(s.hooks[projectID], hook)
+		hook.Token = ""
+		writeJSON(w, http.StatusCreated, hook)
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		hookID, _ := strconv.Atoi(rest[0])
+		for i, hook := range s.hooks[projectID] {
+			if hook.ID == hookID {
+				s.hooks[projectID] = append(s.hooks[projectID][:i], s.hooks[projectID][i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) serveAccessTokens(w http.ResponseWriter, r *http.Request, projectID int, rest []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		var tokens []AccessToken
+		for _, token := range s.accessTokens[projectID] {
+			listed := *token
+			listed.Token = ""
+			tokens = append(tokens, listed)
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var token AccessToken
+		if json.NewDecoder(r.Body).Decode(&token) != nil || token.Name == "" || len(token.Scopes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token.ID = s.nextID
+		token.Token = fmt.Sprintf("glpat-%d-%d", projectID, s.nextID)
+		// Every project access token has its own bot user
+		token.UserID = botUserIDOffset + s.nextID
+		s.nextID++
+		s.accessTokens[projectID] = append(s.accessTokens[projectID], &token)
+		writeJSON(w, http.StatusCreated, token)
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		tokenID, _ := strconv.Atoi(rest[0])
+		for _, token := range s.accessTokens[projectID] {
+			if token.ID == tokenID && !token.Revoked {
+				token.Revoked = true
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("Writing the response failed: %s\n", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Package gitlabwebhooks receives the GitLab webhooks of the projects tracked by the knowledge graph
+package gitlabwebhooks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxPayloadSize is the largest webhook payload accepted, GitLab limits the commits listed in push events
+const maxPayloadSize = 1 << 20
+
+// GitLab event names from the X-Gitlab-Event header
+const (
+	pushHook    = "Push Hook"
+	tagPushHook = "Tag Push Hook"
+	systemHook  = "System Hook"
+)
+
+// WebhookSecretReader returns the secret of the webhook of a project, it returns models.ErrNotFound if the project has
+// no webhook secret
+type WebhookSecretReader interface {
+	GetProjectWebhookSecret(ctx context.Context, projectID int) (string, error)
+}
+
+// EventDispatcher forwards an event to the knowledge graph, it returns an error if the event could neither be
+// delivered nor queued
+type EventDispatcher interface {
+	Dispatch(ctx context.Context, event models.KGEvent) error
+}
+
+// payload contains the fields of the push, tag push and project system hook payloads that are forwarded
+type payload struct {
+	EventName string `json:"event_name"`
+	ProjectID int    `json:"project_id"`
+	Project   struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	// PathWithNamespace is set in system hooks
+	PathWithNamespace string `json:"path_with_namespace"`
+	Ref               string `json:"ref"`
+	Before            string `json:"before"`
+	After             string `json:"after"`
+}
+
+// Handler receives GitLab webhooks. Project hooks are authenticated with the secret of their project and system
+// hooks, which report project creations, renames and deletions, with systemHookSecret. System hooks are refused when
+// systemHookSecret is empty.
+func Handler(secrets WebhookSecretReader, dispatcher EventDispatcher, systemHookSecret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+			return
+		}
+		var body payload
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPayloadSize)).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+
+		eventName := r.Header.Get("X-Gitlab-Event")
+		event, ok := newEvent(eventName, body)
+		if !ok {
+			// GitLab disables hooks that keep failing, events that are not forwarded are acknowledged
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		token := r.Header.Get("X-Gitlab-Token")
+		if eventName == systemHook {
+			err = checkSecret(token, systemHookSecret)
+		} else {
+			err = checkProjectSecret(r.Context(), secrets, event.ProjectID, token)
+		}
+		if errors.Is(err, errInvalidSecret) {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if err != nil {
+			log.Printf("Reading the webhook secret of project %d failed: %s\n", event.ProjectID, err)
+			writeError(w, http.StatusInternalServerError, "reading the webhook secret failed")
+			return
+		}
+
+		event.ID = r.Header.Get("X-Gitlab-Event-UUID")
+		if event.ID == "" {
+			event.ID = ulid.Make().String()
+		}
+		err = dispatcher.Dispatch(r.Context(), event)
+		if err != nil {
+			log.Printf("Forwarding event %s of project %d failed: %s\n", event.ID, event.ProjectID, err)
+			writeError(w, http.StatusInternalServerError, "forwarding the event failed")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// newEvent normalizes a webhook payload, it returns false for the events that are not forwarded
+func newEvent(eventName string, body payload) (models.KGEvent, bool) {
+	event := models.KGEvent{
+		ProjectID:   body.ProjectID,
+		ProjectPath: body.Project.PathWithNamespace,
+		Ref:         body.Ref,
+		Before:      body.Before,
+		After:       body.After,
+		ReceivedAt:  time.Now(),
+	}
+	switch eventName {
+	case pushHook:
+		event.Type = models.KGEventPush
+	case tagPushHook:
+		event.Type = models.KGEventTag
+	case systemHook:
+		if !strings.HasPrefix(body.EventName, "project_") {
+			return models.KGEvent{}, false
+		}
+		event.Type = models.KGEventProject
+		event.Action = body.EventName
+		event.ProjectPath = body.PathWithNamespace
+	default:
+		return models.KGEvent{}, false
+	}
+	return event, body.ProjectID != 0
+}
+
+var errInvalidSecret = errors.New("invalid webhook secret")
+
+func checkProjectSecret(ctx context.Context, secrets WebhookSecretReader, projectID int, token string) error {
+	secret, err := secrets.GetProjectWebhookSecret(ctx, projectID)
+	if errors.Is(err, models.ErrNotFound) {
+		return errInvalidSecret
+	}
+	if err != nil {
+		return err
+	}
+	return checkSecret(token, secret)
+}
+
+// checkSecret compares a token with a secret in constant time, an empty secret never matches
+func checkSecret(token string, secret string) error {
+	if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errInvalidSecret
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Writing the response failed: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
@@ -0,0 +1,116 @@
+package gitlabwebhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummySecrets map[int]string
+
+func (d DummySecrets) GetProjectWebhookSecret(_ context.Context, projectID int) (string, error) {
+	secret, found := d[projectID]
+	if !found {
+		return "", models.ErrNotFound
+	}
+	return secret, nil
+}
+
+type DummyDispatcher struct {
+	events []models.KGEvent
+	err    error
+}
+
+func (d *DummyDispatcher) Dispatch(_ context.Context, event models.KGEvent) error {
+	d.events = append(d.events, event)
+	return d.err
+}
+
+const pushPayload = `{"object_kind": "push", "ref": "refs/heads/main", "before": "aaa", "after": "bbb",
+	"project_id": 42, "project": {"path_with_namespace": "group/project"}}`
+
+func serve(handler http.Handler, eventName string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/gitlab", strings.NewReader(body))
+	req.Header.Set("X-Gitlab-Event", eventName)
+	req.Header.Set("X-Gitlab-Token", token)
+	req.Header.Set("X-Gitlab-Event-UUID", "uuid-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPushHook(t *testing.T) {
+	dispatcher := &DummyDispatcher{}
+	handler := Handler(DummySecrets{42: "secret"}, dispatcher, "")
+
+	rec := serve(handler, "Push Hook", "secret", pushPayload)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusAccepted)
+	}
+	if len(dispatcher.events) != 1 {
+		t.Fatalf("The number of events is NOT correct, got %v want 1\n", len(dispatcher.events))
+	}
+	event := dispatcher.events[0]
+	if event.ID != "uuid-1" || event.Type != models.KGEventPush || event.ProjectID != 42 ||
+		event.ProjectPath != "group/project" || event.Ref != "refs/heads/main" || event.After != "bbb" {
+		t.Errorf("The event is NOT correct, got %+v\n", event)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	dispatcher := &DummyDispatcher{}
+	handler := Handler(DummySecrets{42: "secret"}, dispatcher, "")
+
+	for _, token := range []string{"", "other"} {
+		if rec := serve(handler, "Tag Push Hook", token, pushPayload); rec.Code != http.StatusUnauthorized {
+			t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusUnauthorized)
+		}
+	}
+	// A project without a secret has no valid token
+	handler = Handler(DummySecrets{}, dispatcher, "")
+	if rec := serve(handler, "Push Hook", "", pushPayload); rec.Code != http.StatusUnauthorized {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusUnauthorized)
+	}
+	if len(dispatcher.events) != 0 {
+		t.Errorf("Unauthenticated events were dispatched, got %v\n", dispatcher.events)
+	}
+}
+
+func TestSystemHook(t *testing.T) {
+	dispatcher := &DummyDispatcher{}
+	handler := Handler(DummySecrets{42: "secret"}, dispatcher, "system-secret")
+	body := `{"event_name": "project_rename", "project_id": 42, "path_with_namespace": "group/renamed"}`
+
+	if rec := serve(handler, "System Hook", "secret", body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("A system hook with a project secret was NOT refused, got %v\n", rec.Code)
+	}
+	if rec := serve(handler, "System Hook", "system-secret", body); rec.Code != http.StatusAccepted {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusAccepted)
+	}
+	event := dispatcher.events[0]
+	if event.Type != models.KGEventProject || event.Action != "project_rename" || event.ProjectPath != "group/renamed" {
+		t.Errorf("The event is NOT correct, got %+v\n", event)
+	}
+
+	// Other system events are acknowledged without being forwarded
+	body = `{"event_name": "user_create", "user_id": 1}`
+	if rec := serve(handler, "System Hook", "system-secret", body); rec.Code != http.StatusNoContent {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusNoContent)
+	}
+	if len(dispatcher.events) != 1 {
+		t.Errorf("An ignored event was dispatched, got %v\n", dispatcher.events)
+	}
+}
+
+func TestDispatchFailure(t *testing.T) {
+	handler := Handler(DummySecrets{42: "secret"}, &DummyDispatcher{err: errors.New("queue full")}, "")
+
+	if rec := serve(handler, "Push Hook", "secret", pushPayload); rec.Code != http.StatusInternalServerError {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// DeviceCookieName is the name of the cookie that carries the device key a session is bound to
+const DeviceCookieName = "_renku_device"
+
+// SessionClientVerifier checks that the client of a request made with a session matches the client that logged in.
+// It returns an error wrapping models.ErrForbidden if the session must not be used by the client.
+type SessionClientVerifier interface {
+	VerifyClient(ctx context.Context, sessionID string, client models.SessionClient) (models.Session, error)
+}
+
+// SessionBinding checks the client of the requests made with a session cookie before passing them to next. Requests
+// refused by the verifier get a 401 response that clears the session and device cookies. The IP address of the client
+// is read from the clientIPHeader header when it is set, it must then be a header set by a trusted proxy, and from
+// the connection otherwise.
+func SessionBinding(
+	verifier SessionClientVerifier,
+	cookies *SessionCookies,
+	clientIPHeader string,
+	next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID, ok := cookies.SessionID(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := sessionClientFromRequest(r, clientIPHeader)
+		client.DeviceKey = cookies.DeviceKey(r)
+		_, err := verifier.VerifyClient(r.Context(), sessionID, client)
+		// Missing sessions are handled by next like requests without a session
+		if errors.Is(err, models.ErrForbidden) {
+			cookies.ClearSession(w)
+			cookies.ClearDeviceKey(w)
+			writeError(w, http.StatusUnauthorized, "the session was used by another client, please log in again")
+			return
+		}
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			log.Printf("Verifying the client of session %s failed: %s\n", models.SessionHandle(sessionID), err)
+			writeError(w, http.StatusInternalServerError, "verifying the session failed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionClientFromRequest reads the IP address and the user agent of the client of a request
+func sessionClientFromRequest(r *http.Request, clientIPHeader string) models.SessionClient {
+	client := models.SessionClient{UserAgent: r.UserAgent()}
+	if clientIPHeader != "" {
+		// Proxies append the address they received the request from, the earlier addresses are set by the client
+		forwarded := r.Header.Get(clientIPHeader)
+		client.IP = strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client.IP = host
+	}
+	return client
+}
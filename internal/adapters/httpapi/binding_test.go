@@ -0,0 +1,82 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyClientVerifier struct {
+	clients []models.SessionClient
+	err     error
+}
+
+func (d *DummyClientVerifier) VerifyClient(
+	_ context.Context,
+	sessionID string,
+	client models.SessionClient,
+) (models.Session, error) {
+	d.clients = append(d.clients, client)
+	return models.Session{ID: sessionID}, d.err
+}
+
+func serveBound(t *testing.T, handler http.Handler, sessionID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/knowledge-graph/projects/1", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("User-Agent", "Firefox")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, 192.0.2.10")
+	if sessionID != "" {
+		req.AddCookie(sessionCookie(t, testCookies, models.Session{ID: sessionID}))
+		req.AddCookie(&http.Cookie{Name: DeviceCookieName, Value: "device-key"})
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSessionBinding(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	verifier := &DummyClientVerifier{}
+
+	rec := serveBound(t, SessionBinding(verifier, testCookies, "X-Forwarded-For", next), "session")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusNoContent)
+	}
+	want := models.SessionClient{IP: "192.0.2.10", UserAgent: "Firefox", DeviceKey: "device-key"}
+	if len(verifier.clients) != 1 || verifier.clients[0] != want {
+		t.Errorf("The client is NOT correct, got %+v want %+v\n", verifier.clients, want)
+	}
+	serveBound(t, SessionBinding(verifier, testCookies, "", next), "session")
+	if verifier.clients[1].IP != "10.0.0.1" {
+		t.Errorf("The client IP is NOT read from the connection, got %v\n", verifier.clients[1].IP)
+	}
+
+	// Requests without a session are not checked
+	serveBound(t, SessionBinding(verifier, testCookies, "", next), "")
+	if len(verifier.clients) != 2 {
+		t.Errorf("A request without a session was checked, got %v\n", verifier.clients)
+	}
+}
+
+func TestSessionBindingMismatch(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	verifier := &DummyClientVerifier{err: fmt.Errorf("mismatch: %w", models.ErrForbidden)}
+	rec := serveBound(t, SessionBinding(verifier, testCookies, "", next), "session")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusUnauthorized)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 2 || cookies[0].MaxAge >= 0 || cookies[1].MaxAge >= 0 {
+		t.Errorf("The cookies were NOT cleared, got %v\n", cookies)
+	}
+
+	verifier = &DummyClientVerifier{err: models.ErrNotFound}
+	rec = serveBound(t, SessionBinding(verifier, testCookies, "", next), "session")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("A request with a missing session was NOT passed on, got %v\n", rec.Code)
+	}
+}
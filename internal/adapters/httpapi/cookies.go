@@ -0,0 +1,159 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// CookieConfig contains the settings of the session and device cookies
+type CookieConfig struct {
+	// Domain is the domain the cookies are sent to, they are only sent to the host that set them when it is empty
+	Domain string
+	// Path is the path prefix the cookies are sent to, it defaults to /
+	Path string
+	// SameSite defaults to http.SameSiteLaxMode so that the session survives the redirects of the login
+	SameSite http.SameSite
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c CookieConfig) withDefaults() CookieConfig {
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.SameSite == 0 {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
+
+// SessionCookies writes and reads the session cookie. Its value is the session ID encrypted with the active key of
+// the key ring and authenticated, so that the cookies keep working while the keys are rotated and cannot be forged or
+// read by the client. The cookies are always Secure and HttpOnly.
+type SessionCookies struct {
+	encryptor *encryption.Encryptor
+	config    CookieConfig
+}
+
+func NewSessionCookies(encryptor *encryption.Encryptor, config CookieConfig) *SessionCookies {
+	return &SessionCookies{encryptor: encryptor, config: config.withDefaults()}
+}
+
+// SetSession writes the session cookie of a session, it expires with the session. The cookies of anonymous sessions,
+// whose expiration is extended every time they are used, last until the browser is closed.
+func (c *SessionCookies) SetSession(w http.ResponseWriter, session models.Session) error {
+	value, err := c.encryptor.Encrypt(session.ID, sessionIDAssociatedData)
+	if err != nil {
+		return err
+	}
+
+	cookie := c.cookie(SessionCookieName, value)
+	if session.ExpiresAt.Unix() > 0 && session.Type != models.SessionTypeAnonymous {
+		cookie.Expires = session.ExpiresAt
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// SessionID reads the ID of the session of a request, it is false when the request has no valid session cookie
+func (c *SessionCookies) SessionID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	// Plaintext values are refused, they would be decrypted as is
+	if err != nil || !encryption.IsEncrypted(cookie.Value) {
+		return "", false
+	}
+	sessionID, err := c.encryptor.Decrypt(cookie.Value, sessionIDAssociatedData)
+	if err != nil || sessionID == "" {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// sessionIDAssociatedData binds the encrypted session ID to the session cookie
+const sessionIDAssociatedData = "sessionID:" + SessionCookieName
+
+// ClearSession tells the browser to drop the session cookie
+func (c *SessionCookies) ClearSession(w http.ResponseWriter) {
+	cookie := c.cookie(SessionCookieName, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// SetDeviceKey stores the device key returned at login in the device cookie of the client, the key is random and is
+// not encrypted
+func (c *SessionCookies) SetDeviceKey(w http.ResponseWriter, deviceKey string) {
+	http.SetCookie(w, c.cookie(DeviceCookieName, deviceKey))
+}
+
+// DeviceKey reads the device key of a request, it is empty when the request has no device cookie
+func (c *SessionCookies) DeviceKey(r *http.Request) string {
+	cookie, err := r.Cookie(DeviceCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// ClearDeviceKey tells the browser to drop the device cookie
+func (c *SessionCookies) ClearDeviceKey(w http.ResponseWriter) {
+	cookie := c.cookie(DeviceCookieName, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// loginStateAssociatedData binds the encrypted login state to the login state cookie
+const loginStateAssociatedData = "loginState:" + LoginStateCookieName
+
+// SetLoginState stores the state of a login and the address the browser returns to afterwards in the login state
+// cookie, encrypted like the session ID. The cookie expires after loginStateTTL.
+func (c *SessionCookies) SetLoginState(w http.ResponseWriter, state string, redirectURL string) error {
+	value, err := c.encryptor.Encrypt(state+" "+redirectURL, loginStateAssociatedData)
+	if err != nil {
+		return err
+	}
+
+	cookie := c.cookie(LoginStateCookieName, value)
+	cookie.MaxAge = int(loginStateTTL / time.Second)
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// LoginState reads the state of a login and its redirect address, it is false when the request has no valid login
+// state cookie
+func (c *SessionCookies) LoginState(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(LoginStateCookieName)
+	if err != nil || !encryption.IsEncrypted(cookie.Value) {
+		return "", "", false
+	}
+	value, err := c.encryptor.Decrypt(cookie.Value, loginStateAssociatedData)
+	if err != nil {
+		return "", "", false
+	}
+	state, redirectURL, found := strings.Cut(value, " ")
+	if !found || state == "" {
+		return "", "", false
+	}
+	return state, redirectURL, true
+}
+
+// ClearLoginState tells the browser to drop the login state cookie
+func (c *SessionCookies) ClearLoginState(w http.ResponseWriter) {
+	cookie := c.cookie(LoginStateCookieName, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+func (c *SessionCookies) cookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   c.config.Domain,
+		Path:     c.config.Path,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: c.config.SameSite,
+	}
+}
@@ -0,0 +1,92 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// DummyKeys is a key ring whose active key is the first one
+type DummyKeys struct {
+	activeKeyID string
+	keys        map[string][]byte
+}
+
+func (d *DummyKeys) ActiveKey() (string, []byte, error) {
+	return d.activeKeyID, d.keys[d.activeKeyID], nil
+}
+
+func (d *DummyKeys) Key(keyID string) ([]byte, error) {
+	key, found := d.keys[keyID]
+	if !found {
+		return nil, encryption.ErrUnknownKey
+	}
+	return key, nil
+}
+
+func newDummyKeys() *DummyKeys {
+	return &DummyKeys{activeKeyID: "key1", keys: map[string][]byte{"key1": []byte("0123456789abcdef0123456789abcdef")}}
+}
+
+func newTestCookies(config CookieConfig) *SessionCookies {
+	return NewSessionCookies(&encryption.Encryptor{Keys: newDummyKeys()}, config)
+}
+
+var testCookies = newTestCookies(CookieConfig{})
+
+// sessionCookie returns the session cookie written for a session
+func sessionCookie(t *testing.T, cookies *SessionCookies, session models.Session) *http.Cookie {
+	rec := httptest.NewRecorder()
+	err := cookies.SetSession(rec, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+// requestWithCookie returns a request carrying a cookie
+func requestWithCookie(cookie *http.Cookie) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	return req
+}
+
+func TestSessionCookie(t *testing.T) {
+	keys := newDummyKeys()
+	cookies := NewSessionCookies(&encryption.Encryptor{Keys: keys}, CookieConfig{Domain: "example.org"})
+	expiresAt := time.Unix(time.Now().Unix()+3600, 0)
+
+	cookie := sessionCookie(t, cookies, models.Session{ID: "12345", ExpiresAt: expiresAt})
+	if cookie.Name != SessionCookieName || strings.Contains(cookie.Value, "12345") || !cookie.Secure ||
+		!cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Domain != "example.org" ||
+		cookie.Path != "/" || !cookie.Expires.Equal(expiresAt) {
+		t.Errorf("The session cookie is NOT correct, got %+v\n", cookie)
+	}
+	sessionID, ok := cookies.SessionID(requestWithCookie(cookie))
+	if !ok || sessionID != "12345" {
+		t.Errorf("The session ID is NOT correct, got %v, %v want 12345\n", sessionID, ok)
+	}
+
+	// Cookies encrypted with a previous key are read after a rotation
+	keys.keys["key2"] = []byte("fedcba9876543210fedcba9876543210")
+	keys.activeKeyID = "key2"
+	if sessionID, ok = cookies.SessionID(requestWithCookie(cookie)); !ok || sessionID != "12345" {
+		t.Errorf("The session ID is NOT read after a key rotation, got %v, %v\n", sessionID, ok)
+	}
+	rotated := sessionCookie(t, cookies, models.Session{ID: "12345"})
+	if !strings.HasPrefix(rotated.Value, "enc:v1:key2:") {
+		t.Errorf("The session cookie is NOT encrypted with the active key, got %v\n", rotated.Value)
+	}
+
+	for _, value := range []string{"12345", cookie.Value[:len(cookie.Value)-2] + "AA", "enc:v1:removed:AAAA"} {
+		forged := &http.Cookie{Name: SessionCookieName, Value: value}
+		if sessionID, ok = cookies.SessionID(requestWithCookie(forged)); ok {
+			t.Errorf("The session cookie %v was NOT refused, got %v\n", value, sessionID)
+		}
+	}
+}
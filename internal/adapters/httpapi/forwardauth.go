@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// AnonymousUserIDHeader is the header of the forward-auth responses that carries the user ID of an anonymous session
+const AnonymousUserIDHeader = "Renku-Auth-Anon-Id"
+
+// SessionReader reads the session of a request
+type SessionReader interface {
+	Session(ctx context.Context, sessionID string) (models.Session, error)
+}
+
+// AnonymousSessions reads the sessions and creates anonymous sessions for the clients that did not log in
+type AnonymousSessions interface {
+	SessionReader
+	NewAnonymousSession(ctx context.Context, client models.SessionClient) (models.Session, error)
+}
+
+// ForwardAuthHandler answers the forward-auth requests of the ingress in front of the notebooks. Requests with a
+// session are allowed, the others get a 401 response: the clients that did not log in get an anonymous session from
+// AnonymousSessionHandler first. The user ID of anonymous sessions is passed in the AnonymousUserIDHeader header,
+// which the ingress copies to the request sent to the notebook.
+func ForwardAuthHandler(sessions SessionReader, cookies *SessionCookies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, ok := cookies.SessionID(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+		session, err := sessions.Session(r.Context(), sessionID)
+		if errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+		if err != nil {
+			log.Printf("Reading session %s of a forward-auth request failed: %s\n", models.SessionHandle(sessionID), err)
+			writeError(w, http.StatusInternalServerError, "reading the session failed")
+			return
+		}
+
+		if session.Type == models.SessionTypeAnonymous {
+			w.Header().Set(AnonymousUserIDHeader, session.UserID)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// AnonymousSessionHandler gives an anonymous session to a client that did not log in, e.g. before it launches a
+// notebook. POST /auth/anonymous sets the cookie of a new anonymous session, a caller that already has a session
+// keeps it. The anonymous sessions a client IP can create are rate limited, the requests above the limit get a 429
+// response. The IP address of the client is read like in SessionBinding.
+func AnonymousSessionHandler(
+	sessions AnonymousSessions,
+	cookies *SessionCookies,
+	clientIPHeader string,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+			return
+		}
+		if sessionID, ok := cookies.SessionID(r); ok {
+			_, err := sessions.Session(r.Context(), sessionID)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if !errors.Is(err, models.ErrNotFound) {
+				log.Printf("Reading session %s failed: %s\n", models.SessionHandle(sessionID), err)
+				writeError(w, http.StatusInternalServerError, "reading the session failed")
+				return
+			}
+		}
+
+		session, err := sessions.NewAnonymousSession(r.Context(), sessionClientFromRequest(r, clientIPHeader))
+		if errors.Is(err, models.ErrRateLimited) {
+			writeError(w, http.StatusTooManyRequests, "too many anonymous sessions, please try again later")
+			return
+		}
+		if err == nil {
+			err = cookies.SetSession(w, session)
+		}
+		if err != nil {
+			log.Printf("Creating an anonymous session failed: %s\n", err)
+			writeError(w, http.StatusInternalServerError, "creating the session failed")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
@@ -0,0 +1,142 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyAnonymousSessions struct {
+	sessions    map[string]models.Session
+	created     int
+	rateLimited bool
+}
+
+func (d *DummyAnonymousSessions) Session(_ context.Context, sessionID string) (models.Session, error) {
+	session, found := d.sessions[sessionID]
+	if !found {
+		return models.Session{}, models.ErrNotFound
+	}
+	return session, nil
+}
+
+func (d *DummyAnonymousSessions) NewAnonymousSession(
+	_ context.Context,
+	client models.SessionClient,
+) (models.Session, error) {
+	if d.rateLimited {
+		return models.Session{}, fmt.Errorf("too many sessions: %w", models.ErrRateLimited)
+	}
+	d.created++
+	session := models.Session{ID: "anonymous", Type: models.SessionTypeAnonymous, UserID: "anon-1234"}
+	d.sessions[session.ID] = session
+	return session, nil
+}
+
+func serveForwardAuth(handler http.Handler, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func serveAnonymousSession(handler http.Handler, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/anonymous", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestForwardAuthAnonymous(t *testing.T) {
+	sessions := &DummyAnonymousSessions{sessions: map[string]models.Session{}}
+	handler := ForwardAuthHandler(sessions, testCookies)
+
+	// Forward-auth does not create sessions
+	rec := serveForwardAuth(handler, nil)
+	if rec.Code != http.StatusUnauthorized || sessions.created != 0 || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("A request without session was NOT refused, got %v, %v sessions created\n", rec.Code, sessions.created)
+	}
+
+	rec = serveAnonymousSession(AnonymousSessionHandler(sessions, testCookies, ""), nil)
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusCreated || len(cookies) != 1 || cookies[0].Name != SessionCookieName {
+		t.Fatalf("The anonymous session cookie was NOT set, got %v, %v\n", rec.Code, cookies)
+	}
+	rec = serveForwardAuth(handler, cookies[0])
+	if rec.Code != http.StatusOK || rec.Header().Get(AnonymousUserIDHeader) != "anon-1234" {
+		t.Errorf("The anonymous session is NOT passed on, got %v, %v\n", rec.Code, rec.Header())
+	}
+}
+
+func TestForwardAuthUser(t *testing.T) {
+	sessions := &DummyAnonymousSessions{sessions: map[string]models.Session{
+		"laptop": {ID: "laptop", Type: models.SessionTypeUser, UserID: "jane"},
+	}}
+	handler := ForwardAuthHandler(sessions, testCookies)
+
+	rec := serveForwardAuth(handler, sessionCookie(t, testCookies, models.Session{ID: "laptop"}))
+	if rec.Code != http.StatusOK || rec.Header().Get(AnonymousUserIDHeader) != "" {
+		t.Errorf("The session of a user is NOT passed on as is, got %v, %v\n", rec.Code, rec.Header())
+	}
+
+	rec = serveForwardAuth(handler, sessionCookie(t, testCookies, models.Session{ID: "expired"}))
+	if rec.Code != http.StatusUnauthorized || sessions.created != 0 {
+		t.Errorf("An expired session was NOT refused, got %v\n", rec.Code)
+	}
+}
+
+func TestAnonymousSessionHandler(t *testing.T) {
+	sessions := &DummyAnonymousSessions{sessions: map[string]models.Session{
+		"laptop": {ID: "laptop", Type: models.SessionTypeUser, UserID: "jane"},
+	}}
+	handler := AnonymousSessionHandler(sessions, testCookies, "")
+
+	// A caller with a session keeps it
+	rec := serveAnonymousSession(handler, sessionCookie(t, testCookies, models.Session{ID: "laptop"}))
+	if rec.Code != http.StatusNoContent || sessions.created != 0 || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("The session of the caller was NOT kept, got %v, %v sessions created\n", rec.Code, sessions.created)
+	}
+
+	// The cookie of an anonymous session lasts until the browser is closed
+	rec = serveAnonymousSession(handler, sessionCookie(t, testCookies, models.Session{ID: "expired"}))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusCreated || sessions.created != 1 || len(cookies) != 1 || !cookies[0].Expires.IsZero() {
+		t.Errorf("The anonymous session is NOT correct, got %v, %v\n", rec.Code, cookies)
+	}
+
+	sessions.rateLimited = true
+	rec = serveAnonymousSession(handler, nil)
+	if rec.Code != http.StatusTooManyRequests || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("The rate limited anonymous session was NOT refused, got %v\n", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/anonymous", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("A GET request was NOT refused, got %v\n", rec.Code)
+	}
+}
+
+func TestForwardAuthBinding(t *testing.T) {
+	sessions := &DummyAnonymousSessions{sessions: map[string]models.Session{
+		"laptop": {ID: "laptop", Type: models.SessionTypeUser, UserID: "jane"},
+	}}
+	verifier := &DummyClientVerifier{err: fmt.Errorf("client mismatch: %w", models.ErrForbidden)}
+	handler := SessionBinding(verifier, testCookies, "", ForwardAuthHandler(sessions, testCookies))
+
+	rec := serveForwardAuth(handler, sessionCookie(t, testCookies, models.Session{ID: "laptop"}))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get(AnonymousUserIDHeader) != "" || sessions.created != 0 {
+		t.Errorf("A session used by another client was NOT refused, got %v, %v\n", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,72 @@
+// Package httpapi contains the HTTP handlers of the gateway API
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// SessionCookieName is the name of the cookie that carries the encrypted session ID, see SessionCookies
+const SessionCookieName = "_renku_session"
+
+// SessionStatusProvider reports the status of a session
+type SessionStatusProvider interface {
+	Status(ctx context.Context, sessionID string) (models.SessionStatus, error)
+}
+
+// sessionStatusResponse is the JSON representation of a session status
+type sessionStatusResponse struct {
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	ReauthRequired bool       `json:"reauthenticationRequired"`
+	ReauthDeadline *time.Time `json:"reauthenticationDeadline,omitempty"`
+}
+
+// SessionStatusHandler reports whether the session of the caller is about to require a new login
+func SessionStatusHandler(sessions SessionStatusProvider, cookies *SessionCookies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, ok := cookies.SessionID(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+
+		status, err := sessions.Status(r.Context(), sessionID)
+		if errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+		if err != nil {
+			log.Printf("Reading the status of session %s failed: %s\n", models.SessionHandle(sessionID), err)
+			writeError(w, http.StatusInternalServerError, "reading the session status failed")
+			return
+		}
+
+		response := sessionStatusResponse{
+			ExpiresAt:      status.ExpiresAt,
+			ReauthRequired: status.ReauthRequired,
+		}
+		if !status.ReauthDeadline.IsZero() {
+			response.ReauthDeadline = &status.ReauthDeadline
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Writing the response failed: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
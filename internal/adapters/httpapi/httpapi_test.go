@@ -0,0 +1,76 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummySessionStatusProvider struct {
+	status models.SessionStatus
+	err    error
+}
+
+func (d *DummySessionStatusProvider) Status(context.Context, string) (models.SessionStatus, error) {
+	return d.status, d.err
+}
+
+func TestSessionStatusHandler(t *testing.T) {
+	deadline := time.Unix(time.Now().Unix()+600, 0).UTC()
+	cookies := newTestCookies(CookieConfig{})
+	handler := SessionStatusHandler(&DummySessionStatusProvider{
+		status: models.SessionStatus{
+			ID:             "12345",
+			ExpiresAt:      deadline.Add(time.Hour),
+			ReauthRequired: true,
+			ReauthDeadline: deadline,
+		},
+	}, cookies)
+
+	req := httptest.NewRequest(http.MethodGet, "/session/status", nil)
+	req.AddCookie(sessionCookie(t, cookies, models.Session{ID: "12345"}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusOK)
+	}
+	var response sessionStatusResponse
+	err := json.NewDecoder(rec.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.ReauthRequired || response.ReauthDeadline == nil || !response.ReauthDeadline.Equal(deadline) {
+		t.Errorf("The session status is NOT correct, got %+v\n", response)
+	}
+}
+
+func TestSessionStatusHandlerWithoutSession(t *testing.T) {
+	handler := SessionStatusHandler(&DummySessionStatusProvider{}, newTestCookies(CookieConfig{}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/session/status", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSessionStatusHandlerWithUnknownSession(t *testing.T) {
+	cookies := newTestCookies(CookieConfig{})
+	handler := SessionStatusHandler(&DummySessionStatusProvider{err: models.ErrNotFound}, cookies)
+
+	req := httptest.NewRequest(http.MethodGet, "/session/status", nil)
+	req.AddCookie(sessionCookie(t, cookies, models.Session{ID: "12345"}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,186 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// LoginStateCookieName is the name of the cookie that carries the state of a login from /login to its callback
+const LoginStateCookieName = "_renku_login"
+
+// loginStateTTL is how long a user has to log in at the identity provider
+const loginStateTTL = 10 * time.Minute
+
+// LoginProvider is the identity provider the users log in at with the authorization code flow
+type LoginProvider interface {
+	// AuthCodeURL returns the address the browser is redirected to to log in, state is passed back to the callback
+	AuthCodeURL(state string) string
+	// Exchange trades the authorization code of a callback for the tokens and the identity of the user
+	Exchange(ctx context.Context, code string) (models.LoginGrant, error)
+}
+
+// Logins stores the sessions of the users who log in, the anonymous session of a browser is replaced by the session
+// of its user
+type Logins interface {
+	Session(ctx context.Context, sessionID string) (models.Session, error)
+	Login(ctx context.Context, session models.Session, grant models.LoginGrant) (models.Session, string, error)
+	UpgradeAnonymousSession(
+		ctx context.Context,
+		anonymousSessionID string,
+		session models.Session,
+		grant models.LoginGrant,
+	) (models.Session, string, error)
+}
+
+// LoginHandler starts the login of a browser. GET /login?redirect_url=<url> redirects to the identity provider and
+// keeps the redirect address, which must be a path or an address on the domain of the session cookie, in the login
+// state cookie until the callback.
+func LoginHandler(provider LoginProvider, cookies *SessionCookies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+		redirectURL := r.URL.Query().Get("redirect_url")
+		if !isAllowedRedirect(r, redirectURL, cookies.config.Domain) {
+			writeError(w, http.StatusBadRequest, "the redirect_url parameter is missing or not allowed")
+			return
+		}
+
+		state, err := newLoginState()
+		if err == nil {
+			err = cookies.SetLoginState(w, state, redirectURL)
+		}
+		if err != nil {
+			log.Printf("Starting a login failed: %s\n", err)
+			writeError(w, http.StatusInternalServerError, "starting the login failed")
+			return
+		}
+		http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+// LoginCallbackHandler completes the login of a browser. GET /token?code=<code>&state=<state> exchanges the
+// authorization code for the tokens of the user, stores them with a new session, sets the session cookie and
+// redirects to the address given at /login. When the browser had an anonymous session, it is replaced by the new
+// session, which has another ID. A login refused because the user has too many sessions gets a 403 response.
+func LoginCallbackHandler(
+	logins Logins,
+	provider LoginProvider,
+	cookies *SessionCookies,
+	clientIPHeader string,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+			return
+		}
+		state, redirectURL, ok := cookies.LoginState(r)
+		query := r.URL.Query()
+		if !ok || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			writeError(w, http.StatusBadRequest, "the login state is not valid, please log in again")
+			return
+		}
+		cookies.ClearLoginState(w)
+		if query.Get("code") == "" {
+			writeError(w, http.StatusForbidden, "the login was refused by the identity provider")
+			return
+		}
+
+		grant, err := provider.Exchange(r.Context(), query.Get("code"))
+		if err != nil {
+			log.Printf("Exchanging an authorization code failed: %s\n", err)
+			writeError(w, http.StatusBadGateway, "the login at the identity provider failed")
+			return
+		}
+		client := sessionClientFromRequest(r, clientIPHeader)
+		session, deviceKey, err := login(r, logins, cookies, models.Session{
+			UserID:       grant.UserID,
+			Username:     grant.Username,
+			IDPSessionID: grant.IDPSessionID,
+			LoginMethod:  models.SessionLoginBrowser,
+			ClientIP:     client.IP,
+			UserAgent:    client.UserAgent,
+		}, grant)
+		if errors.Is(err, models.ErrForbidden) {
+			writeError(w, http.StatusForbidden, "the user has too many sessions, please log out of another one")
+			return
+		}
+		if err == nil {
+			err = cookies.SetSession(w, session)
+		}
+		if err != nil {
+			log.Printf("Storing the session of user %s failed: %s\n", grant.UserID, err)
+			writeError(w, http.StatusInternalServerError, "storing the session failed")
+			return
+		}
+		if deviceKey != "" {
+			cookies.SetDeviceKey(w, deviceKey)
+		}
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+	}
+}
+
+// login stores the session of a login, it replaces the anonymous session of the browser if it has one
+func login(
+	r *http.Request,
+	logins Logins,
+	cookies *SessionCookies,
+	session models.Session,
+	grant models.LoginGrant,
+) (models.Session, string, error) {
+	if sessionID, ok := cookies.SessionID(r); ok {
+		current, err := logins.Session(r.Context(), sessionID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return models.Session{}, "", err
+		}
+		if err == nil && current.Type == models.SessionTypeAnonymous {
+			upgraded, deviceKey, err := logins.UpgradeAnonymousSession(r.Context(), sessionID, session, grant)
+			// The anonymous session expired meanwhile
+			if !errors.Is(err, models.ErrNotFound) {
+				return upgraded, deviceKey, err
+			}
+		}
+	}
+	return logins.Login(r.Context(), session, grant)
+}
+
+// newLoginState returns the random state that ties the callback of a login to the browser that started it
+func newLoginState() (string, error) {
+	value := make([]byte, 32)
+	_, err := rand.Read(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+// isAllowedRedirect reports whether the browser can be sent to redirectURL after a login: a path of the gateway or
+// an address of the host of the request or of the domain of the session cookie, so that the login cannot be used to
+// send users to another site
+func isAllowedRedirect(r *http.Request, redirectURL string, cookieDomain string) bool {
+	target, err := url.Parse(redirectURL)
+	if err != nil || redirectURL == "" || strings.Contains(redirectURL, "\\") {
+		return false
+	}
+	if target.Scheme == "" && target.Host == "" {
+		return strings.HasPrefix(target.Path, "/") && !strings.HasPrefix(redirectURL, "//")
+	}
+	if target.Scheme != "https" && target.Scheme != "http" {
+		return false
+	}
+	host := strings.ToLower(target.Hostname())
+	domain := strings.ToLower(strings.TrimPrefix(cookieDomain, "."))
+	return strings.EqualFold(target.Host, r.Host) ||
+		(domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)))
+}
@@ -0,0 +1,211 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyLoginProvider struct{}
+
+func (d *DummyLoginProvider) AuthCodeURL(state string) string {
+	return "https://idp.example.org/auth?state=" + url.QueryEscape(state)
+}
+
+func (d *DummyLoginProvider) Exchange(_ context.Context, code string) (models.LoginGrant, error) {
+	if code != "code" {
+		return models.LoginGrant{}, fmt.Errorf("unknown code")
+	}
+	return models.LoginGrant{AccessToken: models.AccessToken{Value: "access"}, UserID: "jane", Username: "jane"}, nil
+}
+
+type DummyLogins struct {
+	sessions map[string]models.Session
+	upgraded []string
+	reject   bool
+}
+
+func (d *DummyLogins) Session(_ context.Context, sessionID string) (models.Session, error) {
+	session, found := d.sessions[sessionID]
+	if !found {
+		return models.Session{}, models.ErrNotFound
+	}
+	return session, nil
+}
+
+func (d *DummyLogins) Login(
+	_ context.Context,
+	session models.Session,
+	grant models.LoginGrant,
+) (models.Session, string, error) {
+	if d.reject {
+		return models.Session{}, "", fmt.Errorf("too many sessions: %w", models.ErrForbidden)
+	}
+	session.ID = fmt.Sprintf("session-%d", len(d.sessions))
+	session.TokenIDs = []string{grant.AccessToken.Value}
+	d.sessions[session.ID] = session
+	return session, "", nil
+}
+
+func (d *DummyLogins) UpgradeAnonymousSession(
+	ctx context.Context,
+	anonymousSessionID string,
+	session models.Session,
+	grant models.LoginGrant,
+) (models.Session, string, error) {
+	delete(d.sessions, anonymousSessionID)
+	d.upgraded = append(d.upgraded, anonymousSessionID)
+	return d.Login(ctx, session, grant)
+}
+
+// startLogin serves /login and returns the state passed to the provider and the login state cookie
+func startLogin(t *testing.T, redirectURL string) (string, *http.Cookie) {
+	req := httptest.NewRequest(http.MethodGet, "/login?redirect_url="+url.QueryEscape(redirectURL), nil)
+	rec := httptest.NewRecorder()
+	LoginHandler(&DummyLoginProvider{}, testCookies).ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("The login did NOT redirect to the provider, got %v\n", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != LoginStateCookieName || cookies[0].MaxAge <= 0 {
+		t.Fatalf("The login state cookie is NOT correct, got %v\n", cookies)
+	}
+	return location.Query().Get("state"), cookies[0]
+}
+
+func serveLoginCallback(handler http.Handler, query string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/token?"+query, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// responseCookie returns the cookie of a response with the given name
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	logins := &DummyLogins{sessions: map[string]models.Session{}}
+	handler := LoginCallbackHandler(logins, &DummyLoginProvider{}, testCookies, "")
+	state, stateCookie := startLogin(t, "/projects")
+
+	rec := serveLoginCallback(handler, "code=code&state="+url.QueryEscape(state), stateCookie)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/projects" {
+		t.Fatalf("The callback did NOT redirect to the redirect URL, got %v, %v\n", rec.Code, rec.Header())
+	}
+	session, found := logins.sessions["session-0"]
+	if !found || session.UserID != "jane" || session.LoginMethod != models.SessionLoginBrowser ||
+		len(session.TokenIDs) != 1 {
+		t.Errorf("The session of the login is NOT correct, got %+v\n", logins.sessions)
+	}
+	cookie := responseCookie(rec, SessionCookieName)
+	if cookie == nil {
+		t.Fatalf("The session cookie was NOT set\n")
+	}
+	if sessionID, ok := testCookies.SessionID(requestWithCookie(cookie)); !ok || sessionID != "session-0" {
+		t.Errorf("The session cookie is NOT correct, got %v\n", sessionID)
+	}
+	if cleared := responseCookie(rec, LoginStateCookieName); cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("The login state cookie was NOT cleared, got %v\n", cleared)
+	}
+}
+
+func TestLoginUpgradesAnonymousSession(t *testing.T) {
+	logins := &DummyLogins{sessions: map[string]models.Session{
+		"anonymous": {ID: "anonymous", Type: models.SessionTypeAnonymous, UserID: "anon-1234"},
+	}}
+	handler := LoginCallbackHandler(logins, &DummyLoginProvider{}, testCookies, "")
+	state, stateCookie := startLogin(t, "/projects")
+	anonymousCookie := sessionCookie(t, testCookies, models.Session{ID: "anonymous"})
+
+	rec := serveLoginCallback(handler, "code=code&state="+url.QueryEscape(state), stateCookie, anonymousCookie)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("The callback did NOT redirect, got %v\n", rec.Code)
+	}
+	if len(logins.upgraded) != 1 || logins.upgraded[0] != "anonymous" {
+		t.Errorf("The anonymous session was NOT upgraded, got %v\n", logins.upgraded)
+	}
+	// The session cookie changes to the new session ID
+	cookie := responseCookie(rec, SessionCookieName)
+	if sessionID, _ := testCookies.SessionID(requestWithCookie(cookie)); sessionID == "anonymous" || sessionID == "" {
+		t.Errorf("The session cookie was NOT replaced, got %v\n", sessionID)
+	}
+}
+
+func TestLoginCallbackRefused(t *testing.T) {
+	logins := &DummyLogins{sessions: map[string]models.Session{}}
+	handler := LoginCallbackHandler(logins, &DummyLoginProvider{}, testCookies, "")
+	state, stateCookie := startLogin(t, "/projects")
+
+	tests := []struct {
+		name    string
+		query   string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"without state cookie", "code=code&state=" + url.QueryEscape(state), nil, http.StatusBadRequest},
+		{"with another state", "code=code&state=other", []*http.Cookie{stateCookie}, http.StatusBadRequest},
+		{"without code", "error=access_denied&state=" + url.QueryEscape(state), []*http.Cookie{stateCookie}, 403},
+		{"with unknown code", "code=other&state=" + url.QueryEscape(state), []*http.Cookie{stateCookie}, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveLoginCallback(handler, tt.query, tt.cookies...)
+			if rec.Code != tt.want {
+				t.Errorf("The status is NOT correct, got %v want %v\n", rec.Code, tt.want)
+			}
+		})
+	}
+	if len(logins.sessions) != 0 {
+		t.Errorf("A refused login stored a session, got %v\n", logins.sessions)
+	}
+
+	logins.reject = true
+	rec := serveLoginCallback(handler, "code=code&state="+url.QueryEscape(state), stateCookie)
+	if rec.Code != http.StatusForbidden || responseCookie(rec, SessionCookieName) != nil {
+		t.Errorf("The login above the session limit was NOT refused, got %v\n", rec.Code)
+	}
+}
+
+func TestLoginRedirectURL(t *testing.T) {
+	cookies := newTestCookies(CookieConfig{Domain: ".renku.example.org"})
+	tests := []struct {
+		redirectURL string
+		want        bool
+	}{
+		{"/projects?page=2", true},
+		{"https://renku.example.org/projects", true},
+		{"https://gitlab.renku.example.org/", true},
+		{"http://example.com/projects", true},
+		{"", false},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com/", false},
+		{"https://evil.example.com/", false},
+		{"https://renku.example.org.evil.com/", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/login", nil)
+		if got := isAllowedRedirect(req, tt.redirectURL, cookies.config.Domain); got != tt.want {
+			t.Errorf("The redirect URL %q is NOT checked correctly, got %v want %v\n", tt.redirectURL, got, tt.want)
+		}
+	}
+}
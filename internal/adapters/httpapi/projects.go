@@ -0,0 +1,56 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// ProjectActivator activates and deactivates projects for the knowledge graph
+type ProjectActivator interface {
+	Activate(ctx context.Context, projectID int) error
+	Deactivate(ctx context.Context, projectID int) error
+}
+
+// ProjectActivationHandler activates the project of a request to /projects/<id> for the knowledge graph on PUT and
+// deactivates it on DELETE, the callers authenticate with adminToken as a bearer token
+func ProjectActivationHandler(projects ProjectActivator, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		projectID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/projects/"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid project ID")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			err = projects.Activate(r.Context(), projectID)
+		case http.MethodDelete:
+			err = projects.Deactivate(r.Context(), projectID)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "only PUT and DELETE are allowed")
+			return
+		}
+		if errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "project not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Changing the activation of project %d failed: %s\n", projectID, err)
+			writeError(w, http.StatusInternalServerError, "changing the activation failed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
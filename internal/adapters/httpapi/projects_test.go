@@ -0,0 +1,79 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyProjectActivator struct {
+	active map[int]bool
+	err    error
+}
+
+func (d *DummyProjectActivator) Activate(_ context.Context, projectID int) error {
+	d.active[projectID] = true
+	return d.err
+}
+
+func (d *DummyProjectActivator) Deactivate(_ context.Context, projectID int) error {
+	delete(d.active, projectID)
+	return d.err
+}
+
+func serveProject(handler http.Handler, method string, path string, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestProjectActivationHandler(t *testing.T) {
+	projects := &DummyProjectActivator{active: map[int]bool{}}
+	handler := ProjectActivationHandler(projects, "admin")
+
+	if code := serveProject(handler, http.MethodPut, "/projects/42", "admin"); code != http.StatusNoContent {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", code, http.StatusNoContent)
+	}
+	if !projects.active[42] {
+		t.Errorf("The project was NOT activated\n")
+	}
+	if code := serveProject(handler, http.MethodDelete, "/projects/42", "admin"); code != http.StatusNoContent {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", code, http.StatusNoContent)
+	}
+	if projects.active[42] {
+		t.Errorf("The project was NOT deactivated\n")
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{http.MethodPut, "/projects/42", "other", http.StatusUnauthorized},
+		{http.MethodPut, "/projects/group", "admin", http.StatusNotFound},
+		{http.MethodGet, "/projects/42", "admin", http.StatusMethodNotAllowed},
+	} {
+		if code := serveProject(handler, tt.method, tt.path, tt.token); code != tt.want {
+			t.Errorf("The status code of %s %s is NOT correct, got %v want %v\n", tt.method, tt.path, code, tt.want)
+		}
+	}
+
+	projects.err = models.ErrNotFound
+	if code := serveProject(handler, http.MethodPut, "/projects/7", "admin"); code != http.StatusNotFound {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", code, http.StatusNotFound)
+	}
+}
+
+func TestProjectActivationHandlerWithoutAdminToken(t *testing.T) {
+	handler := ProjectActivationHandler(&DummyProjectActivator{active: map[int]bool{}}, "")
+
+	if code := serveProject(handler, http.MethodPut, "/projects/42", ""); code != http.StatusUnauthorized {
+		t.Errorf("The status code is NOT correct, got %v want %v\n", code, http.StatusUnauthorized)
+	}
+}
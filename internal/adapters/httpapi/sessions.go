@@ -0,0 +1,148 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// UserSessions lists and revokes the sessions of a user
+type UserSessions interface {
+	Session(ctx context.Context, sessionID string) (models.Session, error)
+	ListSessions(ctx context.Context, userID string) ([]models.Session, error)
+	RevokeSession(ctx context.Context, userID string, sessionID string) error
+	RevokeAllSessions(ctx context.Context, userID string) (int, error)
+}
+
+// userSessionResponse is the JSON representation of a session in the list of the sessions of a user, the ID is the
+// handle of the session
+type userSessionResponse struct {
+	ID          string     `json:"id"`
+	Current     bool       `json:"current"`
+	LoginMethod string     `json:"loginMethod,omitempty"`
+	UserAgent   string     `json:"userAgent,omitempty"`
+	ClientIP    string     `json:"clientIp,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	LastSeenAt  *time.Time `json:"lastSeenAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// UserSessionsHandler serves the sessions of the user of the session of the caller. GET /sessions lists them, DELETE
+// /sessions revokes all of them and DELETE /sessions/<id> revokes one of them.
+func UserSessionsHandler(sessions UserSessions, cookies *SessionCookies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, ok := cookies.SessionID(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+		current, err := sessions.Session(r.Context(), sessionID)
+		if errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, "no session")
+			return
+		}
+		if err != nil {
+			log.Printf("Reading session %s failed: %s\n", models.SessionHandle(sessionID), err)
+			writeError(w, http.StatusInternalServerError, "reading the session failed")
+			return
+		}
+		if current.UserID == "" {
+			writeError(w, http.StatusForbidden, "the session does not belong to a user")
+			return
+		}
+
+		handle := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+		switch {
+		case r.Method == http.MethodGet && handle == "":
+			listUserSessions(w, r, sessions, current)
+		case r.Method == http.MethodDelete && handle == "":
+			_, err = sessions.RevokeAllSessions(r.Context(), current.UserID)
+			if err != nil {
+				log.Printf("Revoking the sessions of user %s failed: %s\n", current.UserID, err)
+				writeError(w, http.StatusInternalServerError, "revoking the sessions failed")
+				return
+			}
+			cookies.ClearSession(w)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			revokeUserSession(w, r, sessions, cookies, current, handle)
+		case handle == "":
+			writeError(w, http.StatusMethodNotAllowed, "only GET and DELETE are allowed")
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "only DELETE is allowed")
+		}
+	}
+}
+
+func listUserSessions(w http.ResponseWriter, r *http.Request, sessions UserSessions, current models.Session) {
+	userSessions, err := sessions.ListSessions(r.Context(), current.UserID)
+	if err != nil {
+		log.Printf("Listing the sessions of user %s failed: %s\n", current.UserID, err)
+		writeError(w, http.StatusInternalServerError, "listing the sessions failed")
+		return
+	}
+
+	response := make([]userSessionResponse, 0, len(userSessions))
+	for _, session := range userSessions {
+		response = append(response, userSessionResponse{
+			ID:          models.SessionHandle(session.ID),
+			Current:     session.ID == current.ID,
+			LoginMethod: session.LoginMethod,
+			UserAgent:   session.UserAgent,
+			ClientIP:    session.ClientIP,
+			CreatedAt:   optionalTime(session.CreatedAt),
+			LastSeenAt:  optionalTime(session.LastSeenAt),
+			ExpiresAt:   optionalTime(session.ExpiresAt),
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func revokeUserSession(
+	w http.ResponseWriter,
+	r *http.Request,
+	sessions UserSessions,
+	cookies *SessionCookies,
+	current models.Session,
+	handle string,
+) {
+	userSessions, err := sessions.ListSessions(r.Context(), current.UserID)
+	if err != nil {
+		log.Printf("Listing the sessions of user %s failed: %s\n", current.UserID, err)
+		writeError(w, http.StatusInternalServerError, "listing the sessions failed")
+		return
+	}
+	for _, session := range userSessions {
+		if models.SessionHandle(session.ID) != handle {
+			continue
+		}
+		err = sessions.RevokeSession(r.Context(), current.UserID, session.ID)
+		if errors.Is(err, models.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			log.Printf("Revoking session %s failed: %s\n", models.SessionHandle(session.ID), err)
+			writeError(w, http.StatusInternalServerError, "revoking the session failed")
+			return
+		}
+		if session.ID == current.ID {
+			cookies.ClearSession(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, "session not found")
+}
+
+// optionalTime returns nil for the zero time so that unknown times are left out of the responses
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() || t.Unix() <= 0 {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,133 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyUserSessions struct {
+	sessions map[string]models.Session
+}
+
+func (d *DummyUserSessions) Session(_ context.Context, sessionID string) (models.Session, error) {
+	session, found := d.sessions[sessionID]
+	if !found {
+		return models.Session{}, models.ErrNotFound
+	}
+	return session, nil
+}
+
+func (d *DummyUserSessions) ListSessions(_ context.Context, userID string) ([]models.Session, error) {
+	var sessions []models.Session
+	for _, id := range []string{"laptop", "cli", "other"} {
+		if session, found := d.sessions[id]; found && session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (d *DummyUserSessions) RevokeSession(_ context.Context, userID string, sessionID string) error {
+	if d.sessions[sessionID].UserID != userID {
+		return models.ErrNotFound
+	}
+	delete(d.sessions, sessionID)
+	return nil
+}
+
+func (d *DummyUserSessions) RevokeAllSessions(ctx context.Context, userID string) (int, error) {
+	sessions, _ := d.ListSessions(ctx, userID)
+	for _, session := range sessions {
+		delete(d.sessions, session.ID)
+	}
+	return len(sessions), nil
+}
+
+func newDummyUserSessions() *DummyUserSessions {
+	lastSeenAt := time.Unix(time.Now().Unix(), 0).UTC()
+	return &DummyUserSessions{sessions: map[string]models.Session{
+		"laptop": {ID: "laptop", UserID: "jane", LastSeenAt: lastSeenAt, UserAgent: "Firefox"},
+		"cli":    {ID: "cli", UserID: "jane", LoginMethod: models.SessionLoginCLI},
+		"other":  {ID: "other", UserID: "john"},
+		"legacy": {ID: "legacy"},
+	}}
+}
+
+func serveSessions(
+	t *testing.T,
+	handler http.Handler,
+	method string,
+	path string,
+	sessionID string,
+) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if sessionID != "" {
+		req.AddCookie(sessionCookie(t, testCookies, models.Session{ID: sessionID}))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestListUserSessions(t *testing.T) {
+	handler := UserSessionsHandler(newDummyUserSessions(), testCookies)
+
+	rec := serveSessions(t, handler, http.MethodGet, "/sessions", "laptop")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusOK)
+	}
+	var response []userSessionResponse
+	err := json.NewDecoder(rec.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 || !response[0].Current || response[0].UserAgent != "Firefox" ||
+		response[0].LastSeenAt == nil || response[1].Current || response[1].LastSeenAt != nil {
+		t.Errorf("The sessions are NOT correct, got %+v\n", response)
+	}
+	if response[0].ID != models.SessionHandle("laptop") {
+		t.Errorf("The session ID is NOT hidden, got %v\n", response[0].ID)
+	}
+
+	for sessionID, want := range map[string]int{"": http.StatusUnauthorized, "gone": http.StatusUnauthorized,
+		"legacy": http.StatusForbidden} {
+		if rec := serveSessions(t, handler, http.MethodGet, "/sessions", sessionID); rec.Code != want {
+			t.Errorf("The status code for session %q is NOT correct, got %v want %v\n", sessionID, rec.Code, want)
+		}
+	}
+}
+
+func TestRevokeUserSession(t *testing.T) {
+	sessions := newDummyUserSessions()
+	handler := UserSessionsHandler(sessions, testCookies)
+
+	rec := serveSessions(t, handler, http.MethodDelete, "/sessions/"+models.SessionHandle("other"), "laptop")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Revoking the session of another user was NOT refused, got %v\n", rec.Code)
+	}
+	rec = serveSessions(t, handler, http.MethodDelete, "/sessions/"+models.SessionHandle("cli"), "laptop")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusNoContent)
+	}
+	if _, found := sessions.sessions["cli"]; found || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("The session was NOT revoked alone, got %v\n", sessions.sessions)
+	}
+
+	rec = serveSessions(t, handler, http.MethodDelete, "/sessions", "laptop")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("The status code is NOT correct, got %v want %v\n", rec.Code, http.StatusNoContent)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookieName || cookies[0].MaxAge >= 0 {
+		t.Errorf("The session cookie was NOT cleared, got %v\n", cookies)
+	}
+	if _, found := sessions.sessions["other"]; !found || len(sessions.sessions) != 2 {
+		t.Errorf("The sessions left are NOT correct, got %v\n", sessions.sessions)
+	}
+}
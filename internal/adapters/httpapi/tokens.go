@@ -0,0 +1,69 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// RefreshTokenExchanger returns the access token of a refresh token after checking that it was not superseded
+type RefreshTokenExchanger interface {
+	ExchangeRefreshToken(ctx context.Context, presented models.RefreshToken) (models.AccessToken, error)
+}
+
+// refreshTokenRequest is the JSON body of a refresh token exchange
+type refreshTokenRequest struct {
+	ID           string `json:"id"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// accessTokenResponse is the JSON representation of the access token returned for a refresh token
+type accessTokenResponse struct {
+	AccessToken string     `json:"accessToken"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// RefreshTokenHandler exchanges the refresh token posted by the caller for the current access token with the same
+// ID. Superseded and unknown refresh tokens are rejected, a superseded one also revokes its token family.
+func RefreshTokenHandler(tokens RefreshTokenExchanger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+			return
+		}
+		var body refreshTokenRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body)
+		if err != nil || body.ID == "" || body.RefreshToken == "" {
+			writeError(w, http.StatusBadRequest, "the id and the refreshToken are required")
+			return
+		}
+
+		accessToken, err := tokens.ExchangeRefreshToken(r.Context(), models.RefreshToken{
+			ID:    body.ID,
+			Value: body.RefreshToken,
+		})
+		if errors.Is(err, models.ErrForbidden) || errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, "invalid refresh token")
+			return
+		}
+		if err != nil {
+			log.Printf("Exchanging the refresh token %s failed: %s\n", body.ID, err)
+			writeError(w, http.StatusInternalServerError, "exchanging the refresh token failed")
+			return
+		}
+		if accessToken.Value == "" {
+			writeError(w, http.StatusUnauthorized, "invalid refresh token")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, accessTokenResponse{
+			AccessToken: accessToken.Value,
+			ExpiresAt:   optionalTime(accessToken.ExpiresAt),
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyRefreshTokenExchanger struct {
+	refreshTokens map[string]string
+	accessTokens  map[string]string
+}
+
+func (d *DummyRefreshTokenExchanger) ExchangeRefreshToken(
+	_ context.Context,
+	presented models.RefreshToken,
+) (models.AccessToken, error) {
+	if d.refreshTokens[presented.ID] != presented.Value {
+		return models.AccessToken{}, models.ErrForbidden
+	}
+	return models.AccessToken{ID: presented.ID, Value: d.accessTokens[presented.ID]}, nil
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	handler := RefreshTokenHandler(&DummyRefreshTokenExchanger{
+		refreshTokens: map[string]string{"gitlab": "refresh"},
+		accessTokens:  map[string]string{"gitlab": "access"},
+	})
+
+	for _, tt := range []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, `{"id": "gitlab", "refreshToken": "refresh"}`, http.StatusOK},
+		{http.MethodPost, `{"id": "gitlab", "refreshToken": "superseded"}`, http.StatusUnauthorized},
+		{http.MethodPost, `{"id": "gitlab"}`, http.StatusBadRequest},
+		{http.MethodPost, `not json`, http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tt.method, "/tokens/refresh", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("The status code of %s %s is NOT correct, got %v want %v\n", tt.method, tt.body, rec.Code, tt.want)
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var response accessTokenResponse
+		err := json.NewDecoder(rec.Body).Decode(&response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.AccessToken != "access" {
+			t.Errorf("The access token is NOT correct, got %v want %v\n", response.AccessToken, "access")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Package kgclient sends the GitLab events of the projects tracked by the knowledge graph to its services
+package kgclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// event is the JSON representation of a knowledge graph event
+type event struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Action      string    `json:"action,omitempty"`
+	ProjectID   int       `json:"projectId"`
+	ProjectPath string    `json:"projectPath,omitempty"`
+	Ref         string    `json:"ref,omitempty"`
+	Before      string    `json:"before,omitempty"`
+	After       string    `json:"after,omitempty"`
+	ReceivedAt  time.Time `json:"receivedAt"`
+}
+
+// Sender posts events as JSON to the knowledge graph services, it uses http.DefaultClient when Client is nil
+type Sender struct {
+	Client *http.Client
+}
+
+// Send posts an event to a service with the project token as a bearer token, the event ID is sent in the
+// Idempotency-Key header so that the services can ignore retried deliveries they already received
+func (s *Sender) Send(ctx context.Context, target string, kgEvent models.KGEvent, token string) error {
+	body, err := json.Marshal(event{
+		ID:          kgEvent.ID,
+		Type:        kgEvent.Type,
+		Action:      kgEvent.Action,
+		ProjectID:   kgEvent.ProjectID,
+		ProjectPath: kgEvent.ProjectPath,
+		Ref:         kgEvent.Ref,
+		Before:      kgEvent.Before,
+		After:       kgEvent.After,
+		ReceivedAt:  kgEvent.ReceivedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", kgEvent.ID)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("knowledge graph service %s responded with status %d", target, resp.StatusCode)
+	}
+	return nil
+}
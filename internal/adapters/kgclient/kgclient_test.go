@@ -0,0 +1,49 @@
+package kgclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func TestSend(t *testing.T) {
+	received := make(chan event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer glpat-42" || r.Header.Get("Idempotency-Key") != "e1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body event
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- body
+	}))
+	defer srv.Close()
+
+	sender := Sender{}
+	err := sender.Send(context.Background(), srv.URL, models.KGEvent{
+		ID:        "e1",
+		Type:      models.KGEventPush,
+		ProjectID: 42,
+		Ref:       "refs/heads/main",
+	}, "glpat-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := <-received
+	if body.ID != "e1" || body.Type != models.KGEventPush || body.ProjectID != 42 || body.Ref != "refs/heads/main" {
+		t.Errorf("The service received the wrong event, got %+v\n", body)
+	}
+
+	err = sender.Send(context.Background(), srv.URL, models.KGEvent{ID: "e1"}, "other")
+	if err == nil {
+		t.Errorf("A rejected event did NOT return an error\n")
+	}
+}
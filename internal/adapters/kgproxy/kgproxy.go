@@ -0,0 +1,96 @@
+// Package kgproxy forwards the requests about projects to the knowledge graph API with the credential picked for the
+// caller
+package kgproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/httpapi"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// CredentialProvider returns the token to send with a request of a caller about a project, an empty token means that
+// the request is sent anonymously. It returns models.ErrNotFound if the caller cannot see the project and
+// models.ErrForbidden if the request must not reach the knowledge graph.
+type CredentialProvider interface {
+	Credential(ctx context.Context, projectID int, caller models.KGCaller) (string, error)
+}
+
+// Handler forwards the requests to /projects/<id>[/...] to the knowledge graph API at target. The credentials of the
+// caller, the Authorization header and the cookies, are replaced by the credential picked for the request.
+func Handler(credentials CredentialProvider, cookies *httpapi.SessionCookies, target *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		projectID, ok := projectIDFromPath(r.URL.Path)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		credential, err := credentials.Credential(r.Context(), projectID, callerFromRequest(r, cookies))
+		if errors.Is(err, models.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "project not found")
+			return
+		}
+		if errors.Is(err, models.ErrForbidden) {
+			writeError(w, http.StatusForbidden, "the project is not available in the knowledge graph")
+			return
+		}
+		if err != nil {
+			log.Printf("Picking the credential of project %d failed: %s\n", projectID, err)
+			writeError(w, http.StatusInternalServerError, "checking the access to the project failed")
+			return
+		}
+
+		out := r.Clone(r.Context())
+		out.Header.Del("Authorization")
+		out.Header.Del("Cookie")
+		if credential != "" {
+			out.Header.Set("Authorization", "Bearer "+credential)
+		}
+		proxy.ServeHTTP(w, out)
+	})
+}
+
+// projectIDFromPath reads the project ID of a path starting with /projects/<id>
+func projectIDFromPath(path string) (int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != "projects" {
+		return 0, false
+	}
+	projectID, err := strconv.Atoi(parts[1])
+	return projectID, err == nil
+}
+
+// callerFromRequest reads the GitLab token of the Authorization header and the session cookie of a request
+func callerFromRequest(r *http.Request, cookies *httpapi.SessionCookies) models.KGCaller {
+	var caller models.KGCaller
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		caller.Token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if sessionID, ok := cookies.SessionID(r); ok {
+		caller.SessionID = sessionID
+	}
+	return caller
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Writing the response failed: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
@@ -0,0 +1,104 @@
+package kgproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/httpapi"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// DummyCredentials gives the project token to the callers with the member token or session and refuses the others
+type DummyCredentials struct{}
+
+func (DummyCredentials) Credential(_ context.Context, projectID int, caller models.KGCaller) (string, error) {
+	switch {
+	case projectID == 1:
+		return "", nil
+	case projectID == 3:
+		return "", models.ErrForbidden
+	case caller.Token == "member" || caller.SessionID == "member-session":
+		return "project-token", nil
+	default:
+		return "", models.ErrNotFound
+	}
+}
+
+// DummyKeys is a key ring with a single key
+type DummyKeys struct{}
+
+func (DummyKeys) ActiveKey() (string, []byte, error) {
+	return "key1", []byte("0123456789abcdef0123456789abcdef"), nil
+}
+
+func (DummyKeys) Key(string) ([]byte, error) {
+	return []byte("0123456789abcdef0123456789abcdef"), nil
+}
+
+func TestHandler(t *testing.T) {
+	type received struct {
+		path          string
+		authorization string
+		cookie        string
+	}
+	requests := make(chan received, 1)
+	kg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- received{path: r.URL.Path, authorization: r.Header.Get("Authorization"), cookie: r.Header.Get("Cookie")}
+	}))
+	defer kg.Close()
+	target, err := url.Parse(kg.URL + "/knowledge-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := httpapi.NewSessionCookies(&encryption.Encryptor{Keys: DummyKeys{}}, httpapi.CookieConfig{})
+	handler := Handler(DummyCredentials{}, cookies, target)
+
+	tests := []struct {
+		name              string
+		path              string
+		token             string
+		sessionID         string
+		wantStatus        int
+		wantAuthorization string
+	}{
+		{"public anonymous", "/projects/1/datasets", "", "", http.StatusOK, ""},
+		{"public with token", "/projects/1", "member", "", http.StatusOK, ""},
+		{"private member token", "/projects/2/datasets", "member", "", http.StatusOK, "Bearer project-token"},
+		{"private member session", "/projects/2", "", "member-session", http.StatusOK, "Bearer project-token"},
+		{"private outsider", "/projects/2", "outsider", "", http.StatusNotFound, ""},
+		{"not activated", "/projects/3", "member", "", http.StatusForbidden, ""},
+		{"not a project", "/datasets", "member", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.sessionID != "" {
+			cookie := httptest.NewRecorder()
+			err = cookies.SetSession(cookie, models.Session{ID: tt.sessionID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(cookie.Result().Cookies()[0])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("The status code for %s is NOT correct, got %v want %v\n", tt.name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		got := <-requests
+		if got.path != "/knowledge-graph"+tt.path || got.authorization != tt.wantAuthorization || got.cookie != "" {
+			t.Errorf("The request forwarded for %s is NOT correct, got %+v\n", tt.name, got)
+		}
+	}
+}
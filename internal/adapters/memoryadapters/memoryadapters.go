@@ -0,0 +1,686 @@
+// Package memoryadapters contains a thread-safe in-memory store that behaves like the Redis adapter, it allows the
+// gateway to run locally and in tests without Redis
+package memoryadapters
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+var _ repository.Repository = (*MemoryAdapter)(nil)
+
+// defaultSweepInterval is the interval of RunExpirySweep when none is given
+const defaultSweepInterval = time.Minute
+
+// MemoryAdapter keeps sessions and tokens in memory. Like in Redis, expirations are stored with a precision of one
+// second, sessions disappear once they expire and indexes are ordered by expiration and then by ID.
+type MemoryAdapter struct {
+	mu                         sync.RWMutex
+	sessions                   map[string]models.Session
+	accessTokens               map[string]models.AccessToken
+	refreshTokens              map[string]models.RefreshToken
+	refreshTokenHistory        map[string][]string
+	reauthNotices              map[string]int64
+	tokenSessions              map[string]string
+	indexExpiringTokens        map[string]int64
+	indexExpiringRefreshTokens map[string]int64
+	projectTokens              map[int]map[string]int64
+	projectWebhookSecrets      map[int]string // the secret of a deactivated project is empty
+	subscribers                map[chan time.Time]struct{}
+}
+
+// NewMemoryAdapter creates an empty in-memory store
+func NewMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{
+		sessions:                   map[string]models.Session{},
+		accessTokens:               map[string]models.AccessToken{},
+		refreshTokens:              map[string]models.RefreshToken{},
+		refreshTokenHistory:        map[string][]string{},
+		reauthNotices:              map[string]int64{},
+		tokenSessions:              map[string]string{},
+		indexExpiringTokens:        map[string]int64{},
+		indexExpiringRefreshTokens: map[string]int64{},
+		projectTokens:              map[int]map[string]int64{},
+		projectWebhookSecrets:      map[int]string{},
+		subscribers:                map[chan time.Time]struct{}{},
+	}
+}
+
+// writeOp is a write applied while the lock of the adapter is held
+type writeOp func(m *MemoryAdapter)
+
+// apply runs writes as a single atomic operation
+func (m *MemoryAdapter) apply(ops ...writeOp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, op := range ops {
+		op(m)
+	}
+	return nil
+}
+
+// Update collects the writes made by fn and applies them as a single atomic operation if fn succeeds
+func (m *MemoryAdapter) Update(_ context.Context, fn func(tx repository.Writer) error) error {
+	tx := &batch{}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	return m.apply(tx.ops...)
+}
+
+// batch is the repository.Writer of a transaction, it collects writes until the transaction is applied
+type batch struct {
+	ops []writeOp
+}
+
+func (b *batch) SetSession(_ context.Context, session models.Session) error {
+	b.ops = append(b.ops, setSession(session))
+	return nil
+}
+
+func (b *batch) SetAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	b.ops = append(b.ops, setAccessToken(accessToken))
+	return nil
+}
+
+func (b *batch) SetRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	b.ops = append(b.ops, setRefreshToken(refreshToken))
+	return nil
+}
+
+func (b *batch) AddSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	b.ops = append(b.ops, addSupersededRefreshToken(refreshToken))
+	return nil
+}
+
+func (b *batch) SetProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	b.ops = append(b.ops, setProjectToken(projectID, accessToken))
+	return nil
+}
+
+func (b *batch) SetProjectWebhookSecret(_ context.Context, projectID int, secret string) error {
+	b.ops = append(b.ops, setProjectWebhookSecret(projectID, secret))
+	return nil
+}
+
+func (b *batch) RemoveSession(_ context.Context, sessionID string) error {
+	b.ops = append(b.ops, removeSession(sessionID))
+	return nil
+}
+
+func (b *batch) RemoveAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	b.ops = append(b.ops, removeAccessToken(accessToken.ID))
+	return nil
+}
+
+func (b *batch) RemoveRefreshToken(_ context.Context, refreshTokenID string) error {
+	b.ops = append(b.ops, removeRefreshToken(refreshTokenID))
+	return nil
+}
+
+func (b *batch) RemoveSupersededRefreshTokens(_ context.Context, refreshTokenID string) error {
+	b.ops = append(b.ops, removeSupersededRefreshTokens(refreshTokenID))
+	return nil
+}
+
+func (b *batch) RemoveProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	b.ops = append(b.ops, removeProjectToken(projectID, accessToken.ID))
+	return nil
+}
+
+func (b *batch) DeactivateProjectWebhook(_ context.Context, projectID int) error {
+	b.ops = append(b.ops, deactivateProjectWebhook(projectID))
+	return nil
+}
+
+func (b *batch) RemoveProjectWebhookSecret(_ context.Context, projectID int) error {
+	b.ops = append(b.ops, removeProjectWebhookSecret(projectID))
+	return nil
+}
+
+// Set/write functions
+
+// SetSession writes a session, the session is removed once it expires
+func (m *MemoryAdapter) SetSession(_ context.Context, session models.Session) error {
+	return m.apply(setSession(session))
+}
+
+func setSession(session models.Session) writeOp {
+	session.ExpiresAt = truncate(session.ExpiresAt)
+	session.TokenIDs = copyStrings(session.TokenIDs)
+	if !session.CreatedAt.IsZero() {
+		session.CreatedAt = truncate(session.CreatedAt)
+	}
+	if !session.LastSeenAt.IsZero() {
+		session.LastSeenAt = truncate(session.LastSeenAt)
+	}
+	return func(m *MemoryAdapter) {
+		m.sessions[session.ID] = session
+		for _, tokenID := range session.TokenIDs {
+			m.tokenSessions[tokenID] = session.ID
+		}
+	}
+}
+
+// TouchSession sets the last seen time of a session that has not expired and extends its expiration
+func (m *MemoryAdapter) TouchSession(
+	_ context.Context,
+	sessionID string,
+	lastSeenAt time.Time,
+	expiresAt time.Time,
+) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, found := m.sessions[sessionID]
+	if !found || isExpired(session, time.Now()) {
+		return false, nil
+	}
+	session.LastSeenAt = lastSeenAt
+	if !expiresAt.IsZero() {
+		session.ExpiresAt = expiresAt
+	}
+	setSession(session)(m)
+	return true, nil
+}
+
+// SetAccessToken writes an access token, adds it to the expiring tokens index and notifies the subscribers
+func (m *MemoryAdapter) SetAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	return m.apply(setAccessToken(accessToken))
+}
+
+func setAccessToken(accessToken models.AccessToken) writeOp {
+	accessToken = copyAccessToken(accessToken)
+	accessToken.ExpiresAt = truncate(accessToken.ExpiresAt)
+	if !accessToken.IssuedAt.IsZero() {
+		accessToken.IssuedAt = truncate(accessToken.IssuedAt)
+	}
+	return func(m *MemoryAdapter) {
+		m.accessTokens[accessToken.ID] = accessToken
+		m.indexExpiringTokens[accessToken.ID] = accessToken.ExpiresAt.Unix()
+
+		// Like Redis pub/sub, notifications are dropped for subscribers that do not keep up
+		for subscriber := range m.subscribers {
+			select {
+			case subscriber <- accessToken.ExpiresAt:
+			default:
+			}
+		}
+	}
+}
+
+// SetRefreshToken writes a refresh token and adds it to the expiring refresh tokens index if it expires
+func (m *MemoryAdapter) SetRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	return m.apply(setRefreshToken(refreshToken))
+}
+
+func setRefreshToken(refreshToken models.RefreshToken) writeOp {
+	refreshToken.ExpiresAt = truncate(refreshToken.ExpiresAt)
+	return func(m *MemoryAdapter) {
+		m.refreshTokens[refreshToken.ID] = refreshToken
+		if refreshToken.ExpiresAt.Unix() <= 0 {
+			delete(m.indexExpiringRefreshTokens, refreshToken.ID)
+		} else {
+			m.indexExpiringRefreshTokens[refreshToken.ID] = refreshToken.ExpiresAt.Unix()
+		}
+	}
+}
+
+// AddSupersededRefreshToken adds a hash of a refresh token value that was replaced by a rotation to the history
+func (m *MemoryAdapter) AddSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) error {
+	return m.apply(addSupersededRefreshToken(refreshToken))
+}
+
+func addSupersededRefreshToken(refreshToken models.RefreshToken) writeOp {
+	hash := repository.HashTokenValue(refreshToken.Value)
+	return func(m *MemoryAdapter) {
+		history := append([]string{hash}, m.refreshTokenHistory[refreshToken.ID]...)
+		if len(history) > repository.RefreshTokenHistoryLength {
+			history = history[:repository.RefreshTokenHistoryLength]
+		}
+		m.refreshTokenHistory[refreshToken.ID] = history
+	}
+}
+
+// SetProjectToken adds a token ID to the tokens of a project
+func (m *MemoryAdapter) SetProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	return m.apply(setProjectToken(projectID, accessToken))
+}
+
+func setProjectToken(projectID int, accessToken models.AccessToken) writeOp {
+	return func(m *MemoryAdapter) {
+		if m.projectTokens[projectID] == nil {
+			m.projectTokens[projectID] = map[string]int64{}
+		}
+		m.projectTokens[projectID][accessToken.ID] = accessToken.ExpiresAt.Unix()
+	}
+}
+
+// SetProjectWebhookSecret writes the secret of the GitLab webhook of a project
+func (m *MemoryAdapter) SetProjectWebhookSecret(_ context.Context, projectID int, secret string) error {
+	return m.apply(setProjectWebhookSecret(projectID, secret))
+}
+
+func setProjectWebhookSecret(projectID int, secret string) writeOp {
+	return func(m *MemoryAdapter) {
+		m.projectWebhookSecrets[projectID] = secret
+	}
+}
+
+// Remove/delete functions
+
+// RemoveSession removes a session and the session of its tokens
+func (m *MemoryAdapter) RemoveSession(_ context.Context, sessionID string) error {
+	return m.apply(removeSession(sessionID))
+}
+
+func removeSession(sessionID string) writeOp {
+	return func(m *MemoryAdapter) {
+		session, found := m.sessions[sessionID]
+		if !found {
+			return
+		}
+		for _, tokenID := range session.TokenIDs {
+			delete(m.tokenSessions, tokenID)
+		}
+		delete(m.sessions, sessionID)
+	}
+}
+
+// RemoveAccessToken removes an access token and its entry in the expiring tokens index
+func (m *MemoryAdapter) RemoveAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	return m.apply(removeAccessToken(accessToken.ID))
+}
+
+func removeAccessToken(tokenID string) writeOp {
+	return func(m *MemoryAdapter) {
+		delete(m.indexExpiringTokens, tokenID)
+		delete(m.accessTokens, tokenID)
+	}
+}
+
+// RemoveRefreshToken removes a refresh token and its entry in the expiring refresh tokens index
+func (m *MemoryAdapter) RemoveRefreshToken(_ context.Context, refreshTokenID string) error {
+	return m.apply(removeRefreshToken(refreshTokenID))
+}
+
+func removeRefreshToken(tokenID string) writeOp {
+	return func(m *MemoryAdapter) {
+		delete(m.indexExpiringRefreshTokens, tokenID)
+		delete(m.refreshTokens, tokenID)
+	}
+}
+
+// RemoveSupersededRefreshTokens removes the refresh token history of a token ID
+func (m *MemoryAdapter) RemoveSupersededRefreshTokens(_ context.Context, refreshTokenID string) error {
+	return m.apply(removeSupersededRefreshTokens(refreshTokenID))
+}
+
+func removeSupersededRefreshTokens(tokenID string) writeOp {
+	return func(m *MemoryAdapter) {
+		delete(m.refreshTokenHistory, tokenID)
+	}
+}
+
+// RemoveProjectToken removes a token ID from the tokens of a project
+func (m *MemoryAdapter) RemoveProjectToken(_ context.Context, projectID int, accessToken models.AccessToken) error {
+	return m.apply(removeProjectToken(projectID, accessToken.ID))
+}
+
+func removeProjectToken(projectID int, tokenID string) writeOp {
+	return func(m *MemoryAdapter) {
+		delete(m.projectTokens[projectID], tokenID)
+		if len(m.projectTokens[projectID]) == 0 {
+			delete(m.projectTokens, projectID)
+		}
+	}
+}
+
+// DeactivateProjectWebhook removes the secret of the GitLab webhook of a project and keeps the project as inactive
+func (m *MemoryAdapter) DeactivateProjectWebhook(_ context.Context, projectID int) error {
+	return m.apply(deactivateProjectWebhook(projectID))
+}
+
+func deactivateProjectWebhook(projectID int) writeOp {
+	return func(m *MemoryAdapter) {
+		m.projectWebhookSecrets[projectID] = ""
+	}
+}
+
+// RemoveProjectWebhookSecret removes the secret of the GitLab webhook of a project
+func (m *MemoryAdapter) RemoveProjectWebhookSecret(_ context.Context, projectID int) error {
+	return m.apply(removeProjectWebhookSecret(projectID))
+}
+
+func removeProjectWebhookSecret(projectID int) writeOp {
+	return func(m *MemoryAdapter) {
+		delete(m.projectWebhookSecrets, projectID)
+	}
+}
+
+// Get functions
+
+// GetSession reads a session, it returns models.ErrNotFound if the session does not exist or has expired
+func (m *MemoryAdapter) GetSession(_ context.Context, sessionID string) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, found := m.sessions[sessionID]
+	if !found {
+		return models.Session{}, models.ErrNotFound
+	}
+	if isExpired(session, time.Now()) {
+		removeSession(sessionID)(m)
+		return models.Session{}, models.ErrNotFound
+	}
+	session.TokenIDs = copyStrings(session.TokenIDs)
+	return session, nil
+}
+
+// GetAccessToken reads an access token, it returns models.ErrNotFound if the token does not exist
+func (m *MemoryAdapter) GetAccessToken(_ context.Context, tokenID string) (models.AccessToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	accessToken, found := m.accessTokens[tokenID]
+	if !found {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	return copyAccessToken(accessToken), nil
+}
+
+// GetRefreshToken reads a refresh token, it returns models.ErrNotFound if the token does not exist
+func (m *MemoryAdapter) GetRefreshToken(_ context.Context, tokenID string) (models.RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refreshToken, found := m.refreshTokens[tokenID]
+	if !found {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+	return refreshToken, nil
+}
+
+// IsSupersededRefreshToken checks whether a refresh token value is in the refresh token history of its token ID
+func (m *MemoryAdapter) IsSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hash := repository.HashTokenValue(refreshToken.Value)
+	for _, superseded := range m.refreshTokenHistory[refreshToken.ID] {
+		if superseded == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetExpiringAccessTokenIDs reads the IDs of the access tokens expiring between startTime and stopTime
+func (m *MemoryAdapter) GetExpiringAccessTokenIDs(
+	_ context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return rangeByScore(m.indexExpiringTokens, startTime.Unix(), stopTime.Unix()), nil
+}
+
+// GetExpiringRefreshTokenIDs reads the IDs of the refresh tokens expiring between startTime and stopTime
+func (m *MemoryAdapter) GetExpiringRefreshTokenIDs(
+	_ context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return rangeByScore(m.indexExpiringRefreshTokens, startTime.Unix(), stopTime.Unix()), nil
+}
+
+// GetTokenSessionID reads the ID of the session a token belongs to, it is empty if there is no such session
+func (m *MemoryAdapter) GetTokenSessionID(_ context.Context, tokenID string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.tokenSessions[tokenID], nil
+}
+
+// GetUserSessionIDs reads the IDs of the sessions of a user that have not expired, ordered by expiration
+func (m *MemoryAdapter) GetUserSessionIDs(_ context.Context, userID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	userSessions := map[string]int64{}
+	for sessionID, session := range m.sessions {
+		if session.UserID != userID || session.Type == models.SessionTypeAnonymous || isExpired(session, now) {
+			continue
+		}
+		userSessions[sessionID] = userSessionScore(session.ExpiresAt.Unix())
+	}
+	return sortedMembers(userSessions), nil
+}
+
+// GetProjectTokens reads the token IDs of a project ordered by expiration
+func (m *MemoryAdapter) GetProjectTokens(_ context.Context, projectID int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sortedMembers(m.projectTokens[projectID]), nil
+}
+
+// ListProjectTokens reads a page of the tokens of a project with their expiration
+func (m *MemoryAdapter) ListProjectTokens(
+	_ context.Context,
+	projectID int,
+	query models.ProjectTokenQuery,
+) (models.ProjectTokenPage, error) {
+	tokenRange, err := repository.NewProjectTokenRange(query)
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tokens []models.ProjectToken
+	index := m.projectTokens[projectID]
+	for _, tokenID := range sortedMembers(index) {
+		token := models.ProjectToken{ID: tokenID, ExpiresAt: time.Unix(index[tokenID], 0)}
+		if !tokenRange.Includes(token) {
+			continue
+		}
+		tokens = append(tokens, token)
+		if len(tokens) > tokenRange.Limit {
+			break
+		}
+	}
+	return tokenRange.Page(tokens), nil
+}
+
+// GetProjectWebhookSecret reads the secret of the GitLab webhook of a project
+func (m *MemoryAdapter) GetProjectWebhookSecret(_ context.Context, projectID int) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	secret := m.projectWebhookSecrets[projectID]
+	if secret == "" {
+		return "", models.ErrNotFound
+	}
+	return secret, nil
+}
+
+// ListProjectWebhooks reads the projects with a webhook secret and the deactivated ones
+func (m *MemoryAdapter) ListProjectWebhooks(_ context.Context) ([]models.ProjectWebhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	webhooks := []models.ProjectWebhook{}
+	for projectID, secret := range m.projectWebhookSecrets {
+		webhooks = append(webhooks, models.ProjectWebhook{ProjectID: projectID, Active: secret != ""})
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ProjectID < webhooks[j].ProjectID
+	})
+	return webhooks, nil
+}
+
+// GetEarliestAccessTokenExpiry reads the earliest access token expiration that is later than the given time
+func (m *MemoryAdapter) GetEarliestAccessTokenExpiry(
+	_ context.Context,
+	after time.Time,
+) (expiresAt time.Time, found bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var earliest int64
+	for _, score := range m.indexExpiringTokens {
+		if score > after.Unix() && (!found || score < earliest) {
+			earliest, found = score, true
+		}
+	}
+	if !found {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(earliest, 0), true, nil
+}
+
+// SubscribeExpiringAccessTokens returns a channel that receives the expiration of every access token written, the
+// channel is closed when the context is done
+func (m *MemoryAdapter) SubscribeExpiringAccessTokens(ctx context.Context) (<-chan time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscriber := make(chan time.Time, 100)
+	m.subscribers[subscriber] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, subscriber)
+		close(subscriber)
+	}()
+	return subscriber, nil
+}
+
+// ClaimReauthNotice claims the re-authentication notice of a refresh token expiration
+func (m *MemoryAdapter) ClaimReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if claimed, found := m.reauthNotices[tokenID]; found && claimed == expiresAt.Unix() {
+		return false, nil
+	}
+	m.reauthNotices[tokenID] = expiresAt.Unix()
+	return true, nil
+}
+
+// ReleaseReauthNotice removes the claim of the re-authentication notice of a refresh token expiration
+func (m *MemoryAdapter) ReleaseReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.reauthNotices[tokenID] == expiresAt.Unix() {
+		delete(m.reauthNotices, tokenID)
+	}
+	return nil
+}
+
+// RunExpirySweep removes the expired sessions and re-authentication notice claims at every interval until the
+// context is done, expired sessions are never returned even without the sweep but they are only freed when they are
+// read
+func (m *MemoryAdapter) RunExpirySweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for sessionID, session := range m.sessions {
+				if isExpired(session, now) {
+					removeSession(sessionID)(m)
+				}
+			}
+			for tokenID, expiresAt := range m.reauthNotices {
+				if expiresAt <= now.Unix() {
+					delete(m.reauthNotices, tokenID)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// userSessionScore orders the sessions of a user by expiration, the sessions without an expiration come last
+func userSessionScore(expiresAt int64) int64 {
+	if expiresAt <= 0 {
+		return math.MaxInt64
+	}
+	return expiresAt
+}
+
+// isExpired reports whether a session has an expiration that has passed
+func isExpired(session models.Session, now time.Time) bool {
+	return session.ExpiresAt.Unix() > 0 && !session.ExpiresAt.After(now)
+}
+
+// rangeByScore returns the members with a score between start and stop included, ordered like a Redis sorted set
+func rangeByScore(index map[string]int64, start int64, stop int64) []string {
+	inRange := map[string]int64{}
+	for member, score := range index {
+		if score >= start && score <= stop {
+			inRange[member] = score
+		}
+	}
+	return sortedMembers(inRange)
+}
+
+// sortedMembers returns the members ordered by score and then by member like a Redis sorted set, it returns nil
+// when there are no members
+func sortedMembers(index map[string]int64) []string {
+	var members []string
+	for member := range index {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if index[members[i]] != index[members[j]] {
+			return index[members[i]] < index[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// truncate drops the sub-second part of a time, Redis stores expirations as Unix seconds
+func truncate(t time.Time) time.Time {
+	return time.Unix(t.Unix(), 0)
+}
+
+// copyAccessToken returns an access token that does not share its lists with the given one
+func copyAccessToken(accessToken models.AccessToken) models.AccessToken {
+	accessToken.Scopes = copyStrings(accessToken.Scopes)
+	accessToken.Audience = copyStrings(accessToken.Audience)
+	return accessToken
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
@@ -0,0 +1,70 @@
+package memoryadapters
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		return NewMemoryAdapter()
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	adapter := NewMemoryAdapter()
+
+	mySession := models.Session{
+		ID:        "12345",
+		Type:      "user",
+		ExpiresAt: time.Now().Add(time.Hour),
+		TokenIDs:  []string{"test"},
+	}
+	expiredSession := models.Session{ID: "67890", ExpiresAt: time.Now().Add(-time.Second), TokenIDs: []string{"old"}}
+	adapter.SetSession(ctx, mySession)
+	adapter.SetSession(ctx, expiredSession)
+
+	session, err := adapter.GetSession(ctx, "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ExpiresAt.Unix() != mySession.ExpiresAt.Unix() || !reflect.DeepEqual(session.TokenIDs, mySession.TokenIDs) {
+		t.Errorf("session is NOT the correct value, got %v want %v\n", session, mySession)
+	}
+	if _, err := adapter.GetSession(ctx, "67890"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("expired session error is NOT the correct value, got %v want %v\n", err, models.ErrNotFound)
+	}
+	if sessionID, _ := adapter.GetTokenSessionID(ctx, "old"); sessionID != "" {
+		t.Errorf("token session ID is NOT the correct value, got %v want %v\n", sessionID, "")
+	}
+
+	adapter.RemoveSession(ctx, "12345")
+	if _, err := adapter.GetSession(ctx, "12345"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("removed session error is NOT the correct value, got %v want %v\n", err, models.ErrNotFound)
+	}
+}
+
+func TestRunExpirySweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	adapter := NewMemoryAdapter()
+	adapter.SetSession(ctx, models.Session{ID: "12345", ExpiresAt: time.Now().Add(time.Second)})
+
+	go adapter.RunExpirySweep(ctx, 100*time.Millisecond)
+	time.Sleep(2100 * time.Millisecond)
+
+	adapter.mu.RLock()
+	remaining := len(adapter.sessions)
+	adapter.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("number of sessions is NOT the correct value, got %v want %v\n", remaining, 0)
+	}
+}
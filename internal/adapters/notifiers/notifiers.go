@@ -0,0 +1,81 @@
+// Package notifiers sends re-authentication notices to users or to other services
+package notifiers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// reauthEvent is the JSON representation of a re-authentication notice
+type reauthEvent struct {
+	Event         string    `json:"event"`
+	UserID        string    `json:"userId,omitempty"`
+	SessionHandle string    `json:"sessionHandle,omitempty"`
+	TokenID       string    `json:"tokenId"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+func newReauthEvent(notice models.ReauthNotice) reauthEvent {
+	return reauthEvent{
+		Event:         "reauthentication_required_soon",
+		UserID:        notice.UserID,
+		SessionHandle: notice.SessionHandle,
+		TokenID:       notice.TokenID,
+		ExpiresAt:     notice.ExpiresAt,
+	}
+}
+
+// LogNotifier writes re-authentication notices to the log
+type LogNotifier struct{}
+
+// NotifyReauthRequired writes a re-authentication notice to the log
+func (LogNotifier) NotifyReauthRequired(_ context.Context, notice models.ReauthNotice) error {
+	event, err := json.Marshal(newReauthEvent(notice))
+	if err != nil {
+		return err
+	}
+	log.Printf("NOTICE %s\n", event)
+	return nil
+}
+
+// WebhookNotifier posts re-authentication notices as JSON to a webhook, it uses http.DefaultClient when Client is nil
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NotifyReauthRequired posts a re-authentication notice to the webhook
+func (w *WebhookNotifier) NotifyReauthRequired(ctx context.Context, notice models.ReauthNotice) error {
+	event, err := json.Marshal(newReauthEvent(notice))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with status %d", w.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	expiresAt := time.Unix(time.Now().Unix()+3600, 0).UTC()
+	received := make(chan reauthEvent, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event reauthEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	notifier := WebhookNotifier{URL: srv.URL}
+	err := notifier.NotifyReauthRequired(context.Background(), models.ReauthNotice{
+		UserID:        "jane",
+		SessionHandle: models.SessionHandle("12345"),
+		TokenID:       "6789",
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-received
+	if event.UserID != "jane" || event.SessionHandle != models.SessionHandle("12345") || event.TokenID != "6789" ||
+		!event.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("The webhook received the wrong notice, got %+v\n", event)
+	}
+}
+
+func TestWebhookNotifierFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	notifier := WebhookNotifier{URL: srv.URL}
+	err := notifier.NotifyReauthRequired(context.Background(), models.ReauthNotice{UserID: "jane"})
+	if err == nil {
+		t.Errorf("A failing webhook did NOT return an error\n")
+	}
+}
@@ -0,0 +1,168 @@
+// Package oidcprovider logs the users in at an OpenID Connect provider with the authorization code flow
+package oidcprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// tokenResponse is the response of the token endpoint to an authorization code
+type tokenResponse struct {
+	AccessToken           string `json:"access_token"`
+	ExpiresIn             int64  `json:"expires_in"`
+	RefreshToken          string `json:"refresh_token"`
+	RefreshTokenExpiresIn int64  `json:"refresh_expires_in"`
+	Scope                 string `json:"scope"`
+	IDToken               string `json:"id_token"`
+}
+
+// idTokenClaims are the claims of the ID token the gateway reads, the audience is either a string or a list
+type idTokenClaims struct {
+	Subject           string          `json:"sub"`
+	PreferredUsername string          `json:"preferred_username"`
+	SessionID         string          `json:"sid"`
+	Audience          json.RawMessage `json:"aud"`
+}
+
+// Provider sends the users to the authorization endpoint of the provider and exchanges the authorization codes of
+// the callbacks for tokens with the oauth client of the gateway, it uses http.DefaultClient when Client is nil
+type Provider struct {
+	// ID is the provider of the tokens, see models.AccessToken
+	ID               string
+	AuthorizationURL string
+	TokenURL         string
+	ClientID         string
+	ClientSecret     string
+	// RedirectURL is the address of the callback of the gateway that receives the authorization codes
+	RedirectURL string
+	Scopes      []string
+	Client      *http.Client
+}
+
+// AuthCodeURL returns the address of the authorization endpoint the browser is redirected to, the provider passes
+// state back to the callback
+func (p *Provider) AuthCodeURL(state string) string {
+	params := url.Values{}
+	params.Add("response_type", "code")
+	params.Add("client_id", p.ClientID)
+	params.Add("redirect_uri", p.RedirectURL)
+	params.Add("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	params.Add("state", state)
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationURL, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationURL + separator + params.Encode()
+}
+
+// Exchange trades an authorization code for the tokens of the user and reads the user from the ID token
+func (p *Provider) Exchange(ctx context.Context, code string) (models.LoginGrant, error) {
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	params.Add("redirect_uri", p.RedirectURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return models.LoginGrant{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return models.LoginGrant{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return models.LoginGrant{}, fmt.Errorf("token request to %s failed with status %d", p.TokenURL, resp.StatusCode)
+	}
+	token := tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return models.LoginGrant{}, err
+	}
+	if token.AccessToken == "" {
+		return models.LoginGrant{}, fmt.Errorf("the token response of %s has no access token", p.TokenURL)
+	}
+	claims, err := p.readIDToken(token.IDToken)
+	if err != nil {
+		return models.LoginGrant{}, err
+	}
+
+	now := time.Now()
+	grant := models.LoginGrant{
+		AccessToken: models.AccessToken{
+			Value:    token.AccessToken,
+			URL:      p.TokenURL,
+			Provider: p.ID,
+			Subject:  claims.Subject,
+			Scopes:   strings.Fields(token.Scope),
+			IssuedAt: now,
+		},
+		RefreshToken: models.RefreshToken{Value: token.RefreshToken},
+		UserID:       claims.Subject,
+		Username:     claims.PreferredUsername,
+		IDPSessionID: claims.SessionID,
+	}
+	if token.ExpiresIn > 0 {
+		grant.AccessToken.ExpiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	// The refresh tokens of GitLab do not expire, like the token refresher they are stored without an expiration
+	grant.RefreshToken.ExpiresAt = time.Unix(0, 0)
+	if token.RefreshTokenExpiresIn > 0 {
+		grant.RefreshToken.ExpiresAt = now.Add(time.Duration(token.RefreshTokenExpiresIn) * time.Second)
+	}
+	return grant, nil
+}
+
+// readIDToken reads the claims of the ID token of a token response. The signature is not checked: the token comes
+// straight from the token endpoint over TLS, which authenticates the provider
+// (see https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation).
+func (p *Provider) readIDToken(idToken string) (idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, fmt.Errorf("the token response of %s has no valid ID token", p.TokenURL)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("decoding the ID token failed: %w", err)
+	}
+	claims := idTokenClaims{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("decoding the ID token failed: %w", err)
+	}
+	if claims.Subject == "" {
+		return idTokenClaims{}, fmt.Errorf("the ID token has no subject")
+	}
+
+	audience := []string{}
+	var single string
+	if json.Unmarshal(claims.Audience, &single) == nil {
+		audience = append(audience, single)
+	} else if json.Unmarshal(claims.Audience, &audience) != nil {
+		return idTokenClaims{}, fmt.Errorf("the audience of the ID token is not valid")
+	}
+	for _, client := range audience {
+		if client == p.ClientID {
+			return claims, nil
+		}
+	}
+	return idTokenClaims{}, fmt.Errorf("the ID token is not issued to the client %s", p.ClientID)
+}
@@ -0,0 +1,120 @@
+package oidcprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newIDToken(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func newTokenServer(t *testing.T, idToken string, received chan url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- r.PostForm
+		if r.PostForm.Get("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":       "access",
+			"expires_in":         300,
+			"refresh_token":      "refresh",
+			"refresh_expires_in": 3600,
+			"scope":              "openid profile",
+			"id_token":           idToken,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	provider := Provider{
+		AuthorizationURL: "https://renku.example.org/auth?kc_idp_hint=gitlab",
+		ClientID:         "gateway",
+		RedirectURL:      "https://renku.example.org/api/auth/token",
+		Scopes:           []string{"profile"},
+	}
+	got, err := url.Parse(provider.AuthCodeURL("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := got.Query()
+	if got.Host != "renku.example.org" || query.Get("kc_idp_hint") != "gitlab" || query.Get("state") != "state" ||
+		query.Get("client_id") != "gateway" || query.Get("scope") != "openid profile" ||
+		query.Get("response_type") != "code" || query.Get("redirect_uri") != provider.RedirectURL {
+		t.Errorf("The authorization URL is NOT correct, got %v\n", got)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	received := make(chan url.Values, 2)
+	idToken := newIDToken(t, map[string]interface{}{
+		"sub":                "jane-id",
+		"preferred_username": "jane",
+		"sid":                "idp-session",
+		"aud":                []string{"gateway", "renku"},
+	})
+	srv := newTokenServer(t, idToken, received)
+	defer srv.Close()
+
+	provider := Provider{ID: "renku", TokenURL: srv.URL + "/token", ClientID: "gateway", ClientSecret: "secret"}
+	grant, err := provider.Exchange(context.Background(), "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := <-received
+	if form.Get("grant_type") != "authorization_code" || form.Get("client_secret") != "secret" {
+		t.Errorf("The token request is NOT correct, got %v\n", form)
+	}
+	if grant.UserID != "jane-id" || grant.Username != "jane" || grant.IDPSessionID != "idp-session" {
+		t.Errorf("The user of the grant is NOT correct, got %+v\n", grant)
+	}
+	if grant.AccessToken.Value != "access" || grant.AccessToken.URL != provider.TokenURL ||
+		grant.AccessToken.Provider != "renku" || len(grant.AccessToken.Scopes) != 2 ||
+		time.Until(grant.AccessToken.ExpiresAt) > 5*time.Minute {
+		t.Errorf("The access token of the grant is NOT correct, got %+v\n", grant.AccessToken)
+	}
+	if grant.RefreshToken.Value != "refresh" || time.Until(grant.RefreshToken.ExpiresAt) < 59*time.Minute {
+		t.Errorf("The refresh token of the grant is NOT correct, got %+v\n", grant.RefreshToken)
+	}
+
+	_, err = provider.Exchange(context.Background(), "unknown")
+	if err == nil {
+		t.Errorf("A refused code was NOT reported\n")
+	}
+}
+
+func TestExchangeOtherAudience(t *testing.T) {
+	received := make(chan url.Values, 1)
+	srv := newTokenServer(t, newIDToken(t, map[string]interface{}{"sub": "jane-id", "aud": "other"}), received)
+	defer srv.Close()
+
+	provider := Provider{TokenURL: srv.URL + "/token", ClientID: "gateway"}
+	_, err := provider.Exchange(context.Background(), "code")
+	if err == nil {
+		t.Errorf("An ID token issued to another client was NOT refused\n")
+	}
+}
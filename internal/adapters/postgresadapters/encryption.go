@@ -0,0 +1,191 @@
+package postgresadapters
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+)
+
+// maxReencryptAttempts is how many times the re-encryption of a value is attempted when it is written concurrently
+const maxReencryptAttempts = 5
+
+// encryptedColumn is a table column holding encrypted values and the associated data binding them to their row
+type encryptedColumn struct {
+	table          string
+	idColumn       string
+	column         string
+	associatedData func(id string) string
+}
+
+// encryptedColumns are the columns holding encrypted values, the IDs are compared as text so that project IDs and
+// token IDs can be paged through the same way
+var encryptedColumns = []encryptedColumn{
+	{table: "access_tokens", idColumn: "id", column: "value", associatedData: encryption.AccessTokenAssociatedData},
+	{table: "refresh_tokens", idColumn: "id", column: "value", associatedData: encryption.RefreshTokenAssociatedData},
+	{
+		table:          "project_webhook_secrets",
+		idColumn:       "project_id",
+		column:         "secret",
+		associatedData: encryption.WebhookSecretAssociatedData,
+	},
+}
+
+func encryptValue(encryptor encryption.ValueEncryptor, value string, associatedData string) (string, error) {
+	if encryptor == nil {
+		return value, nil
+	}
+	return encryptor.Encrypt(value, associatedData)
+}
+
+func (p *PostgresAdapter) decryptValue(value string, associatedData string) (string, error) {
+	if p.Encryptor == nil {
+		return value, nil
+	}
+	return p.Encryptor.Decrypt(value, associatedData)
+}
+
+// ReencryptTokens encrypts every access and refresh token value and every webhook secret that is not encrypted with
+// the active key again, plaintext values included. It reads the rows in batches of batchSize and calls progress after
+// every batch with the number of values scanned and rewritten so far. A value is only rewritten if it did not change
+// since it was read so that a concurrent refresh is never overwritten, which makes it safe to run while the gateway
+// is serving users.
+func (p *PostgresAdapter) ReencryptTokens(
+	ctx context.Context,
+	batchSize int64,
+	progress func(scanned int, rewritten int),
+) (int, error) {
+	if p.Encryptor == nil {
+		return 0, fmt.Errorf("no encryptor is configured")
+	}
+
+	scanned, rewritten := 0, 0
+	for _, column := range encryptedColumns {
+		lastID := ""
+		for {
+			values, ids, err := p.readEncryptedColumn(ctx, column, lastID, batchSize)
+			if err != nil {
+				return rewritten, err
+			}
+			for i, id := range ids {
+				scanned++
+				changed, err := p.reencryptValue(ctx, column, id, values[i])
+				if err != nil {
+					return rewritten, err
+				}
+				if changed {
+					rewritten++
+				}
+			}
+			if progress != nil {
+				progress(scanned, rewritten)
+			}
+			if int64(len(ids)) < batchSize {
+				break
+			}
+			lastID = ids[len(ids)-1]
+		}
+	}
+	return rewritten, nil
+}
+
+// readEncryptedColumn reads a batch of the values of an encrypted column ordered by the text of their ID, starting
+// after afterID
+func (p *PostgresAdapter) readEncryptedColumn(
+	ctx context.Context,
+	column encryptedColumn,
+	afterID string,
+	batchSize int64,
+) ([]string, []string, error) {
+	rows, err := p.DB.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT %[1]s::text, %[2]s FROM %[3]s WHERE %[2]s IS NOT NULL AND %[1]s::text COLLATE "C" > $1
+			ORDER BY %[1]s::text COLLATE "C" LIMIT $2`,
+			column.idColumn,
+			column.column,
+			column.table,
+		),
+		afterID,
+		batchSize,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var values, ids []string
+	for rows.Next() {
+		var id, value string
+		err = rows.Scan(&id, &value)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		values = append(values, value)
+	}
+	return values, ids, rows.Err()
+}
+
+// reencryptValue encrypts a value of an encrypted column with the active key if needed. A concurrent write of the
+// row makes the update miss, the new value is then read and re-encrypted since it can also use an old key.
+func (p *PostgresAdapter) reencryptValue(
+	ctx context.Context,
+	column encryptedColumn,
+	id string,
+	value string,
+) (bool, error) {
+	associatedData := column.associatedData(id)
+	for attempt := 0; attempt < maxReencryptAttempts; attempt++ {
+		if p.Encryptor.IsCurrent(value) {
+			return false, nil
+		}
+		plaintext, err := p.Encryptor.Decrypt(value, associatedData)
+		if err != nil {
+			return false, err
+		}
+		ciphertext, err := p.Encryptor.Encrypt(plaintext, associatedData)
+		if err != nil {
+			return false, err
+		}
+
+		result, err := p.DB.ExecContext(
+			ctx,
+			fmt.Sprintf(
+				"UPDATE %[3]s SET %[2]s = $1 WHERE %[1]s::text = $2 AND %[2]s = $3",
+				column.idColumn,
+				column.column,
+				column.table,
+			),
+			ciphertext,
+			id,
+			value,
+		)
+		if err != nil {
+			return false, err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil || updated > 0 {
+			return err == nil, err
+		}
+
+		log.Printf("Value %s of %s changed during re-encryption, retrying\n", id, column.table)
+		var current sql.NullString
+		err = p.DB.QueryRowContext(
+			ctx,
+			fmt.Sprintf("SELECT %[2]s FROM %[3]s WHERE %[1]s::text = $1", column.idColumn, column.column, column.table),
+			id,
+		).Scan(&current)
+		// A removed row or a deactivated webhook has nothing left to re-encrypt
+		if err == sql.ErrNoRows || (err == nil && !current.Valid) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		value = current.String
+	}
+	return false, fmt.Errorf("value %s of %s kept changing during re-encryption", id, column.table)
+}
@@ -0,0 +1,140 @@
+package postgresadapters
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// DummyEncryptor "encrypts" values by prefixing them with its key ID and the associated data
+type DummyEncryptor struct {
+	keyID string
+}
+
+func (d *DummyEncryptor) Encrypt(plaintext string, associatedData string) (string, error) {
+	return d.keyID + "|" + associatedData + "|" + plaintext, nil
+}
+func (d *DummyEncryptor) Decrypt(value string, associatedData string) (string, error) {
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 || parts[1] != associatedData {
+		return value, nil
+	}
+	return parts[2], nil
+}
+func (d *DummyEncryptor) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, d.keyID+"|")
+}
+
+func TestConformanceWithEncryption(t *testing.T) {
+	testDSN(t)
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		adapter := newTestAdapter(t)
+		adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+		return adapter
+	})
+}
+
+// storedValue reads a value as it is stored in the database
+func storedValue(t *testing.T, adapter *PostgresAdapter, query string, id interface{}) string {
+	var value string
+	err := adapter.DB.QueryRowContext(context.Background(), query, id).Scan(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestTokenValuesAreEncrypted(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t)
+	adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+
+	err := adapter.SetAccessToken(ctx, models.AccessToken{ID: "12345", Value: "6789", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "12345", Value: "abcd", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetProjectWebhookSecret(ctx, 42, "efgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query string
+		id    interface{}
+		want  string
+	}{
+		{"SELECT value FROM access_tokens WHERE id = $1", "12345", "key1|accessToken:12345|6789"},
+		{"SELECT value FROM refresh_tokens WHERE id = $1", "12345", "key1|refreshToken:12345|abcd"},
+		{"SELECT secret FROM project_webhook_secrets WHERE project_id = $1", 42, "key1|webhookSecret:42|efgh"},
+	} {
+		if stored := storedValue(t, adapter, tt.query, tt.id); stored != tt.want {
+			t.Errorf("The stored value is NOT encrypted, got %v want %v\n", stored, tt.want)
+		}
+	}
+
+	accessToken, err := adapter.GetAccessToken(ctx, "12345")
+	if err != nil || accessToken.Value != "6789" {
+		t.Errorf("The access token was NOT decrypted, got %v, %v\n", accessToken.Value, err)
+	}
+	refreshToken, err := adapter.GetRefreshToken(ctx, "12345")
+	if err != nil || refreshToken.Value != "abcd" {
+		t.Errorf("The refresh token was NOT decrypted, got %v, %v\n", refreshToken.Value, err)
+	}
+	secret, err := adapter.GetProjectWebhookSecret(ctx, 42)
+	if err != nil || secret != "efgh" {
+		t.Errorf("The webhook secret was NOT decrypted, got %v, %v\n", secret, err)
+	}
+}
+
+func TestReencryptTokens(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t)
+
+	// Plaintext values written before encryption was enabled are encrypted too
+	for _, id := range []string{"a", "b", "c"} {
+		err := adapter.SetAccessToken(ctx, models.AccessToken{ID: id, Value: id + "-access", ExpiresAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+	err := adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "a", Value: "a-refresh", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.SetProjectWebhookSecret(ctx, 42, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter.Encryptor = &DummyEncryptor{keyID: "key2"}
+	rewritten, err := adapter.ReencryptTokens(ctx, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != 5 {
+		t.Errorf("The number of re-encrypted values is NOT correct, got %v want %v\n", rewritten, 5)
+	}
+	stored := storedValue(t, adapter, "SELECT value FROM access_tokens WHERE id = $1", "c")
+	if stored != "key2|accessToken:c|c-access" {
+		t.Errorf("The access token is NOT encrypted with the active key, got %v\n", stored)
+	}
+	secret, err := adapter.GetProjectWebhookSecret(ctx, 42)
+	if err != nil || secret != "secret" {
+		t.Errorf("The webhook secret was NOT decrypted, got %v, %v\n", secret, err)
+	}
+
+	rewritten, err = adapter.ReencryptTokens(ctx, 2, nil)
+	if err != nil || rewritten != 0 {
+		t.Errorf("Values encrypted with the active key were rewritten, got %v, %v\n", rewritten, err)
+	}
+}
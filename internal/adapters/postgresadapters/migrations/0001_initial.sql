@@ -0,0 +1,54 @@
+-- Expirations are stored as Unix seconds like in Redis, 0 means that there is no expiration
+
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    expires_at BIGINT NOT NULL,
+    token_ids JSONB NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at) WHERE expires_at > 0;
+
+CREATE TABLE token_sessions (
+    token_id TEXT PRIMARY KEY,
+    session_id TEXT NOT NULL
+);
+
+CREATE INDEX token_sessions_session_id_idx ON token_sessions (session_id);
+
+CREATE TABLE access_tokens (
+    id TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    expires_at BIGINT NOT NULL,
+    url TEXT NOT NULL,
+    type TEXT NOT NULL,
+    -- Refresh workers claim a token until this time so that it is refreshed only once
+    claimed_until BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX access_tokens_expires_at_idx ON access_tokens (expires_at, id);
+
+CREATE TABLE refresh_tokens (
+    id TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    expires_at BIGINT NOT NULL
+);
+
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at, id) WHERE expires_at > 0;
+
+CREATE TABLE refresh_token_history (
+    id BIGSERIAL PRIMARY KEY,
+    token_id TEXT NOT NULL,
+    value_hash TEXT NOT NULL
+);
+
+CREATE INDEX refresh_token_history_token_id_idx ON refresh_token_history (token_id, id);
+
+CREATE TABLE project_tokens (
+    project_id INTEGER NOT NULL,
+    token_id TEXT NOT NULL,
+    expires_at BIGINT NOT NULL,
+    PRIMARY KEY (project_id, token_id)
+);
+
+CREATE INDEX project_tokens_expires_at_idx ON project_tokens (project_id, expires_at, token_id);
@@ -0,0 +1,6 @@
+-- The secrets of the GitLab webhooks of the projects tracked by the knowledge graph
+
+CREATE TABLE project_webhook_secrets (
+    project_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL
+);
@@ -0,0 +1,3 @@
+-- The secret of a project deactivated for the knowledge graph is NULL until its GitLab webhook is removed
+
+ALTER TABLE project_webhook_secrets ALTER COLUMN secret DROP NOT NULL;
@@ -0,0 +1,9 @@
+-- The tokens written before the claims were stored have no provider, subject, scopes or audience and an issued_at of
+-- 0, which means that the issue time is not known
+
+ALTER TABLE access_tokens
+    ADD COLUMN provider TEXT NOT NULL DEFAULT '',
+    ADD COLUMN subject TEXT NOT NULL DEFAULT '',
+    ADD COLUMN scopes JSONB NOT NULL DEFAULT 'null',
+    ADD COLUMN audience JSONB NOT NULL DEFAULT 'null',
+    ADD COLUMN issued_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,12 @@
+-- The sessions created before the metadata was stored have empty values and created_at and last_seen_at of 0, which
+-- means that the time is not known
+
+ALTER TABLE sessions
+    ADD COLUMN user_id TEXT NOT NULL DEFAULT '',
+    ADD COLUMN username TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN last_seen_at BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN login_method TEXT NOT NULL DEFAULT '',
+    ADD COLUMN client_ip TEXT NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN idp_session_id TEXT NOT NULL DEFAULT '';
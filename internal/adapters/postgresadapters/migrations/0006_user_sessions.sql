@@ -0,0 +1,3 @@
+-- Sessions are listed per user, the sessions created before the user was stored have an empty user ID
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id, expires_at, id) WHERE user_id <> '';
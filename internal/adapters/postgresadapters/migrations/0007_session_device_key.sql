@@ -0,0 +1,4 @@
+-- Sessions created before the device binding are not bound to a device
+
+ALTER TABLE sessions
+    ADD COLUMN device_key_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- The gateways claim the re-authentication notice of a refresh token expiration so that it is sent only once, the
+-- claims are removed by the expiry sweep once the expiration has passed
+
+CREATE TABLE reauth_notices (
+    token_id TEXT PRIMARY KEY,
+    expires_at BIGINT NOT NULL
+);
+
+CREATE INDEX reauth_notices_expires_at_idx ON reauth_notices (expires_at);
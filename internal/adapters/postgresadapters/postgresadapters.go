@@ -0,0 +1,954 @@
+// Package postgresadapters contains functions for storing sessions and tokens in PostgreSQL
+package postgresadapters
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	"github.com/lib/pq"
+)
+
+var _ repository.Repository = (*PostgresAdapter)(nil)
+
+// defaultSweepInterval is the interval of RunExpirySweep when none is given
+const defaultSweepInterval = time.Minute
+
+// expiringTokensChannel is the channel on which the expiration of every access token written is notified
+const expiringTokensChannel = "expiring_tokens_updates"
+
+// PostgresAdapter stores sessions and tokens in PostgreSQL. Like in Redis, expirations are stored with a precision of
+// one second and expired sessions are never returned. Token values and webhook secrets are encrypted when an
+// Encryptor is set.
+type PostgresAdapter struct {
+	DB        *sql.DB
+	Encryptor encryption.ValueEncryptor
+	dsn       string
+}
+
+// NewPostgresAdapter connects to the database at dsn and applies the pending schema migrations
+func NewPostgresAdapter(ctx context.Context, dsn string) (*PostgresAdapter, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.PingContext(ctx)
+	if err == nil {
+		err = Migrate(ctx, db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresAdapter{DB: db, dsn: dsn}, nil
+}
+
+// Close closes the connections to the database
+func (p *PostgresAdapter) Close() error {
+	return p.DB.Close()
+}
+
+// querier runs statements on the database or within a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// postgresWriter is the repository.Writer of a transaction
+type postgresWriter struct {
+	q         querier
+	encryptor encryption.ValueEncryptor
+}
+
+// writer returns the repository.Writer that runs its statements with q
+func (p *PostgresAdapter) writer(q querier) *postgresWriter {
+	return &postgresWriter{q: q, encryptor: p.Encryptor}
+}
+
+// Update runs fn in a single transaction that is rolled back if fn fails, the subscribers are notified of the access
+// tokens written once it is committed
+func (p *PostgresAdapter) Update(ctx context.Context, fn func(tx repository.Writer) error) error {
+	return p.inTx(ctx, func(w *postgresWriter) error {
+		return fn(w)
+	})
+}
+
+// inTx runs fn in a transaction that is committed if fn succeeds
+func (p *PostgresAdapter) inTx(ctx context.Context, fn func(w *postgresWriter) error) error {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(p.writer(tx))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Set/write functions
+
+// SetSession writes a session and the session of its tokens
+func (p *PostgresAdapter) SetSession(ctx context.Context, session models.Session) error {
+	return p.inTx(ctx, func(w *postgresWriter) error {
+		return w.SetSession(ctx, session)
+	})
+}
+
+// SetAccessToken writes an access token, which also adds it to the expiring tokens index, and notifies the
+// subscribers of its expiration
+func (p *PostgresAdapter) SetAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+	return p.inTx(ctx, func(w *postgresWriter) error {
+		return w.SetAccessToken(ctx, accessToken)
+	})
+}
+
+// SetRefreshToken writes a refresh token, refresh tokens that expire are part of the expiring refresh tokens index
+func (p *PostgresAdapter) SetRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+	return p.writer(p.DB).SetRefreshToken(ctx, refreshToken)
+}
+
+// AddSupersededRefreshToken adds a hash of a refresh token value that was replaced by a rotation to the history of
+// its token ID, only the latest values are kept
+func (p *PostgresAdapter) AddSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+	return p.inTx(ctx, func(w *postgresWriter) error {
+		return w.AddSupersededRefreshToken(ctx, refreshToken)
+	})
+}
+
+// SetProjectToken adds a token ID to the tokens of a project
+func (p *PostgresAdapter) SetProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+	return p.writer(p.DB).SetProjectToken(ctx, projectID, accessToken)
+}
+
+// SetProjectWebhookSecret writes the secret of the GitLab webhook of a project
+func (p *PostgresAdapter) SetProjectWebhookSecret(ctx context.Context, projectID int, secret string) error {
+	return p.writer(p.DB).SetProjectWebhookSecret(ctx, projectID, secret)
+}
+
+// Remove/delete functions
+
+// RemoveSession removes a session and the session of its tokens
+func (p *PostgresAdapter) RemoveSession(ctx context.Context, sessionID string) error {
+	return p.inTx(ctx, func(w *postgresWriter) error {
+		return w.RemoveSession(ctx, sessionID)
+	})
+}
+
+// RemoveAccessToken removes an access token, which also removes it from the expiring tokens index
+func (p *PostgresAdapter) RemoveAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+	return p.writer(p.DB).RemoveAccessToken(ctx, accessToken)
+}
+
+// RemoveRefreshToken removes a refresh token, which also removes it from the expiring refresh tokens index
+func (p *PostgresAdapter) RemoveRefreshToken(ctx context.Context, refreshTokenID string) error {
+	return p.writer(p.DB).RemoveRefreshToken(ctx, refreshTokenID)
+}
+
+// RemoveSupersededRefreshTokens removes the refresh token history of a token ID
+func (p *PostgresAdapter) RemoveSupersededRefreshTokens(ctx context.Context, refreshTokenID string) error {
+	return p.writer(p.DB).RemoveSupersededRefreshTokens(ctx, refreshTokenID)
+}
+
+// RemoveProjectToken removes a token ID from the tokens of a project
+func (p *PostgresAdapter) RemoveProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+	return p.writer(p.DB).RemoveProjectToken(ctx, projectID, accessToken)
+}
+
+// DeactivateProjectWebhook removes the secret of the GitLab webhook of a project and keeps the project as inactive
+func (p *PostgresAdapter) DeactivateProjectWebhook(ctx context.Context, projectID int) error {
+	return p.writer(p.DB).DeactivateProjectWebhook(ctx, projectID)
+}
+
+// RemoveProjectWebhookSecret removes the secret of the GitLab webhook of a project
+func (p *PostgresAdapter) RemoveProjectWebhookSecret(ctx context.Context, projectID int) error {
+	return p.writer(p.DB).RemoveProjectWebhookSecret(ctx, projectID)
+}
+
+// RemoveExpiredSessions removes the sessions that have expired and the session of their tokens, it returns the
+// number of sessions removed
+func (p *PostgresAdapter) RemoveExpiredSessions(ctx context.Context) (int64, error) {
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM token_sessions WHERE session_id IN (
+			SELECT id FROM sessions WHERE expires_at > 0 AND expires_at <= $1
+		)`,
+		now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at > 0 AND expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, tx.Commit()
+}
+
+// RemoveExpiredReauthNotices removes the re-authentication notice claims of the expirations that have passed
+func (p *PostgresAdapter) RemoveExpiredReauthNotices(ctx context.Context) (int64, error) {
+	result, err := p.DB.ExecContext(ctx, "DELETE FROM reauth_notices WHERE expires_at <= $1", time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RunExpirySweep removes the expired sessions and re-authentication notice claims at every interval until the
+// context is done, expired sessions are never returned even without the sweep
+func (p *PostgresAdapter) RunExpirySweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := p.RemoveExpiredSessions(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("RemoveExpiredSessions failed: %s\n", err)
+			}
+			_, err = p.RemoveExpiredReauthNotices(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("RemoveExpiredReauthNotices failed: %s\n", err)
+			}
+		}
+	}
+}
+
+// Get functions
+
+// GetSession reads a session, it returns models.ErrNotFound if the session does not exist or has expired
+func (p *PostgresAdapter) GetSession(ctx context.Context, sessionID string) (models.Session, error) {
+
+	session := models.Session{ID: sessionID}
+	var expiresAt, createdAt, lastSeenAt int64
+	var tokenIDs []byte
+	err := p.DB.QueryRowContext(
+		ctx,
+		`SELECT type, expires_at, token_ids, user_id, username, created_at, last_seen_at, login_method, client_ip,
+		user_agent, idp_session_id, device_key_hash
+		FROM sessions WHERE id = $1 AND (expires_at <= 0 OR expires_at > $2)`,
+		sessionID,
+		time.Now().Unix(),
+	).Scan(
+		&session.Type,
+		&expiresAt,
+		&tokenIDs,
+		&session.UserID,
+		&session.Username,
+		&createdAt,
+		&lastSeenAt,
+		&session.LoginMethod,
+		&session.ClientIP,
+		&session.UserAgent,
+		&session.IDPSessionID,
+		&session.DeviceKeyHash,
+	)
+	if err == sql.ErrNoRows {
+		return models.Session{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	session.CreatedAt = models.TimeOrZero(createdAt)
+	session.LastSeenAt = models.TimeOrZero(lastSeenAt)
+	err = json.Unmarshal(tokenIDs, &session.TokenIDs)
+	return session, err
+}
+
+// GetAccessToken reads an access token, it returns models.ErrNotFound if the token does not exist
+func (p *PostgresAdapter) GetAccessToken(ctx context.Context, tokenID string) (models.AccessToken, error) {
+
+	accessToken := models.AccessToken{ID: tokenID}
+	var expiresAt, issuedAt int64
+	var scopes, audience []byte
+	err := p.DB.QueryRowContext(
+		ctx,
+		`SELECT value, expires_at, url, type, provider, subject, scopes, audience, issued_at
+		FROM access_tokens WHERE id = $1`,
+		tokenID,
+	).Scan(
+		&accessToken.Value,
+		&expiresAt,
+		&accessToken.URL,
+		&accessToken.Type,
+		&accessToken.Provider,
+		&accessToken.Subject,
+		&scopes,
+		&audience,
+		&issuedAt,
+	)
+	if err == sql.ErrNoRows {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	err = json.Unmarshal(scopes, &accessToken.Scopes)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	err = json.Unmarshal(audience, &accessToken.Audience)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	accessToken.Value, err = p.decryptValue(accessToken.Value, encryption.AccessTokenAssociatedData(tokenID))
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	accessToken.ExpiresAt = time.Unix(expiresAt, 0)
+	accessToken.IssuedAt = models.TimeOrZero(issuedAt)
+	return accessToken, nil
+}
+
+// GetRefreshToken reads a refresh token, it returns models.ErrNotFound if the token does not exist
+func (p *PostgresAdapter) GetRefreshToken(ctx context.Context, tokenID string) (models.RefreshToken, error) {
+
+	refreshToken := models.RefreshToken{ID: tokenID}
+	var expiresAt int64
+	err := p.DB.QueryRowContext(
+		ctx,
+		"SELECT value, expires_at FROM refresh_tokens WHERE id = $1",
+		tokenID,
+	).Scan(&refreshToken.Value, &expiresAt)
+	if err == sql.ErrNoRows {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	refreshToken.Value, err = p.decryptValue(refreshToken.Value, encryption.RefreshTokenAssociatedData(tokenID))
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	refreshToken.ExpiresAt = time.Unix(expiresAt, 0)
+	return refreshToken, nil
+}
+
+// IsSupersededRefreshToken checks whether a refresh token value is in the refresh token history of its token ID
+func (p *PostgresAdapter) IsSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) (bool, error) {
+
+	var superseded bool
+	err := p.DB.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM refresh_token_history WHERE token_id = $1 AND value_hash = $2)",
+		refreshToken.ID,
+		repository.HashTokenValue(refreshToken.Value),
+	).Scan(&superseded)
+
+	return superseded, err
+}
+
+// TouchSession sets the last seen time of a session that has not expired and extends its expiration
+func (p *PostgresAdapter) TouchSession(
+	ctx context.Context,
+	sessionID string,
+	lastSeenAt time.Time,
+	expiresAt time.Time,
+) (bool, error) {
+	result, err := p.DB.ExecContext(
+		ctx,
+		`UPDATE sessions SET last_seen_at = $2,
+		expires_at = CASE WHEN $3::BIGINT > 0 THEN $3::BIGINT ELSE expires_at END
+		WHERE id = $1 AND (expires_at = 0 OR expires_at > $4)`,
+		sessionID,
+		lastSeenAt.Unix(),
+		models.UnixOrZero(expiresAt),
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	touched, err := result.RowsAffected()
+	return touched > 0, err
+}
+
+// ClaimReauthNotice claims the re-authentication notice of a refresh token expiration, a claim of an earlier
+// expiration of the token is replaced
+func (p *PostgresAdapter) ClaimReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	result, err := p.DB.ExecContext(
+		ctx,
+		`INSERT INTO reauth_notices (token_id, expires_at) VALUES ($1, $2)
+		ON CONFLICT (token_id) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE reauth_notices.expires_at <> EXCLUDED.expires_at`,
+		tokenID,
+		expiresAt.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+// ReleaseReauthNotice removes the claim of the re-authentication notice of a refresh token expiration
+func (p *PostgresAdapter) ReleaseReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	_, err := p.DB.ExecContext(
+		ctx,
+		"DELETE FROM reauth_notices WHERE token_id = $1 AND expires_at = $2",
+		tokenID,
+		expiresAt.Unix(),
+	)
+	return err
+}
+
+// GetExpiringAccessTokenIDs reads the IDs of the access tokens expiring between startTime and stopTime
+func (p *PostgresAdapter) GetExpiringAccessTokenIDs(
+	ctx context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+
+	return p.queryIDs(
+		ctx,
+		"SELECT id FROM access_tokens WHERE expires_at BETWEEN $1 AND $2 ORDER BY expires_at, id",
+		startTime.Unix(),
+		stopTime.Unix(),
+	)
+}
+
+// ClaimExpiringAccessTokenIDs reads the IDs of the access tokens expiring between startTime and stopTime and claims
+// them for claimFor, tokens claimed by another worker are skipped until they are written again or the claim lapses.
+// This lets several gateway replicas refresh the same tokens without refreshing a token twice.
+func (p *PostgresAdapter) ClaimExpiringAccessTokenIDs(
+	ctx context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+	claimFor time.Duration,
+) ([]string, error) {
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT id FROM access_tokens
+		WHERE expires_at BETWEEN $1 AND $2 AND claimed_until <= $3
+		ORDER BY expires_at, id
+		FOR UPDATE SKIP LOCKED`,
+		startTime.Unix(),
+		stopTime.Unix(),
+		now.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil || len(ids) == 0 {
+		return ids, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE access_tokens SET claimed_until = $1 WHERE id = ANY($2)",
+		now.Add(claimFor).Unix(),
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit()
+}
+
+// GetExpiringRefreshTokenIDs reads the IDs of the refresh tokens expiring between startTime and stopTime
+func (p *PostgresAdapter) GetExpiringRefreshTokenIDs(
+	ctx context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+
+	return p.queryIDs(
+		ctx,
+		"SELECT id FROM refresh_tokens WHERE expires_at > 0 AND expires_at BETWEEN $1 AND $2 ORDER BY expires_at, id",
+		startTime.Unix(),
+		stopTime.Unix(),
+	)
+}
+
+// GetTokenSessionID reads the ID of the session a token belongs to, it returns an empty ID if the token does not
+// belong to a session
+func (p *PostgresAdapter) GetTokenSessionID(ctx context.Context, tokenID string) (string, error) {
+
+	var sessionID string
+	err := p.DB.QueryRowContext(
+		ctx,
+		"SELECT session_id FROM token_sessions WHERE token_id = $1",
+		tokenID,
+	).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return sessionID, err
+}
+
+// GetUserSessionIDs reads the IDs of the sessions of a user that have not expired, ordered by expiration, IDs are
+// compared byte by byte like in the other adapters
+func (p *PostgresAdapter) GetUserSessionIDs(ctx context.Context, userID string) ([]string, error) {
+
+	return p.queryIDs(
+		ctx,
+		`SELECT id FROM sessions WHERE user_id = $1 AND type <> $2 AND (expires_at <= 0 OR expires_at > $3)
+		ORDER BY expires_at <= 0, expires_at, id COLLATE "C"`,
+		userID,
+		models.SessionTypeAnonymous,
+		time.Now().Unix(),
+	)
+}
+
+// GetProjectTokens reads the token IDs of a project ordered by expiration
+func (p *PostgresAdapter) GetProjectTokens(ctx context.Context, projectID int) ([]string, error) {
+
+	return p.queryIDs(
+		ctx,
+		"SELECT token_id FROM project_tokens WHERE project_id = $1 ORDER BY expires_at, token_id",
+		projectID,
+	)
+}
+
+// ListProjectTokens reads a page of the tokens of a project with their expiration, IDs are compared byte by byte
+// like in the other adapters
+func (p *PostgresAdapter) ListProjectTokens(
+	ctx context.Context,
+	projectID int,
+	query models.ProjectTokenQuery,
+) (models.ProjectTokenPage, error) {
+
+	tokenRange, err := repository.NewProjectTokenRange(query)
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+
+	statement := "SELECT token_id, expires_at FROM project_tokens WHERE project_id = $1 AND expires_at BETWEEN $2 AND $3"
+	args := []interface{}{projectID, tokenRange.Min, tokenRange.Max}
+	if tokenRange.After != nil {
+		statement += ` AND (expires_at > $4 OR (expires_at = $4 AND token_id COLLATE "C" > $5))`
+		args = append(args, tokenRange.After.ExpiresAt.Unix(), tokenRange.After.ID)
+	}
+	args = append(args, tokenRange.Limit+1)
+	statement += ` ORDER BY expires_at, token_id COLLATE "C" LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := p.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+	defer rows.Close()
+
+	var tokens []models.ProjectToken
+	for rows.Next() {
+		var tokenID string
+		var expiresAt int64
+		err = rows.Scan(&tokenID, &expiresAt)
+		if err != nil {
+			return models.ProjectTokenPage{}, err
+		}
+		tokens = append(tokens, models.ProjectToken{ID: tokenID, ExpiresAt: time.Unix(expiresAt, 0)})
+	}
+	if err = rows.Err(); err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+	return tokenRange.Page(tokens), nil
+}
+
+// GetProjectWebhookSecret reads the secret of the GitLab webhook of a project
+func (p *PostgresAdapter) GetProjectWebhookSecret(ctx context.Context, projectID int) (string, error) {
+
+	var secret string
+	err := p.DB.QueryRowContext(
+		ctx,
+		"SELECT secret FROM project_webhook_secrets WHERE project_id = $1 AND secret IS NOT NULL",
+		projectID,
+	).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", models.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return p.decryptValue(secret, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+}
+
+// ListProjectWebhooks reads the projects with a webhook secret and the deactivated ones
+func (p *PostgresAdapter) ListProjectWebhooks(ctx context.Context) ([]models.ProjectWebhook, error) {
+
+	rows, err := p.DB.QueryContext(
+		ctx,
+		"SELECT project_id, secret IS NOT NULL FROM project_webhook_secrets ORDER BY project_id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.ProjectWebhook{}
+	for rows.Next() {
+		var webhook models.ProjectWebhook
+		err = rows.Scan(&webhook.ProjectID, &webhook.Active)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetEarliestAccessTokenExpiry reads the earliest access token expiration that is later than the given time, found
+// is false if there is no such expiration
+func (p *PostgresAdapter) GetEarliestAccessTokenExpiry(
+	ctx context.Context,
+	after time.Time,
+) (expiresAt time.Time, found bool, err error) {
+
+	var earliest sql.NullInt64
+	err = p.DB.QueryRowContext(
+		ctx,
+		"SELECT MIN(expires_at) FROM access_tokens WHERE expires_at > $1",
+		after.Unix(),
+	).Scan(&earliest)
+	if err != nil || !earliest.Valid {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(earliest.Int64, 0), true, nil
+}
+
+// SubscribeExpiringAccessTokens returns a channel that receives the expiration of every access token written, the
+// channel is closed when the context is done
+func (p *PostgresAdapter) SubscribeExpiringAccessTokens(ctx context.Context) (<-chan time.Time, error) {
+	listener := pq.NewListener(p.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Listening to expiring token updates failed: %s\n", err)
+		}
+	})
+	// Listen returns once the server confirmed the subscription so that no update is missed after returning
+	err := listener.Listen(expiringTokensChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	expirations := make(chan time.Time)
+	go func() {
+		defer close(expirations)
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// A nil notification is sent after a reconnection, updates may have been missed in between
+				if notification == nil {
+					continue
+				}
+				expiresAtInt64, err := strconv.ParseInt(notification.Extra, 10, 64)
+				if err != nil {
+					continue
+				}
+				select {
+				case expirations <- time.Unix(expiresAtInt64, 0):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return expirations, nil
+}
+
+// Writes within a transaction
+
+func (w *postgresWriter) SetSession(ctx context.Context, session models.Session) error {
+
+	tokenIDs, err := json.Marshal(session.TokenIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.q.ExecContext(
+		ctx,
+		`INSERT INTO sessions (id, type, expires_at, token_ids, user_id, username, created_at, last_seen_at,
+		login_method, client_ip, user_agent, idp_session_id, device_key_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (id) DO UPDATE SET type = $2, expires_at = $3, token_ids = $4, user_id = $5, username = $6,
+		created_at = $7, last_seen_at = $8, login_method = $9, client_ip = $10, user_agent = $11, idp_session_id = $12,
+		device_key_hash = $13`,
+		session.ID,
+		session.Type,
+		session.ExpiresAt.Unix(),
+		string(tokenIDs),
+		session.UserID,
+		session.Username,
+		models.UnixOrZero(session.CreatedAt),
+		models.UnixOrZero(session.LastSeenAt),
+		session.LoginMethod,
+		session.ClientIP,
+		session.UserAgent,
+		session.IDPSessionID,
+		session.DeviceKeyHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The tokens that no longer belong to the session must not resolve to it, a nil array would match no row
+	sessionTokenIDs := session.TokenIDs
+	if sessionTokenIDs == nil {
+		sessionTokenIDs = []string{}
+	}
+	_, err = w.q.ExecContext(
+		ctx,
+		"DELETE FROM token_sessions WHERE session_id = $1 AND token_id <> ALL($2)",
+		session.ID,
+		pq.Array(sessionTokenIDs),
+	)
+	if err != nil {
+		return err
+	}
+	for _, tokenID := range session.TokenIDs {
+		_, err = w.q.ExecContext(
+			ctx,
+			`INSERT INTO token_sessions (token_id, session_id) VALUES ($1, $2)
+			ON CONFLICT (token_id) DO UPDATE SET session_id = $2`,
+			tokenID,
+			session.ID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *postgresWriter) SetAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+
+	scopes, err := json.Marshal(accessToken.Scopes)
+	if err != nil {
+		return err
+	}
+	audience, err := json.Marshal(accessToken.Audience)
+	if err != nil {
+		return err
+	}
+	value, err := encryptValue(w.encryptor, accessToken.Value, encryption.AccessTokenAssociatedData(accessToken.ID))
+	if err != nil {
+		return err
+	}
+
+	// Writing a token releases the claim of the worker that refreshed it
+	_, err = w.q.ExecContext(
+		ctx,
+		`INSERT INTO access_tokens (id, value, expires_at, url, type, provider, subject, scopes, audience, issued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET value = $2, expires_at = $3, url = $4, type = $5, provider = $6, subject = $7,
+		scopes = $8, audience = $9, issued_at = $10, claimed_until = 0`,
+		accessToken.ID,
+		value,
+		accessToken.ExpiresAt.Unix(),
+		accessToken.URL,
+		accessToken.Type,
+		accessToken.Provider,
+		accessToken.Subject,
+		string(scopes),
+		string(audience),
+		models.UnixOrZero(accessToken.IssuedAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	// The notification is only delivered once the transaction is committed
+	_, err = w.q.ExecContext(
+		ctx,
+		"SELECT pg_notify($1, $2)",
+		expiringTokensChannel,
+		strconv.FormatInt(accessToken.ExpiresAt.Unix(), 10),
+	)
+	return err
+}
+
+func (w *postgresWriter) SetRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+
+	value, err := encryptValue(w.encryptor, refreshToken.Value, encryption.RefreshTokenAssociatedData(refreshToken.ID))
+	if err != nil {
+		return err
+	}
+	_, err = w.q.ExecContext(
+		ctx,
+		`INSERT INTO refresh_tokens (id, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET value = $2, expires_at = $3`,
+		refreshToken.ID,
+		value,
+		refreshToken.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+func (w *postgresWriter) AddSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+
+	_, err := w.q.ExecContext(
+		ctx,
+		"INSERT INTO refresh_token_history (token_id, value_hash) VALUES ($1, $2)",
+		refreshToken.ID,
+		repository.HashTokenValue(refreshToken.Value),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.q.ExecContext(
+		ctx,
+		`DELETE FROM refresh_token_history WHERE token_id = $1 AND id NOT IN (
+			SELECT id FROM refresh_token_history WHERE token_id = $1 ORDER BY id DESC LIMIT $2
+		)`,
+		refreshToken.ID,
+		repository.RefreshTokenHistoryLength,
+	)
+	return err
+}
+
+func (w *postgresWriter) SetProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+
+	_, err := w.q.ExecContext(
+		ctx,
+		`INSERT INTO project_tokens (project_id, token_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, token_id) DO UPDATE SET expires_at = $3`,
+		projectID,
+		accessToken.ID,
+		accessToken.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+func (w *postgresWriter) SetProjectWebhookSecret(ctx context.Context, projectID int, secret string) error {
+
+	value, err := encryptValue(w.encryptor, secret, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+	if err != nil {
+		return err
+	}
+	_, err = w.q.ExecContext(
+		ctx,
+		`INSERT INTO project_webhook_secrets (project_id, secret) VALUES ($1, $2)
+		ON CONFLICT (project_id) DO UPDATE SET secret = $2`,
+		projectID,
+		value,
+	)
+	return err
+}
+
+func (w *postgresWriter) RemoveSession(ctx context.Context, sessionID string) error {
+
+	_, err := w.q.ExecContext(ctx, "DELETE FROM token_sessions WHERE session_id = $1", sessionID)
+	if err != nil {
+		return err
+	}
+	_, err = w.q.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1", sessionID)
+	return err
+}
+
+func (w *postgresWriter) RemoveAccessToken(ctx context.Context, accessToken models.AccessToken) error {
+
+	_, err := w.q.ExecContext(ctx, "DELETE FROM access_tokens WHERE id = $1", accessToken.ID)
+	return err
+}
+
+func (w *postgresWriter) RemoveRefreshToken(ctx context.Context, refreshTokenID string) error {
+
+	_, err := w.q.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE id = $1", refreshTokenID)
+	return err
+}
+
+func (w *postgresWriter) RemoveSupersededRefreshTokens(ctx context.Context, refreshTokenID string) error {
+
+	_, err := w.q.ExecContext(ctx, "DELETE FROM refresh_token_history WHERE token_id = $1", refreshTokenID)
+	return err
+}
+
+func (w *postgresWriter) RemoveProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
+
+	_, err := w.q.ExecContext(
+		ctx,
+		"DELETE FROM project_tokens WHERE project_id = $1 AND token_id = $2",
+		projectID,
+		accessToken.ID,
+	)
+	return err
+}
+
+func (w *postgresWriter) DeactivateProjectWebhook(ctx context.Context, projectID int) error {
+
+	_, err := w.q.ExecContext(
+		ctx,
+		`INSERT INTO project_webhook_secrets (project_id, secret) VALUES ($1, NULL)
+		ON CONFLICT (project_id) DO UPDATE SET secret = NULL`,
+		projectID,
+	)
+	return err
+}
+
+func (w *postgresWriter) RemoveProjectWebhookSecret(ctx context.Context, projectID int) error {
+
+	_, err := w.q.ExecContext(ctx, "DELETE FROM project_webhook_secrets WHERE project_id = $1", projectID)
+	return err
+}
+
+// queryIDs runs a query that returns a single text column
+func (p *PostgresAdapter) queryIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// scanIDs reads and closes rows of a single text column, it returns nil when there are no rows
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,137 @@
+package postgresadapters
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// testDSNVariable names the environment variable with the DSN of a database that the tests may empty
+const testDSNVariable = "GATEWAY_TEST_POSTGRES_DSN"
+
+func testDSN(t *testing.T) string {
+	dsn := os.Getenv(testDSNVariable)
+	if dsn == "" {
+		t.Skipf("%s is not set\n", testDSNVariable)
+	}
+	return dsn
+}
+
+func newTestAdapter(t *testing.T) *PostgresAdapter {
+	ctx := context.Background()
+	adapter, err := NewPostgresAdapter(ctx, testDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { adapter.Close() })
+
+	_, err = adapter.DB.ExecContext(
+		ctx,
+		`TRUNCATE sessions, token_sessions, access_tokens, refresh_tokens, refresh_token_history, project_tokens,
+		project_webhook_secrets`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adapter
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration version is NOT the correct value, got %v want %v\n", m.version, i+1)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	testDSN(t)
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		return newTestAdapter(t)
+	})
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	adapter := newTestAdapter(t)
+
+	err := Migrate(context.Background(), adapter.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimExpiringAccessTokenIDs(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t)
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, id := range []string{"a", "b"} {
+		err := adapter.SetAccessToken(ctx, models.AccessToken{ID: id, Value: id, ExpiresAt: now.Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := adapter.ClaimExpiringAccessTokenIDs(ctx, now, now.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(claimed, []string{"a", "b"}) {
+		t.Errorf("claimed token IDs are NOT the correct value, got %v want %v\n", claimed, []string{"a", "b"})
+	}
+
+	// Claimed tokens are skipped until they are written again
+	claimed, err = adapter.ClaimExpiringAccessTokenIDs(ctx, now, now.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 0 {
+		t.Errorf("claimed token IDs are NOT the correct value, got %v want none\n", claimed)
+	}
+
+	err = adapter.SetAccessToken(ctx, models.AccessToken{ID: "a", Value: "a2", ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = adapter.ClaimExpiringAccessTokenIDs(ctx, now, now.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(claimed, []string{"a"}) {
+		t.Errorf("claimed token IDs are NOT the correct value, got %v want %v\n", claimed, []string{"a"})
+	}
+}
+
+func TestSetSessionRemovesStaleTokenSessions(t *testing.T) {
+	ctx := context.Background()
+	adapter := newTestAdapter(t)
+	session := models.Session{ID: "12345", ExpiresAt: time.Now().Add(time.Hour), TokenIDs: []string{"gitlab", "keycloak"}}
+	err := adapter.SetSession(ctx, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.TokenIDs = []string{"keycloak"}
+	err = adapter.SetSession(ctx, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tokenID, want := range map[string]string{"gitlab": "", "keycloak": "12345"} {
+		sessionID, err := adapter.GetTokenSessionID(ctx, tokenID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionID != want {
+			t.Errorf("the session of token %s is NOT the correct value, got %v want %v\n", tokenID, sessionID, want)
+		}
+	}
+}
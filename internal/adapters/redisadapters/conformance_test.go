@@ -0,0 +1,31 @@
+package redisadapters
+
+import (
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/storetest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		adapter, _ := newMiniredisAdapter(t)
+		return adapter
+	})
+}
+
+func TestConformanceWithEncryption(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		adapter, _ := newMiniredisAdapter(t)
+		adapter.Encryptor = &DummyEncryptor{keyID: "key1"}
+		return adapter
+	})
+}
+
+func TestConformanceWithNamespace(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) repository.Repository {
+		adapter, _ := newMiniredisAdapter(t)
+		adapter.Namespace = "renku-dev"
+		return adapter
+	})
+}
@@ -0,0 +1,129 @@
+package redisadapters
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
+	"github.com/go-redis/redis/v9"
+	"golang.org/x/net/context"
+)
+
+// maxReencryptAttempts is how many times the re-encryption of a value is attempted when it is written concurrently
+const maxReencryptAttempts = 5
+
+// encryptedField is the hash field holding an encrypted value and the associated data binding it to its ID
+type encryptedField struct {
+	name           string
+	associatedData func(id string) string
+}
+
+// encryptedFields maps the key prefix of the hashes holding encrypted values to their encrypted field
+var encryptedFields = map[string]encryptedField{
+	"accessTokens-":          {name: "accessToken", associatedData: encryption.AccessTokenAssociatedData},
+	"refreshTokens-":         {name: "refreshToken", associatedData: encryption.RefreshTokenAssociatedData},
+	"projectWebhookSecrets-": {name: "webhookSecret", associatedData: encryption.WebhookSecretAssociatedData},
+}
+
+func (r *RedisAdapter) encryptValue(value string, associatedData string) (string, error) {
+	if r.Encryptor == nil {
+		return value, nil
+	}
+	return r.Encryptor.Encrypt(value, associatedData)
+}
+
+func (r *RedisAdapter) decryptValue(value string, associatedData string) (string, error) {
+	if r.Encryptor == nil {
+		return value, nil
+	}
+	return r.Encryptor.Decrypt(value, associatedData)
+}
+
+// ReencryptTokens encrypts every access and refresh token value and every webhook secret that is not encrypted with
+// the active key again, plaintext values included. It scans the keys in batches of batchSize and calls progress after
+// every batch with the number of values scanned and rewritten so far. Values are rewritten in an optimistic
+// transaction so that a concurrent refresh is never overwritten, which makes it safe to run while the gateway is
+// serving users.
+func (r *RedisAdapter) ReencryptTokens(
+	ctx context.Context,
+	batchSize int64,
+	progress func(scanned int, rewritten int),
+) (int, error) {
+	if r.Encryptor == nil {
+		return 0, fmt.Errorf("no encryptor is configured")
+	}
+
+	scanned, rewritten := 0, 0
+	for prefix, field := range encryptedFields {
+		var cursor uint64
+		for {
+			keys, nextCursor, err := r.Rdb.Scan(ctx, cursor, r.keyPattern(prefix), batchSize).Result()
+			if err != nil {
+				return rewritten, err
+			}
+			for _, key := range keys {
+				changed, err := r.reencryptValue(ctx, key, field, r.key(prefix))
+				if err != nil {
+					return rewritten, err
+				}
+				scanned++
+				if changed {
+					rewritten++
+				}
+			}
+			if progress != nil {
+				progress(scanned, rewritten)
+			}
+			cursor = nextCursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptValue encrypts the value stored in the encrypted field of a hash with the active key if needed. A
+// concurrent write of the hash restarts the transaction, since the new value can also be encrypted with an old key.
+func (r *RedisAdapter) reencryptValue(
+	ctx context.Context,
+	key string,
+	field encryptedField,
+	prefix string,
+) (bool, error) {
+	associatedData := field.associatedData(key[len(prefix):])
+
+	changed := false
+	reencrypt := func(tx *redis.Tx) error {
+		value, err := tx.HGet(ctx, key, field.name).Result()
+		if err == redis.Nil || (err == nil && r.Encryptor.IsCurrent(value)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := r.Encryptor.Decrypt(value, associatedData)
+		if err != nil {
+			return err
+		}
+		ciphertext, err := r.Encryptor.Encrypt(plaintext, associatedData)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, field.name, ciphertext)
+			return nil
+		})
+		changed = err == nil
+		return err
+	}
+	for attempt := 0; attempt < maxReencryptAttempts; attempt++ {
+		err := r.Rdb.Watch(ctx, reencrypt, key)
+		if err != redis.TxFailedErr {
+			return changed, err
+		}
+		log.Printf("Token %s changed during re-encryption, retrying\n", key)
+	}
+	return false, fmt.Errorf("token %s kept changing during re-encryption", key)
+}
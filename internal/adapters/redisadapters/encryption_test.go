@@ -0,0 +1,121 @@
+package redisadapters
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+// DummyEncryptor "encrypts" values by prefixing them with its key ID and the associated data
+type DummyEncryptor struct {
+	keyID string
+}
+
+func (d *DummyEncryptor) Encrypt(plaintext string, associatedData string) (string, error) {
+	return d.keyID + "|" + associatedData + "|" + plaintext, nil
+}
+func (d *DummyEncryptor) Decrypt(value string, associatedData string) (string, error) {
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 || parts[1] != associatedData {
+		return value, nil
+	}
+	return parts[2], nil
+}
+func (d *DummyEncryptor) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, d.keyID+"|")
+}
+
+func newMiniredisAdapter(t *testing.T) (*RedisAdapter, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &RedisAdapter{Rdb: *client}, server
+}
+
+func TestTokenValuesAreEncrypted(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	adapter1.Encryptor = &DummyEncryptor{keyID: "key1"}
+
+	err := adapter1.SetAccessToken(ctx, models.AccessToken{ID: "12345", Value: "6789", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter1.SetRefreshToken(ctx, models.RefreshToken{ID: "12345", Value: "abcd", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := server.HGet("accessTokens-12345", "accessToken"); stored != "key1|accessToken:12345|6789" {
+		t.Errorf("The stored access token is NOT encrypted, got %v\n", stored)
+	}
+	if stored := server.HGet("refreshTokens-12345", "refreshToken"); stored != "key1|refreshToken:12345|abcd" {
+		t.Errorf("The stored refresh token is NOT encrypted, got %v\n", stored)
+	}
+	err = adapter1.SetProjectWebhookSecret(ctx, 42, "efgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := server.HGet("projectWebhookSecrets-42", "webhookSecret"); stored != "key1|webhookSecret:42|efgh" {
+		t.Errorf("The stored webhook secret is NOT encrypted, got %v\n", stored)
+	}
+	secret, err := adapter1.GetProjectWebhookSecret(ctx, 42)
+	if err != nil || secret != "efgh" {
+		t.Errorf("The webhook secret was NOT decrypted, got %v, %v\n", secret, err)
+	}
+
+	accessToken, err := adapter1.GetAccessToken(ctx, "12345")
+	if err != nil || accessToken.Value != "6789" {
+		t.Errorf("The access token was NOT decrypted, got %v, %v\n", accessToken.Value, err)
+	}
+	refreshToken, err := adapter1.GetRefreshToken(ctx, "12345")
+	if err != nil || refreshToken.Value != "abcd" {
+		t.Errorf("The refresh token was NOT decrypted, got %v, %v\n", refreshToken.Value, err)
+	}
+}
+
+func TestReencryptTokens(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+
+	// One plaintext value written before encryption was enabled and one encrypted with a previous key
+	err := adapter1.SetAccessToken(ctx, models.AccessToken{ID: "plain", Value: "6789", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter1.Encryptor = &DummyEncryptor{keyID: "key1"}
+	err = adapter1.SetRefreshToken(ctx, models.RefreshToken{ID: "old", Value: "abcd", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter1.Encryptor = &DummyEncryptor{keyID: "key2"}
+	err = adapter1.SetRefreshToken(ctx, models.RefreshToken{ID: "current", Value: "efgh", ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	rewritten, err := adapter1.ReencryptTokens(ctx, 10, func(int, int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten != 2 || calls == 0 {
+		t.Errorf("The number of rewritten values is NOT correct, got %v want %v\n", rewritten, 2)
+	}
+
+	if stored := server.HGet("accessTokens-plain", "accessToken"); stored != "key2|accessToken:plain|6789" {
+		t.Errorf("The plaintext access token was NOT encrypted, got %v\n", stored)
+	}
+	if stored := server.HGet("refreshTokens-old", "refreshToken"); stored != "key2|refreshToken:old|abcd" {
+		t.Errorf("The refresh token was NOT encrypted with the active key, got %v\n", stored)
+	}
+	if stored := server.HGet("refreshTokens-current", "refreshToken"); stored != "key2|refreshToken:current|efgh" {
+		t.Errorf("The current refresh token was changed, got %v\n", stored)
+	}
+}
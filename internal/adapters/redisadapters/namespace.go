@@ -0,0 +1,121 @@
+package redisadapters
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// namespaceSeparator separates the namespace from the name of a key
+const namespaceSeparator = ":"
+
+// keyPrefixes lists the names of every key written by the gateway, a name ending with "-" is followed by an ID
+var keyPrefixes = []string{
+	"session-",
+	"tokenSessions",
+	"userSessions-",
+	"accessTokens-",
+	"refreshTokens-",
+	"refreshTokenHistory-",
+	"reauthNotices-",
+	"indexExpiringTokens",
+	"indexExpiringRefreshTokens",
+	"projectTokens-",
+	"projectWebhookSecrets-",
+	"projectWebhooks",
+	schemaVersionKey,
+}
+
+// key returns the name of a key in the namespace of the adapter
+func (r *RedisAdapter) key(name string) string {
+	if r.Namespace == "" {
+		return name
+	}
+	return r.Namespace + namespaceSeparator + name
+}
+
+// keyPattern returns the SCAN pattern matching the keys of the namespace that start with prefix, the namespace is
+// escaped so that it is matched literally
+func (r *RedisAdapter) keyPattern(prefix string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(r.key(prefix))
+	return escaped + "*"
+}
+
+// NamespaceKeys scans the keys written by the gateway in the namespace of the adapter in batches of batchSize and
+// calls fn with every batch, keys of other namespaces are never returned
+func (r *RedisAdapter) NamespaceKeys(ctx context.Context, batchSize int64, fn func(keys []string) error) error {
+	for _, prefix := range keyPrefixes {
+		var cursor uint64
+		for {
+			keys, nextCursor, err := r.Rdb.Scan(ctx, cursor, r.keyPattern(prefix), batchSize).Result()
+			if err != nil {
+				return err
+			}
+			keys = r.ownKeys(keys)
+			if len(keys) > 0 {
+				err = fn(keys)
+				if err != nil {
+					return err
+				}
+			}
+			cursor = nextCursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ownKeys drops the keys of namespaced adapters that the patterns of an adapter without a namespace can match, e.g.
+// "session-a:session-b" for the pattern "session-*"
+func (r *RedisAdapter) ownKeys(keys []string) []string {
+	if r.Namespace != "" {
+		return keys
+	}
+	own := keys[:0]
+	for _, key := range keys {
+		namespace, name, found := strings.Cut(key, namespaceSeparator)
+		if found && isGatewayKey(name) && namespace != "" {
+			continue
+		}
+		own = append(own, key)
+	}
+	return own
+}
+
+// isGatewayKey reports whether a key name (without namespace) is one written by the gateway
+func isGatewayKey(name string) bool {
+	for _, prefix := range keyPrefixes {
+		if name == prefix || (strings.HasSuffix(prefix, "-") && strings.HasPrefix(name, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeNamespace removes every key written by the gateway in the namespace of the adapter and returns the number of
+// keys removed, with dryRun the keys are only counted. Keys of other namespaces are never removed. It calls progress
+// after every batch with the number of keys removed so far.
+func (r *RedisAdapter) PurgeNamespace(
+	ctx context.Context,
+	batchSize int64,
+	dryRun bool,
+	progress func(removed int),
+) (int, error) {
+	removed := 0
+	err := r.NamespaceKeys(ctx, batchSize, func(keys []string) error {
+		if !dryRun {
+			err := r.Rdb.Del(ctx, keys...).Err()
+			if err != nil {
+				return err
+			}
+		}
+		removed += len(keys)
+		if progress != nil {
+			progress(removed)
+		}
+		return nil
+	})
+	return removed, err
+}
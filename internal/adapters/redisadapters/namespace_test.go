@@ -0,0 +1,170 @@
+package redisadapters
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+)
+
+// newNamespacedAdapters returns adapters without a namespace and in the namespaces "dev" and "prod" sharing one Redis
+func newNamespacedAdapters(t *testing.T) (*RedisAdapter, *RedisAdapter, *RedisAdapter, *miniredis.Miniredis) {
+	plain, server := newMiniredisAdapter(t)
+	dev := &RedisAdapter{Rdb: plain.Rdb, Namespace: "dev"}
+	prod := &RedisAdapter{Rdb: plain.Rdb, Namespace: "prod"}
+	return plain, dev, prod, server
+}
+
+// writeAll writes one record of every kind with the same IDs
+func writeAll(ctx context.Context, t *testing.T, adapter *RedisAdapter) {
+	expiresAt := time.Now().Add(time.Hour)
+	errs := []error{
+		adapter.SetSession(ctx, models.Session{ID: "12345", Type: "user", ExpiresAt: expiresAt, TokenIDs: []string{"6789"}}),
+		adapter.SetAccessToken(ctx, models.AccessToken{ID: "6789", Value: "abcd", ExpiresAt: expiresAt}),
+		adapter.SetRefreshToken(ctx, models.RefreshToken{ID: "6789", Value: "efgh", ExpiresAt: expiresAt}),
+		adapter.AddSupersededRefreshToken(ctx, models.RefreshToken{ID: "6789", Value: "ijkl"}),
+		adapter.SetProjectToken(ctx, 1, models.AccessToken{ID: "6789", ExpiresAt: expiresAt}),
+	}
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNamespaceKeys(t *testing.T) {
+	ctx := context.Background()
+	_, dev, _, server := newNamespacedAdapters(t)
+	writeAll(ctx, t, dev)
+
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "dev:") {
+			t.Errorf("The key %v is NOT in the namespace\n", key)
+		}
+	}
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	ctx := context.Background()
+	plain, dev, prod, _ := newNamespacedAdapters(t)
+	writeAll(ctx, t, plain)
+	writeAll(ctx, t, dev)
+
+	_, err := prod.GetSession(ctx, "12345")
+	if err != models.ErrNotFound {
+		t.Errorf("The session of another namespace was read, got %v\n", err)
+	}
+	sessionID, err := prod.GetTokenSessionID(ctx, "6789")
+	if err != nil || sessionID != "" {
+		t.Errorf("The token session of another namespace was read, got %v, %v\n", sessionID, err)
+	}
+	tokenIDs, err := prod.GetExpiringAccessTokenIDs(ctx, time.Unix(0, 0), time.Now().Add(2*time.Hour))
+	if err != nil || len(tokenIDs) != 0 {
+		t.Errorf("The expiring tokens of another namespace were read, got %v, %v\n", tokenIDs, err)
+	}
+
+	err = dev.RemoveSession(ctx, "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.RemoveAccessToken(ctx, models.AccessToken{ID: "6789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = plain.GetSession(ctx, "12345")
+	if err != nil {
+		t.Errorf("Removing a session removed the session of another namespace, got %v\n", err)
+	}
+	accessToken, err := plain.GetAccessToken(ctx, "6789")
+	if err != nil || accessToken.Value != "abcd" {
+		t.Errorf("Removing an access token removed the token of another namespace, got %v\n", err)
+	}
+}
+
+func TestNamespacedExpiringTokenUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, dev, prod, _ := newNamespacedAdapters(t)
+
+	expirations, err := prod.SubscribeExpiringAccessTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(ctx, t, dev)
+	err = prod.SetAccessToken(ctx, models.AccessToken{ID: "6789", ExpiresAt: time.Unix(1000, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first update received is the one of the own namespace
+	if expiresAt := <-expirations; expiresAt.Unix() != 1000 {
+		t.Errorf("The update of another namespace was received, got %v want %v\n", expiresAt.Unix(), 1000)
+	}
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	ctx := context.Background()
+	plain, dev, prod, server := newNamespacedAdapters(t)
+	writeAll(ctx, t, plain)
+	writeAll(ctx, t, dev)
+	writeAll(ctx, t, prod)
+	// A key that was not written by the gateway
+	err := plain.Rdb.Set(ctx, "dev:other", "value", 0).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysBefore := len(server.Keys())
+
+	removed, err := dev.PurgeNamespace(ctx, 2, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 8 || len(server.Keys()) != keysBefore {
+		t.Errorf("The dry run is NOT correct, got %v removed and %v keys want 8 and %v\n",
+			removed, len(server.Keys()), keysBefore)
+	}
+
+	removed, err = dev.PurgeNamespace(ctx, 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 8 {
+		t.Errorf("The number of removed keys is NOT correct, got %v want %v\n", removed, 8)
+	}
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, "dev:") && key != "dev:other" {
+			t.Errorf("The key %v was NOT purged\n", key)
+		}
+	}
+
+	// The keys of an adapter without a namespace never include those of namespaces
+	var plainKeys []string
+	err = plain.NamespaceKeys(ctx, 10, func(keys []string) error {
+		plainKeys = append(plainKeys, keys...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(plainKeys)
+	for _, key := range plainKeys {
+		if strings.Contains(key, namespaceSeparator) {
+			t.Errorf("The key %v of a namespace was listed without a namespace\n", key)
+		}
+	}
+	if len(plainKeys) != 8 {
+		t.Errorf("The number of keys is NOT correct, got %v want %v\n", len(plainKeys), 8)
+	}
+}
+
+func TestKeyPatternEscapesNamespace(t *testing.T) {
+	adapter := &RedisAdapter{Rdb: redis.Client{}, Namespace: "dev*"}
+	if pattern := adapter.keyPattern("session-"); pattern != `dev\*:session-*` {
+		t.Errorf("The key pattern is NOT the correct value, got %v want %v\n", pattern, `dev\*:session-*`)
+	}
+}
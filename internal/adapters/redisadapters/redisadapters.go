@@ -3,23 +3,67 @@ package redisadapters
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/encryption"
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 	"github.com/go-redis/redis/v9"
 	"golang.org/x/net/context"
 )
 
-// RedisAdapter contains a redis client
+// maxTouchAttempts is how many times the update of the last seen time of a session is attempted when the session is
+// written concurrently
+const maxTouchAttempts = 5
+
+// expiringTokensChannel is the channel on which the expiration of every access token written to Redis is published
+const expiringTokensChannel = "expiringTokensUpdates"
+
+var _ repository.Repository = (*RedisAdapter)(nil)
+
+// States of the projects in the projectWebhooks hash
+const (
+	projectWebhookActive   = "active"
+	projectWebhookInactive = "inactive"
+)
+
+// RedisAdapter contains a redis client, token values are encrypted with Encryptor when it is set and every key is
+// prefixed with Namespace when it is set
 type RedisAdapter struct {
-	Rdb redis.Client
+	Rdb       redis.Client
+	Encryptor encryption.ValueEncryptor
+	Namespace string
+	// pipe queues the writes of a transaction started by Update
+	pipe redis.Pipeliner
+}
+
+// Update queues the writes made by fn in a MULTI/EXEC transaction that is only executed if fn succeeds. The reads
+// that some writes need, such as the tokens of a removed session, are made before the transaction is executed.
+func (r *RedisAdapter) Update(ctx context.Context, fn func(tx repository.Writer) error) error {
+
+	_, err := r.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return fn(&RedisAdapter{Rdb: r.Rdb, Encryptor: r.Encryptor, Namespace: r.Namespace, pipe: pipe})
+	})
+	return err
+}
+
+// writer returns the pipeline of the current transaction, or the client outside of a transaction
+func (r *RedisAdapter) writer() redis.Cmdable {
+	if r.pipe != nil {
+		return r.pipe
+	}
+	return &r.Rdb
 }
 
 // Set/write functions
 
-// SetSession writes the associated ID, type, expiration and tokenID of a session to Redis
+// SetSession writes the associated ID, type, expiration, tokenID, user and client of a session to Redis, the session
+// is removed by Redis once it expires
 func (r *RedisAdapter) SetSession(ctx context.Context, session models.Session) error {
 
 	accessTokenList, err := json.Marshal(session.TokenIDs)
@@ -27,50 +71,272 @@ func (r *RedisAdapter) SetSession(ctx context.Context, session models.Session) e
 		return err
 	}
 
-	return r.Rdb.HSet(
+	// A session that changes user leaves the sessions of its previous user
+	previousUserID, err := r.Rdb.HGet(
 		ctx,
-		"session-"+session.ID,
+		r.key("session-"+session.ID),
+		"userId",
+	).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if previousUserID != "" && previousUserID != session.UserID {
+		err = r.writer().ZRem(
+			ctx,
+			r.key("userSessions-"+previousUserID),
+			session.ID,
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = r.writer().HSet(
+		ctx,
+		r.key("session-"+session.ID),
 		"type",
 		session.Type,
 		"expiresAt",
 		session.ExpiresAt.Unix(),
 		"tokenIds",
 		accessTokenList,
+		"userId",
+		session.UserID,
+		"username",
+		session.Username,
+		"createdAt",
+		models.UnixOrZero(session.CreatedAt),
+		"lastSeenAt",
+		models.UnixOrZero(session.LastSeenAt),
+		"loginMethod",
+		session.LoginMethod,
+		"clientIp",
+		session.ClientIP,
+		"userAgent",
+		session.UserAgent,
+		"idpSessionId",
+		session.IDPSessionID,
+		"deviceKeyHash",
+		session.DeviceKeyHash,
+		schemaVersionField,
+		currentSchemaVersion,
 	).Err()
+	if err != nil {
+		return err
+	}
+
+	// Sessions without an expiration are kept until they are removed
+	if session.ExpiresAt.Unix() > 0 {
+		err = r.writer().ExpireAt(
+			ctx,
+			r.key("session-"+session.ID),
+			session.ExpiresAt,
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+	// Anonymous sessions are not indexed, each of them would leave the sessions of a user nobody lists
+	if session.UserID != "" && session.Type != models.SessionTypeAnonymous {
+		err = r.setUserSession(ctx, session)
+		if err != nil {
+			return err
+		}
+	}
+	if len(session.TokenIDs) == 0 {
+		return nil
+	}
+
+	// Keep track of the session each token belongs to
+	tokenSessions := make([]interface{}, 0, 2*len(session.TokenIDs))
+	for _, tokenID := range session.TokenIDs {
+		tokenSessions = append(tokenSessions, tokenID, session.ID)
+	}
+	return r.writer().HSet(
+		ctx,
+		r.key("tokenSessions"),
+		tokenSessions...,
+	).Err()
+}
+
+// TouchSession sets the last seen time of a session and extends its expiration in an optimistic transaction, so that
+// a session removed concurrently is not written again
+func (r *RedisAdapter) TouchSession(
+	ctx context.Context,
+	sessionID string,
+	lastSeenAt time.Time,
+	expiresAt time.Time,
+) (bool, error) {
+	touched := false
+	touch := func(tx *redis.Tx) error {
+		session, err := r.GetSession(ctx, sessionID)
+		if errors.Is(err, models.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session.LastSeenAt = lastSeenAt
+		if !expiresAt.IsZero() {
+			session.ExpiresAt = expiresAt
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			writer := &RedisAdapter{Rdb: r.Rdb, Encryptor: r.Encryptor, Namespace: r.Namespace, pipe: pipe}
+			return writer.SetSession(ctx, session)
+		})
+		touched = err == nil
+		return err
+	}
+	for attempt := 0; attempt < maxTouchAttempts; attempt++ {
+		err := r.Rdb.Watch(ctx, touch, r.key("session-"+sessionID))
+		if err != redis.TxFailedErr {
+			return touched, err
+		}
+	}
+	return false, fmt.Errorf("session %s kept changing while it was touched", models.SessionHandle(sessionID))
 }
 
-// SetAccessToken writes the associated ID, access token value, expiration, tokenID and refresh URL of an access token to Redis
+// setUserSession adds a session to the sessions of its user, scored by expiration, and drops the expired sessions of
+// the user that Redis removed
+func (r *RedisAdapter) setUserSession(ctx context.Context, session models.Session) error {
+
+	// Sessions without an expiration come last
+	score := math.Inf(1)
+	if session.ExpiresAt.Unix() > 0 {
+		score = float64(session.ExpiresAt.Unix())
+	}
+	err := r.writer().ZAdd(
+		ctx,
+		r.key("userSessions-"+session.UserID),
+		redis.Z{
+			Score:  score,
+			Member: session.ID,
+		},
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.writer().ZRemRangeByScore(
+		ctx,
+		r.key("userSessions-"+session.UserID),
+		"-inf",
+		strconv.FormatInt(time.Now().Unix(), 10),
+	).Err()
+}
+
+// SetAccessToken writes the associated ID, access token value, expiration, tokenID, refresh URL and claims of an access
+// token to Redis
 func (r *RedisAdapter) SetAccessToken(ctx context.Context, accessToken models.AccessToken) error {
 
-	err := r.setToIndexExpiringTokens(ctx, accessToken)
+	value, err := r.encryptValue(accessToken.Value, encryption.AccessTokenAssociatedData(accessToken.ID))
+	if err != nil {
+		return err
+	}
+	scopes, err := json.Marshal(accessToken.Scopes)
+	if err != nil {
+		return err
+	}
+	audience, err := json.Marshal(accessToken.Audience)
+	if err != nil {
+		return err
+	}
+
+	err = r.setToIndexExpiringTokens(ctx, accessToken)
 	if err != nil {
 		return err
 	}
 
-	return r.Rdb.HSet(
+	err = r.writer().HSet(
 		ctx,
-		"accessTokens-"+accessToken.ID,
+		r.key("accessTokens-"+accessToken.ID),
 		"accessToken",
-		accessToken.Value,
+		value,
 		"expiresAt",
 		accessToken.ExpiresAt.Unix(),
 		"URL",
 		accessToken.URL,
 		"type",
 		accessToken.Type,
+		"provider",
+		accessToken.Provider,
+		"subject",
+		accessToken.Subject,
+		"scopes",
+		scopes,
+		"audience",
+		audience,
+		"issuedAt",
+		models.UnixOrZero(accessToken.IssuedAt),
+		schemaVersionField,
+		currentSchemaVersion,
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	// Let the token refresher know that the index has changed, it may have to wake up earlier
+	return r.writer().Publish(
+		ctx,
+		r.key(expiringTokensChannel),
+		accessToken.ExpiresAt.Unix(),
 	).Err()
 }
 
 // SetRefreshToken writes the associated ID, access token value, expiration and tokenID of a refresh token to Redis
 func (r *RedisAdapter) SetRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
 
-	return r.Rdb.HSet(
+	value, err := r.encryptValue(refreshToken.Value, encryption.RefreshTokenAssociatedData(refreshToken.ID))
+	if err != nil {
+		return err
+	}
+
+	err = r.writer().HSet(
 		ctx,
-		"refreshTokens-"+refreshToken.ID,
+		r.key("refreshTokens-"+refreshToken.ID),
 		"refreshToken",
-		refreshToken.Value,
+		value,
 		"expiresAt",
 		refreshToken.ExpiresAt.Unix(),
+		schemaVersionField,
+		currentSchemaVersion,
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	// Refresh tokens without an expiration (e.g. from GitLab) are kept out of the index
+	if refreshToken.ExpiresAt.Unix() <= 0 {
+		return r.removeFromIndexExpiringRefreshTokens(ctx, refreshToken.ID)
+	}
+	return r.writer().ZAdd(
+		ctx,
+		r.key("indexExpiringRefreshTokens"),
+		redis.Z{
+			Score:  float64(refreshToken.ExpiresAt.Unix()),
+			Member: refreshToken.ID,
+		},
+	).Err()
+}
+
+// AddSupersededRefreshToken writes a hash of a refresh token value that was replaced by a rotation to the refresh
+// token history, only the most recent repository.RefreshTokenHistoryLength values are kept
+func (r *RedisAdapter) AddSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) error {
+
+	err := r.writer().LPush(
+		ctx,
+		r.key("refreshTokenHistory-"+refreshToken.ID),
+		repository.HashTokenValue(refreshToken.Value),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.writer().LTrim(
+		ctx,
+		r.key("refreshTokenHistory-"+refreshToken.ID),
+		0,
+		repository.RefreshTokenHistoryLength-1,
 	).Err()
 }
 
@@ -81,9 +347,9 @@ func (r *RedisAdapter) setToIndexExpiringTokens(ctx context.Context, accessToken
 	z1.Score = float64(accessToken.ExpiresAt.Unix())
 	z1.Member = accessToken.ID
 
-	return r.Rdb.ZAdd(
+	return r.writer().ZAdd(
 		ctx,
-		"indexExpiringTokens",
+		r.key("indexExpiringTokens"),
 		z1,
 	).Err()
 }
@@ -96,21 +362,82 @@ func (r *RedisAdapter) SetProjectToken(ctx context.Context, projectID int, acces
 		Member: accessToken.ID,
 	}
 
-	return r.Rdb.ZAdd(
+	return r.writer().ZAdd(
 		ctx,
-		"projectTokens-"+strconv.Itoa(projectID),
+		r.key("projectTokens-"+strconv.Itoa(projectID)),
 		z1,
 	).Err()
 }
 
+// SetProjectWebhookSecret writes the secret of the GitLab webhook of a project to Redis
+func (r *RedisAdapter) SetProjectWebhookSecret(ctx context.Context, projectID int, secret string) error {
+
+	value, err := r.encryptValue(secret, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+	if err != nil {
+		return err
+	}
+
+	err = r.writer().HSet(
+		ctx,
+		r.key("projectWebhookSecrets-"+strconv.Itoa(projectID)),
+		"webhookSecret",
+		value,
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.writer().HSet(
+		ctx,
+		r.key("projectWebhooks"),
+		strconv.Itoa(projectID),
+		projectWebhookActive,
+	).Err()
+}
+
 // Remove/delete functions
 
-// RemoveSession removes a session entry from Redis
+// RemoveSession removes a session entry and the session of its tokens from Redis
 func (r *RedisAdapter) RemoveSession(ctx context.Context, sessionID string) error {
 
-	return r.Rdb.Del(
+	output, err := r.Rdb.HMGet(
 		ctx,
-		"session-"+sessionID,
+		r.key("session-"+sessionID),
+		"tokenIds",
+		"userId",
+	).Result()
+	if err != nil {
+		return err
+	}
+	tokenIDs, _ := output[0].(string)
+	userID, _ := output[1].(string)
+
+	if userID != "" {
+		err = r.writer().ZRem(
+			ctx,
+			r.key("userSessions-"+userID),
+			sessionID,
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	var accessTokenList []string
+	if tokenIDs != "" && json.Unmarshal([]byte(tokenIDs), &accessTokenList) == nil && len(accessTokenList) > 0 {
+		err = r.writer().HDel(
+			ctx,
+			r.key("tokenSessions"),
+			accessTokenList...,
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.writer().Del(
+		ctx,
+		r.key("session-"+sessionID),
 	).Err()
 }
 
@@ -122,88 +449,205 @@ func (r *RedisAdapter) RemoveAccessToken(ctx context.Context, accessToken models
 		return err
 	}
 
-	return r.Rdb.Del(
+	return r.writer().Del(
 		ctx,
-		"accessTokens-"+accessToken.ID,
+		r.key("accessTokens-"+accessToken.ID),
 	).Err()
 }
 
-// RemoveRefreshToken removes an access token entry from Redis
+// RemoveRefreshToken removes a refresh token entry from Redis
 func (r *RedisAdapter) RemoveRefreshToken(ctx context.Context, refreshTokenID string) error {
 
-	return r.Rdb.Del(
+	err := r.removeFromIndexExpiringRefreshTokens(ctx, refreshTokenID)
+	if err != nil {
+		return err
+	}
+
+	return r.writer().Del(
+		ctx,
+		r.key("refreshTokens-"+refreshTokenID),
+	).Err()
+}
+
+// removeFromIndexExpiringRefreshTokens removes a refresh token entry in the indexExpiringRefreshTokens sorted set
+// from Redis
+func (r *RedisAdapter) removeFromIndexExpiringRefreshTokens(ctx context.Context, refreshTokenID string) error {
+
+	return r.writer().ZRem(
+		ctx,
+		r.key("indexExpiringRefreshTokens"),
+		refreshTokenID,
+	).Err()
+}
+
+// RemoveSupersededRefreshTokens removes the refresh token history of a token ID from Redis
+func (r *RedisAdapter) RemoveSupersededRefreshTokens(ctx context.Context, refreshTokenID string) error {
+
+	return r.writer().Del(
 		ctx,
-		"refreshTokens-"+refreshTokenID,
+		r.key("refreshTokenHistory-"+refreshTokenID),
 	).Err()
 }
 
 // removeFromIndexExpiringTokens removes an access token entry in the indexExpiringTokens sorted set from Redis
 func (r *RedisAdapter) removeFromIndexExpiringTokens(ctx context.Context, accessToken models.AccessToken) error {
 
-	var z1 redis.Z
-	z1.Score = float64(accessToken.ExpiresAt.Unix())
-	z1.Member = accessToken.ID
-
-	return r.Rdb.ZRem(
+	return r.writer().ZRem(
 		ctx,
-		"indexExpiringTokens",
-		z1,
+		r.key("indexExpiringTokens"),
+		accessToken.ID,
 	).Err()
 }
 
 // RemoveProjectToken removes an access token entry in a projectTokens sorted set from Redis
 func (r *RedisAdapter) RemoveProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error {
 
-	var z1 redis.Z
-	z1.Score = float64(accessToken.ExpiresAt.Unix())
-	z1.Member = accessToken.ID
+	return r.writer().ZRem(
+		ctx,
+		r.key("projectTokens-"+strconv.Itoa(projectID)),
+		accessToken.ID,
+	).Err()
+}
+
+// DeactivateProjectWebhook removes the secret of the GitLab webhook of a project from Redis and keeps the project as
+// inactive in the projectWebhooks hash
+func (r *RedisAdapter) DeactivateProjectWebhook(ctx context.Context, projectID int) error {
 
-	return r.Rdb.ZRem(
+	err := r.writer().Del(
 		ctx,
-		"projectTokens-"+strconv.Itoa(projectID),
-		z1,
+		r.key("projectWebhookSecrets-"+strconv.Itoa(projectID)),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.writer().HSet(
+		ctx,
+		r.key("projectWebhooks"),
+		strconv.Itoa(projectID),
+		projectWebhookInactive,
+	).Err()
+}
+
+// RemoveProjectWebhookSecret removes the secret of the GitLab webhook of a project and the project from Redis
+func (r *RedisAdapter) RemoveProjectWebhookSecret(ctx context.Context, projectID int) error {
+
+	err := r.writer().Del(
+		ctx,
+		r.key("projectWebhookSecrets-"+strconv.Itoa(projectID)),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.writer().HDel(
+		ctx,
+		r.key("projectWebhooks"),
+		strconv.Itoa(projectID),
 	).Err()
 }
 
 // Get functions
 
-// GetSession reads the associated ID, type, expiration and tokenID of a session from Redis
+// GetSession reads the associated ID, type, expiration, tokenID, user and client of a session from Redis, it returns
+// models.ErrNotFound if the session does not exist or has expired
 func (r *RedisAdapter) GetSession(ctx context.Context, sessionID string) (models.Session, error) {
 
 	output, err := r.Rdb.HGetAll(
 		ctx,
-		"session-"+sessionID,
+		r.key("session-"+sessionID),
 	).Result()
+	if err != nil {
+		return models.Session{}, err
+	}
+	if len(output) == 0 {
+		return models.Session{}, models.ErrNotFound
+	}
+	r.upgradeOnRead(ctx, "session-", sessionID, output)
 
 	expiresAtInt64, err := strconv.ParseInt(output["expiresAt"], 10, 64)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	// Sessions written by older gateways have no creation and last seen times
+	createdAt, err := parseTimeOrZero(output["createdAt"])
+	if err != nil {
+		return models.Session{}, err
+	}
+	lastSeenAt, err := parseTimeOrZero(output["lastSeenAt"])
+	if err != nil {
+		return models.Session{}, err
+	}
 
 	var accessTokenList []string
 	err = json.Unmarshal([]byte(output["tokenIds"]), &accessTokenList)
 
 	return models.Session{
-		ID:        sessionID,
-		Type:      output["type"],
-		ExpiresAt: time.Unix(expiresAtInt64, 0),
-		TokenIDs:  accessTokenList,
+		ID:            sessionID,
+		Type:          output["type"],
+		ExpiresAt:     time.Unix(expiresAtInt64, 0),
+		TokenIDs:      accessTokenList,
+		UserID:        output["userId"],
+		Username:      output["username"],
+		CreatedAt:     createdAt,
+		LastSeenAt:    lastSeenAt,
+		LoginMethod:   output["loginMethod"],
+		ClientIP:      output["clientIp"],
+		UserAgent:     output["userAgent"],
+		IDPSessionID:  output["idpSessionId"],
+		DeviceKeyHash: output["deviceKeyHash"],
 	}, err
 }
 
-// GetAccessToken reads the associated ID, access token value, expiration, tokenID and refresh URL of an access token from Redis
+// GetAccessToken reads the associated ID, access token value, expiration, tokenID, refresh URL and claims of an access
+// token from Redis
 func (r *RedisAdapter) GetAccessToken(ctx context.Context, tokenID string) (models.AccessToken, error) {
 
 	output, err := r.Rdb.HGetAll(
 		ctx,
-		"accessTokens-"+tokenID,
+		r.key("accessTokens-"+tokenID),
 	).Result()
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	if len(output) == 0 {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	r.upgradeOnRead(ctx, "accessTokens-", tokenID, output)
 
 	expiresAtInt64, err := strconv.ParseInt(output["expiresAt"], 10, 64)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	// Tokens written by older gateways have no claims
+	issuedAt, err := parseTimeOrZero(output["issuedAt"])
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	scopes, err := unmarshalStrings(output["scopes"])
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	audience, err := unmarshalStrings(output["audience"])
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	value, err := r.decryptValue(output["accessToken"], encryption.AccessTokenAssociatedData(tokenID))
 
 	return models.AccessToken{
 		ID:        tokenID,
-		Value:     output["accessToken"],
+		Value:     value,
 		ExpiresAt: time.Unix(expiresAtInt64, 0),
 		URL:       output["URL"],
 		Type:      output["type"],
+		Provider:  output["provider"],
+		Subject:   output["subject"],
+		Scopes:    scopes,
+		Audience:  audience,
+		IssuedAt:  issuedAt,
 	}, err
 }
 
@@ -212,24 +656,71 @@ func (r *RedisAdapter) GetRefreshToken(ctx context.Context, tokenID string) (mod
 
 	output, err := r.Rdb.HGetAll(
 		ctx,
-		"refreshTokens-"+tokenID,
+		r.key("refreshTokens-"+tokenID),
 	).Result()
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	if len(output) == 0 {
+		return models.RefreshToken{}, models.ErrNotFound
+	}
+	r.upgradeOnRead(ctx, "refreshTokens-", tokenID, output)
 
 	expiresAtInt64, err := strconv.ParseInt(output["expiresAt"], 10, 64)
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	value, err := r.decryptValue(output["refreshToken"], encryption.RefreshTokenAssociatedData(tokenID))
 
 	return models.RefreshToken{
 		ID:        tokenID,
-		Value:     output["refreshToken"],
+		Value:     value,
 		ExpiresAt: time.Unix(expiresAtInt64, 0),
 	}, err
 }
 
+// IsSupersededRefreshToken checks whether a refresh token value is in the refresh token history of its token ID
+func (r *RedisAdapter) IsSupersededRefreshToken(ctx context.Context, refreshToken models.RefreshToken) (bool, error) {
+
+	err := r.Rdb.LPos(
+		ctx,
+		r.key("refreshTokenHistory-"+refreshToken.ID),
+		repository.HashTokenValue(refreshToken.Value),
+		redis.LPosArgs{},
+	).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ClaimReauthNotice claims the re-authentication notice of a refresh token expiration with a key that expires with
+// the token
+func (r *RedisAdapter) ClaimReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	ttl := time.Until(expiresAt)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return r.Rdb.SetNX(ctx, r.reauthNoticeKey(tokenID, expiresAt), 1, ttl).Result()
+}
+
+// ReleaseReauthNotice removes the claim of the re-authentication notice of a refresh token expiration
+func (r *RedisAdapter) ReleaseReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	return r.Rdb.Del(ctx, r.reauthNoticeKey(tokenID, expiresAt)).Err()
+}
+
+func (r *RedisAdapter) reauthNoticeKey(tokenID string, expiresAt time.Time) string {
+	return r.key("reauthNotices-" + tokenID + "-" + strconv.FormatInt(expiresAt.Unix(), 10))
+}
+
 // GetExpiringAccessTokenIDs reads the associated expiration and tokenID of an access token from Redis
 func (r *RedisAdapter) GetExpiringAccessTokenIDs(ctx context.Context, startTime time.Time, stopTime time.Time) ([]string, error) {
 	var expiringTokens []string
 
 	zrangeargs := redis.ZRangeArgs{
-		Key:     "indexExpiringTokens",
+		Key:     r.key("indexExpiringTokens"),
 		Start:   startTime.Unix(),
 		Stop:    stopTime.Unix(),
 		ByScore: true,
@@ -247,14 +738,63 @@ func (r *RedisAdapter) GetExpiringAccessTokenIDs(ctx context.Context, startTime
 	return expiringTokens, err
 }
 
+// GetExpiringRefreshTokenIDs reads the IDs of the refresh tokens expiring between startTime and stopTime from Redis
+func (r *RedisAdapter) GetExpiringRefreshTokenIDs(
+	ctx context.Context,
+	startTime time.Time,
+	stopTime time.Time,
+) ([]string, error) {
+
+	zrangeargs := redis.ZRangeArgs{
+		Key:     r.key("indexExpiringRefreshTokens"),
+		Start:   startTime.Unix(),
+		Stop:    stopTime.Unix(),
+		ByScore: true,
+	}
+
+	return r.Rdb.ZRangeArgs(
+		ctx,
+		zrangeargs,
+	).Result()
+}
+
+// GetTokenSessionID reads the ID of the session a token belongs to from Redis, it returns an empty ID if the token
+// does not belong to a session
+func (r *RedisAdapter) GetTokenSessionID(ctx context.Context, tokenID string) (string, error) {
+
+	sessionID, err := r.Rdb.HGet(
+		ctx,
+		r.key("tokenSessions"),
+		tokenID,
+	).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return sessionID, err
+}
+
+// GetUserSessionIDs reads the IDs of the sessions of a user that have not expired from Redis, ordered by expiration
+func (r *RedisAdapter) GetUserSessionIDs(ctx context.Context, userID string) ([]string, error) {
+
+	return r.Rdb.ZRangeByScore(
+		ctx,
+		r.key("userSessions-"+userID),
+		&redis.ZRangeBy{
+			Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+			Max: "+inf",
+		},
+	).Result()
+}
+
 // GetProjectTokens reads the project ID and associated expiration and tokenID of a project from Redis
 func (r *RedisAdapter) GetProjectTokens(ctx context.Context, projectID int) ([]string, error) {
 	var projectTokens []string
 
 	zrangeargs := redis.ZRangeArgs{
-		Key:     "projectTokens-" + strconv.Itoa(projectID),
+		Key:     r.key("projectTokens-" + strconv.Itoa(projectID)),
 		Start:   0,
-		Stop:    999999,
+		Stop:    -1,
 		ByScore: false,
 	}
 
@@ -269,3 +809,186 @@ func (r *RedisAdapter) GetProjectTokens(ctx context.Context, projectID int) ([]s
 
 	return projectTokens, err
 }
+
+// ListProjectTokens reads a page of the tokens of a project with their expiration from Redis
+func (r *RedisAdapter) ListProjectTokens(
+	ctx context.Context,
+	projectID int,
+	query models.ProjectTokenQuery,
+) (models.ProjectTokenPage, error) {
+
+	tokenRange, err := repository.NewProjectTokenRange(query)
+	if err != nil {
+		return models.ProjectTokenPage{}, err
+	}
+
+	// Tokens expiring at the same time as the cursor are fetched again and skipped, hence the loop
+	var tokens []models.ProjectToken
+	var offset int64
+	for len(tokens) <= tokenRange.Limit {
+		zrangeargs := redis.ZRangeArgs{
+			Key:     r.key("projectTokens-" + strconv.Itoa(projectID)),
+			Start:   tokenRange.Min,
+			Stop:    tokenRange.Max,
+			ByScore: true,
+			Offset:  offset,
+			Count:   int64(tokenRange.Limit + 1),
+		}
+
+		zrange, err := r.Rdb.ZRangeArgsWithScores(
+			ctx,
+			zrangeargs,
+		).Result()
+		if err != nil {
+			return models.ProjectTokenPage{}, err
+		}
+
+		for _, projectToken := range zrange {
+			token := models.ProjectToken{
+				ID:        fmt.Sprintf("%v", projectToken.Member),
+				ExpiresAt: time.Unix(int64(projectToken.Score), 0),
+			}
+			if tokenRange.Includes(token) && len(tokens) <= tokenRange.Limit {
+				tokens = append(tokens, token)
+			}
+		}
+		if int64(len(zrange)) < zrangeargs.Count {
+			break
+		}
+		offset += int64(len(zrange))
+	}
+
+	return tokenRange.Page(tokens), nil
+}
+
+// GetProjectWebhookSecret reads the secret of the GitLab webhook of a project from Redis, it returns
+// models.ErrNotFound if the project has no webhook secret
+func (r *RedisAdapter) GetProjectWebhookSecret(ctx context.Context, projectID int) (string, error) {
+
+	value, err := r.Rdb.HGet(
+		ctx,
+		r.key("projectWebhookSecrets-"+strconv.Itoa(projectID)),
+		"webhookSecret",
+	).Result()
+	if err == redis.Nil {
+		return "", models.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return r.decryptValue(value, encryption.WebhookSecretAssociatedData(strconv.Itoa(projectID)))
+}
+
+// ListProjectWebhooks reads the projects with a webhook secret and the deactivated ones from the projectWebhooks hash
+func (r *RedisAdapter) ListProjectWebhooks(ctx context.Context) ([]models.ProjectWebhook, error) {
+
+	output, err := r.Rdb.HGetAll(
+		ctx,
+		r.key("projectWebhooks"),
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []models.ProjectWebhook{}
+	for field, state := range output {
+		projectID, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, models.ProjectWebhook{ProjectID: projectID, Active: state == projectWebhookActive})
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ProjectID < webhooks[j].ProjectID
+	})
+	return webhooks, nil
+}
+
+// GetEarliestAccessTokenExpiry reads the earliest expiration in the indexExpiringTokens sorted set that is later than
+// the given time, found is false if there is no such expiration
+func (r *RedisAdapter) GetEarliestAccessTokenExpiry(
+	ctx context.Context,
+	after time.Time,
+) (expiresAt time.Time, found bool, err error) {
+
+	zrangeargs := redis.ZRangeArgs{
+		Key:     r.key("indexExpiringTokens"),
+		Start:   "(" + strconv.FormatInt(after.Unix(), 10),
+		Stop:    "+inf",
+		ByScore: true,
+		Count:   1,
+	}
+
+	zrange, err := r.Rdb.ZRangeArgsWithScores(
+		ctx,
+		zrangeargs,
+	).Result()
+	if err != nil || len(zrange) == 0 {
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(int64(zrange[0].Score), 0), true, nil
+}
+
+// SubscribeExpiringAccessTokens returns a channel that receives the expiration of every access token written to Redis,
+// the channel is closed when the context is done
+func (r *RedisAdapter) SubscribeExpiringAccessTokens(ctx context.Context) (<-chan time.Time, error) {
+	pubsub := r.Rdb.Subscribe(ctx, r.key(expiringTokensChannel))
+	// Wait for the subscription to be confirmed so that no update is missed after returning
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	expirations := make(chan time.Time)
+	go func() {
+		defer close(expirations)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				expiresAtInt64, err := strconv.ParseInt(message.Payload, 10, 64)
+				if err != nil {
+					continue
+				}
+				select {
+				case expirations <- time.Unix(expiresAtInt64, 0):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return expirations, nil
+}
+
+// parseTimeOrZero returns the time of Unix seconds written by models.UnixOrZero, a missing field is the zero time
+func parseTimeOrZero(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return models.TimeOrZero(seconds), nil
+}
+
+// unmarshalStrings decodes a JSON list of strings, a missing field is an empty list
+func unmarshalStrings(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var values []string
+	err := json.Unmarshal([]byte(value), &values)
+	return values, err
+}
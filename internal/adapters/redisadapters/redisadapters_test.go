@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"math/rand"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 	"github.com/go-redis/redis/v9"
 	"github.com/go-redis/redismock/v9"
 )
@@ -25,14 +27,28 @@ func TestSetSession(t *testing.T) {
 	testTokenIDs := []string{"test"}
 	jsonTestTokenIDs, _ := json.Marshal(testTokenIDs)
 
-	mySession := models.Session{
-		ID:        "12345",
-		Type:      "user",
-		ExpiresAt: expirationTime,
-		TokenIDs:  testTokenIDs,
-	}
+	createdAt := time.Unix(time.Now().Unix(), 0)
 
-	mock.ExpectHSet("session-12345", "type", "user", "expiresAt", expirationTime.Unix(), "tokenIds", jsonTestTokenIDs)
+	mySession := models.Session{
+		ID:          "12345",
+		Type:        "user",
+		ExpiresAt:   expirationTime,
+		TokenIDs:    testTokenIDs,
+		UserID:      "f0b5c5a1",
+		Username:    "jane",
+		CreatedAt:   createdAt,
+		LoginMethod: models.SessionLoginBrowser,
+	}
+
+	mock.ExpectHGet("session-12345", "userId").RedisNil()
+	mock.ExpectHSet("session-12345", "type", "user", "expiresAt", expirationTime.Unix(), "tokenIds", jsonTestTokenIDs,
+		"userId", "f0b5c5a1", "username", "jane", "createdAt", createdAt.Unix(), "lastSeenAt", int64(0),
+		"loginMethod", "browser", "clientIp", "", "userAgent", "", "idpSessionId", "", "deviceKeyHash", "",
+		"schemaVersion", currentSchemaVersion).SetVal(12)
+	mock.ExpectExpireAt("session-12345", expirationTime).SetVal(true)
+	mock.ExpectZAdd("userSessions-f0b5c5a1", redis.Z{Score: float64(expirationTime.Unix()), Member: "12345"}).SetVal(1)
+	mock.Regexp().ExpectZRemRangeByScore("userSessions-f0b5c5a1", "-inf", `^\d+$`).SetVal(0)
+	mock.ExpectHSet("tokenSessions", "test", "12345").SetVal(1)
 
 	adapter1.SetSession(ctx, mySession)
 
@@ -68,6 +84,9 @@ func TestRemoveSession(t *testing.T) {
 		Rdb: *client,
 	}
 
+	mock.ExpectHMGet("session-12345", "tokenIds", "userId").SetVal([]interface{}{`["test"]`, "f0b5c5a1"})
+	mock.ExpectZRem("userSessions-f0b5c5a1", "12345").SetVal(1)
+	mock.ExpectHDel("tokenSessions", "test").SetVal(1)
 	mock.ExpectDel("session-12345")
 
 	adapter1.RemoveSession(ctx, "12345")
@@ -103,7 +122,7 @@ func TestSetAccessToken(t *testing.T) {
 
 	mock.ExpectZAdd("indexExpiringTokens", z1)
 
-	//mock.ExpectHSet("accessTokens-12345", "accessToken", "6789", "expiresAt", expirationTime.Unix(), "URL", "https://gitlab.com", "type", "git")
+	//mock.ExpectHSet("accessTokens-12345", "accessToken", "6789", "expiresAt", expirationTime.Unix(), "URL", "https://gitlab.com", "type", "git", "schemaVersion", currentSchemaVersion)
 
 	adapter1.SetAccessToken(ctx, myAccessToken)
 
@@ -149,14 +168,8 @@ func TestRemoveAccessToken(t *testing.T) {
 		Type:      "git",
 	}
 
-	z1 := redis.Z{
-		Score:  float64(myAccessToken.ExpiresAt.Unix()),
-		Member: myAccessToken.ID,
-	}
-
-	mock.ExpectZRem("indexExpiringTokens", z1)
-
-	//mock.ExpectDel("accessTokens-12345")
+	mock.ExpectZRem("indexExpiringTokens", "12345").SetVal(1)
+	mock.ExpectDel("accessTokens-12345").SetVal(1)
 
 	adapter1.RemoveAccessToken(ctx, myAccessToken)
 
@@ -182,7 +195,8 @@ func TestSetRefreshToken(t *testing.T) {
 		ExpiresAt: expirationTime,
 	}
 
-	mock.ExpectHSet("refreshTokens-12345", "refreshToken", "6789", "expiresAt", expirationTime.Unix())
+	mock.ExpectHSet("refreshTokens-12345", "refreshToken", "6789", "expiresAt", expirationTime.Unix(), "schemaVersion", currentSchemaVersion).SetVal(3)
+	mock.ExpectZAdd("indexExpiringRefreshTokens", redis.Z{Score: float64(expirationTime.Unix()), Member: "12345"})
 
 	adapter1.SetRefreshToken(ctx, myRefreshToken)
 
@@ -218,6 +232,7 @@ func TestRemoveRefreshToken(t *testing.T) {
 		Rdb: *client,
 	}
 
+	mock.ExpectZRem("indexExpiringRefreshTokens", "12345").SetVal(1)
 	mock.ExpectDel("refreshTokens-12345")
 
 	adapter1.RemoveRefreshToken(ctx, "12345")
@@ -256,6 +271,41 @@ func TestGetExpiringAccessTokenIDs(t *testing.T) {
 	}
 }
 
+func TestGetEarliestAccessTokenExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	client, mock := redismock.NewClientMock()
+
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	afterTime := time.Now()
+	expirationTime := time.Unix(afterTime.Unix()+rand.Int63n(14400)+1, 0)
+
+	zRangeArgs := redis.ZRangeArgs{
+		Key:     "indexExpiringTokens",
+		Start:   "(" + strconv.FormatInt(afterTime.Unix(), 10),
+		Stop:    "+inf",
+		ByScore: true,
+		Count:   1,
+	}
+
+	mock.ExpectZRangeArgsWithScores(zRangeArgs).SetVal([]redis.Z{{Score: float64(expirationTime.Unix()), Member: "12345"}})
+
+	expiresAt, found, err := adapter1.GetEarliestAccessTokenExpiry(ctx, afterTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !expiresAt.Equal(expirationTime) {
+		t.Errorf("The earliest expiration is NOT the correct value, got %v want %v\n", expiresAt, expirationTime)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSetProjectToken(t *testing.T) {
 	ctx := context.Background()
 
@@ -301,7 +351,7 @@ func TestGetProjectTokens(t *testing.T) {
 	zRangeArgs := redis.ZRangeArgs{
 		Key:     "projectTokens-4567",
 		Start:   0,
-		Stop:    999999,
+		Stop:    -1,
 		ByScore: false,
 	}
 
@@ -333,14 +383,150 @@ func TestRemoveProjectToken(t *testing.T) {
 		Type:      "git",
 	}
 
-	z1 := redis.Z{
-		Score:  float64(myAccessToken.ExpiresAt.Unix()),
-		Member: myAccessToken.ID,
+	mock.ExpectZRem("projectTokens-4567", "12345").SetVal(1)
+
+	adapter1.RemoveProjectToken(ctx, 4567, myAccessToken)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
 	}
+}
+
+func TestAddSupersededRefreshToken(t *testing.T) {
+	ctx := context.Background()
 
-	mock.ExpectZRem("projectTokens-4567", z1)
+	client, mock := redismock.NewClientMock()
 
-	adapter1.RemoveProjectToken(ctx, 4567, myAccessToken)
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	myRefreshToken := models.RefreshToken{
+		ID:    "12345",
+		Value: "6789",
+	}
+
+	mock.ExpectLPush("refreshTokenHistory-12345", repository.HashTokenValue("6789")).SetVal(1)
+	mock.ExpectLTrim("refreshTokenHistory-12345", 0, repository.RefreshTokenHistoryLength-1).SetVal("OK")
+
+	err := adapter1.AddSupersededRefreshToken(ctx, myRefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsSupersededRefreshToken(t *testing.T) {
+	ctx := context.Background()
+
+	client, mock := redismock.NewClientMock()
+
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	mock.ExpectLPos("refreshTokenHistory-12345", repository.HashTokenValue("6789"), redis.LPosArgs{}).SetVal(3)
+	mock.ExpectLPos("refreshTokenHistory-12345", repository.HashTokenValue("unknown"), redis.LPosArgs{}).RedisNil()
+
+	superseded, err := adapter1.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "12345", Value: "6789"})
+	if err != nil || !superseded {
+		t.Errorf("The superseded refresh token was NOT found, got %v, %v\n", superseded, err)
+	}
+
+	superseded, err = adapter1.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "12345", Value: "unknown"})
+	if err != nil || superseded {
+		t.Errorf("An unknown refresh token was reported as superseded, got %v, %v\n", superseded, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetRefreshTokenWithoutExpiration(t *testing.T) {
+	ctx := context.Background()
+
+	client, mock := redismock.NewClientMock()
+
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	myRefreshToken := models.RefreshToken{
+		ID:        "12345",
+		Value:     "6789",
+		ExpiresAt: time.Unix(0, 0),
+	}
+
+	mock.ExpectHSet("refreshTokens-12345", "refreshToken", "6789", "expiresAt", int64(0), "schemaVersion", currentSchemaVersion).SetVal(3)
+	mock.ExpectZRem("indexExpiringRefreshTokens", "12345").SetVal(0)
+
+	err := adapter1.SetRefreshToken(ctx, myRefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetExpiringRefreshTokenIDs(t *testing.T) {
+	ctx := context.Background()
+
+	client, mock := redismock.NewClientMock()
+
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	startTime := time.Now()
+
+	stopTime := time.Now().Add(time.Hour * 4)
+
+	zRangeArgs := redis.ZRangeArgs{
+		Key:     "indexExpiringRefreshTokens",
+		Start:   startTime.Unix(),
+		Stop:    stopTime.Unix(),
+		ByScore: true,
+	}
+
+	mock.ExpectZRangeArgs(zRangeArgs).SetVal([]string{"12345"})
+
+	tokenIDs, err := adapter1.GetExpiringRefreshTokenIDs(ctx, startTime, stopTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenIDs) != 1 || tokenIDs[0] != "12345" {
+		t.Errorf("The expiring refresh token IDs are NOT correct, got %v\n", tokenIDs)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTokenSessionID(t *testing.T) {
+	ctx := context.Background()
+
+	client, mock := redismock.NewClientMock()
+
+	adapter1 := RedisAdapter{
+		Rdb: *client,
+	}
+
+	mock.ExpectHGet("tokenSessions", "6789").SetVal("12345")
+
+	sessionID, err := adapter1.GetTokenSessionID(ctx, "6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionID != "12345" {
+		t.Errorf("The session ID is NOT correct, got %v want %v\n", sessionID, "12345")
+	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Fatal(err)
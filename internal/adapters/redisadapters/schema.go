@@ -0,0 +1,249 @@
+package redisadapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/go-redis/redis/v9"
+	"golang.org/x/net/context"
+)
+
+// schemaVersionKey holds the schema version that every record in Redis has been migrated to
+const schemaVersionKey = "schemaVersion"
+
+// schemaVersionField holds the schema version of a record in its hash, records without it have version 0
+const schemaVersionField = "schemaVersion"
+
+// recordUpgrade queues the commands that upgrade the record with the given ID from one schema version to the next
+type recordUpgrade func(r *RedisAdapter, ctx context.Context, pipe redis.Pipeliner, id string, fields map[string]string)
+
+// recordUpgrades lists the upgrades of the records of each key prefix, upgrades[i] upgrades a record from version i
+// to version i+1. A change to the layout of a record adds an upgrade here.
+var recordUpgrades = map[string][]recordUpgrade{
+	"session-":       {(*RedisAdapter).upgradeSessionV1, (*RedisAdapter).upgradeSessionV2},
+	"accessTokens-":  {(*RedisAdapter).upgradeAccessTokenV1, noUpgrade},
+	"refreshTokens-": {(*RedisAdapter).upgradeRefreshTokenV1, noUpgrade},
+}
+
+// currentSchemaVersion is the schema version of the records written by this version of the gateway
+var currentSchemaVersion = len(recordUpgrades["session-"])
+
+// upgradeSessionV1 removes expired sessions and backfills the token sessions and the expiration that older gateways
+// did not write
+func (r *RedisAdapter) upgradeSessionV1(
+	ctx context.Context,
+	pipe redis.Pipeliner,
+	sessionID string,
+	fields map[string]string,
+) {
+	expiresAt, _ := strconv.ParseInt(fields["expiresAt"], 10, 64)
+	if expiresAt > 0 && expiresAt <= time.Now().Unix() {
+		pipe.Del(ctx, r.key("session-"+sessionID))
+		return
+	}
+
+	var tokenIDs []string
+	if json.Unmarshal([]byte(fields["tokenIds"]), &tokenIDs) == nil && len(tokenIDs) > 0 {
+		tokenSessions := make([]interface{}, 0, 2*len(tokenIDs))
+		for _, tokenID := range tokenIDs {
+			tokenSessions = append(tokenSessions, tokenID, sessionID)
+		}
+		pipe.HSet(ctx, r.key("tokenSessions"), tokenSessions...)
+	}
+	if expiresAt > 0 {
+		pipe.ExpireAt(ctx, r.key("session-"+sessionID), time.Unix(expiresAt, 0))
+	}
+}
+
+// upgradeSessionV2 backfills the index of the sessions of a user that older gateways did not write
+func (r *RedisAdapter) upgradeSessionV2(
+	ctx context.Context,
+	pipe redis.Pipeliner,
+	sessionID string,
+	fields map[string]string,
+) {
+	expiresAt, _ := strconv.ParseInt(fields["expiresAt"], 10, 64)
+	userID := fields["userId"]
+	// Anonymous sessions are not indexed, like in SetSession
+	if userID == "" || fields["type"] == models.SessionTypeAnonymous {
+		return
+	}
+	if expiresAt > 0 && expiresAt <= time.Now().Unix() {
+		return
+	}
+
+	// Sessions without an expiration come last, like in setUserSession
+	score := math.Inf(1)
+	if expiresAt > 0 {
+		score = float64(expiresAt)
+	}
+	pipe.ZAdd(ctx, r.key("userSessions-"+userID), redis.Z{Score: score, Member: sessionID})
+}
+
+// noUpgrade is the upgrade of the records whose layout did not change in a schema version
+func noUpgrade(*RedisAdapter, context.Context, redis.Pipeliner, string, map[string]string) {}
+
+// upgradeAccessTokenV1 backfills the expiring access token index
+func (r *RedisAdapter) upgradeAccessTokenV1(
+	ctx context.Context,
+	pipe redis.Pipeliner,
+	tokenID string,
+	fields map[string]string,
+) {
+	expiresAt, _ := strconv.ParseInt(fields["expiresAt"], 10, 64)
+	pipe.ZAdd(ctx, r.key("indexExpiringTokens"), redis.Z{Score: float64(expiresAt), Member: tokenID})
+}
+
+// upgradeRefreshTokenV1 backfills the expiring refresh token index
+func (r *RedisAdapter) upgradeRefreshTokenV1(
+	ctx context.Context,
+	pipe redis.Pipeliner,
+	tokenID string,
+	fields map[string]string,
+) {
+	expiresAt, _ := strconv.ParseInt(fields["expiresAt"], 10, 64)
+	if expiresAt <= 0 {
+		pipe.ZRem(ctx, r.key("indexExpiringRefreshTokens"), tokenID)
+		return
+	}
+	pipe.ZAdd(ctx, r.key("indexExpiringRefreshTokens"), redis.Z{Score: float64(expiresAt), Member: tokenID})
+}
+
+// recordVersion returns the schema version of a record read from Redis
+func recordVersion(fields map[string]string) int {
+	version, err := strconv.Atoi(fields[schemaVersionField])
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// SchemaVersion reads the schema version that every record has been migrated to, it is 0 if the store was never
+// migrated
+func (r *RedisAdapter) SchemaVersion(ctx context.Context) (int, error) {
+
+	version, err := r.Rdb.Get(
+		ctx,
+		r.key(schemaVersionKey),
+	).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// MigrateSchema upgrades every record that is older than the current schema version and then records the current
+// version as the schema version of the store. It scans the keys in batches of batchSize and calls progress after
+// every batch with the number of records scanned and upgraded so far. With dryRun the records that would be upgraded
+// are counted but nothing is written. Records are upgraded in optimistic transactions so it is safe to run while the
+// gateway is serving users, which also upgrades old records lazily when it reads them.
+func (r *RedisAdapter) MigrateSchema(
+	ctx context.Context,
+	batchSize int64,
+	dryRun bool,
+	progress func(scanned int, upgraded int),
+) (int, error) {
+
+	version, err := r.SchemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if version > currentSchemaVersion {
+		return 0, fmt.Errorf("the store has schema version %v, newer than the supported version %v",
+			version, currentSchemaVersion)
+	}
+
+	scanned, upgraded := 0, 0
+	for prefix := range recordUpgrades {
+		var cursor uint64
+		for {
+			keys, nextCursor, err := r.Rdb.Scan(ctx, cursor, r.keyPattern(prefix), batchSize).Result()
+			if err != nil {
+				return upgraded, err
+			}
+			for _, key := range keys {
+				changed, err := r.upgradeRecord(ctx, prefix, key[len(r.key(prefix)):], dryRun)
+				if err != nil {
+					return upgraded, err
+				}
+				scanned++
+				if changed {
+					upgraded++
+				}
+			}
+			if progress != nil {
+				progress(scanned, upgraded)
+			}
+			cursor = nextCursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	if dryRun {
+		return upgraded, nil
+	}
+	return upgraded, r.Rdb.Set(
+		ctx,
+		r.key(schemaVersionKey),
+		currentSchemaVersion,
+		0,
+	).Err()
+}
+
+// upgradeRecord upgrades a record to the current schema version if it is older, it reports whether the record was
+// (or with dryRun would have been) upgraded
+func (r *RedisAdapter) upgradeRecord(ctx context.Context, prefix string, id string, dryRun bool) (bool, error) {
+	key := r.key(prefix + id)
+	changed := false
+	err := r.Rdb.Watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, key).Result()
+		if err != nil || len(fields) == 0 {
+			return err
+		}
+		version := recordVersion(fields)
+		if version >= currentSchemaVersion {
+			return nil
+		}
+		if dryRun {
+			changed = true
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// The version is written first because an upgrade may remove the record
+			pipe.HSet(ctx, key, schemaVersionField, currentSchemaVersion)
+			for _, upgrade := range recordUpgrades[prefix][version:] {
+				upgrade(r, ctx, pipe, id, fields)
+			}
+			return nil
+		})
+		changed = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// The record was written concurrently, which means that it now has the current schema version
+		log.Printf("Record %s changed during the migration, skipping it\n", key)
+		return false, nil
+	}
+	return changed, err
+}
+
+// upgradeOnRead upgrades a record that was just read if it is older than the current schema version, failures are
+// only logged because the record can still be used as read
+func (r *RedisAdapter) upgradeOnRead(ctx context.Context, prefix string, id string, fields map[string]string) {
+	if recordVersion(fields) >= currentSchemaVersion {
+		return
+	}
+	_, err := r.upgradeRecord(ctx, prefix, id, false)
+	if err != nil {
+		log.Printf("Upgrading record %s failed: %s\n", prefix+id, err)
+	}
+}
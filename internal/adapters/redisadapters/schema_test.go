@@ -0,0 +1,148 @@
+package redisadapters
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// setVersion0Records writes records the way gateways without a schema version did: without the version field, the
+// session expiration, the token sessions and the expiring token indexes
+func setVersion0Records(server *miniredis.Miniredis) {
+	server.HSet("session-12345", "type", "user", "expiresAt", "0", "tokenIds", `["6789"]`)
+	server.HSet("session-expired", "type", "user", "expiresAt", "1", "tokenIds", `[]`)
+	server.HSet("accessTokens-6789", "accessToken", "abcd", "expiresAt", "1000", "URL", "", "type", "git")
+	server.HSet("refreshTokens-6789", "refreshToken", "efgh", "expiresAt", "2000")
+}
+
+func TestMigrateSchema(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	setVersion0Records(server)
+
+	calls := 0
+	upgraded, err := adapter1.MigrateSchema(ctx, 10, false, func(int, int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded != 4 || calls == 0 {
+		t.Errorf("The number of upgraded records is NOT correct, got %v want %v\n", upgraded, 4)
+	}
+
+	version, err := adapter1.SchemaVersion(ctx)
+	if err != nil || version != currentSchemaVersion {
+		t.Errorf("The schema version is NOT the correct value, got %v want %v\n", version, currentSchemaVersion)
+	}
+	if stored := server.HGet("accessTokens-6789", schemaVersionField); stored != "2" {
+		t.Errorf("The access token version is NOT the correct value, got %v want %v\n", stored, "2")
+	}
+	if server.Exists("session-expired") {
+		t.Errorf("The expired session was NOT removed\n")
+	}
+	if sessionID := server.HGet("tokenSessions", "6789"); sessionID != "12345" {
+		t.Errorf("The token session is NOT the correct value, got %v want %v\n", sessionID, "12345")
+	}
+	tokenIDs, err := adapter1.GetExpiringAccessTokenIDs(ctx, time.Unix(0, 0), time.Unix(1000, 0))
+	if err != nil || len(tokenIDs) != 1 {
+		t.Errorf("The access token index is NOT the correct value, got %v\n", tokenIDs)
+	}
+	tokenIDs, err = adapter1.GetExpiringRefreshTokenIDs(ctx, time.Unix(0, 0), time.Unix(2000, 0))
+	if err != nil || len(tokenIDs) != 1 {
+		t.Errorf("The refresh token index is NOT the correct value, got %v\n", tokenIDs)
+	}
+
+	// A second run finds nothing left to upgrade
+	upgraded, err = adapter1.MigrateSchema(ctx, 10, false, nil)
+	if err != nil || upgraded != 0 {
+		t.Errorf("The number of upgraded records is NOT correct, got %v want %v\n", upgraded, 0)
+	}
+}
+
+func TestMigrateSchemaIndexesUserSessions(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	// Sessions of version 1 have a user but are not in the index of the sessions of their user
+	expiresAt := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	server.HSet("session-laptop", "type", "user", "expiresAt", expiresAt, "tokenIds", `[]`, "userId", "jane",
+		schemaVersionField, "1")
+	server.HSet("session-cli", "type", "user", "expiresAt", "0", "tokenIds", `[]`, "userId", "jane",
+		schemaVersionField, "1")
+	server.HSet("session-legacy", "type", "user", "expiresAt", "0", "tokenIds", `[]`, schemaVersionField, "1")
+	server.HSet("session-guest", "type", "anonymous", "expiresAt", expiresAt, "tokenIds", `[]`, "userId", "anon-1",
+		schemaVersionField, "1")
+
+	upgraded, err := adapter1.MigrateSchema(ctx, 10, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded != 4 {
+		t.Errorf("The number of upgraded records is NOT correct, got %v want %v\n", upgraded, 4)
+	}
+	if server.Exists("userSessions-anon-1") {
+		t.Errorf("An anonymous session was indexed with the sessions of its user\n")
+	}
+	sessionIDs, err := adapter1.GetUserSessionIDs(ctx, "jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sessionIDs, []string{"laptop", "cli"}) {
+		t.Errorf("The sessions of the user are NOT correct, got %v want %v\n", sessionIDs, []string{"laptop", "cli"})
+	}
+}
+
+func TestMigrateSchemaDryRun(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	setVersion0Records(server)
+
+	upgraded, err := adapter1.MigrateSchema(ctx, 1, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded != 4 {
+		t.Errorf("The number of records to upgrade is NOT correct, got %v want %v\n", upgraded, 4)
+	}
+
+	version, err := adapter1.SchemaVersion(ctx)
+	if err != nil || version != 0 {
+		t.Errorf("The schema version is NOT the correct value, got %v want %v\n", version, 0)
+	}
+	if stored := server.HGet("accessTokens-6789", schemaVersionField); stored != "" {
+		t.Errorf("The dry run changed a record, got version %v\n", stored)
+	}
+	if !server.Exists("session-expired") {
+		t.Errorf("The dry run removed a record\n")
+	}
+}
+
+func TestUpgradeOnRead(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	setVersion0Records(server)
+
+	accessToken, err := adapter1.GetAccessToken(ctx, "6789")
+	if err != nil || accessToken.Value != "abcd" {
+		t.Errorf("The access token is NOT the correct value, got %v, %v\n", accessToken.Value, err)
+	}
+	if stored := server.HGet("accessTokens-6789", schemaVersionField); stored != "2" {
+		t.Errorf("The access token was NOT upgraded on read, got version %v\n", stored)
+	}
+	if stored := server.HGet("refreshTokens-6789", schemaVersionField); stored != "" {
+		t.Errorf("A record that was not read was upgraded, got version %v\n", stored)
+	}
+}
+
+func TestMigrateSchemaNewerStore(t *testing.T) {
+	ctx := context.Background()
+	adapter1, server := newMiniredisAdapter(t)
+	server.Set(schemaVersionKey, "99")
+
+	_, err := adapter1.MigrateSchema(ctx, 10, false, nil)
+	if err == nil {
+		t.Errorf("Migrating a store with a newer schema version did NOT fail\n")
+	}
+}
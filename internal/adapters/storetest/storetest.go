@@ -0,0 +1,716 @@
+// Package storetest contains a conformance test suite that every implementation of the gateway store runs, so that
+// the adapters can be swapped without changing the behaviour of the gateway
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// Run runs the conformance suite, newStore must return an empty store every time it is called
+func Run(t *testing.T, newStore func(t *testing.T) repository.Repository) {
+	tests := []struct {
+		name string
+		test func(*testing.T, repository.Repository)
+	}{
+		{"SessionRoundTrip", testSessionRoundTrip},
+		{"ExpiredSession", testExpiredSession},
+		{"AccessTokenRoundTrip", testAccessTokenRoundTrip},
+		{"RefreshTokenRoundTrip", testRefreshTokenRoundTrip},
+		{"NotFound", testNotFound},
+		{"ExpiringAccessTokenIDs", testExpiringAccessTokenIDs},
+		{"ExpiringRefreshTokenIDs", testExpiringRefreshTokenIDs},
+		{"EarliestAccessTokenExpiry", testEarliestAccessTokenExpiry},
+		{"ProjectTokenOrdering", testProjectTokenOrdering},
+		{"ProjectTokenPagination", testProjectTokenPagination},
+		{"ProjectTokenExpiryWindows", testProjectTokenExpiryWindows},
+		{"ProjectWebhookSecrets", testProjectWebhookSecrets},
+		{"ProjectWebhookDeactivation", testProjectWebhookDeactivation},
+		{"UserSessions", testUserSessions},
+		{"RemovalCascades", testRemovalCascades},
+		{"SupersededRefreshTokens", testSupersededRefreshTokens},
+		{"TouchSession", testTouchSession},
+		{"ReauthNoticeClaims", testReauthNoticeClaims},
+		{"SubscribeExpiringAccessTokens", testSubscribeExpiringAccessTokens},
+		{"ConcurrentAccess", testConcurrentAccess},
+		{"UpdateAppliesAllWrites", testUpdateAppliesAllWrites},
+		{"UpdateDiscardsWritesOnError", testUpdateDiscardsWritesOnError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+// unixNow returns the current time truncated to the second, the precision of the stored expirations
+func unixNow() time.Time {
+	return time.Unix(time.Now().Unix(), 0)
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkEqual(t *testing.T, name string, got interface{}, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s is NOT the correct value, got %v want %v\n", name, got, want)
+	}
+}
+
+func testSessionRoundTrip(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	session := models.Session{
+		ID:            "12345",
+		Type:          "user",
+		ExpiresAt:     unixNow().Add(time.Hour),
+		TokenIDs:      []string{"gitlab", "renku"},
+		UserID:        "f0b5c5a1",
+		Username:      "jane",
+		CreatedAt:     unixNow().Add(-time.Hour),
+		LastSeenAt:    unixNow(),
+		LoginMethod:   models.SessionLoginCLI,
+		ClientIP:      "192.0.2.1",
+		UserAgent:     "renku-cli/2.0",
+		IDPSessionID:  "idp-session",
+		DeviceKeyHash: "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b",
+	}
+	check(t, store.SetSession(ctx, session))
+
+	got, err := store.GetSession(ctx, session.ID)
+	check(t, err)
+	checkEqual(t, "session ID", got.ID, session.ID)
+	checkEqual(t, "session type", got.Type, session.Type)
+	checkEqual(t, "session expiration", got.ExpiresAt.Unix(), session.ExpiresAt.Unix())
+	checkEqual(t, "session token IDs", got.TokenIDs, session.TokenIDs)
+	checkEqual(t, "session", got, session)
+
+	for _, tokenID := range session.TokenIDs {
+		sessionID, err := store.GetTokenSessionID(ctx, tokenID)
+		check(t, err)
+		checkEqual(t, "token session ID", sessionID, session.ID)
+	}
+}
+
+func testExpiredSession(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	check(t, store.SetSession(ctx, models.Session{ID: "12345", Type: "user", ExpiresAt: unixNow().Add(-time.Minute)}))
+
+	_, err := store.GetSession(ctx, "12345")
+	checkEqual(t, "expired session error", errors.Is(err, models.ErrNotFound), true)
+}
+
+func testAccessTokenRoundTrip(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	accessToken := models.AccessToken{
+		ID:        "gitlab",
+		Value:     "access-value",
+		ExpiresAt: unixNow().Add(time.Hour),
+		URL:       "https://gitlab.example.org/oauth/token",
+		Type:      "bearer",
+		Provider:  "gitlab",
+		Subject:   "42",
+		Scopes:    []string{"api", "read_user"},
+		Audience:  []string{"renku"},
+		IssuedAt:  unixNow().Add(-time.Minute),
+	}
+	check(t, store.SetAccessToken(ctx, accessToken))
+
+	got, err := store.GetAccessToken(ctx, accessToken.ID)
+	check(t, err)
+	checkEqual(t, "access token", got, accessToken)
+
+	// Writing a token again replaces it
+	accessToken.Value = "new-access-value"
+	accessToken.ExpiresAt = accessToken.ExpiresAt.Add(time.Hour)
+	check(t, store.SetAccessToken(ctx, accessToken))
+	got, err = store.GetAccessToken(ctx, accessToken.ID)
+	check(t, err)
+	checkEqual(t, "replaced access token", got, accessToken)
+
+	// The claims a provider did not send stay empty
+	accessToken = models.AccessToken{ID: "renku", Value: "access-value", ExpiresAt: unixNow().Add(time.Hour)}
+	check(t, store.SetAccessToken(ctx, accessToken))
+	got, err = store.GetAccessToken(ctx, accessToken.ID)
+	check(t, err)
+	checkEqual(t, "access token without claims", got, accessToken)
+}
+
+func testRefreshTokenRoundTrip(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	refreshToken := models.RefreshToken{ID: "gitlab", Value: "refresh-value", ExpiresAt: unixNow().Add(time.Hour)}
+	check(t, store.SetRefreshToken(ctx, refreshToken))
+
+	got, err := store.GetRefreshToken(ctx, refreshToken.ID)
+	check(t, err)
+	checkEqual(t, "refresh token", got, refreshToken)
+}
+
+func testNotFound(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+
+	_, err := store.GetSession(ctx, "missing")
+	checkEqual(t, "missing session error", errors.Is(err, models.ErrNotFound), true)
+	_, err = store.GetAccessToken(ctx, "missing")
+	checkEqual(t, "missing access token error", errors.Is(err, models.ErrNotFound), true)
+	_, err = store.GetRefreshToken(ctx, "missing")
+	checkEqual(t, "missing refresh token error", errors.Is(err, models.ErrNotFound), true)
+
+	sessionID, err := store.GetTokenSessionID(ctx, "missing")
+	check(t, err)
+	checkEqual(t, "missing token session ID", sessionID, "")
+	projectTokens, err := store.GetProjectTokens(ctx, 42)
+	check(t, err)
+	checkEqual(t, "number of missing project tokens", len(projectTokens), 0)
+	superseded, err := store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "missing", Value: "value"})
+	check(t, err)
+	checkEqual(t, "missing refresh token is superseded", superseded, false)
+	_, found, err := store.GetEarliestAccessTokenExpiry(ctx, time.Unix(0, 0))
+	check(t, err)
+	checkEqual(t, "earliest expiry of an empty store found", found, false)
+
+	// Removing what does not exist is not an error
+	check(t, store.RemoveSession(ctx, "missing"))
+	check(t, store.RemoveAccessToken(ctx, models.AccessToken{ID: "missing"}))
+	check(t, store.RemoveRefreshToken(ctx, "missing"))
+	check(t, store.RemoveSupersededRefreshTokens(ctx, "missing"))
+	check(t, store.RemoveProjectToken(ctx, 42, models.AccessToken{ID: "missing"}))
+}
+
+func testExpiringAccessTokenIDs(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	for id, expiresIn := range map[string]time.Duration{
+		"b":     time.Minute,
+		"a":     time.Minute,
+		"early": 0,
+		"late":  2 * time.Minute,
+		"out":   time.Hour,
+	} {
+		check(t, store.SetAccessToken(ctx, models.AccessToken{ID: id, Value: id, ExpiresAt: now.Add(expiresIn)}))
+	}
+
+	// Both bounds are included and tokens are ordered by expiration and then by ID
+	ids, err := store.GetExpiringAccessTokenIDs(ctx, now, now.Add(2*time.Minute))
+	check(t, err)
+	checkEqual(t, "expiring token IDs", ids, []string{"early", "a", "b", "late"})
+
+	ids, err = store.GetExpiringAccessTokenIDs(ctx, now.Add(2*time.Hour), now.Add(3*time.Hour))
+	check(t, err)
+	checkEqual(t, "number of expiring token IDs out of range", len(ids), 0)
+}
+
+func testExpiringRefreshTokenIDs(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	check(t, store.SetRefreshToken(ctx, models.RefreshToken{ID: "b", Value: "b", ExpiresAt: now.Add(time.Hour)}))
+	check(t, store.SetRefreshToken(ctx, models.RefreshToken{ID: "a", Value: "a", ExpiresAt: now.Add(time.Minute)}))
+	// Refresh tokens without an expiration are never in the index
+	check(t, store.SetRefreshToken(ctx, models.RefreshToken{ID: "c", Value: "c", ExpiresAt: time.Unix(0, 0)}))
+
+	ids, err := store.GetExpiringRefreshTokenIDs(ctx, time.Unix(0, 0), now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "expiring refresh token IDs", ids, []string{"a", "b"})
+
+	// A token that stops expiring leaves the index
+	check(t, store.SetRefreshToken(ctx, models.RefreshToken{ID: "a", Value: "a", ExpiresAt: time.Unix(0, 0)}))
+	ids, err = store.GetExpiringRefreshTokenIDs(ctx, time.Unix(0, 0), now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "expiring refresh token IDs", ids, []string{"b"})
+}
+
+func testEarliestAccessTokenExpiry(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	check(t, store.SetAccessToken(ctx, models.AccessToken{ID: "a", Value: "a", ExpiresAt: now.Add(time.Minute)}))
+	check(t, store.SetAccessToken(ctx, models.AccessToken{ID: "b", Value: "b", ExpiresAt: now.Add(time.Hour)}))
+
+	expiresAt, found, err := store.GetEarliestAccessTokenExpiry(ctx, now)
+	check(t, err)
+	checkEqual(t, "earliest expiry found", found, true)
+	checkEqual(t, "earliest expiry", expiresAt.Unix(), now.Add(time.Minute).Unix())
+
+	// The given time is excluded
+	expiresAt, found, err = store.GetEarliestAccessTokenExpiry(ctx, now.Add(time.Minute))
+	check(t, err)
+	checkEqual(t, "earliest expiry found", found, true)
+	checkEqual(t, "earliest expiry", expiresAt.Unix(), now.Add(time.Hour).Unix())
+
+	_, found, err = store.GetEarliestAccessTokenExpiry(ctx, now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "earliest expiry found", found, false)
+}
+
+func testProjectTokenOrdering(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "late", ExpiresAt: now.Add(time.Hour)}))
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "b", ExpiresAt: now}))
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "a", ExpiresAt: now}))
+	check(t, store.SetProjectToken(ctx, 2, models.AccessToken{ID: "other", ExpiresAt: now}))
+
+	tokens, err := store.GetProjectTokens(ctx, 1)
+	check(t, err)
+	checkEqual(t, "project tokens", tokens, []string{"a", "b", "late"})
+
+	check(t, store.RemoveProjectToken(ctx, 1, models.AccessToken{ID: "b"}))
+	tokens, err = store.GetProjectTokens(ctx, 1)
+	check(t, err)
+	checkEqual(t, "project tokens", tokens, []string{"a", "late"})
+	tokens, err = store.GetProjectTokens(ctx, 2)
+	check(t, err)
+	checkEqual(t, "other project tokens", tokens, []string{"other"})
+}
+
+func testProjectTokenPagination(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	var want []models.ProjectToken
+	// Several tokens share an expiration so that pages end in the middle of them
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		token := models.ProjectToken{ID: id, ExpiresAt: now.Add(time.Duration(i/3) * time.Minute)}
+		check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: token.ID, ExpiresAt: token.ExpiresAt}))
+		want = append(want, token)
+	}
+	check(t, store.SetProjectToken(ctx, 2, models.AccessToken{ID: "other", ExpiresAt: now}))
+
+	var got []models.ProjectToken
+	query := models.ProjectTokenQuery{Limit: 2}
+	pages := 0
+	for {
+		page, err := store.ListProjectTokens(ctx, 1, query)
+		check(t, err)
+		got = append(got, page.Tokens...)
+		pages++
+		if page.NextCursor == "" || pages > 5 {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	checkEqual(t, "listed project tokens", got, want)
+	checkEqual(t, "number of pages", pages, 3)
+
+	page, err := store.ListProjectTokens(ctx, 3, models.ProjectTokenQuery{})
+	check(t, err)
+	checkEqual(t, "tokens of a project without tokens", len(page.Tokens), 0)
+	checkEqual(t, "next cursor of a project without tokens", page.NextCursor, "")
+
+	_, err = store.ListProjectTokens(ctx, 1, models.ProjectTokenQuery{Cursor: "not a cursor"})
+	checkEqual(t, "invalid cursor error", err, models.ErrInvalidCursor)
+}
+
+func testProjectTokenExpiryWindows(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "expired", ExpiresAt: now.Add(-time.Hour)}))
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "expiring-now", ExpiresAt: now}))
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "soon", ExpiresAt: now.Add(time.Minute)}))
+	check(t, store.SetProjectToken(ctx, 1, models.AccessToken{ID: "valid", ExpiresAt: now.Add(time.Hour)}))
+
+	listIDs := func(query models.ProjectTokenQuery) []string {
+		t.Helper()
+		page, err := store.ListProjectTokens(ctx, 1, query)
+		check(t, err)
+		var ids []string
+		for _, token := range page.Tokens {
+			ids = append(ids, token.ID)
+		}
+		return ids
+	}
+	checkEqual(t, "valid project tokens", listIDs(models.ValidProjectTokens(now)), []string{"soon", "valid"})
+	checkEqual(t, "expiring project tokens", listIDs(models.ExpiringProjectTokens(now, time.Minute)), []string{"soon"})
+	checkEqual(t, "expired project tokens", listIDs(models.ExpiredProjectTokens(now)), []string{"expired", "expiring-now"})
+
+	// The expiry window applies to every page
+	query := models.ValidProjectTokens(now)
+	query.Limit = 1
+	page, err := store.ListProjectTokens(ctx, 1, query)
+	check(t, err)
+	query.Cursor = page.NextCursor
+	page, err = store.ListProjectTokens(ctx, 1, query)
+	check(t, err)
+	checkEqual(t, "second page of valid project tokens", page.Tokens,
+		[]models.ProjectToken{{ID: "valid", ExpiresAt: now.Add(time.Hour)}})
+	checkEqual(t, "next cursor of the last page", page.NextCursor, "")
+}
+
+func testProjectWebhookSecrets(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	_, err := store.GetProjectWebhookSecret(ctx, 1)
+	checkEqual(t, "missing webhook secret error", err, models.ErrNotFound)
+
+	check(t, store.SetProjectWebhookSecret(ctx, 1, "first"))
+	check(t, store.SetProjectWebhookSecret(ctx, 2, "other"))
+	check(t, store.Update(ctx, func(tx repository.Writer) error {
+		return tx.SetProjectWebhookSecret(ctx, 1, "second")
+	}))
+	secret, err := store.GetProjectWebhookSecret(ctx, 1)
+	check(t, err)
+	checkEqual(t, "webhook secret", secret, "second")
+
+	check(t, store.RemoveProjectWebhookSecret(ctx, 1))
+	check(t, store.RemoveProjectWebhookSecret(ctx, 1))
+	_, err = store.GetProjectWebhookSecret(ctx, 1)
+	checkEqual(t, "removed webhook secret error", err, models.ErrNotFound)
+	secret, err = store.GetProjectWebhookSecret(ctx, 2)
+	check(t, err)
+	checkEqual(t, "other webhook secret", secret, "other")
+}
+
+func testProjectWebhookDeactivation(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	webhooks, err := store.ListProjectWebhooks(ctx)
+	check(t, err)
+	checkEqual(t, "webhooks of an empty store", webhooks, []models.ProjectWebhook{})
+
+	check(t, store.SetProjectWebhookSecret(ctx, 10, "ten"))
+	check(t, store.SetProjectWebhookSecret(ctx, 9, "nine"))
+	check(t, store.SetProjectWebhookSecret(ctx, 11, "eleven"))
+	check(t, store.Update(ctx, func(tx repository.Writer) error {
+		return tx.DeactivateProjectWebhook(ctx, 10)
+	}))
+	check(t, store.DeactivateProjectWebhook(ctx, 12))
+
+	_, err = store.GetProjectWebhookSecret(ctx, 10)
+	checkEqual(t, "deactivated webhook secret error", err, models.ErrNotFound)
+	webhooks, err = store.ListProjectWebhooks(ctx)
+	check(t, err)
+	checkEqual(t, "webhooks", webhooks, []models.ProjectWebhook{
+		{ProjectID: 9, Active: true},
+		{ProjectID: 10, Active: false},
+		{ProjectID: 11, Active: true},
+		{ProjectID: 12, Active: false},
+	})
+
+	// A deactivated project can be activated again
+	check(t, store.SetProjectWebhookSecret(ctx, 12, "twelve"))
+	check(t, store.RemoveProjectWebhookSecret(ctx, 10))
+	check(t, store.RemoveProjectWebhookSecret(ctx, 11))
+	webhooks, err = store.ListProjectWebhooks(ctx)
+	check(t, err)
+	checkEqual(t, "webhooks after removal", webhooks, []models.ProjectWebhook{
+		{ProjectID: 9, Active: true},
+		{ProjectID: 12, Active: true},
+	})
+}
+
+func testUserSessions(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	check(t, store.SetSession(ctx, models.Session{ID: "forever", UserID: "jane"}))
+	check(t, store.SetSession(ctx, models.Session{ID: "late", UserID: "jane", ExpiresAt: now.Add(time.Hour)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "b", UserID: "jane", ExpiresAt: now.Add(time.Minute)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "a", UserID: "jane", ExpiresAt: now.Add(time.Minute)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "expired", UserID: "jane", ExpiresAt: now.Add(-time.Minute)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "other", UserID: "john", ExpiresAt: now.Add(time.Hour)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "anonymous", ExpiresAt: now.Add(time.Hour)}))
+	check(t, store.SetSession(ctx, models.Session{
+		ID:        "guest",
+		Type:      models.SessionTypeAnonymous,
+		UserID:    "anon-1234",
+		ExpiresAt: now.Add(time.Hour),
+	}))
+
+	ids, err := store.GetUserSessionIDs(ctx, "jane")
+	check(t, err)
+	checkEqual(t, "user sessions", ids, []string{"a", "b", "late", "forever"})
+
+	// A refreshed session moves with its expiration and its user
+	check(t, store.SetSession(ctx, models.Session{ID: "a", UserID: "jane", ExpiresAt: now.Add(2 * time.Hour)}))
+	check(t, store.SetSession(ctx, models.Session{ID: "b", UserID: "john", ExpiresAt: now.Add(time.Minute)}))
+	ids, err = store.GetUserSessionIDs(ctx, "jane")
+	check(t, err)
+	checkEqual(t, "refreshed user sessions", ids, []string{"late", "a", "forever"})
+	ids, err = store.GetUserSessionIDs(ctx, "john")
+	check(t, err)
+	checkEqual(t, "sessions of the new user", ids, []string{"b", "other"})
+
+	check(t, store.RemoveSession(ctx, "late"))
+	check(t, store.Update(ctx, func(tx repository.Writer) error {
+		return tx.RemoveSession(ctx, "forever")
+	}))
+	ids, err = store.GetUserSessionIDs(ctx, "jane")
+	check(t, err)
+	checkEqual(t, "user sessions after removal", ids, []string{"a"})
+	ids, err = store.GetUserSessionIDs(ctx, "nobody")
+	check(t, err)
+	checkEqual(t, "number of sessions of an unknown user", len(ids), 0)
+	ids, err = store.GetUserSessionIDs(ctx, "anon-1234")
+	check(t, err)
+	checkEqual(t, "number of sessions of an anonymous user", len(ids), 0)
+}
+
+func testRemovalCascades(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	accessToken := models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: now.Add(time.Minute)}
+	refreshToken := models.RefreshToken{ID: "gitlab", Value: "refresh", ExpiresAt: now.Add(time.Hour)}
+	session := models.Session{ID: "12345", Type: "user", ExpiresAt: now.Add(time.Hour), TokenIDs: []string{"gitlab"}}
+	check(t, store.SetAccessToken(ctx, accessToken))
+	check(t, store.SetRefreshToken(ctx, refreshToken))
+	check(t, store.SetSession(ctx, session))
+
+	check(t, store.RemoveSession(ctx, session.ID))
+	sessionID, err := store.GetTokenSessionID(ctx, accessToken.ID)
+	check(t, err)
+	checkEqual(t, "token session ID after removing the session", sessionID, "")
+
+	check(t, store.RemoveAccessToken(ctx, accessToken))
+	ids, err := store.GetExpiringAccessTokenIDs(ctx, now, now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "number of expiring token IDs after removal", len(ids), 0)
+	_, found, err := store.GetEarliestAccessTokenExpiry(ctx, now)
+	check(t, err)
+	checkEqual(t, "earliest expiry found after removal", found, false)
+
+	check(t, store.RemoveRefreshToken(ctx, refreshToken.ID))
+	ids, err = store.GetExpiringRefreshTokenIDs(ctx, now, now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "number of expiring refresh token IDs after removal", len(ids), 0)
+	_, err = store.GetRefreshToken(ctx, refreshToken.ID)
+	checkEqual(t, "removed refresh token error", errors.Is(err, models.ErrNotFound), true)
+}
+
+func testSupersededRefreshTokens(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	// Only the latest superseded values are kept
+	for i := 0; i < 11; i++ {
+		check(t, store.AddSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: fmt.Sprint(i)}))
+	}
+
+	superseded, err := store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "10"})
+	check(t, err)
+	checkEqual(t, "latest value is superseded", superseded, true)
+	superseded, err = store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "0"})
+	check(t, err)
+	checkEqual(t, "oldest value is superseded", superseded, false)
+	superseded, err = store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "other", Value: "10"})
+	check(t, err)
+	checkEqual(t, "value of another token is superseded", superseded, false)
+
+	check(t, store.RemoveSupersededRefreshTokens(ctx, "gitlab"))
+	superseded, err = store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "10"})
+	check(t, err)
+	checkEqual(t, "removed value is superseded", superseded, false)
+}
+
+func testTouchSession(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	session := models.Session{
+		ID:         "12345",
+		Type:       "user",
+		ExpiresAt:  now.Add(time.Hour),
+		TokenIDs:   []string{"gitlab"},
+		UserID:     "f0b5c5a1",
+		CreatedAt:  now.Add(-time.Hour),
+		LastSeenAt: now.Add(-time.Hour),
+	}
+	check(t, store.SetSession(ctx, session))
+
+	touched, err := store.TouchSession(ctx, session.ID, now, time.Time{})
+	check(t, err)
+	checkEqual(t, "session touched", touched, true)
+	got, err := store.GetSession(ctx, session.ID)
+	check(t, err)
+	session.LastSeenAt = now
+	checkEqual(t, "touched session", got, session)
+
+	touched, err = store.TouchSession(ctx, session.ID, now, now.Add(2*time.Hour))
+	check(t, err)
+	checkEqual(t, "session extended", touched, true)
+	got, err = store.GetSession(ctx, session.ID)
+	check(t, err)
+	checkEqual(t, "extended expiration", got.ExpiresAt, now.Add(2*time.Hour))
+	sessionIDs, err := store.GetUserSessionIDs(ctx, session.UserID)
+	check(t, err)
+	checkEqual(t, "user sessions", sessionIDs, []string{session.ID})
+	sessionID, err := store.GetTokenSessionID(ctx, "gitlab")
+	check(t, err)
+	checkEqual(t, "token session ID", sessionID, session.ID)
+
+	// A removed session is not written again
+	check(t, store.RemoveSession(ctx, session.ID))
+	touched, err = store.TouchSession(ctx, session.ID, now, now.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "removed session touched", touched, false)
+	_, err = store.GetSession(ctx, session.ID)
+	checkEqual(t, "removed session error", errors.Is(err, models.ErrNotFound), true)
+}
+
+func testReauthNoticeClaims(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	expiresAt := unixNow().Add(time.Hour)
+
+	claimed, err := store.ClaimReauthNotice(ctx, "gitlab", expiresAt)
+	check(t, err)
+	checkEqual(t, "first claim", claimed, true)
+	claimed, err = store.ClaimReauthNotice(ctx, "gitlab", expiresAt)
+	check(t, err)
+	checkEqual(t, "second claim", claimed, false)
+	claimed, err = store.ClaimReauthNotice(ctx, "renku", expiresAt)
+	check(t, err)
+	checkEqual(t, "claim of another token", claimed, true)
+
+	// A refresh extends the expiration, which has to be notified again
+	claimed, err = store.ClaimReauthNotice(ctx, "gitlab", expiresAt.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "claim of a later expiration", claimed, true)
+
+	check(t, store.ReleaseReauthNotice(ctx, "gitlab", expiresAt.Add(time.Hour)))
+	claimed, err = store.ClaimReauthNotice(ctx, "gitlab", expiresAt.Add(time.Hour))
+	check(t, err)
+	checkEqual(t, "claim after a release", claimed, true)
+}
+
+func testSubscribeExpiringAccessTokens(t *testing.T, store repository.Repository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := store.SubscribeExpiringAccessTokens(ctx)
+	check(t, err)
+
+	expiresAt := unixNow().Add(time.Minute)
+	check(t, store.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: expiresAt}))
+	select {
+	case update := <-updates:
+		checkEqual(t, "expiring token update", update.Unix(), expiresAt.Unix())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no expiring token update received")
+	}
+
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range updates {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the updates channel is not closed once the context is done")
+	}
+}
+
+func testConcurrentAccess(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	workers, tokensPerWorker := 8, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < tokensPerWorker; i++ {
+				id := fmt.Sprintf("token-%d-%d", w, i)
+				accessToken := models.AccessToken{ID: id, Value: id, ExpiresAt: now.Add(time.Minute)}
+				if err := store.SetAccessToken(ctx, accessToken); err != nil {
+					errs <- err
+					return
+				}
+				if err := store.SetProjectToken(ctx, 1, accessToken); err != nil {
+					errs <- err
+					return
+				}
+				got, err := store.GetAccessToken(ctx, id)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if got.Value != id {
+					errs <- fmt.Errorf("access token %s has the value %s", id, got.Value)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	ids, err := store.GetExpiringAccessTokenIDs(ctx, now, now.Add(time.Minute))
+	check(t, err)
+	checkEqual(t, "number of expiring token IDs", len(ids), workers*tokensPerWorker)
+	tokens, err := store.GetProjectTokens(ctx, 1)
+	check(t, err)
+	checkEqual(t, "number of project tokens", len(tokens), workers*tokensPerWorker)
+}
+
+func testUpdateAppliesAllWrites(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	accessToken := models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: now.Add(time.Minute)}
+	refreshToken := models.RefreshToken{ID: "gitlab", Value: "refresh", ExpiresAt: now.Add(time.Hour)}
+	session := models.Session{ID: "12345", Type: "user", ExpiresAt: now.Add(time.Hour), TokenIDs: []string{"gitlab"}}
+	check(t, store.SetSession(ctx, models.Session{ID: "old", Type: "user", ExpiresAt: now.Add(time.Hour)}))
+
+	err := store.Update(ctx, func(tx repository.Writer) error {
+		check(t, tx.SetAccessToken(ctx, accessToken))
+		check(t, tx.SetRefreshToken(ctx, refreshToken))
+		check(t, tx.AddSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "superseded"}))
+		check(t, tx.SetProjectToken(ctx, 1, accessToken))
+		check(t, tx.SetSession(ctx, session))
+		return tx.RemoveSession(ctx, "old")
+	})
+	check(t, err)
+
+	gotAccessToken, err := store.GetAccessToken(ctx, accessToken.ID)
+	check(t, err)
+	checkEqual(t, "access token", gotAccessToken, accessToken)
+	gotRefreshToken, err := store.GetRefreshToken(ctx, refreshToken.ID)
+	check(t, err)
+	checkEqual(t, "refresh token", gotRefreshToken, refreshToken)
+	superseded, err := store.IsSupersededRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "superseded"})
+	check(t, err)
+	checkEqual(t, "value is superseded", superseded, true)
+	projectTokens, err := store.GetProjectTokens(ctx, 1)
+	check(t, err)
+	checkEqual(t, "project tokens", projectTokens, []string{"gitlab"})
+	sessionID, err := store.GetTokenSessionID(ctx, "gitlab")
+	check(t, err)
+	checkEqual(t, "token session ID", sessionID, session.ID)
+	_, err = store.GetSession(ctx, "old")
+	checkEqual(t, "removed session error", errors.Is(err, models.ErrNotFound), true)
+}
+
+func testUpdateDiscardsWritesOnError(t *testing.T, store repository.Repository) {
+	ctx := context.Background()
+	now := unixNow()
+	failure := errors.New("failure")
+	check(t, store.SetSession(ctx, models.Session{ID: "12345", Type: "user", ExpiresAt: now.Add(time.Hour)}))
+
+	err := store.Update(ctx, func(tx repository.Writer) error {
+		check(t, tx.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "access", ExpiresAt: now}))
+		check(t, tx.SetRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "refresh", ExpiresAt: now}))
+		check(t, tx.RemoveSession(ctx, "12345"))
+		return failure
+	})
+	checkEqual(t, "update error", errors.Is(err, failure), true)
+
+	_, err = store.GetAccessToken(ctx, "gitlab")
+	checkEqual(t, "discarded access token error", errors.Is(err, models.ErrNotFound), true)
+	_, err = store.GetRefreshToken(ctx, "gitlab")
+	checkEqual(t, "discarded refresh token error", errors.Is(err, models.ErrNotFound), true)
+	ids, err := store.GetExpiringAccessTokenIDs(ctx, now, now)
+	check(t, err)
+	checkEqual(t, "number of expiring token IDs", len(ids), 0)
+	_, err = store.GetSession(ctx, "12345")
+	check(t, err)
+}
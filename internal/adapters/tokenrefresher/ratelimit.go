@@ -0,0 +1,75 @@
+package tokenrefresher
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit defines a token bucket that refills at RequestsPerSecond and allows bursts of up to Burst requests
+type RateLimit struct {
+	RequestsPerSecond float64
+	// Burst defaults to the requests of one second, a limiter without burst would refuse every request
+	Burst int
+}
+
+// withDefaults returns a copy of the rate limit where unset values are replaced by defaults
+func (l RateLimit) withDefaults() RateLimit {
+	if l.RequestsPerSecond <= 0 {
+		return RateLimit{RequestsPerSecond: defaultRequestsPerSecond, Burst: defaultBurst}
+	}
+	if l.Burst <= 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.RequestsPerSecond)))
+	}
+	return l
+}
+
+// providerLimiters keeps one token bucket per provider, a provider is identified by the host of its token URL
+type providerLimiters struct {
+	mu           sync.Mutex
+	limits       map[string]RateLimit
+	defaultLimit RateLimit
+	limiters     map[string]*rate.Limiter
+}
+
+func newProviderLimiters(limits map[string]RateLimit, defaultLimit RateLimit) *providerLimiters {
+	return &providerLimiters{
+		limits:       limits,
+		defaultLimit: defaultLimit,
+		limiters:     map[string]*rate.Limiter{},
+	}
+}
+
+// wait blocks until the provider serving tokenURL allows another request or the context is done
+func (p *providerLimiters) wait(ctx context.Context, tokenURL string) error {
+	return p.limiter(providerKey(tokenURL)).Wait(ctx)
+}
+
+// limiter returns the token bucket for a provider, creating it on first use
+func (p *providerLimiters) limiter(provider string) *rate.Limiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if limiter, found := p.limiters[provider]; found {
+		return limiter
+	}
+	limit, found := p.limits[provider]
+	if !found {
+		limit = p.defaultLimit
+	}
+	limiter := rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst)
+	p.limiters[provider] = limiter
+	return limiter
+}
+
+// providerKey returns the host of a token URL, or the URL itself if it cannot be parsed
+func providerKey(tokenURL string) string {
+	parsed, err := url.Parse(tokenURL)
+	if err != nil || parsed.Host == "" {
+		return tokenURL
+	}
+	return parsed.Host
+}
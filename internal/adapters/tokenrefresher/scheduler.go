@@ -0,0 +1,161 @@
+package tokenrefresher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrAlreadyStarted is returned when starting a token refresher that is already running
+var ErrAlreadyStarted = errors.New("the token refresher is already running")
+
+// ScheduleRefreshExpiringTokens refreshes the tokens in the token store shortly before they expire. Instead of polling
+// it sleeps until the earliest expiration in the token store minus the lead time, and wakes up earlier when the token
+// store reports a token that expires sooner. It returns once the context is done and in-flight refreshes completed.
+func ScheduleRefreshExpiringTokens(ctx context.Context, tokenStore RefresherTokenStore, config Config) error {
+	return NewTokenRefresher(tokenStore, config).Run(ctx)
+}
+
+// Run starts the token refresher and blocks until the context is done and the in-flight refreshes completed
+func (r *TokenRefresher) Run(ctx context.Context) error {
+	done, err := r.start(ctx)
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Start runs the token refresher in the background until the context is done or Stop is called
+func (r *TokenRefresher) Start(ctx context.Context) error {
+	_, err := r.start(ctx)
+	return err
+}
+
+// start launches the delay queue loop and returns a channel that is closed when the loop has returned
+func (r *TokenRefresher) start(ctx context.Context) (<-chan struct{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil {
+		return nil, ErrAlreadyStarted
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	updates, err := r.store.SubscribeExpiringAccessTokens(runCtx)
+	if err != nil {
+		cancel()
+		log.Printf("Subscribing to expiring token updates failed: %s\n", err)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	r.cancel = cancel
+	r.done = done
+	go func() {
+		defer close(done)
+		r.run(runCtx, updates)
+		cancel()
+		// Allow the refresher to be started again once the loop has returned
+		r.mu.Lock()
+		if r.done == done {
+			r.cancel, r.done = nil, nil
+		}
+		r.mu.Unlock()
+		log.Printf("Token refresher stopped\n")
+	}()
+	return done, nil
+}
+
+// Stop stops the token refresher from starting new refreshes and waits until the in-flight refreshes have been
+// persisted or the shutdown timeout has passed. It is safe to call Stop on a refresher that is not running.
+func (r *TokenRefresher) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// run is the delay queue loop of the token refresher
+func (r *TokenRefresher) run(ctx context.Context, updates <-chan time.Time) {
+	// Run once right away to catch up with the tokens that expired while the refresher was not running
+	nextRun := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			nextRun = r.runOnce(ctx)
+			resetTimer(timer, nextRun)
+		case expiresAt, ok := <-updates:
+			if !ok {
+				// The subscription is gone, from now on the refresher only wakes up at the computed deadlines
+				log.Printf("Expiring token updates stopped, relying on scheduled deadlines only\n")
+				updates = nil
+				continue
+			}
+			deadline := expiresAt.Add(-r.config.LeadTime)
+			if nextRun.IsZero() || deadline.Before(nextRun) {
+				nextRun = deadline
+				resetTimer(timer, nextRun)
+			}
+		}
+	}
+}
+
+// runOnce refreshes the tokens that are due and returns when the refresher should run next, a zero time means that
+// there is nothing to refresh until the token store reports a new token. The tokens that already expired are refreshed
+// as well, their refresh tokens may still be valid: they expired while the refresher was not running or their
+// previous refreshes failed until they expired.
+func (r *TokenRefresher) runOnce(ctx context.Context) time.Time {
+	now := time.Now()
+	refreshErr := r.refreshTokensExpiringBetween(ctx, catchUpStart, now.Add(r.config.LeadTime))
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
+
+	var nextRun time.Time
+	expiresAt, found, err := r.store.GetEarliestAccessTokenExpiry(ctx, now.Add(r.config.LeadTime))
+	if err != nil {
+		log.Printf("GetEarliestAccessTokenExpiry failed: %s\n", err)
+		return now.Add(r.config.RetryInterval)
+	}
+	if found {
+		nextRun = expiresAt.Add(-r.config.LeadTime)
+	}
+
+	// Tokens that failed to refresh are still in the index, retry them later
+	retryAt := now.Add(r.config.RetryInterval)
+	if refreshErr != nil && (nextRun.IsZero() || retryAt.Before(nextRun)) {
+		nextRun = retryAt
+	}
+
+	if nextRun.IsZero() {
+		log.Printf("No tokens to refresh, waiting for new tokens\n")
+	} else {
+		log.Printf("Next token refresh scheduled at %v\n", nextRun)
+	}
+	return nextRun
+}
+
+// resetTimer stops the timer and restarts it so that it fires at the deadline, a zero deadline leaves it stopped
+func resetTimer(timer *time.Timer, deadline time.Time) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if !deadline.IsZero() {
+		timer.Reset(time.Until(deadline))
+	}
+}
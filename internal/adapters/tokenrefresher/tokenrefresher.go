@@ -8,10 +8,12 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
-	"github.com/go-co-op/gocron"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 )
 
 // tokenReponse struct required to unmarshal the response from a POST token refresh request
@@ -29,112 +31,371 @@ func (t tokenResponse) String() string {
 	return fmt.Sprintf("CreatedAt: %v, Type: %v, ExpiresIn: %v, RefreshTokenExpiresIn: %v", t.CreatedAt, t.Type, t.ExpiresIn, t.RefreshTokenExpiresIn)
 }
 
+var _ RefresherTokenStore = repository.Repository(nil)
+
 // RefresherTokenStore is an interface used for refreshing tokens stored by the gateway
 type RefresherTokenStore interface {
-	GetRefreshToken(context.Context, string) (models.RefreshToken, error)
-	GetAccessToken(context.Context, string) (models.AccessToken, error)
-	SetRefreshToken(context.Context, models.RefreshToken) error
-	SetAccessToken(context.Context, models.AccessToken) error
-	GetExpiringAccessTokenIDs(context.Context, time.Time, time.Time) ([]string, error)
+	repository.AccessTokenReader
+	repository.RefreshTokenReader
+	repository.ExpiringTokenIndex
+	repository.Transactor
 }
 
-// ScheduleRefreshExpiringTokens intialises a gocron job to run refreshExpiringTokens at a specified interval
-func ScheduleRefreshExpiringTokens(ctx context.Context, tokenStore RefresherTokenStore, gitlabClientID string, gitlabClientSecret string, minsToExpiration int) error {
-	s := gocron.NewScheduler(time.UTC)
-	job, err := s.Every(minsToExpiration).Minutes().Do(refreshExpiringTokens, ctx, tokenStore, gitlabClientID, gitlabClientSecret, minsToExpiration)
-	s.StartBlocking()
-	if err != nil {
-		log.Printf("Starting gocron job failed: %s\n", err)
-	} else {
-		log.Printf("Job starting: %v\n", job)
+// ExpiringTokenClaimer is implemented by the token stores that are shared by several gateway replicas. The refresher
+// claims the expiring tokens of such a store so that every token is refreshed by a single replica, a claim lasts for
+// the retry interval so that the tokens that failed to refresh are retried by any replica.
+type ExpiringTokenClaimer interface {
+	ClaimExpiringAccessTokenIDs(
+		ctx context.Context,
+		startTime time.Time,
+		stopTime time.Time,
+		claimFor time.Duration,
+	) ([]string, error)
+}
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultConcurrency       = 10
+	defaultHTTPTimeout       = 10 * time.Second
+	defaultRequestsPerSecond = 5
+	defaultBurst             = 10
+	defaultLeadTime          = 5 * time.Minute
+	defaultRetryInterval     = time.Minute
+	defaultShutdownTimeout   = 30 * time.Second
+)
+
+// catchUpStart is the start of the window of the scheduled refreshes, it includes every token that already expired but
+// leaves out the tokens without an expiration, which are indexed at 0
+var catchUpStart = time.Unix(1, 0)
+
+// Config contains the settings used to refresh tokens
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	// LeadTime is how long before its expiration an access token is refreshed
+	LeadTime time.Duration
+	// RetryInterval is how long to wait before retrying refreshes that failed
+	RetryInterval time.Duration
+	// ShutdownTimeout is how long in-flight refreshes may take to complete once the refresher is stopped
+	ShutdownTimeout time.Duration
+	// Concurrency is the maximum number of tokens that are refreshed in parallel
+	Concurrency int
+	// HTTPTimeout is the maximum duration of a single refresh request
+	HTTPTimeout time.Duration
+	// RateLimits contains the rate limit of each provider, keyed by the host of the provider token URL
+	RateLimits map[string]RateLimit
+	// DefaultRateLimit is used for providers that are not listed in RateLimits
+	DefaultRateLimit RateLimit
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaultConcurrency
+	}
+	if c.HTTPTimeout <= 0 {
+		c.HTTPTimeout = defaultHTTPTimeout
+	}
+	if c.LeadTime <= 0 {
+		c.LeadTime = defaultLeadTime
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	c.DefaultRateLimit = c.DefaultRateLimit.withDefaults()
+	// The limits are copied so that the map of the caller is not changed
+	rateLimits := make(map[string]RateLimit, len(c.RateLimits))
+	for provider, limit := range c.RateLimits {
+		rateLimits[provider] = limit.withDefaults()
+	}
+	c.RateLimits = rateLimits
+	return c
+}
+
+// TokenRefresher refreshes expiring tokens from a token store with a bounded pool of workers
+type TokenRefresher struct {
+	store    RefresherTokenStore
+	config   Config
+	client   *http.Client
+	limiters *providerLimiters
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewTokenRefresher creates a token refresher with a dedicated HTTP client and per-provider rate limits
+func NewTokenRefresher(tokenStore RefresherTokenStore, config Config) *TokenRefresher {
+	config = config.withDefaults()
+	return &TokenRefresher{
+		store:    tokenStore,
+		config:   config,
+		client:   newHTTPClient(config.HTTPTimeout, config.Concurrency),
+		limiters: newProviderLimiters(config.RateLimits, config.DefaultRateLimit),
+	}
+}
+
+// newHTTPClient creates an HTTP client with a request timeout that keeps enough idle connections for every worker
+func newHTTPClient(timeout time.Duration, maxConnsPerHost int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxConnsPerHost * 2
+	transport.MaxIdleConnsPerHost = maxConnsPerHost
+	transport.MaxConnsPerHost = maxConnsPerHost
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
 	}
-	return err
 }
 
-// refreshExpiringTokens refreshes tokens in the token store expiring in the next minsToExpiration minutes
-func refreshExpiringTokens(ctx context.Context, tokenStore RefresherTokenStore, clientID string, clientSecret string, minsToExpiration int) error {
-	// Get a list of expiring access tokens ids in the next minsToExpiration minutes
-	expiringTokenIDs, err := tokenStore.GetExpiringAccessTokenIDs(ctx, time.Now(), time.Now().Add(time.Minute*time.Duration(minsToExpiration)))
+// refreshExpiringTokens refreshes tokens in the token store expiring within the lead time after now
+func (r *TokenRefresher) refreshExpiringTokens(ctx context.Context, now time.Time) error {
+	return r.refreshTokensExpiringBetween(ctx, now, now.Add(r.config.LeadTime))
+}
+
+// refreshTokensExpiringBetween refreshes tokens in the token store expiring between start and stop. Once ctx is
+// done no more refreshes are started, the refreshes that are in flight are given the shutdown timeout to complete.
+func (r *TokenRefresher) refreshTokensExpiringBetween(ctx context.Context, start time.Time, stop time.Time) error {
+	expiringTokenIDs, err := r.expiringTokenIDs(ctx, start, stop)
 	if err != nil {
-		log.Printf("GetExpiringAccessTokenIDs failed: %s\n", err)
+		log.Printf("Reading the expiring access tokens failed: %s\n", err)
 		return err
 	}
 
-	// For each token id expiring in the next minsToExpiration minutes
-	for _, expiringTokenID := range expiringTokenIDs {
+	workCtx, cancelWork := r.workContext(ctx)
+	defer cancelWork()
 
-		// Get the refresh and access tokens associated with the token ID
-		myRefreshToken, err := tokenStore.GetRefreshToken(ctx, expiringTokenID)
-		if err != nil {
-			log.Printf("GetRefreshToken failed: %s\n", err)
-			return err
+	// Hand out the token ids to a bounded number of workers
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		failed   int
+	)
+	tokenIDs := make(chan string)
+	for i := 0; i < r.config.Concurrency && i < len(expiringTokenIDs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tokenID := range tokenIDs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := r.refreshToken(ctx, workCtx, tokenID); err != nil {
+					log.Printf("Refreshing token %s failed: %s\n", tokenID, err)
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+dispatch:
+	for i, expiringTokenID := range expiringTokenIDs {
+		select {
+		case tokenIDs <- expiringTokenID:
+		case <-ctx.Done():
+			log.Printf("Refresher stopping, %v expiring access tokens were not refreshed\n", len(expiringTokenIDs)-i)
+			break dispatch
 		}
+	}
+	close(tokenIDs)
+	wg.Wait()
 
-		myAccessToken, err := tokenStore.GetAccessToken(ctx, expiringTokenID)
-		if err != nil {
-			log.Printf("GetAccessToken failed: %s\n", err)
-			return err
-		}
+	log.Printf(
+		"%v expiring access tokens processed (%v failed)\n",
+		len(expiringTokenIDs),
+		failed,
+	)
+	// Report the first failure, the others have been logged already
+	return firstErr
+}
 
-		// Set the parameters required to refresh the tokens
-		params := url.Values{}
-		params.Add("client_id", clientID)
-		params.Add("client_secret", clientSecret)
-		params.Add("refresh_token", myRefreshToken.Value)
-		params.Add("grant_type", "refresh_token")
+// expiringTokenIDs returns the IDs of the access tokens expiring between start and stop, they are claimed when the
+// store supports it
+func (r *TokenRefresher) expiringTokenIDs(ctx context.Context, start time.Time, stop time.Time) ([]string, error) {
+	if claimer, ok := r.store.(ExpiringTokenClaimer); ok {
+		return claimer.ClaimExpiringAccessTokenIDs(ctx, start, stop, r.config.RetryInterval)
+	}
+	return r.store.GetExpiringAccessTokenIDs(ctx, start, stop)
+}
 
-		// Send the POST request to refresh the tokens
-		resp, err := http.PostForm(myAccessToken.URL, params)
-		if err != nil {
-			log.Printf("Request Failed: %s\n", err)
-			return err
+// workContext returns the context used by in-flight refreshes, it outlives ctx by at most the shutdown timeout so
+// that refreshes already sent to a provider can still be persisted when the refresher is stopped
+func (r *TokenRefresher) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+			return
 		}
-		defer resp.Body.Close()
-
-		// Decode JSON returned from the POST refresh request into a tokenResponse
-		token := tokenResponse{}
-		err = json.NewDecoder(resp.Body).Decode(&token)
-		if err != nil {
-			log.Printf("Decoding body failed: %s\n", err)
-			return err
+		timer := time.NewTimer(r.config.ShutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Printf("Shutdown timeout exceeded, aborting in-flight refreshes\n")
+			cancel()
+		case <-finished:
 		}
+	}()
+	return workCtx, func() {
+		close(finished)
+		cancel()
+	}
+}
+
+// refreshToken refreshes the access and refresh tokens with the given ID and writes them back to the token store.
+// The refresh is abandoned if ctx is done before the request is sent, after that it completes with workCtx.
+func (r *TokenRefresher) refreshToken(ctx context.Context, workCtx context.Context, tokenID string) error {
+	// Get the access and refresh tokens associated with the token ID
+	myAccessToken, err := r.store.GetAccessToken(workCtx, tokenID)
+	if err != nil {
+		log.Printf("GetAccessToken failed: %s\n", err)
+		return err
+	}
+	// Project access tokens have no refresh token, they are rotated by the project token manager
+	if myAccessToken.Type == models.AccessTokenTypeProject {
+		return nil
+	}
 
-		log.Printf("New token received: %v\n", token)
+	myRefreshToken, err := r.store.GetRefreshToken(workCtx, tokenID)
+	if err != nil {
+		log.Printf("GetRefreshToken failed: %s\n", err)
+		return err
+	}
 
-		// Calculate the UNIX timestamp at which the newly refreshed access and refresh tokens will expire
-		accessTokenExpiration := time.Unix(token.CreatedAt+token.ExpiresIn, 0)
-		// Keycloak does not provide a created_at parameter.
-		// Therefore, if the value of token.CreatedAt is 0,
-		// we replace token.CreatedAt with time.Now()
-		if token.CreatedAt == 0 {
-			accessTokenExpiration = time.Now().Add(time.Second * time.Duration(token.ExpiresIn))
-		}
+	// Wait until the provider rate limit allows another request
+	err = r.limiters.wait(ctx, myAccessToken.URL)
+	if err != nil {
+		return err
+	}
 
-		refreshTokenExpiration := time.Now().Add(time.Second * time.Duration(token.RefreshTokenExpiresIn))
-		// Gitlab refresh tokens do not expire
-		// (see https://gitlab.com/gitlab-org/gitlab/-/issues/340848#note_953496566).
-		// Therefore, in the case that there is no refresh token expiration time,
-		// we set a refresh token expiration time of 0.
-		if token.RefreshTokenExpiresIn == 0 {
-			refreshTokenExpiration = time.Unix(0, 0)
-		}
+	token, err := r.postRefreshRequest(workCtx, myAccessToken.URL, myRefreshToken.Value)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("New token received: %v\n", token)
+
+	// Calculate the UNIX timestamp at which the newly refreshed access and refresh tokens will expire
+	issuedAt := time.Unix(token.CreatedAt, 0)
+	accessTokenExpiration := time.Unix(token.CreatedAt+token.ExpiresIn, 0)
+	// Keycloak does not provide a created_at parameter.
+	// Therefore, if the value of token.CreatedAt is 0,
+	// we replace token.CreatedAt with time.Now()
+	if token.CreatedAt == 0 {
+		issuedAt = time.Now()
+		accessTokenExpiration = time.Now().Add(time.Second * time.Duration(token.ExpiresIn))
+	}
+
+	// A provider that does not return the scope granted the scopes of the refreshed token
+	// (see https://www.rfc-editor.org/rfc/rfc6749#section-5.1)
+	scopes := myAccessToken.Scopes
+	if token.Scope != "" {
+		scopes = strings.Fields(token.Scope)
+	}
+
+	refreshTokenExpiration := time.Now().Add(time.Second * time.Duration(token.RefreshTokenExpiresIn))
+	// Gitlab refresh tokens do not expire
+	// (see https://gitlab.com/gitlab-org/gitlab/-/issues/340848#note_953496566).
+	// Therefore, in the case that there is no refresh token expiration time,
+	// we set a refresh token expiration time of 0.
+	if token.RefreshTokenExpiresIn == 0 {
+		refreshTokenExpiration = time.Unix(0, 0)
+	}
+	// A provider that does not return a refresh token did not rotate it, the current one stays valid
+	// (see https://www.rfc-editor.org/rfc/rfc6749#section-6)
+	newRefreshToken := models.RefreshToken{
+		ID:        myRefreshToken.ID,
+		Value:     token.RefreshToken,
+		ExpiresAt: refreshTokenExpiration,
+	}
+	rotated := token.RefreshToken != "" && token.RefreshToken != myRefreshToken.Value
+	if token.RefreshToken == "" {
+		newRefreshToken = myRefreshToken
+	}
 
-		// Set the refreshed access and refresh token values into the token store
-		err = tokenStore.SetAccessToken(ctx, models.AccessToken{
+	// Set the refreshed access and refresh token values into the token store together so that they stay a pair
+	err = r.store.Update(workCtx, func(tx repository.Writer) error {
+		err := tx.SetAccessToken(workCtx, models.AccessToken{
 			ID:        myAccessToken.ID,
 			Value:     token.AccessToken,
 			ExpiresAt: accessTokenExpiration,
 			URL:       myAccessToken.URL,
 			Type:      myAccessToken.Type,
+			Provider:  myAccessToken.Provider,
+			Subject:   myAccessToken.Subject,
+			Scopes:    scopes,
+			Audience:  myAccessToken.Audience,
+			IssuedAt:  issuedAt,
 		})
+		if err != nil {
+			return err
+		}
 
-		err = tokenStore.SetRefreshToken(ctx, models.RefreshToken{
-			ID:        myRefreshToken.ID,
-			Value:     token.RefreshToken,
-			ExpiresAt: refreshTokenExpiration,
+		return tx.SetRefreshToken(workCtx, newRefreshToken)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remember the rotated refresh token so that a later use of it can be detected as a reuse. This is done after
+	// the new value is stored, a current refresh token must never be in the history.
+	if rotated {
+		err = r.store.Update(workCtx, func(tx repository.Writer) error {
+			return tx.AddSupersededRefreshToken(workCtx, myRefreshToken)
 		})
+		if err != nil {
+			log.Printf("AddSupersededRefreshToken failed: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// postRefreshRequest sends the refresh token to the provider token URL and decodes the response
+func (r *TokenRefresher) postRefreshRequest(
+	ctx context.Context,
+	tokenURL string,
+	refreshToken string,
+) (tokenResponse, error) {
+	// Set the parameters required to refresh the tokens
+	params := url.Values{}
+	params.Add("client_id", r.config.ClientID)
+	params.Add("client_secret", r.config.ClientSecret)
+	params.Add("refresh_token", refreshToken)
+	params.Add("grant_type", "refresh_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return tokenResponse{}, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	log.Printf("%v expiring access tokens refreshed, evaluating again in %v minutes\n", len(expiringTokenIDs), minsToExpiration)
-	return err
+	// Send the POST request to refresh the tokens
+	resp, err := r.client.Do(req)
+	if err != nil {
+		log.Printf("Request Failed: %s\n", err)
+		return tokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return tokenResponse{}, fmt.Errorf("refresh request to %s failed with status %d", tokenURL, resp.StatusCode)
+	}
+
+	// Decode JSON returned from the POST refresh request into a tokenResponse
+	token := tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		log.Printf("Decoding body failed: %s\n", err)
+		return tokenResponse{}, err
+	}
+	return token, nil
 }
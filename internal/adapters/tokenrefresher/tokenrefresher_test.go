@@ -3,24 +3,35 @@ package tokenrefresher
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 )
 
 var ctx = context.Background()
 
+// DummyAdapter implements the operations used by the token refresher, the others are left to the nil repository
 type DummyAdapter struct {
-	err          error
-	accessToken  models.AccessToken
-	refreshToken models.RefreshToken
-	tokenID      string
+	repository.Repository
+	err                 error
+	accessToken         models.AccessToken
+	refreshToken        models.RefreshToken
+	tokenID             string
+	supersededRefreshes []models.RefreshToken
 }
 
+func (d *DummyAdapter) Update(_ context.Context, fn func(tx repository.Writer) error) error {
+	return fn(d)
+}
 func (d *DummyAdapter) GetRefreshToken(context.Context, string) (models.RefreshToken, error) {
 	return d.refreshToken, d.err
 }
@@ -38,6 +49,16 @@ func (d *DummyAdapter) SetAccessToken(ctx context.Context, anAccessToken models.
 func (d *DummyAdapter) GetExpiringAccessTokenIDs(context.Context, time.Time, time.Time) ([]string, error) {
 	return []string{d.tokenID}, d.err
 }
+func (d *DummyAdapter) GetEarliestAccessTokenExpiry(context.Context, time.Time) (time.Time, bool, error) {
+	return time.Time{}, false, d.err
+}
+func (d *DummyAdapter) SubscribeExpiringAccessTokens(context.Context) (<-chan time.Time, error) {
+	return nil, d.err
+}
+func (d *DummyAdapter) AddSupersededRefreshToken(_ context.Context, aRefreshToken models.RefreshToken) error {
+	d.supersededRefreshes = append(d.supersededRefreshes, aRefreshToken)
+	return d.err
+}
 
 func TestRefreshExpiringTokensGitlab(t *testing.T) {
 
@@ -112,7 +133,7 @@ func TestRefreshExpiringTokensGitlab(t *testing.T) {
 	defer srv.Close()
 
 	// Initialise dummy token store
-	var myRefresherTokenStore RefresherTokenStore = &DummyAdapter{}
+	myRefresherTokenStore := &DummyAdapter{}
 
 	// Create a refresh and access token in our dummy token store with the pre-refresh token values
 	err := myRefresherTokenStore.SetAccessToken(ctx, models.AccessToken{
@@ -121,6 +142,9 @@ func TestRefreshExpiringTokensGitlab(t *testing.T) {
 		ExpiresAt: time.Now().Add(time.Minute * 5),
 		URL:       srv.URL,
 		Type:      tokenType,
+		Provider:  "gitlab",
+		Subject:   "42",
+		Scopes:    []string{"read_user"},
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -135,7 +159,12 @@ func TestRefreshExpiringTokensGitlab(t *testing.T) {
 	}
 
 	// Refresh tokens expiring in the next 5 minutes
-	err = refreshExpiringTokens(ctx, myRefresherTokenStore, clientID, clientSecret, 5)
+	refresher := NewTokenRefresher(myRefresherTokenStore, Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		LeadTime:     5 * time.Minute,
+	})
+	err = refresher.refreshExpiringTokens(ctx, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -180,6 +209,67 @@ func TestRefreshExpiringTokensGitlab(t *testing.T) {
 	} else {
 		t.Errorf("The new refresh token received is NOT the correct value, got %v want %v\n", myNewRefreshToken.Value, refreshedRefreshTokenValue)
 	}
+
+	// The claims of the provider are kept, the scopes and the issue time are the ones of the response
+	if myNewAccessToken.Provider != "gitlab" || myNewAccessToken.Subject != "42" {
+		t.Errorf("The new access token claims are NOT the correct value, got %v %v\n", myNewAccessToken.Provider, myNewAccessToken.Subject)
+	}
+	if !reflect.DeepEqual(myNewAccessToken.Scopes, []string{"api"}) {
+		t.Errorf("The new access token scopes are NOT the correct value, got %v want %v\n", myNewAccessToken.Scopes, []string{"api"})
+	}
+	if myNewAccessToken.IssuedAt.Unix() != refreshedTokenCreationTime {
+		t.Errorf("The new access token issue time is NOT the correct value, got %v want %v\n", myNewAccessToken.IssuedAt.Unix(), refreshedTokenCreationTime)
+	}
+
+	superseded := myRefresherTokenStore.supersededRefreshes
+	if len(superseded) == 1 && superseded[0].Value == refreshTokenValue {
+		log.Printf("The rotated refresh token was added to the history, %v\n", superseded[0].Value)
+	} else {
+		t.Errorf("The rotated refresh token was NOT added to the history, got %v want %v\n", superseded, refreshTokenValue)
+	}
+}
+
+func TestRefreshExpiringTokensWithoutRotation(t *testing.T) {
+	// The provider keeps the refresh token and returns none (see https://www.rfc-editor.org/rfc/rfc6749#section-6)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(&tokenResponse{
+			AccessToken: "new-access-token",
+			Type:        "bearer",
+			ExpiresIn:   7200,
+			CreatedAt:   time.Now().Unix(),
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	refreshToken := models.RefreshToken{
+		ID:        "token-0",
+		Value:     "refresh-token-0",
+		ExpiresAt: time.Unix(time.Now().Unix()+3600, 0),
+	}
+	store := &DummyAdapter{
+		accessToken:  models.AccessToken{ID: "token-0", Value: "access-token-0", ExpiresAt: time.Now(), URL: srv.URL},
+		refreshToken: refreshToken,
+		tokenID:      "token-0",
+	}
+	refresher := NewTokenRefresher(store, Config{LeadTime: 5 * time.Minute})
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.accessToken.Value != "new-access-token" {
+		t.Errorf("The access token was NOT refreshed, got %v\n", store.accessToken.Value)
+	}
+	if !reflect.DeepEqual(store.refreshToken, refreshToken) {
+		t.Errorf("The refresh token that was NOT rotated is NOT kept, got %v want %v\n", store.refreshToken, refreshToken)
+	}
+	if len(store.supersededRefreshes) != 0 {
+		t.Errorf("The refresh token that was NOT rotated was added to the history, got %v\n", store.supersededRefreshes)
+	}
 }
 
 func TestRefreshExpiringTokensKeycloak(t *testing.T) {
@@ -255,7 +345,7 @@ func TestRefreshExpiringTokensKeycloak(t *testing.T) {
 	defer srv.Close()
 
 	// Initialise dummy token store
-	var myRefresherTokenStore RefresherTokenStore = &DummyAdapter{}
+	myRefresherTokenStore := &DummyAdapter{}
 
 	// Create a refresh and access token in our dummy token store with the pre-refresh token values
 	err := myRefresherTokenStore.SetAccessToken(ctx, models.AccessToken{
@@ -278,7 +368,12 @@ func TestRefreshExpiringTokensKeycloak(t *testing.T) {
 	}
 
 	// Refresh tokens expiring in the next 5 minutes
-	err = refreshExpiringTokens(ctx, myRefresherTokenStore, clientID, clientSecret, 5)
+	refresher := NewTokenRefresher(myRefresherTokenStore, Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		LeadTime:     5 * time.Minute,
+	})
+	err = refresher.refreshExpiringTokens(ctx, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -330,3 +425,517 @@ func TestRefreshExpiringTokensKeycloak(t *testing.T) {
 		t.Errorf("The new refresh token received is NOT the correct value, got %v want %v\n", myNewRefreshToken.ExpiresAt.Unix(), refreshedTokenCreationTime+86400)
 	}
 }
+
+// MultiTokenAdapter implements the operations used by the token refresher, the others are left to the nil repository
+type MultiTokenAdapter struct {
+	repository.Repository
+	mu            sync.Mutex
+	accessTokens  map[string]models.AccessToken
+	refreshTokens map[string]models.RefreshToken
+	updates       chan time.Time
+}
+
+func NewMultiTokenAdapter(tokenURL string, numTokens int) *MultiTokenAdapter {
+	m := MultiTokenAdapter{
+		accessTokens:  map[string]models.AccessToken{},
+		refreshTokens: map[string]models.RefreshToken{},
+		updates:       make(chan time.Time, 100),
+	}
+	for i := 0; i < numTokens; i++ {
+		tokenID := fmt.Sprintf("token-%d", i)
+		m.accessTokens[tokenID] = models.AccessToken{
+			ID:        tokenID,
+			Value:     "access-" + tokenID,
+			ExpiresAt: time.Now().Add(time.Minute),
+			URL:       tokenURL,
+			Type:      "git",
+		}
+		m.refreshTokens[tokenID] = models.RefreshToken{ID: tokenID, Value: "refresh-" + tokenID}
+	}
+	return &m
+}
+
+func (m *MultiTokenAdapter) Update(_ context.Context, fn func(tx repository.Writer) error) error {
+	return fn(m)
+}
+
+func (m *MultiTokenAdapter) GetRefreshToken(_ context.Context, tokenID string) (models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refreshTokens[tokenID], nil
+}
+func (m *MultiTokenAdapter) GetAccessToken(_ context.Context, tokenID string) (models.AccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accessTokens[tokenID], nil
+}
+func (m *MultiTokenAdapter) SetRefreshToken(_ context.Context, aRefreshToken models.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshTokens[aRefreshToken.ID] = aRefreshToken
+	return nil
+}
+func (m *MultiTokenAdapter) SetAccessToken(_ context.Context, anAccessToken models.AccessToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accessTokens[anAccessToken.ID] = anAccessToken
+	select {
+	case m.updates <- anAccessToken.ExpiresAt:
+	default:
+	}
+	return nil
+}
+func (m *MultiTokenAdapter) GetExpiringAccessTokenIDs(_ context.Context, start time.Time, stop time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokenIDs := []string{}
+	for tokenID, accessToken := range m.accessTokens {
+		if !accessToken.ExpiresAt.Before(start) && !accessToken.ExpiresAt.After(stop) {
+			tokenIDs = append(tokenIDs, tokenID)
+		}
+	}
+	return tokenIDs, nil
+}
+func (m *MultiTokenAdapter) GetEarliestAccessTokenExpiry(_ context.Context, after time.Time) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var earliest time.Time
+	for _, accessToken := range m.accessTokens {
+		if accessToken.ExpiresAt.After(after) && (earliest.IsZero() || accessToken.ExpiresAt.Before(earliest)) {
+			earliest = accessToken.ExpiresAt
+		}
+	}
+	return earliest, !earliest.IsZero(), nil
+}
+func (m *MultiTokenAdapter) SubscribeExpiringAccessTokens(context.Context) (<-chan time.Time, error) {
+	return m.updates, nil
+}
+func (m *MultiTokenAdapter) AddSupersededRefreshToken(context.Context, models.RefreshToken) error {
+	return nil
+}
+func (m *MultiTokenAdapter) getAccessTokenValue(tokenID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accessTokens[tokenID].Value
+}
+
+// newCountingServer returns a token endpoint that tracks the maximum number of requests it handled at once
+func newCountingServer(t *testing.T, delay time.Duration, maxInFlight *int32) *httptest.Server {
+	var inFlight int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			previous := atomic.LoadInt32(maxInFlight)
+			if current <= previous || atomic.CompareAndSwapInt32(maxInFlight, previous, current) {
+				break
+			}
+		}
+		time.Sleep(delay)
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(&tokenResponse{
+			AccessToken:  "new-" + r.PostForm.Get("refresh_token"),
+			Type:         "bearer",
+			ExpiresIn:    7200,
+			RefreshToken: "new-" + r.PostForm.Get("refresh_token"),
+			CreatedAt:    time.Now().Unix(),
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestRefreshExpiringTokensConcurrency(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 20*time.Millisecond, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 40)
+	refresher := NewTokenRefresher(store, Config{
+		LeadTime:         5 * time.Minute,
+		Concurrency:      4,
+		DefaultRateLimit: RateLimit{RequestsPerSecond: 1000, Burst: 1000},
+	})
+
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxInFlight > 4 {
+		t.Errorf("Too many concurrent refresh requests, got %v want at most %v\n", maxInFlight, 4)
+	}
+	if maxInFlight < 2 {
+		t.Errorf("Refresh requests were not sent concurrently, got %v in flight\n", maxInFlight)
+	}
+	for tokenID, accessToken := range store.accessTokens {
+		if accessToken.Value != "new-refresh-"+tokenID {
+			t.Errorf("The access token %v was not refreshed, got %v\n", tokenID, accessToken.Value)
+		}
+	}
+}
+
+// ClaimingTokenAdapter is a MultiTokenAdapter shared by several replicas that claims the expiring tokens
+type ClaimingTokenAdapter struct {
+	*MultiTokenAdapter
+	claimed map[string]bool
+}
+
+func (c *ClaimingTokenAdapter) ClaimExpiringAccessTokenIDs(
+	ctx context.Context,
+	start time.Time,
+	stop time.Time,
+	_ time.Duration,
+) ([]string, error) {
+	expiringTokenIDs, _ := c.GetExpiringAccessTokenIDs(ctx, start, stop)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokenIDs := []string{}
+	for _, tokenID := range expiringTokenIDs {
+		if !c.claimed[tokenID] {
+			c.claimed[tokenID] = true
+			tokenIDs = append(tokenIDs, tokenID)
+		}
+	}
+	return tokenIDs, nil
+}
+
+func TestRefreshExpiringTokensClaimsTokens(t *testing.T) {
+	var maxInFlight, requests int32
+	srv := newCountingServer(t, 20*time.Millisecond, &maxInFlight)
+	defer srv.Close()
+	counting := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		counting.ServeHTTP(w, r)
+	})
+
+	store := &ClaimingTokenAdapter{MultiTokenAdapter: NewMultiTokenAdapter(srv.URL, 10), claimed: map[string]bool{}}
+	config := Config{LeadTime: 5 * time.Minute, DefaultRateLimit: RateLimit{RequestsPerSecond: 1000}}
+
+	// Two replicas refresh the tokens of the same store at once
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := NewTokenRefresher(store, config).refreshExpiringTokens(ctx, time.Now())
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests != 10 {
+		t.Errorf("The number of refresh requests is NOT correct, got %v want %v\n", requests, 10)
+	}
+	for tokenID := range store.accessTokens {
+		if value := store.getAccessTokenValue(tokenID); value != "new-refresh-"+tokenID {
+			t.Errorf("The access token %v was not refreshed, got %v\n", tokenID, value)
+		}
+	}
+}
+
+func TestRefreshExpiringTokensRateLimit(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 6)
+	refresher := NewTokenRefresher(store, Config{
+		LeadTime:    5 * time.Minute,
+		Concurrency: 6,
+		RateLimits: map[string]RateLimit{
+			providerKey(srv.URL): {RequestsPerSecond: 20, Burst: 1},
+		},
+	})
+
+	start := time.Now()
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a burst of 1 and 20 requests per second, 6 requests need at least 5 refills of 50ms
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("The provider rate limit was not applied, 6 refreshes took %v\n", elapsed)
+	}
+}
+
+func TestRefreshExpiringTokensRateLimitWithoutBurst(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 2)
+	refresher := NewTokenRefresher(store, Config{
+		LeadTime:         5 * time.Minute,
+		RateLimits:       map[string]RateLimit{providerKey(srv.URL): {RequestsPerSecond: 20}},
+		DefaultRateLimit: RateLimit{RequestsPerSecond: 20},
+	})
+
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tokenID := range store.accessTokens {
+		if value := store.getAccessTokenValue(tokenID); value != "new-refresh-"+tokenID {
+			t.Errorf("The access token %v was NOT refreshed without a burst, got %v\n", tokenID, value)
+		}
+	}
+	if limit := refresher.config.DefaultRateLimit; limit.Burst != 20 {
+		t.Errorf("The default burst is NOT correct, got %v want 20\n", limit.Burst)
+	}
+}
+
+func TestRefreshExpiringTokensTimeout(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 200*time.Millisecond, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 1)
+	refresher := NewTokenRefresher(store, Config{
+		LeadTime:    5 * time.Minute,
+		HTTPTimeout: 50 * time.Millisecond,
+	})
+
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err == nil {
+		t.Errorf("Expected the refresh request to time out\n")
+	}
+}
+
+func TestRefreshExpiringTokensSkipsProjectTokens(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("A project access token was refreshed\n")
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	projectToken := models.AccessToken{
+		ID:        "gitlab-project-1-2",
+		Value:     "glpat",
+		ExpiresAt: time.Now(),
+		URL:       srv.URL,
+		Type:      models.AccessTokenTypeProject,
+	}
+	store := &DummyAdapter{accessToken: projectToken, tokenID: projectToken.ID}
+	refresher := NewTokenRefresher(store, Config{})
+
+	err := refresher.refreshExpiringTokens(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(store.accessToken, projectToken) {
+		t.Errorf("The project access token was changed, got %v\n", store.accessToken)
+	}
+}
+
+func TestScheduleRefreshExpiringTokensAtDeadline(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+
+	// The token is due for a refresh 300ms from now
+	store := NewMultiTokenAdapter(srv.URL, 0)
+	store.accessTokens["token-0"] = models.AccessToken{
+		ID:        "token-0",
+		Value:     "access-token-0",
+		ExpiresAt: time.Now().Add(time.Minute + 300*time.Millisecond),
+		URL:       srv.URL,
+	}
+	store.refreshTokens["token-0"] = models.RefreshToken{ID: "token-0", Value: "refresh-token-0"}
+
+	schedulerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := ScheduleRefreshExpiringTokens(schedulerCtx, store, Config{LeadTime: time.Minute})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if value := store.getAccessTokenValue("token-0"); value != "access-token-0" {
+		t.Errorf("The access token was refreshed before its deadline, got %v\n", value)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if value := store.getAccessTokenValue("token-0"); value != "new-refresh-token-0" {
+		t.Errorf("The access token was not refreshed at its deadline, got %v\n", value)
+	}
+}
+
+func TestScheduleRefreshExpiringTokensCatchesUp(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+
+	// The access token expired while the refresher was not running
+	store := NewMultiTokenAdapter(srv.URL, 0)
+	store.accessTokens["token-0"] = models.AccessToken{
+		ID:        "token-0",
+		Value:     "access-token-0",
+		ExpiresAt: time.Now().Add(-time.Hour),
+		URL:       srv.URL,
+	}
+	store.refreshTokens["token-0"] = models.RefreshToken{ID: "token-0", Value: "refresh-token-0"}
+
+	schedulerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := ScheduleRefreshExpiringTokens(schedulerCtx, store, Config{LeadTime: time.Minute})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if value := store.getAccessTokenValue("token-0"); value != "new-refresh-token-0" {
+		t.Errorf("The expired access token was NOT refreshed at start, got %v\n", value)
+	}
+}
+
+func TestScheduleRefreshExpiringTokensRetriesExpiredTokens(t *testing.T) {
+	var maxInFlight, requests int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+	counting := srv.Config.Handler
+	// The provider fails until the access token has expired
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		counting.ServeHTTP(w, r)
+	})
+
+	store := NewMultiTokenAdapter(srv.URL, 0)
+	store.accessTokens["token-0"] = models.AccessToken{
+		ID:        "token-0",
+		Value:     "access-token-0",
+		ExpiresAt: time.Now().Add(50 * time.Millisecond),
+		URL:       srv.URL,
+	}
+	store.refreshTokens["token-0"] = models.RefreshToken{ID: "token-0", Value: "refresh-token-0"}
+
+	schedulerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := ScheduleRefreshExpiringTokens(schedulerCtx, store, Config{
+			LeadTime:      time.Minute,
+			RetryInterval: 200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	time.Sleep(400 * time.Millisecond)
+	if value := store.getAccessTokenValue("token-0"); value != "new-refresh-token-0" {
+		t.Errorf("The access token that expired after a failed refresh was NOT retried, got %v\n", value)
+	}
+}
+
+func TestScheduleRefreshExpiringTokensWakesUp(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 0, &maxInFlight)
+	defer srv.Close()
+
+	// The token store is empty so the scheduler has no deadline until a token is added
+	store := NewMultiTokenAdapter(srv.URL, 0)
+
+	schedulerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := ScheduleRefreshExpiringTokens(schedulerCtx, store, Config{LeadTime: time.Minute})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err := store.SetRefreshToken(ctx, models.RefreshToken{ID: "token-0", Value: "refresh-token-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetAccessToken(ctx, models.AccessToken{
+		ID:        "token-0",
+		Value:     "access-token-0",
+		ExpiresAt: time.Now().Add(time.Minute + 100*time.Millisecond),
+		URL:       srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if value := store.getAccessTokenValue("token-0"); value != "new-refresh-token-0" {
+		t.Errorf("The scheduler did not wake up for the new access token, got %v\n", value)
+	}
+}
+
+func TestTokenRefresherStopPersistsInFlightRefreshes(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 300*time.Millisecond, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 1)
+	refresher := NewTokenRefresher(store, Config{LeadTime: 5 * time.Minute, ShutdownTimeout: 5 * time.Second})
+
+	err := refresher.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = refresher.Start(ctx)
+	if err != ErrAlreadyStarted {
+		t.Errorf("Starting a running refresher did NOT fail, got %v want %v\n", err, ErrAlreadyStarted)
+	}
+
+	// Stop while the refresh request is in flight
+	time.Sleep(100 * time.Millisecond)
+	refresher.Stop()
+
+	if value := store.getAccessTokenValue("token-0"); value != "new-refresh-token-0" {
+		t.Errorf("The in-flight refresh was NOT persisted when stopping, got %v\n", value)
+	}
+}
+
+func TestTokenRefresherShutdownTimeout(t *testing.T) {
+	var maxInFlight int32
+	srv := newCountingServer(t, 2*time.Second, &maxInFlight)
+	defer srv.Close()
+
+	store := NewMultiTokenAdapter(srv.URL, 1)
+	refresher := NewTokenRefresher(store, Config{LeadTime: 5 * time.Minute, ShutdownTimeout: 100 * time.Millisecond})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	returned := make(chan error)
+	go func() {
+		returned <- refresher.Run(runCtx)
+	}()
+
+	// Cancel while the refresh request is in flight, Run has to return once the shutdown timeout has passed
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did NOT return within the shutdown timeout\n")
+	}
+
+	if value := store.getAccessTokenValue("token-0"); value != "access-token-0" {
+		t.Errorf("The aborted refresh was persisted, got %v\n", value)
+	}
+}
@@ -0,0 +1,63 @@
+// Package tokenrevoker revokes oauth tokens at the providers that issued them
+package tokenrevoker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Revoker sends token revocation requests (see https://www.rfc-editor.org/rfc/rfc7009) with the oauth client of the
+// gateway, it uses http.DefaultClient when Client is nil
+type Revoker struct {
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client
+}
+
+// RevokeToken revokes a token at the provider whose token endpoint is tokenURL, tokenTypeHint is either
+// "access_token" or "refresh_token". A token the provider does not know is not an error.
+func (r *Revoker) RevokeToken(ctx context.Context, tokenURL string, token string, tokenTypeHint string) error {
+	revocationURL, err := revocationURL(tokenURL)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("client_id", r.ClientID)
+	params.Add("client_secret", r.ClientSecret)
+	params.Add("token", token)
+	params.Add("token_type_hint", tokenTypeHint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revocationURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation request to %s failed with status %d", revocationURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// revocationURL returns the revocation endpoint of a provider, GitLab (/oauth/token) and Keycloak
+// (/protocol/openid-connect/token) serve it next to the token endpoint
+func revocationURL(tokenURL string) (string, error) {
+	if !strings.HasSuffix(tokenURL, "/token") {
+		return "", fmt.Errorf("the revocation endpoint of the token URL %s is not known", tokenURL)
+	}
+	return strings.TrimSuffix(tokenURL, "token") + "revoke", nil
+}
@@ -0,0 +1,65 @@
+package tokenrevoker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRevokeToken(t *testing.T) {
+	received := make(chan url.Values, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/oauth/revoke" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- r.PostForm
+	}))
+	defer srv.Close()
+
+	revoker := Revoker{ClientID: "client", ClientSecret: "secret"}
+	err := revoker.RevokeToken(context.Background(), srv.URL+"/oauth/token", "refresh-value", "refresh_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := <-received
+	if form.Get("token") != "refresh-value" || form.Get("token_type_hint") != "refresh_token" ||
+		form.Get("client_id") != "client" || form.Get("client_secret") != "secret" {
+		t.Errorf("The revocation request is NOT correct, got %v\n", form)
+	}
+
+	err = revoker.RevokeToken(context.Background(), srv.URL+"/oauth/other", "refresh-value", "refresh_token")
+	if err == nil {
+		t.Errorf("A token URL without a known revocation endpoint was NOT refused\n")
+	}
+	err = revoker.RevokeToken(context.Background(), srv.URL+"/missing/token", "refresh-value", "refresh_token")
+	if err == nil {
+		t.Errorf("A failed revocation was NOT reported\n")
+	}
+}
+
+func TestRevocationURL(t *testing.T) {
+	tests := []struct {
+		tokenURL string
+		want     string
+	}{
+		{"https://gitlab.example.org/oauth/token", "https://gitlab.example.org/oauth/revoke"},
+		{
+			"https://renku.example.org/auth/realms/Renku/protocol/openid-connect/token",
+			"https://renku.example.org/auth/realms/Renku/protocol/openid-connect/revoke",
+		},
+	}
+	for _, tt := range tests {
+		got, err := revocationURL(tt.tokenURL)
+		if err != nil || got != tt.want {
+			t.Errorf("The revocation URL is NOT the correct value, got %v, %v want %v\n", got, err, tt.want)
+		}
+	}
+}
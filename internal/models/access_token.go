@@ -2,10 +2,25 @@ package models
 
 import "time"
 
+// AccessTokenTypeProject is the type of the GitLab project access tokens that the gateway creates itself, they are
+// rotated instead of refreshed
+const AccessTokenTypeProject = "project"
+
+// AccessTokenProviderGitlab is the provider of the tokens issued by the GitLab instance of the gateway
+const AccessTokenProviderGitlab = "gitlab"
+
 type AccessToken struct {
 	ID        string
 	Value     string
 	ExpiresAt time.Time
 	URL       string
 	Type      string
+	// Provider is the ID of the identity provider that issued the token
+	Provider string
+	// Subject identifies the user the token belongs to at the provider
+	Subject  string
+	Scopes   []string
+	Audience []string
+	// IssuedAt is the zero time when the provider did not tell when the token was issued
+	IssuedAt time.Time
 }
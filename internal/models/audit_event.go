@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+const (
+	AuditEventRefreshTokenReuse      = "refresh_token_reuse"
+	AuditEventSessionEvicted         = "session_evicted"
+	AuditEventSessionBindingMismatch = "session_binding_mismatch"
+)
+
+type AuditEvent struct {
+	Type      string
+	Time      time.Time
+	SessionID string
+	UserID    string
+	TokenIDs  []string
+	Message   string
+}
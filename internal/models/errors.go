@@ -0,0 +1,11 @@
+package models
+
+import "errors"
+
+var ErrNotFound = errors.New("not found")
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+var ErrForbidden = errors.New("forbidden")
+
+var ErrRateLimited = errors.New("rate limited")
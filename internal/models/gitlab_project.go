@@ -0,0 +1,15 @@
+package models
+
+// Visibility levels of GitLab projects
+const (
+	GitlabVisibilityPublic   = "public"
+	GitlabVisibilityInternal = "internal"
+	GitlabVisibilityPrivate  = "private"
+)
+
+// GitlabProject is a project read through the GitLab API
+type GitlabProject struct {
+	ID                int
+	PathWithNamespace string
+	Visibility        string
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// GitlabProjectAccessTokenRequest describes a project access token to create through the GitLab API
+type GitlabProjectAccessTokenRequest struct {
+	Name        string
+	Scopes      []string
+	AccessLevel int
+	// ExpiresAt is rounded down to a date by GitLab
+	ExpiresAt time.Time
+}
+
+// GitlabProjectAccessToken is a project access token created through the GitLab API
+type GitlabProjectAccessToken struct {
+	ID        int
+	Value     string
+	ExpiresAt time.Time
+	// UserID is the ID of the bot user GitLab created for the token
+	UserID int
+}
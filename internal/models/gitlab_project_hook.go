@@ -0,0 +1,18 @@
+package models
+
+// GitlabProjectHook is a webhook of a GitLab project, the secret token of a hook is never returned by GitLab
+type GitlabProjectHook struct {
+	ID            int
+	URL           string
+	PushEvents    bool
+	TagPushEvents bool
+}
+
+// GitlabProjectHookRequest describes a project webhook to create through the GitLab API
+type GitlabProjectHookRequest struct {
+	URL string
+	// Token is sent by GitLab in the X-Gitlab-Token header of every request of the hook
+	Token         string
+	PushEvents    bool
+	TagPushEvents bool
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+const (
+	KGEventPush    = "push"
+	KGEventTag     = "tag"
+	KGEventProject = "project"
+)
+
+// KGEvent is a GitLab webhook event normalized for the knowledge graph services
+type KGEvent struct {
+	ID   string
+	Type string
+	// Action is the GitLab name of project events, e.g. project_create or project_rename
+	Action      string
+	ProjectID   int
+	ProjectPath string
+	Ref         string
+	Before      string
+	After       string
+	ReceivedAt  time.Time
+}
+
+// KGDelivery is the delivery of an event to one knowledge graph service that has to be retried
+type KGDelivery struct {
+	ID            string
+	Target        string
+	Event         KGEvent
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// KGCaller identifies who sends a request to the knowledge graph, both fields are empty for anonymous callers
+type KGCaller struct {
+	// SessionID is the gateway session of the caller, its GitLab token is read from the store
+	SessionID string
+	// Token is a GitLab OAuth token sent by the caller, it is used before the token of the session
+	Token string
+}
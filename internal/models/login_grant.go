@@ -0,0 +1,12 @@
+package models
+
+// LoginGrant contains what the identity provider issues when a user logs in with the authorization code flow
+type LoginGrant struct {
+	AccessToken AccessToken
+	// RefreshToken has an empty value when the provider did not issue one
+	RefreshToken RefreshToken
+	// UserID, Username and IDPSessionID are read from the ID token
+	UserID       string
+	Username     string
+	IDPSessionID string
+}
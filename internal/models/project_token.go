@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+type ProjectToken struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
+// ProjectTokenQuery selects a page of the tokens of a project, a zero bound leaves that side of the expiry window open
+type ProjectTokenQuery struct {
+	// ExpiresAfter excludes the tokens expiring at or before it
+	ExpiresAfter time.Time
+	// ExpiresBefore excludes the tokens expiring after it
+	ExpiresBefore time.Time
+	// Cursor is the NextCursor of the previous page, it is empty for the first page
+	Cursor string
+	// Limit is the maximum number of tokens in the page, a default is used when it is not set
+	Limit int
+}
+
+// ProjectTokenPage is a page of project tokens ordered by expiration and then by ID
+type ProjectTokenPage struct {
+	Tokens []ProjectToken
+	// NextCursor continues the listing after this page, it is empty on the last page
+	NextCursor string
+}
+
+// ValidProjectTokens selects the project tokens that have not expired at now
+func ValidProjectTokens(now time.Time) ProjectTokenQuery {
+	return ProjectTokenQuery{ExpiresAfter: now}
+}
+
+// ExpiringProjectTokens selects the project tokens that have not expired at now but will within the given duration
+func ExpiringProjectTokens(now time.Time, within time.Duration) ProjectTokenQuery {
+	return ProjectTokenQuery{ExpiresAfter: now, ExpiresBefore: now.Add(within)}
+}
+
+// ExpiredProjectTokens selects the project tokens that have expired at now
+func ExpiredProjectTokens(now time.Time) ProjectTokenQuery {
+	return ProjectTokenQuery{ExpiresBefore: now}
+}
@@ -0,0 +1,30 @@
+package models
+
+// ProjectWebhook is a project for which the knowledge graph registers a GitLab webhook. A deactivated project is kept
+// until its webhook is removed from GitLab.
+type ProjectWebhook struct {
+	ProjectID int
+	Active    bool
+}
+
+// Kinds of differences between the stored project webhooks and the hooks found in GitLab
+const (
+	// WebhookDriftMissing is an active project without hook
+	WebhookDriftMissing = "missing"
+	// WebhookDriftDuplicate is a second hook of an active project
+	WebhookDriftDuplicate = "duplicate"
+	// WebhookDriftMisconfigured is a hook that does not send push or tag push events
+	WebhookDriftMisconfigured = "misconfigured"
+	// WebhookDriftLeftOver is a hook of a deactivated project
+	WebhookDriftLeftOver = "left_over"
+	// WebhookDriftProjectGone is an active project that does not exist in GitLab anymore
+	WebhookDriftProjectGone = "project_gone"
+)
+
+// ProjectWebhookDrift is a difference found by a reconciliation of the project webhooks, HookID is 0 when there is no
+// hook involved
+type ProjectWebhookDrift struct {
+	ProjectID int
+	Kind      string
+	HookID    int
+}
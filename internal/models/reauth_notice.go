@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type ReauthNotice struct {
+	// UserID and SessionHandle identify the session, the session ID itself is a credential that is never sent
+	UserID        string
+	SessionHandle string
+	TokenID       string
+	ExpiresAt     time.Time
+}
@@ -1,10 +1,66 @@
 package models
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Types of a session
+const (
+	SessionTypeUser = "user"
+	// SessionTypeAnonymous sessions have a generated user ID and no tokens
+	SessionTypeAnonymous = "anonymous"
+)
+
+// Login methods of a session
+const (
+	SessionLoginBrowser = "browser"
+	SessionLoginCLI     = "cli"
+	SessionLoginDevice  = "device"
+)
 
 type Session struct {
 	ID        string
 	Type      string
 	ExpiresAt time.Time
 	TokenIDs  []string
+	// UserID and Username identify the user, they are read from the ID token at login
+	UserID   string
+	Username string
+	// CreatedAt and LastSeenAt are the zero time for sessions created by older gateways
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// LoginMethod is one of the SessionLogin constants
+	LoginMethod string
+	// ClientIP and UserAgent describe the client that logged in
+	ClientIP  string
+	UserAgent string
+	// IDPSessionID is the ID of the session at the identity provider, back-channel logouts refer to it
+	IDPSessionID string
+	// DeviceKeyHash is the SHA-256 hash of the key of the device cookie the session is bound to, it is empty when the
+	// session is not bound to a device
+	DeviceKeyHash string
+}
+
+// SessionHandle returns the ID under which a session is shown to its user, written to the logs and sent to other
+// services. It is a hash of the session ID, which is a credential that must not leave the cookie.
+func SessionHandle(sessionID string) string {
+	hash := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(hash[:16])
+}
+
+// SessionClient describes the client of a request made with a session, it is compared with the client that logged in
+type SessionClient struct {
+	IP        string
+	UserAgent string
+	// DeviceKey is the value of the device cookie
+	DeviceKey string
+}
+
+type SessionStatus struct {
+	ID             string
+	ExpiresAt      time.Time
+	ReauthRequired bool
+	ReauthDeadline time.Time
 }
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// UnixOrZero returns the Unix seconds of a time, the zero time is written as 0 so that it is not stored as a date
+// in year 1
+func UnixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// TimeOrZero returns the time of Unix seconds written by UnixOrZero
+func TimeOrZero(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
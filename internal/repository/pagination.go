@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"encoding/base64"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// DefaultProjectTokenLimit is the number of tokens in a page of project tokens when the query sets no limit
+const DefaultProjectTokenLimit = 100
+
+// MaxProjectTokenLimit is the largest number of tokens in a page of project tokens
+const MaxProjectTokenLimit = 1000
+
+// ProjectTokenRange is a ProjectTokenQuery in the terms of an index ordered by expiration (in Unix seconds) and
+// then by ID, which is how every adapter stores project tokens
+type ProjectTokenRange struct {
+	// Min and Max are the inclusive bounds of the expirations, the listing starts at Min
+	Min int64
+	Max int64
+	// After is the last token of the previous page, the listing continues after it
+	After *models.ProjectToken
+	Limit int
+}
+
+// NewProjectTokenRange checks a query and converts it to a range, it returns models.ErrInvalidCursor if the cursor was
+// not returned by a previous listing
+func NewProjectTokenRange(query models.ProjectTokenQuery) (ProjectTokenRange, error) {
+	r := ProjectTokenRange{Min: math.MinInt64, Max: math.MaxInt64, Limit: query.Limit}
+	if !query.ExpiresAfter.IsZero() {
+		r.Min = query.ExpiresAfter.Unix() + 1
+	}
+	if !query.ExpiresBefore.IsZero() {
+		r.Max = query.ExpiresBefore.Unix()
+	}
+	if r.Limit <= 0 {
+		r.Limit = DefaultProjectTokenLimit
+	}
+	if r.Limit > MaxProjectTokenLimit {
+		r.Limit = MaxProjectTokenLimit
+	}
+
+	if query.Cursor != "" {
+		after, err := parseProjectTokenCursor(query.Cursor)
+		if err != nil {
+			return ProjectTokenRange{}, err
+		}
+		r.After = &after
+		if after.ExpiresAt.Unix() > r.Min {
+			r.Min = after.ExpiresAt.Unix()
+		}
+	}
+	return r, nil
+}
+
+// Includes reports whether a token is in the range
+func (r ProjectTokenRange) Includes(token models.ProjectToken) bool {
+	score := token.ExpiresAt.Unix()
+	if score < r.Min || score > r.Max {
+		return false
+	}
+	if r.After == nil {
+		return true
+	}
+	return score > r.After.ExpiresAt.Unix() || (score == r.After.ExpiresAt.Unix() && token.ID > r.After.ID)
+}
+
+// Page returns the page of the range given its tokens in order, tokens holds up to Limit+1 tokens so that the last
+// page can be told apart
+func (r ProjectTokenRange) Page(tokens []models.ProjectToken) models.ProjectTokenPage {
+	if len(tokens) <= r.Limit {
+		return models.ProjectTokenPage{Tokens: tokens}
+	}
+	return models.ProjectTokenPage{
+		Tokens:     tokens[:r.Limit],
+		NextCursor: projectTokenCursor(tokens[r.Limit-1]),
+	}
+}
+
+// projectTokenCursor encodes the position of a token, the cursor is opaque to callers
+func projectTokenCursor(token models.ProjectToken) string {
+	position := strconv.FormatInt(token.ExpiresAt.Unix(), 10) + ":" + token.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+func parseProjectTokenCursor(cursor string) (models.ProjectToken, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.ProjectToken{}, models.ErrInvalidCursor
+	}
+	score, id, found := strings.Cut(string(position), ":")
+	if !found {
+		return models.ProjectToken{}, models.ErrInvalidCursor
+	}
+	expiresAt, err := strconv.ParseInt(score, 10, 64)
+	if err != nil {
+		return models.ProjectToken{}, models.ErrInvalidCursor
+	}
+	return models.ProjectToken{ID: id, ExpiresAt: time.Unix(expiresAt, 0)}, nil
+}
@@ -0,0 +1,16 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// RefreshTokenHistoryLength is the number of superseded refresh token values every store keeps for each token ID
+const RefreshTokenHistoryLength = 10
+
+// HashTokenValue returns the hex encoded SHA-256 hash of a token value, the stores keep the hashes of the superseded
+// refresh token values instead of the values
+func HashTokenValue(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,132 @@
+// Package repository defines the storage API that the use cases rely on and that every store adapter implements.
+// All operations take a context, missing sessions and tokens are reported with models.ErrNotFound and removing
+// something that does not exist is not an error.
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type SessionReader interface {
+	// GetSession returns models.ErrNotFound if the session does not exist or has expired
+	GetSession(ctx context.Context, sessionID string) (models.Session, error)
+	// GetTokenSessionID returns an empty ID if the token does not belong to a session
+	GetTokenSessionID(ctx context.Context, tokenID string) (string, error)
+	// GetUserSessionIDs returns the IDs of the sessions of a user that have not expired, ordered by expiration and
+	// then by ID, sessions without an expiration come last. Anonymous sessions are not listed, their generated user
+	// IDs are never looked up.
+	GetUserSessionIDs(ctx context.Context, userID string) ([]string, error)
+}
+
+type SessionWriter interface {
+	SetSession(context.Context, models.Session) error
+	RemoveSession(ctx context.Context, sessionID string) error
+}
+
+type AccessTokenReader interface {
+	GetAccessToken(ctx context.Context, tokenID string) (models.AccessToken, error)
+}
+
+type AccessTokenWriter interface {
+	SetAccessToken(context.Context, models.AccessToken) error
+	RemoveAccessToken(context.Context, models.AccessToken) error
+}
+
+type RefreshTokenReader interface {
+	GetRefreshToken(ctx context.Context, tokenID string) (models.RefreshToken, error)
+	IsSupersededRefreshToken(context.Context, models.RefreshToken) (bool, error)
+}
+
+type RefreshTokenWriter interface {
+	SetRefreshToken(context.Context, models.RefreshToken) error
+	RemoveRefreshToken(ctx context.Context, refreshTokenID string) error
+	AddSupersededRefreshToken(context.Context, models.RefreshToken) error
+	RemoveSupersededRefreshTokens(ctx context.Context, refreshTokenID string) error
+}
+
+// ExpiringTokenIndex gives access to the tokens ordered by expiration, the ranges include both bounds
+type ExpiringTokenIndex interface {
+	GetExpiringAccessTokenIDs(ctx context.Context, startTime time.Time, stopTime time.Time) ([]string, error)
+	GetExpiringRefreshTokenIDs(ctx context.Context, startTime time.Time, stopTime time.Time) ([]string, error)
+	// GetEarliestAccessTokenExpiry returns the earliest expiration strictly later than after
+	GetEarliestAccessTokenExpiry(ctx context.Context, after time.Time) (time.Time, bool, error)
+	// SubscribeExpiringAccessTokens returns a channel that receives the expiration of every access token written, the
+	// channel is closed when the context is done
+	SubscribeExpiringAccessTokens(ctx context.Context) (<-chan time.Time, error)
+}
+
+type ProjectTokenReader interface {
+	// GetProjectTokens returns the token IDs of a project ordered by expiration
+	GetProjectTokens(ctx context.Context, projectID int) ([]string, error)
+	// ListProjectTokens returns a page of the tokens of a project with their expiration, ordered by expiration and
+	// then by ID. It returns models.ErrInvalidCursor if the cursor of the query is not valid.
+	ListProjectTokens(ctx context.Context, projectID int, query models.ProjectTokenQuery) (models.ProjectTokenPage, error)
+	// GetProjectWebhookSecret returns the secret of the GitLab webhook of a project, it returns models.ErrNotFound if
+	// the project has no webhook secret
+	GetProjectWebhookSecret(ctx context.Context, projectID int) (string, error)
+	// ListProjectWebhooks returns the projects with a webhook secret and the deactivated projects whose webhook is not
+	// removed yet, ordered by project ID
+	ListProjectWebhooks(ctx context.Context) ([]models.ProjectWebhook, error)
+}
+
+type ProjectTokenWriter interface {
+	SetProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error
+	RemoveProjectToken(ctx context.Context, projectID int, accessToken models.AccessToken) error
+	SetProjectWebhookSecret(ctx context.Context, projectID int, secret string) error
+	// DeactivateProjectWebhook removes the webhook secret of a project but keeps the project listed as inactive until
+	// RemoveProjectWebhookSecret is called
+	DeactivateProjectWebhook(ctx context.Context, projectID int) error
+	RemoveProjectWebhookSecret(ctx context.Context, projectID int) error
+}
+
+type Reader interface {
+	SessionReader
+	AccessTokenReader
+	RefreshTokenReader
+	ExpiringTokenIndex
+	ProjectTokenReader
+}
+
+type Writer interface {
+	SessionWriter
+	AccessTokenWriter
+	RefreshTokenWriter
+	ProjectTokenWriter
+}
+
+// Transactor applies several writes atomically
+type Transactor interface {
+	// Update calls fn with a Writer whose writes are applied all together once fn returns, none of them are applied
+	// if fn returns an error. The writes are not visible to reads made before Update returns.
+	Update(ctx context.Context, fn func(tx Writer) error) error
+}
+
+// SessionToucher records the activity of the sessions
+type SessionToucher interface {
+	// TouchSession sets the last seen time of a session and extends its expiration when expiresAt is not zero. It
+	// returns false without writing anything if the session does not exist or has expired, so that a session removed
+	// meanwhile is never written again.
+	TouchSession(ctx context.Context, sessionID string, lastSeenAt time.Time, expiresAt time.Time) (bool, error)
+}
+
+// ReauthNoticeClaimer records which refresh token expirations have been notified, so that every gateway instance
+// sends the re-authentication notice of a token expiration only once
+type ReauthNoticeClaimer interface {
+	// ClaimReauthNotice returns true if the notice of the token expiration has not been claimed yet, the claim is
+	// kept until the expiration
+	ClaimReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error)
+	// ReleaseReauthNotice removes the claim of a token expiration, e.g. when the notice could not be sent
+	ReleaseReauthNotice(ctx context.Context, tokenID string, expiresAt time.Time) error
+}
+
+// Repository is the complete storage API of the gateway
+type Repository interface {
+	Reader
+	Writer
+	Transactor
+	SessionToucher
+	ReauthNoticeClaimer
+}
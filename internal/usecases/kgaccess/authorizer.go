@@ -0,0 +1,223 @@
+// Package kgaccess decides which credential the requests of a caller to the knowledge graph are sent with
+package kgaccess
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultCacheTTL = time.Minute
+	// maxCacheEntries is the size of the cache, the least recently used entries are dropped beyond it
+	maxCacheEntries = 10000
+)
+
+// Config contains the settings of the authorizer
+type Config struct {
+	// GitlabURL selects the GitLab token among the tokens of a session, it is the token whose URL starts with it
+	GitlabURL string
+	// CacheTTL is how long the visibility of a project and the access of a user to a project are cached
+	CacheTTL time.Duration
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultCacheTTL
+	}
+	return c
+}
+
+// Authorizer picks the credential of the requests to the knowledge graph. Requests about public projects are sent
+// anonymously, requests about the other projects are sent with the project token once the GitLab token of the caller
+// proved that the caller can see the project. The knowledge graph never receives the tokens of the users.
+type Authorizer struct {
+	store    SessionTokenStore
+	tokens   ProjectTokenSource
+	projects ProjectAPI
+	config   Config
+
+	// The cache is keyed by hashes of the tokens of the callers, which anyone can make up, so its size is bounded
+	mu        sync.Mutex
+	cache     map[string]*list.Element
+	cacheList *list.List
+}
+
+// cacheEntry is an element of the cache list, which is ordered from the most to the least recently used entry
+type cacheEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+func NewAuthorizer(
+	store SessionTokenStore,
+	tokens ProjectTokenSource,
+	projects ProjectAPI,
+	config Config,
+) *Authorizer {
+	return &Authorizer{
+		store:     store,
+		tokens:    tokens,
+		projects:  projects,
+		config:    config.withDefaults(),
+		cache:     map[string]*list.Element{},
+		cacheList: list.New(),
+	}
+}
+
+// Credential returns the token to send with a request of a caller about a project, an empty token means that the
+// request is sent anonymously. It returns models.ErrNotFound if the caller cannot see the project, like GitLab does,
+// and models.ErrForbidden if the project is not activated for the knowledge graph.
+func (a *Authorizer) Credential(ctx context.Context, projectID int, caller models.KGCaller) (string, error) {
+	visibility, err := a.visibility(ctx, projectID)
+	if err != nil {
+		return "", err
+	}
+	if visibility == models.GitlabVisibilityPublic {
+		return "", nil
+	}
+
+	userToken, err := a.userToken(ctx, caller)
+	if err != nil {
+		return "", err
+	}
+	if userToken == "" {
+		return "", models.ErrNotFound
+	}
+	visible, err := a.visibleTo(ctx, userToken, projectID)
+	if err != nil {
+		return "", err
+	}
+	if !visible {
+		return "", models.ErrNotFound
+	}
+
+	projectToken, err := a.tokens.ProjectToken(ctx, projectID)
+	if errors.Is(err, models.ErrNotFound) {
+		return "", models.ErrForbidden
+	}
+	if err != nil {
+		return "", err
+	}
+	return projectToken.Value, nil
+}
+
+// visibility returns the visibility of a project, it returns models.ErrNotFound if the project does not exist
+func (a *Authorizer) visibility(ctx context.Context, projectID int) (string, error) {
+	key := "visibility:" + strconv.Itoa(projectID)
+	visibility, found := a.cached(key)
+	if !found {
+		project, err := a.projects.GetProject(ctx, projectID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return "", err
+		}
+		// An empty visibility caches that the project does not exist
+		visibility = project.Visibility
+		a.setCached(key, visibility)
+	}
+	if visibility == "" {
+		return "", models.ErrNotFound
+	}
+	return visibility, nil
+}
+
+// visibleTo reports whether a user can see a project
+func (a *Authorizer) visibleTo(ctx context.Context, userToken string, projectID int) (bool, error) {
+	hash := sha256.Sum256([]byte(userToken))
+	key := "access:" + hex.EncodeToString(hash[:]) + ":" + strconv.Itoa(projectID)
+	if value, found := a.cached(key); found {
+		return value == "visible", nil
+	}
+
+	_, err := a.projects.GetProjectAsUser(ctx, userToken, projectID)
+	// GitLab refuses expired or revoked tokens
+	if err != nil && !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrForbidden) {
+		return false, err
+	}
+	visible := err == nil
+	value := ""
+	if visible {
+		value = "visible"
+	}
+	a.setCached(key, value)
+	return visible, nil
+}
+
+// userToken returns the GitLab token of a caller, it is empty when the caller is anonymous or the session has no
+// valid GitLab token
+func (a *Authorizer) userToken(ctx context.Context, caller models.KGCaller) (string, error) {
+	if caller.Token != "" || caller.SessionID == "" {
+		return caller.Token, nil
+	}
+
+	session, err := a.store.GetSession(ctx, caller.SessionID)
+	if errors.Is(err, models.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, tokenID := range session.TokenIDs {
+		accessToken, err := a.store.GetAccessToken(ctx, tokenID)
+		if errors.Is(err, models.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if a.config.GitlabURL != "" && strings.HasPrefix(accessToken.URL, a.config.GitlabURL) &&
+			accessToken.ExpiresAt.After(time.Now()) {
+			return accessToken.Value, nil
+		}
+	}
+	log.Printf("Session %s has no valid GitLab token\n", models.SessionHandle(caller.SessionID))
+	return "", nil
+}
+
+func (a *Authorizer) cached(key string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	element, found := a.cache[key]
+	if !found {
+		return "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		a.cacheList.Remove(element)
+		delete(a.cache, key)
+		return "", false
+	}
+	a.cacheList.MoveToFront(element)
+	return entry.value, true
+}
+
+func (a *Authorizer) setCached(key string, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expiresAt := time.Now().Add(a.config.CacheTTL)
+	if element, found := a.cache[key]; found {
+		entry := element.Value.(*cacheEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		a.cacheList.MoveToFront(element)
+		return
+	}
+
+	a.cache[key] = a.cacheList.PushFront(&cacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for a.cacheList.Len() > maxCacheEntries {
+		oldest := a.cacheList.Back()
+		a.cacheList.Remove(oldest)
+		delete(a.cache, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,154 @@
+package kgaccess
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab/gitlabtest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/memoryadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+var ctx = context.Background()
+
+type dummyTokens map[int]string
+
+func (d dummyTokens) ProjectToken(_ context.Context, projectID int) (models.AccessToken, error) {
+	value, found := d[projectID]
+	if !found {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	return models.AccessToken{Value: value}, nil
+}
+
+func newTestAuthorizer(t *testing.T) (*Authorizer, *memoryadapters.MemoryAdapter, *gitlabtest.Server) {
+	server := gitlabtest.NewServer(t)
+	server.AddProject(gitlabtest.Project{ID: 1, Visibility: models.GitlabVisibilityPublic})
+	server.AddProject(gitlabtest.Project{ID: 2, Visibility: models.GitlabVisibilityInternal})
+	server.AddProject(gitlabtest.Project{ID: 3, Visibility: models.GitlabVisibilityPrivate})
+	server.AddProject(gitlabtest.Project{ID: 4, Visibility: models.GitlabVisibilityPrivate})
+	server.AddUser("member", 3, 4)
+	server.AddUser("outsider")
+
+	store := memoryadapters.NewMemoryAdapter()
+	authorizer := NewAuthorizer(
+		store,
+		dummyTokens{2: "project-2", 3: "project-3"},
+		&gitlab.Client{URL: server.URL, Token: server.Token},
+		Config{GitlabURL: server.URL},
+	)
+	return authorizer, store, server
+}
+
+func TestCredential(t *testing.T) {
+	authorizer, _, _ := newTestAuthorizer(t)
+
+	tests := []struct {
+		name      string
+		projectID int
+		caller    models.KGCaller
+		want      string
+		wantErr   error
+	}{
+		{"public anonymous", 1, models.KGCaller{}, "", nil},
+		{"public member", 1, models.KGCaller{Token: "member"}, "", nil},
+		{"internal anonymous", 2, models.KGCaller{}, "", models.ErrNotFound},
+		{"internal user", 2, models.KGCaller{Token: "outsider"}, "project-2", nil},
+		{"private member", 3, models.KGCaller{Token: "member"}, "project-3", nil},
+		{"private outsider", 3, models.KGCaller{Token: "outsider"}, "", models.ErrNotFound},
+		{"private invalid token", 3, models.KGCaller{Token: "expired"}, "", models.ErrNotFound},
+		{"private without project token", 4, models.KGCaller{Token: "member"}, "", models.ErrForbidden},
+		{"missing project", 5, models.KGCaller{Token: "member"}, "", models.ErrNotFound},
+	}
+	for _, tt := range tests {
+		credential, err := authorizer.Credential(ctx, tt.projectID, tt.caller)
+		if credential != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("The credential for %s is NOT correct, got %q, %v want %q, %v\n",
+				tt.name, credential, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCredentialFromSession(t *testing.T) {
+	authorizer, store, server := newTestAuthorizer(t)
+	expiresAt := time.Now().Add(time.Hour)
+	err := store.SetAccessToken(ctx, models.AccessToken{ID: "github", Value: "other", URL: "https://github.com",
+		ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetAccessToken(ctx, models.AccessToken{ID: "gitlab", Value: "member", URL: server.URL + "/oauth/token",
+		ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetSession(ctx, models.Session{
+		ID:        "session",
+		ExpiresAt: expiresAt,
+		TokenIDs:  []string{"github", "gitlab"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := authorizer.Credential(ctx, 3, models.KGCaller{SessionID: "session"})
+	if err != nil || credential != "project-3" {
+		t.Errorf("The credential of a member session is NOT correct, got %q, %v\n", credential, err)
+	}
+	_, err = authorizer.Credential(ctx, 3, models.KGCaller{SessionID: "unknown"})
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("An unknown session was NOT refused, got %v\n", err)
+	}
+}
+
+func TestCredentialCache(t *testing.T) {
+	authorizer, _, server := newTestAuthorizer(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := authorizer.Credential(ctx, 3, models.KGCaller{Token: "member"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests := server.Requests(http.MethodGet, "/projects/3"); requests != 2 {
+		t.Errorf("The number of GitLab requests is NOT correct, got %v want 2\n", requests)
+	}
+
+	// Expired entries are read again
+	authorizer.config.CacheTTL = 0
+	authorizer.cache = map[string]*list.Element{}
+	authorizer.cacheList = list.New()
+	for i := 0; i < 2; i++ {
+		_, err := authorizer.Credential(ctx, 3, models.KGCaller{Token: "member"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests := server.Requests(http.MethodGet, "/projects/3"); requests != 6 {
+		t.Errorf("The number of GitLab requests is NOT correct, got %v want 6\n", requests)
+	}
+}
+
+func TestCredentialCacheIsBounded(t *testing.T) {
+	authorizer, _, _ := newTestAuthorizer(t)
+
+	for i := 0; i < maxCacheEntries+10; i++ {
+		authorizer.setCached(strconv.Itoa(i), "visible")
+		// The first entry is used all along so it is never the least recently used one
+		if _, found := authorizer.cached("0"); !found {
+			t.Fatalf("The most recently used entry was dropped after %v entries\n", i+1)
+		}
+	}
+	if len(authorizer.cache) != maxCacheEntries || authorizer.cacheList.Len() != maxCacheEntries {
+		t.Errorf("The cache size is NOT correct, got %v want %v\n", len(authorizer.cache), maxCacheEntries)
+	}
+	if _, found := authorizer.cached("1"); found {
+		t.Errorf("The least recently used entry was NOT dropped\n")
+	}
+}
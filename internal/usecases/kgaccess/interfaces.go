@@ -0,0 +1,35 @@
+package kgaccess
+
+import (
+	"context"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projecttokenmgr"
+)
+
+var (
+	_ SessionTokenStore  = repository.Repository(nil)
+	_ ProjectTokenSource = (*projecttokenmgr.ProjectTokenManager)(nil)
+)
+
+// SessionTokenStore reads the sessions of the callers and their tokens
+type SessionTokenStore interface {
+	repository.SessionReader
+	repository.AccessTokenReader
+}
+
+// ProjectTokenSource returns the current token of a project, it returns models.ErrNotFound if the project has none
+type ProjectTokenSource interface {
+	ProjectToken(ctx context.Context, projectID int) (models.AccessToken, error)
+}
+
+// ProjectAPI reads projects from GitLab, both methods return models.ErrNotFound if the project does not exist or is
+// not visible
+type ProjectAPI interface {
+	// GetProject reads a project with the token of the gateway, which can see every project
+	GetProject(ctx context.Context, projectID int) (models.GitlabProject, error)
+	// GetProjectAsUser reads a project with the OAuth token of a user, it returns models.ErrForbidden if the token is
+	// not valid
+	GetProjectAsUser(ctx context.Context, token string, projectID int) (models.GitlabProject, error)
+}
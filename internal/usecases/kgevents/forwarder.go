@@ -0,0 +1,196 @@
+// Package kgevents forwards the GitLab events of the projects tracked by the knowledge graph to its services
+package kgevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultRetryDelay    = 30 * time.Second
+	defaultMaxRetryDelay = time.Hour
+	defaultMaxAttempts   = 20
+	defaultInterval      = 10 * time.Second
+	defaultBatchSize     = 100
+	defaultClaimDuration = 5 * time.Minute
+)
+
+// Config contains the settings of the event forwarding
+type Config struct {
+	// Targets are the addresses of the knowledge graph services, every event is sent to each of them
+	Targets []string
+	// RetryDelay is the delay before the first retry, it doubles with every attempt up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// MaxAttempts is the number of attempts after which a delivery is moved to the dead letters
+	MaxAttempts int
+	// Interval is how often the queue is checked for deliveries to retry
+	Interval time.Duration
+	// BatchSize is the number of deliveries retried at every interval
+	BatchSize int
+	// ClaimDuration is how long the deliveries being retried are hidden from the other retries, a delivery whose
+	// retry was interrupted, e.g. by a restart, is retried once its claim has passed
+	ClaimDuration time.Duration
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultRetryDelay
+	}
+	if c.MaxRetryDelay <= 0 {
+		c.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.ClaimDuration <= 0 {
+		c.ClaimDuration = defaultClaimDuration
+	}
+	return c
+}
+
+// Forwarder sends events to every knowledge graph service with the token of their project, failed deliveries are
+// queued and retried with an exponential backoff
+type Forwarder struct {
+	tokens ProjectTokenSource
+	sender EventSender
+	queue  DeliveryQueue
+	config Config
+}
+
+func NewForwarder(tokens ProjectTokenSource, sender EventSender, queue DeliveryQueue, config Config) *Forwarder {
+	return &Forwarder{tokens: tokens, sender: sender, queue: queue, config: config.withDefaults()}
+}
+
+// deliveryID returns the ID of the delivery of an event to a target
+func deliveryID(eventID string, target string) string {
+	return eventID + " " + target
+}
+
+// Dispatch sends an event to every target in parallel. The deliveries that fail are queued for a retry, an error is
+// only returned if one of them could not be queued.
+func (f *Forwarder) Dispatch(ctx context.Context, event models.KGEvent) error {
+	token, tokenErr := f.projectToken(ctx, event)
+
+	errs := make([]error, len(f.config.Targets))
+	var wg sync.WaitGroup
+	for i, target := range f.config.Targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			delivery := models.KGDelivery{ID: deliveryID(event.ID, target), Target: target, Event: event}
+			sendErr := tokenErr
+			if sendErr == nil {
+				sendErr = f.sender.Send(ctx, target, event, token)
+			}
+			if sendErr == nil {
+				return
+			}
+			errs[i] = f.retryLater(ctx, delivery, sendErr)
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectToken returns the value of the token sent with an event. Project events are also sent when the project has
+// no token, e.g. after it was deleted, the other events cannot be read without one.
+func (f *Forwarder) projectToken(ctx context.Context, event models.KGEvent) (string, error) {
+	token, err := f.tokens.ProjectToken(ctx, event.ProjectID)
+	if errors.Is(err, models.ErrNotFound) && event.Type == models.KGEventProject {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading the token of project %d failed: %w", event.ProjectID, err)
+	}
+	return token.Value, nil
+}
+
+// retryLater records a failed attempt of a delivery and queues it for the next one, or moves it to the dead letters
+// once it reached the maximum number of attempts
+func (f *Forwarder) retryLater(ctx context.Context, delivery models.KGDelivery, sendErr error) error {
+	delivery.Attempts++
+	delivery.LastError = sendErr.Error()
+	if delivery.Attempts >= f.config.MaxAttempts {
+		log.Printf("Delivery %s failed %v times, giving up: %s\n", delivery.ID, delivery.Attempts, sendErr)
+		return f.queue.DeadLetter(ctx, delivery)
+	}
+
+	delivery.NextAttemptAt = time.Now().Add(f.retryDelay(delivery.Attempts))
+	log.Printf("Delivery %s failed, retrying at %v: %s\n", delivery.ID, delivery.NextAttemptAt, sendErr)
+	return f.queue.Enqueue(ctx, delivery)
+}
+
+// retryDelay returns the delay after a number of failed attempts
+func (f *Forwarder) retryDelay(attempts int) time.Duration {
+	delay := f.config.RetryDelay
+	for i := 1; i < attempts && delay < f.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > f.config.MaxRetryDelay {
+		return f.config.MaxRetryDelay
+	}
+	return delay
+}
+
+// RetryDue attempts the queued deliveries that are due again, they are claimed first so that the concurrent retries
+// of a queue send each of them once
+func (f *Forwarder) RetryDue(ctx context.Context) error {
+	deliveries, err := f.queue.ClaimDueDeliveries(ctx, time.Now(), f.config.BatchSize, f.config.ClaimDuration)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		token, err := f.projectToken(ctx, delivery.Event)
+		if err == nil {
+			err = f.sender.Send(ctx, delivery.Target, delivery.Event, token)
+		}
+		if err != nil {
+			err = f.retryLater(ctx, delivery, err)
+		} else {
+			err = f.queue.Remove(ctx, delivery.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run retries the due deliveries at every interval until the context is done
+func (f *Forwarder) Run(ctx context.Context) error {
+	ticker := time.NewTicker(f.config.Interval)
+	defer ticker.Stop()
+	for {
+		err := f.RetryDue(ctx)
+		if err != nil {
+			log.Printf("Retrying the knowledge graph deliveries failed: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package kgevents
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/boltadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+var ctx = context.Background()
+
+type dummyTokens map[int]string
+
+func (d dummyTokens) ProjectToken(_ context.Context, projectID int) (models.AccessToken, error) {
+	value, found := d[projectID]
+	if !found {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	return models.AccessToken{ID: "token", Value: value}, nil
+}
+
+// dummySender records the events sent and fails for the targets in failing
+type dummySender struct {
+	mu      sync.Mutex
+	sent    map[string][]string
+	failing map[string]bool
+}
+
+func (d *dummySender) Send(_ context.Context, target string, event models.KGEvent, token string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failing[target] {
+		return errors.New("unavailable")
+	}
+	d.sent[target] = append(d.sent[target], event.ID+":"+token)
+	return nil
+}
+
+func newTestForwarder(t *testing.T, config Config) (*Forwarder, *dummySender, *boltadapters.DeliveryQueue) {
+	queue, err := boltadapters.NewDeliveryQueue(filepath.Join(t.TempDir(), "deliveries.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	sender := &dummySender{sent: map[string][]string{}, failing: map[string]bool{}}
+	config.Targets = []string{"http://kg-a", "http://kg-b"}
+	return NewForwarder(dummyTokens{42: "glpat-42"}, sender, queue, config), sender, queue
+}
+
+func TestDispatch(t *testing.T) {
+	forwarder, sender, queue := newTestForwarder(t, Config{})
+	sender.failing["http://kg-b"] = true
+
+	err := forwarder.Dispatch(ctx, models.KGEvent{ID: "e1", Type: models.KGEventPush, ProjectID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := sender.sent["http://kg-a"]; len(sent) != 1 || sent[0] != "e1:glpat-42" {
+		t.Errorf("The event sent is NOT the correct value, got %v\n", sent)
+	}
+
+	queued, err := queue.DueDeliveries(ctx, time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Target != "http://kg-b" || queued[0].Attempts != 1 {
+		t.Errorf("The queued deliveries are NOT the correct value, got %v\n", queued)
+	}
+	if !queued[0].NextAttemptAt.After(time.Now()) {
+		t.Errorf("The failed delivery is due immediately, got %v\n", queued[0].NextAttemptAt)
+	}
+}
+
+func TestDispatchWithoutToken(t *testing.T) {
+	forwarder, sender, queue := newTestForwarder(t, Config{})
+
+	err := forwarder.Dispatch(ctx, models.KGEvent{ID: "e1", Type: models.KGEventPush, ProjectID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("A push event was sent without a token, got %v\n", sender.sent)
+	}
+	if queued, _ := queue.DueDeliveries(ctx, time.Now().Add(time.Hour), 10); len(queued) != 2 {
+		t.Errorf("The deliveries without a token were NOT queued, got %v\n", queued)
+	}
+
+	err = forwarder.Dispatch(ctx, models.KGEvent{ID: "e2", Type: models.KGEventProject, ProjectID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := sender.sent["http://kg-a"]; len(sent) != 1 || sent[0] != "e2:" {
+		t.Errorf("The project event was NOT sent without a token, got %v\n", sent)
+	}
+}
+
+func TestRetryDue(t *testing.T) {
+	forwarder, sender, queue := newTestForwarder(t, Config{RetryDelay: time.Nanosecond, MaxAttempts: 3})
+	sender.failing["http://kg-b"] = true
+
+	err := forwarder.Dispatch(ctx, models.KGEvent{ID: "e1", Type: models.KGEventTag, ProjectID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// A second failure keeps the delivery queued
+	err = forwarder.RetryDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := queue.DueDeliveries(ctx, time.Now().Add(time.Hour), 10)
+	if len(queued) != 1 || queued[0].Attempts != 2 || queued[0].LastError != "unavailable" {
+		t.Errorf("The retried delivery is NOT the correct value, got %v\n", queued)
+	}
+
+	sender.failing["http://kg-b"] = false
+	time.Sleep(time.Millisecond)
+	err = forwarder.RetryDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := sender.sent["http://kg-b"]; len(sent) != 1 || sent[0] != "e1:glpat-42" {
+		t.Errorf("The retried event is NOT the correct value, got %v\n", sent)
+	}
+	if queued, _ := queue.DueDeliveries(ctx, time.Now().Add(time.Hour), 10); len(queued) != 0 {
+		t.Errorf("The delivered event is still queued, got %v\n", queued)
+	}
+}
+
+func TestConcurrentRetryDue(t *testing.T) {
+	forwarder, sender, queue := newTestForwarder(t, Config{RetryDelay: time.Nanosecond})
+	sender.failing["http://kg-b"] = true
+
+	err := forwarder.Dispatch(ctx, models.KGEvent{ID: "e1", Type: models.KGEventPush, ProjectID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.failing["http://kg-b"] = false
+	time.Sleep(time.Millisecond)
+
+	// The forwarders of two instances retry the same queue at the same time
+	other := NewForwarder(dummyTokens{42: "glpat-42"}, sender, queue, forwarder.config)
+	var wg sync.WaitGroup
+	for _, f := range []*Forwarder{forwarder, other} {
+		wg.Add(1)
+		go func(f *Forwarder) {
+			defer wg.Done()
+			err := f.RetryDue(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	if sent := sender.sent["http://kg-b"]; len(sent) != 1 {
+		t.Errorf("The number of retried events is NOT correct, got %v want %v\n", len(sent), 1)
+	}
+}
+
+func TestRetryDueGivesUp(t *testing.T) {
+	forwarder, sender, queue := newTestForwarder(t, Config{RetryDelay: time.Nanosecond, MaxAttempts: 2})
+	sender.failing["http://kg-a"] = true
+
+	err := forwarder.Dispatch(ctx, models.KGEvent{ID: "e1", Type: models.KGEventPush, ProjectID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	err = forwarder.RetryDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queued, _ := queue.DueDeliveries(ctx, time.Now().Add(time.Hour), 10); len(queued) != 0 {
+		t.Errorf("The delivery is still queued after the last attempt, got %v\n", queued)
+	}
+	dead, err := queue.DeadDeliveries(ctx)
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Errorf("The dead deliveries are NOT the correct value, got %v, %v\n", dead, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	forwarder := NewForwarder(nil, nil, nil, Config{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second})
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second,
+		4: 5 * time.Second, 100: 5 * time.Second} {
+		if delay := forwarder.retryDelay(attempts); delay != want {
+			t.Errorf("The delay after %v attempts is NOT the correct value, got %v want %v\n", attempts, delay, want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package kgevents
+
+import (
+	"context"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projecttokenmgr"
+)
+
+var _ ProjectTokenSource = (*projecttokenmgr.ProjectTokenManager)(nil)
+
+// ProjectTokenSource returns the current token of a project, it returns models.ErrNotFound if the project has none
+type ProjectTokenSource interface {
+	ProjectToken(ctx context.Context, projectID int) (models.AccessToken, error)
+}
+
+// EventSender delivers an event to a knowledge graph service, token is empty when the event is sent without one
+type EventSender interface {
+	Send(ctx context.Context, target string, event models.KGEvent, token string) error
+}
+
+// DeliveryQueue keeps the deliveries that have to be retried
+type DeliveryQueue interface {
+	// Enqueue adds a delivery or replaces the queued delivery with the same ID
+	Enqueue(ctx context.Context, delivery models.KGDelivery) error
+	// ClaimDueDeliveries returns up to limit deliveries whose next attempt is at or before now, they are not returned
+	// again for claimFor unless they are enqueued again
+	ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, claimFor time.Duration) ([]models.KGDelivery, error)
+	Remove(ctx context.Context, id string) error
+	DeadLetter(ctx context.Context, delivery models.KGDelivery) error
+}
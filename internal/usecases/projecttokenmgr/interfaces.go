@@ -0,0 +1,30 @@
+package projecttokenmgr
+
+import (
+	"context"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+var _ ProjectTokenStore = repository.Repository(nil)
+
+// ProjectTokenStore contains the operations needed to keep the project access tokens of the knowledge graph, the
+// values are stored as access tokens and listed through the project token index
+type ProjectTokenStore interface {
+	repository.AccessTokenReader
+	repository.ExpiringTokenIndex
+	repository.ProjectTokenReader
+	repository.Transactor
+}
+
+// ProjectAccessTokenAPI creates and revokes project access tokens in GitLab
+type ProjectAccessTokenAPI interface {
+	CreateProjectAccessToken(
+		ctx context.Context,
+		projectID int,
+		request models.GitlabProjectAccessTokenRequest,
+	) (models.GitlabProjectAccessToken, error)
+	// RevokeProjectAccessToken returns models.ErrNotFound if the token does not exist or was already revoked
+	RevokeProjectAccessToken(ctx context.Context, projectID int, tokenID int) error
+}
@@ -0,0 +1,284 @@
+// Package projecttokenmgr provisions, rotates and revokes the GitLab project access tokens used by the knowledge graph
+package projecttokenmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultTokenName    = "renku-knowledge-graph"
+	defaultAccessLevel  = 20 // Reporter
+	defaultLifetime     = 30 * 24 * time.Hour
+	defaultRotateBefore = 7 * 24 * time.Hour
+	defaultInterval     = time.Hour
+)
+
+var defaultScopes = []string{"read_api", "read_repository"}
+
+// Config contains the settings of the project access tokens
+type Config struct {
+	// GitlabURL is stored as the URL of the tokens
+	GitlabURL   string
+	TokenName   string
+	Scopes      []string
+	AccessLevel int
+	// Lifetime is how long a new token is valid, it must be longer than RotateBefore
+	Lifetime time.Duration
+	// RotateBefore is how long before its expiration a token is replaced by a new one
+	RotateBefore time.Duration
+	// Interval is how often the tokens are checked for rotation
+	Interval time.Duration
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.TokenName == "" {
+		c.TokenName = defaultTokenName
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = defaultScopes
+	}
+	if c.AccessLevel == 0 {
+		c.AccessLevel = defaultAccessLevel
+	}
+	if c.Lifetime <= 0 {
+		c.Lifetime = defaultLifetime
+	}
+	if c.RotateBefore <= 0 {
+		c.RotateBefore = defaultRotateBefore
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	return c
+}
+
+// ProjectTokenManager keeps one valid GitLab project access token for every project tracked by the knowledge graph
+type ProjectTokenManager struct {
+	store  ProjectTokenStore
+	api    ProjectAccessTokenAPI
+	config Config
+}
+
+func NewProjectTokenManager(
+	store ProjectTokenStore,
+	api ProjectAccessTokenAPI,
+	config Config,
+) (*ProjectTokenManager, error) {
+	config = config.withDefaults()
+	if config.Lifetime <= config.RotateBefore {
+		return nil, fmt.Errorf("the token lifetime %v must be longer than the rotation period %v",
+			config.Lifetime, config.RotateBefore)
+	}
+	return &ProjectTokenManager{store: store, api: api, config: config}, nil
+}
+
+// tokenID returns the ID under which a GitLab project access token is stored
+func tokenID(projectID int, gitlabTokenID int) string {
+	return fmt.Sprintf("gitlab-project-%d-%d", projectID, gitlabTokenID)
+}
+
+// parseTokenID returns the project ID and the GitLab token ID of a stored token ID
+func parseTokenID(id string) (projectID int, gitlabTokenID int, err error) {
+	_, err = fmt.Sscanf(id, "gitlab-project-%d-%d", &projectID, &gitlabTokenID)
+	return projectID, gitlabTokenID, err
+}
+
+// ProjectToken returns the current token of a project, it returns models.ErrNotFound if the project has no valid
+// token
+func (m *ProjectTokenManager) ProjectToken(ctx context.Context, projectID int) (models.AccessToken, error) {
+	return m.latestToken(ctx, projectID, models.ValidProjectTokens(time.Now()))
+}
+
+// latestToken returns the token of a project selected by the query that expires last
+func (m *ProjectTokenManager) latestToken(
+	ctx context.Context,
+	projectID int,
+	query models.ProjectTokenQuery,
+) (models.AccessToken, error) {
+	var latest models.ProjectToken
+	for {
+		page, err := m.store.ListProjectTokens(ctx, projectID, query)
+		if err != nil {
+			return models.AccessToken{}, err
+		}
+		if len(page.Tokens) > 0 {
+			latest = page.Tokens[len(page.Tokens)-1]
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if latest.ID == "" {
+		return models.AccessToken{}, models.ErrNotFound
+	}
+	return m.store.GetAccessToken(ctx, latest.ID)
+}
+
+// Provision makes sure that a project has a token that is not due for rotation and returns it, a new token is
+// created in GitLab if needed
+func (m *ProjectTokenManager) Provision(ctx context.Context, projectID int) (models.AccessToken, error) {
+	notDue := models.ValidProjectTokens(time.Now().Add(m.config.RotateBefore))
+	accessToken, err := m.latestToken(ctx, projectID, notDue)
+	if err == nil || !errors.Is(err, models.ErrNotFound) {
+		return accessToken, err
+	}
+
+	created, err := m.api.CreateProjectAccessToken(ctx, projectID, models.GitlabProjectAccessTokenRequest{
+		Name:        m.config.TokenName,
+		Scopes:      m.config.Scopes,
+		AccessLevel: m.config.AccessLevel,
+		ExpiresAt:   time.Now().Add(m.config.Lifetime),
+	})
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+
+	accessToken = models.AccessToken{
+		ID:        tokenID(projectID, created.ID),
+		Value:     created.Value,
+		ExpiresAt: created.ExpiresAt,
+		URL:       m.config.GitlabURL,
+		Type:      models.AccessTokenTypeProject,
+		Provider:  models.AccessTokenProviderGitlab,
+		Scopes:    m.config.Scopes,
+		IssuedAt:  time.Now(),
+	}
+	if created.UserID != 0 {
+		accessToken.Subject = strconv.Itoa(created.UserID)
+	}
+	err = m.store.Update(ctx, func(tx repository.Writer) error {
+		err := tx.SetAccessToken(ctx, accessToken)
+		if err != nil {
+			return err
+		}
+		return tx.SetProjectToken(ctx, projectID, accessToken)
+	})
+	if err != nil {
+		// A token that cannot be stored would never be rotated or revoked
+		revokeErr := m.api.RevokeProjectAccessToken(ctx, projectID, created.ID)
+		if revokeErr != nil {
+			log.Printf("Revoking the unstored token %s failed: %s\n", accessToken.ID, revokeErr)
+		}
+		return models.AccessToken{}, err
+	}
+
+	log.Printf("Project access token %s created, expires at %v\n", accessToken.ID, accessToken.ExpiresAt)
+	return accessToken, nil
+}
+
+// RotateExpiringTokens replaces the project tokens that expire within the rotation period, expired ones included,
+// and revokes them once their replacement is stored
+func (m *ProjectTokenManager) RotateExpiringTokens(ctx context.Context) error {
+	tokenIDs, err := m.store.GetExpiringAccessTokenIDs(ctx, time.Unix(0, 0), time.Now().Add(m.config.RotateBefore))
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	rotated := 0
+	for _, id := range tokenIDs {
+		projectID, _, err := parseTokenID(id)
+		if err != nil {
+			// Not a project token
+			continue
+		}
+		err = m.rotateToken(ctx, projectID, id)
+		if err != nil {
+			log.Printf("Rotating project access token %s failed: %s\n", id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		rotated++
+	}
+	if rotated > 0 {
+		log.Printf("%v project access tokens rotated\n", rotated)
+	}
+	return firstErr
+}
+
+// rotateToken provisions the replacement of a token and then revokes it
+func (m *ProjectTokenManager) rotateToken(ctx context.Context, projectID int, id string) error {
+	_, err := m.Provision(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	return m.revokeToken(ctx, projectID, id)
+}
+
+// Revoke revokes every token of a project in GitLab and removes them from the store, it is called when the
+// knowledge graph stops tracking the project
+func (m *ProjectTokenManager) Revoke(ctx context.Context, projectID int) error {
+	query := models.ProjectTokenQuery{}
+	for {
+		page, err := m.store.ListProjectTokens(ctx, projectID, query)
+		if err != nil {
+			return err
+		}
+		for _, token := range page.Tokens {
+			err = m.revokeToken(ctx, projectID, token.ID)
+			if err != nil {
+				return err
+			}
+		}
+		// The revoked tokens are gone from the listing, the next page starts at the beginning again
+		if page.NextCursor == "" {
+			return nil
+		}
+	}
+}
+
+// revokeToken revokes a token in GitLab and removes it from the store, a token that GitLab does not know anymore is
+// only removed
+func (m *ProjectTokenManager) revokeToken(ctx context.Context, projectID int, id string) error {
+	_, gitlabTokenID, err := parseTokenID(id)
+	if err != nil {
+		return err
+	}
+	err = m.api.RevokeProjectAccessToken(ctx, projectID, gitlabTokenID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+
+	err = m.store.Update(ctx, func(tx repository.Writer) error {
+		err := tx.RemoveProjectToken(ctx, projectID, models.AccessToken{ID: id})
+		if err != nil {
+			return err
+		}
+		return tx.RemoveAccessToken(ctx, models.AccessToken{ID: id})
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Project access token %s revoked\n", id)
+	return nil
+}
+
+// Run rotates the expiring project tokens at every interval until the context is done
+func (m *ProjectTokenManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		err := m.RotateExpiringTokens(ctx)
+		if err != nil {
+			log.Printf("Rotating expiring project access tokens failed: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package projecttokenmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab/gitlabtest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/memoryadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+var ctx = context.Background()
+
+func newTestManager(t *testing.T) (*ProjectTokenManager, *memoryadapters.MemoryAdapter, *gitlabtest.Server) {
+	server := gitlabtest.NewServer(t)
+	store := memoryadapters.NewMemoryAdapter()
+	manager, err := NewProjectTokenManager(store, &gitlab.Client{URL: server.URL, Token: server.Token}, Config{
+		GitlabURL: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, store, server
+}
+
+func TestProvision(t *testing.T) {
+	manager, store, server := newTestManager(t)
+
+	token, err := manager.Provision(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != models.AccessTokenTypeProject || token.Value == "" {
+		t.Errorf("The provisioned token is NOT the correct value, got %v\n", token)
+	}
+	created := server.ActiveProjectAccessTokens(42)
+	if len(created) != 1 || created[0].Name != defaultTokenName {
+		t.Errorf("The token created in GitLab is NOT the correct value, got %v\n", created)
+	}
+
+	stored, err := store.GetAccessToken(ctx, token.ID)
+	if err != nil || stored.Value != token.Value {
+		t.Errorf("The provisioned token was NOT stored, got %v, %v\n", stored, err)
+	}
+	if stored.Provider != models.AccessTokenProviderGitlab || stored.Subject == "" || stored.IssuedAt.IsZero() ||
+		len(stored.Scopes) != len(defaultScopes) {
+		t.Errorf("The claims of the provisioned token are NOT correct, got %v\n", stored)
+	}
+	current, err := manager.ProjectToken(ctx, 42)
+	if err != nil || current.ID != token.ID {
+		t.Errorf("The current project token is NOT the correct value, got %v, %v\n", current, err)
+	}
+
+	// A project with a token that is not due for rotation keeps it
+	again, err := manager.Provision(ctx, 42)
+	if err != nil || again.ID != token.ID {
+		t.Errorf("Provisioning again did NOT return the existing token, got %v, %v\n", again, err)
+	}
+	if created := server.ActiveProjectAccessTokens(42); len(created) != 1 {
+		t.Errorf("Provisioning again created a token, got %v\n", created)
+	}
+}
+
+func TestProjectTokenNotFound(t *testing.T) {
+	manager, _, _ := newTestManager(t)
+
+	_, err := manager.ProjectToken(ctx, 42)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The token of a project without tokens did NOT return ErrNotFound, got %v\n", err)
+	}
+}
+
+func TestProvisionFailure(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	server.FailNext(http.MethodPost, "/projects/42/access_tokens", http.StatusForbidden)
+
+	_, err := manager.Provision(ctx, 42)
+	if err == nil {
+		t.Errorf("A failed token creation did NOT return an error\n")
+	}
+	page, err := store.ListProjectTokens(ctx, 42, models.ProjectTokenQuery{})
+	if err != nil || len(page.Tokens) != 0 {
+		t.Errorf("A token was stored after a failed creation, got %v, %v\n", page.Tokens, err)
+	}
+}
+
+func TestRotateExpiringTokens(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	token, err := manager.Provision(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := manager.Provision(ctx, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is due right after provisioning
+	err = manager.RotateExpiringTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := server.ProjectAccessTokens(42); len(created) != 1 {
+		t.Errorf("A token was rotated before it was due, got %v\n", created)
+	}
+
+	// Make the token of project 42 due for rotation
+	token.ExpiresAt = time.Now().Add(time.Hour)
+	err = store.SetAccessToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetProjectToken(ctx, 42, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.RotateExpiringTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := server.ActiveProjectAccessTokens(42)
+	if len(active) != 1 || tokenID(42, active[0].ID) == token.ID {
+		t.Errorf("The token was NOT rotated in GitLab, got %v\n", active)
+	}
+	_, err = store.GetAccessToken(ctx, token.ID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The rotated token was NOT removed, got %v\n", err)
+	}
+	current, err := manager.ProjectToken(ctx, 42)
+	if err != nil || current.ID != tokenID(42, active[0].ID) {
+		t.Errorf("The current project token is NOT the replacement, got %v, %v\n", current, err)
+	}
+	if current, err := manager.ProjectToken(ctx, 43); err != nil || current.ID != other.ID {
+		t.Errorf("The token of another project was rotated, got %v, %v\n", current, err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	_, err := manager.Provision(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Provision(ctx, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.Revoke(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := server.ActiveProjectAccessTokens(42); len(active) != 0 {
+		t.Errorf("The token was NOT revoked in GitLab, got %v\n", active)
+	}
+	page, err := store.ListProjectTokens(ctx, 42, models.ProjectTokenQuery{})
+	if err != nil || len(page.Tokens) != 0 {
+		t.Errorf("The revoked token was NOT removed, got %v, %v\n", page.Tokens, err)
+	}
+	if active := server.ActiveProjectAccessTokens(43); len(active) != 1 {
+		t.Errorf("The token of another project was revoked, got %v\n", active)
+	}
+
+	// A token that was already revoked in GitLab is still removed
+	token, err := manager.Provision(ctx, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, gitlabTokenID, _ := parseTokenID(token.ID)
+	client := &gitlab.Client{URL: server.URL, Token: server.Token}
+	err = client.RevokeProjectAccessToken(ctx, 43, gitlabTokenID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Revoke(ctx, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.ProjectToken(ctx, 43); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The token revoked in GitLab was NOT removed, got %v\n", err)
+	}
+}
+
+func TestNewProjectTokenManagerChecksLifetime(t *testing.T) {
+	_, err := NewProjectTokenManager(nil, nil, Config{Lifetime: time.Hour, RotateBefore: 2 * time.Hour})
+	if err == nil {
+		t.Errorf("A lifetime shorter than the rotation period was accepted\n")
+	}
+}
@@ -0,0 +1,34 @@
+package projectwebhookmgr
+
+import (
+	"context"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projecttokenmgr"
+)
+
+var (
+	_ ProjectWebhookStore = repository.Repository(nil)
+	_ ProjectTokens       = (*projecttokenmgr.ProjectTokenManager)(nil)
+)
+
+// ProjectWebhookStore contains the operations needed to keep the webhook secrets of the projects
+type ProjectWebhookStore interface {
+	repository.ProjectTokenReader
+	repository.ProjectTokenWriter
+}
+
+// ProjectHookAPI lists, creates and deletes project webhooks in GitLab, every method returns models.ErrNotFound if the
+// project does not exist
+type ProjectHookAPI interface {
+	ListProjectHooks(ctx context.Context, projectID int) ([]models.GitlabProjectHook, error)
+	AddProjectHook(ctx context.Context, projectID int, request models.GitlabProjectHookRequest) (int, error)
+	DeleteProjectHook(ctx context.Context, projectID int, hookID int) error
+}
+
+// ProjectTokens provisions and revokes the access tokens of the projects
+type ProjectTokens interface {
+	Provision(ctx context.Context, projectID int) (models.AccessToken, error)
+	Revoke(ctx context.Context, projectID int) error
+}
@@ -0,0 +1,297 @@
+// Package projectwebhookmgr registers the GitLab webhooks of the projects activated for the knowledge graph and keeps
+// them in line with the store
+package projectwebhookmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultInterval = 15 * time.Minute
+	// secretSize is the number of random bytes of a webhook secret
+	secretSize = 32
+)
+
+// Config contains the settings of the project webhooks
+type Config struct {
+	// HookURL is the address of the webhook receiver, the hooks of GitLab with this URL belong to the knowledge graph
+	HookURL string
+	// Interval is how often the hooks are reconciled
+	Interval time.Duration
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	return c
+}
+
+// ProjectWebhookManager creates the GitLab webhook and the access token of the projects activated for the knowledge
+// graph and removes them when the projects are deactivated. The webhook secrets are stored next to the project tokens.
+type ProjectWebhookManager struct {
+	store  ProjectWebhookStore
+	api    ProjectHookAPI
+	tokens ProjectTokens
+	config Config
+}
+
+func NewProjectWebhookManager(
+	store ProjectWebhookStore,
+	api ProjectHookAPI,
+	tokens ProjectTokens,
+	config Config,
+) (*ProjectWebhookManager, error) {
+	if config.HookURL == "" {
+		return nil, fmt.Errorf("the webhook URL is required")
+	}
+	return &ProjectWebhookManager{store: store, api: api, tokens: tokens, config: config.withDefaults()}, nil
+}
+
+// Activate provisions the token of a project and registers its webhook with a new secret, activating a project that
+// is already active only creates what is missing
+func (m *ProjectWebhookManager) Activate(ctx context.Context, projectID int) error {
+	_, err := m.tokens.Provision(ctx, projectID)
+	if err != nil {
+		return err
+	}
+
+	hooks, err := m.ownHooks(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	secret, err := m.store.GetProjectWebhookSecret(ctx, projectID)
+	if errors.Is(err, models.ErrNotFound) {
+		secret, err = newSecret()
+		if err != nil {
+			return err
+		}
+		err = m.store.SetProjectWebhookSecret(ctx, projectID, secret)
+		if err != nil {
+			return err
+		}
+		// GitLab does not return the secret of a hook, the hooks left from an earlier activation are replaced
+		for _, hook := range hooks {
+			err = m.deleteHook(ctx, projectID, hook.ID)
+			if err != nil {
+				return err
+			}
+		}
+		hooks = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(hooks) > 0 {
+		return nil
+	}
+	return m.addHook(ctx, projectID, secret)
+}
+
+// Deactivate stops accepting the webhook of a project at once, then removes the hook from GitLab and revokes the
+// project token. If the removal fails it is completed by the next reconciliation.
+func (m *ProjectWebhookManager) Deactivate(ctx context.Context, projectID int) error {
+	err := m.store.DeactivateProjectWebhook(ctx, projectID)
+	if err != nil {
+		return err
+	}
+
+	hooks, err := m.ownHooks(ctx, projectID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+	for _, hook := range hooks {
+		err = m.deleteHook(ctx, projectID, hook.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return m.removeProject(ctx, projectID)
+}
+
+// removeProject revokes the token of a deactivated project once its hooks are deleted and forgets the project
+func (m *ProjectWebhookManager) removeProject(ctx context.Context, projectID int) error {
+	err := m.tokens.Revoke(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Project %d deactivated for the knowledge graph\n", projectID)
+	return m.store.RemoveProjectWebhookSecret(ctx, projectID)
+}
+
+// Reconcile compares the stored projects with their hooks in GitLab. It recreates the hooks of the active projects
+// that were deleted or changed, removes the duplicate ones and the hooks of the deactivated projects, and returns the
+// differences it found. An active project that was deleted in GitLab is only reported.
+func (m *ProjectWebhookManager) Reconcile(ctx context.Context) ([]models.ProjectWebhookDrift, error) {
+	webhooks, err := m.store.ListProjectWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := []models.ProjectWebhookDrift{}
+	var firstErr error
+	for _, webhook := range webhooks {
+		var found []models.ProjectWebhookDrift
+		if webhook.Active {
+			found, err = m.reconcileActive(ctx, webhook.ProjectID)
+		} else {
+			found, err = m.reconcileInactive(ctx, webhook.ProjectID)
+		}
+		for _, drift := range found {
+			log.Printf("Webhook drift in project %d: %s hook %d\n", drift.ProjectID, drift.Kind, drift.HookID)
+		}
+		drifts = append(drifts, found...)
+		if err != nil {
+			log.Printf("Reconciling the webhook of project %d failed: %s\n", webhook.ProjectID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return drifts, firstErr
+}
+
+func (m *ProjectWebhookManager) reconcileActive(
+	ctx context.Context,
+	projectID int,
+) ([]models.ProjectWebhookDrift, error) {
+	hooks, err := m.ownHooks(ctx, projectID)
+	if errors.Is(err, models.ErrNotFound) {
+		return []models.ProjectWebhookDrift{{ProjectID: projectID, Kind: models.WebhookDriftProjectGone}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []models.ProjectWebhookDrift
+	kept := false
+	for _, hook := range hooks {
+		kind := ""
+		switch {
+		case !hook.PushEvents || !hook.TagPushEvents:
+			kind = models.WebhookDriftMisconfigured
+		case kept:
+			kind = models.WebhookDriftDuplicate
+		default:
+			kept = true
+			continue
+		}
+		drifts = append(drifts, models.ProjectWebhookDrift{ProjectID: projectID, Kind: kind, HookID: hook.ID})
+		err = m.deleteHook(ctx, projectID, hook.ID)
+		if err != nil {
+			return drifts, err
+		}
+	}
+	if kept {
+		return drifts, nil
+	}
+
+	if len(hooks) == 0 {
+		drifts = append(drifts, models.ProjectWebhookDrift{ProjectID: projectID, Kind: models.WebhookDriftMissing})
+	}
+	secret, err := m.store.GetProjectWebhookSecret(ctx, projectID)
+	if err != nil {
+		return drifts, err
+	}
+	return drifts, m.addHook(ctx, projectID, secret)
+}
+
+func (m *ProjectWebhookManager) reconcileInactive(
+	ctx context.Context,
+	projectID int,
+) ([]models.ProjectWebhookDrift, error) {
+	hooks, err := m.ownHooks(ctx, projectID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return nil, err
+	}
+
+	var drifts []models.ProjectWebhookDrift
+	for _, hook := range hooks {
+		drifts = append(drifts, models.ProjectWebhookDrift{
+			ProjectID: projectID,
+			Kind:      models.WebhookDriftLeftOver,
+			HookID:    hook.ID,
+		})
+		err = m.deleteHook(ctx, projectID, hook.ID)
+		if err != nil {
+			return drifts, err
+		}
+	}
+	return drifts, m.removeProject(ctx, projectID)
+}
+
+// ownHooks returns the hooks of a project that call the webhook receiver
+func (m *ProjectWebhookManager) ownHooks(ctx context.Context, projectID int) ([]models.GitlabProjectHook, error) {
+	hooks, err := m.api.ListProjectHooks(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	var own []models.GitlabProjectHook
+	for _, hook := range hooks {
+		if hook.URL == m.config.HookURL {
+			own = append(own, hook)
+		}
+	}
+	return own, nil
+}
+
+func (m *ProjectWebhookManager) addHook(ctx context.Context, projectID int, secret string) error {
+	hookID, err := m.api.AddProjectHook(ctx, projectID, models.GitlabProjectHookRequest{
+		URL:           m.config.HookURL,
+		Token:         secret,
+		PushEvents:    true,
+		TagPushEvents: true,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Webhook %d of project %d created\n", hookID, projectID)
+	return nil
+}
+
+// deleteHook deletes a hook, a hook that is already gone is not an error
+func (m *ProjectWebhookManager) deleteHook(ctx context.Context, projectID int, hookID int) error {
+	err := m.api.DeleteProjectHook(ctx, projectID, hookID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// newSecret returns a random hex encoded webhook secret
+func newSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Run reconciles the project webhooks at every interval until the context is done
+func (m *ProjectWebhookManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		_, err := m.Reconcile(ctx)
+		if err != nil {
+			log.Printf("Reconciling the project webhooks failed: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package projectwebhookmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/gitlab/gitlabtest"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/memoryadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/usecases/projecttokenmgr"
+)
+
+var ctx = context.Background()
+
+const hookURL = "https://kg.example.org/webhooks/gitlab"
+
+func newTestManager(t *testing.T) (*ProjectWebhookManager, *memoryadapters.MemoryAdapter, *gitlabtest.Server) {
+	server := gitlabtest.NewServer(t)
+	store := memoryadapters.NewMemoryAdapter()
+	client := &gitlab.Client{URL: server.URL, Token: server.Token}
+	tokens, err := projecttokenmgr.NewProjectTokenManager(store, client, projecttokenmgr.Config{GitlabURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewProjectWebhookManager(store, client, tokens, Config{HookURL: hookURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, store, server
+}
+
+func TestActivate(t *testing.T) {
+	manager, store, server := newTestManager(t)
+
+	err := manager.Activate(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := store.GetProjectWebhookSecret(ctx, 42)
+	if err != nil || len(secret) != 2*secretSize {
+		t.Errorf("The webhook secret is NOT the correct value, got %v, %v\n", secret, err)
+	}
+	hooks := server.ProjectHooks(42)
+	if len(hooks) != 1 || hooks[0].URL != hookURL || hooks[0].Token != secret || !hooks[0].TagPushEvents {
+		t.Errorf("The hook created in GitLab is NOT the correct value, got %v\n", hooks)
+	}
+	if active := server.ActiveProjectAccessTokens(42); len(active) != 1 {
+		t.Errorf("The project token was NOT provisioned, got %v\n", active)
+	}
+
+	// Activating again keeps the hook and its secret
+	err = manager.Activate(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := server.ProjectHooks(42); !reflect.DeepEqual(again, hooks) {
+		t.Errorf("Activating again changed the hooks, got %v want %v\n", again, hooks)
+	}
+}
+
+func TestDeactivate(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	err := manager.Activate(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHook := server.AddProjectHook(42, gitlabtest.Hook{URL: "https://ci.example.org"})
+
+	err = manager.Deactivate(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks := server.ProjectHooks(42); len(hooks) != 1 || hooks[0].ID != otherHook {
+		t.Errorf("The hooks after deactivation are NOT the correct value, got %v\n", hooks)
+	}
+	if active := server.ActiveProjectAccessTokens(42); len(active) != 0 {
+		t.Errorf("The project token was NOT revoked, got %v\n", active)
+	}
+	webhooks, err := store.ListProjectWebhooks(ctx)
+	if err != nil || len(webhooks) != 0 {
+		t.Errorf("The deactivated project is still stored, got %v, %v\n", webhooks, err)
+	}
+}
+
+func TestDeactivateFailureIsReconciled(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	err := manager.Activate(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hookID := server.ProjectHooks(42)[0].ID
+
+	server.FailNext(http.MethodDelete, "/projects/42/hooks", http.StatusServiceUnavailable)
+	err = manager.Deactivate(ctx, 42)
+	if err == nil {
+		t.Fatalf("A failed hook deletion did NOT return an error\n")
+	}
+	_, err = store.GetProjectWebhookSecret(ctx, 42)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The secret of the deactivated project is still valid, got %v\n", err)
+	}
+
+	drifts, err := manager.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ProjectWebhookDrift{{ProjectID: 42, Kind: models.WebhookDriftLeftOver, HookID: hookID}}
+	if !reflect.DeepEqual(drifts, want) {
+		t.Errorf("The drifts are NOT the correct value, got %v want %v\n", drifts, want)
+	}
+	if hooks := server.ProjectHooks(42); len(hooks) != 0 {
+		t.Errorf("The left over hook was NOT removed, got %v\n", hooks)
+	}
+	if webhooks, _ := store.ListProjectWebhooks(ctx); len(webhooks) != 0 {
+		t.Errorf("The deactivated project is still stored, got %v\n", webhooks)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	manager, store, server := newTestManager(t)
+	for _, projectID := range []int{1, 2, 3, 4} {
+		err := manager.Activate(ctx, projectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	drifts, err := manager.Reconcile(ctx)
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("Reconciling without drift is NOT correct, got %v, %v\n", drifts, err)
+	}
+
+	// Project 1 lost its hook, project 2 has a duplicate, project 3 a hook without tag events and 4 was deleted
+	client := &gitlab.Client{URL: server.URL, Token: server.Token}
+	err = client.DeleteProjectHook(ctx, 1, server.ProjectHooks(1)[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := server.AddProjectHook(2, gitlabtest.Hook{URL: hookURL, PushEvents: true, TagPushEvents: true})
+	misconfigured := server.ProjectHooks(3)[0].ID
+	err = client.DeleteProjectHook(ctx, 3, misconfigured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misconfigured = server.AddProjectHook(3, gitlabtest.Hook{URL: hookURL, PushEvents: true})
+	server.RemoveProject(4)
+
+	drifts, err = manager.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ProjectWebhookDrift{
+		{ProjectID: 1, Kind: models.WebhookDriftMissing},
+		{ProjectID: 2, Kind: models.WebhookDriftDuplicate, HookID: duplicate},
+		{ProjectID: 3, Kind: models.WebhookDriftMisconfigured, HookID: misconfigured},
+		{ProjectID: 4, Kind: models.WebhookDriftProjectGone},
+	}
+	if !reflect.DeepEqual(drifts, want) {
+		t.Errorf("The drifts are NOT the correct value, got %v want %v\n", drifts, want)
+	}
+
+	for _, projectID := range []int{1, 2, 3} {
+		secret, err := store.GetProjectWebhookSecret(ctx, projectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hooks := server.ProjectHooks(projectID)
+		if len(hooks) != 1 || hooks[0].Token != secret || !hooks[0].PushEvents || !hooks[0].TagPushEvents {
+			t.Errorf("The hooks of project %v are NOT the correct value, got %v\n", projectID, hooks)
+		}
+	}
+
+	drifts, err = manager.Reconcile(ctx)
+	if err != nil || len(drifts) != 1 {
+		t.Errorf("Reconciling again did NOT only report the deleted project, got %v, %v\n", drifts, err)
+	}
+}
+
+func TestNewProjectWebhookManagerChecksURL(t *testing.T) {
+	_, err := NewProjectWebhookManager(nil, nil, nil, Config{})
+	if err == nil {
+		t.Errorf("A config without webhook URL was accepted\n")
+	}
+}
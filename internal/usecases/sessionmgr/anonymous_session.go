@@ -0,0 +1,140 @@
+package sessionmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+	"golang.org/x/time/rate"
+)
+
+// Default settings used when the corresponding Config fields are not set
+const (
+	defaultAnonymousSessionTTL      = time.Hour
+	defaultAnonymousSessionsPerHour = 20
+	// anonymousUserIDPrefix marks the generated user IDs of anonymous sessions
+	anonymousUserIDPrefix = "anon-"
+	// maxAnonymousSessionLimiters bounds the number of client IPs whose rate limit is kept in memory
+	maxAnonymousSessionLimiters = 10000
+)
+
+var ErrNotAnonymous = errors.New("the session is not anonymous")
+
+// ErrTooManyAnonymousSessions wraps models.ErrRateLimited so that the adapters can recognize it
+var ErrTooManyAnonymousSessions = fmt.Errorf("too many anonymous sessions were created by the client: %w",
+	models.ErrRateLimited)
+
+// NewAnonymousSession stores a session with a generated user ID and no tokens for a client that did not log in. The
+// user ID stays the same until the session is upgraded at login or expires, which happens once it has not been used
+// for the AnonymousSessionTTL. It returns ErrTooManyAnonymousSessions when the IP of the client has created more than
+// AnonymousSessionsPerHour sessions.
+func (m *UserSessionManager) NewAnonymousSession(
+	ctx context.Context,
+	client models.SessionClient,
+) (models.Session, error) {
+	if !m.anonymousLimiters.allow(client.IP) {
+		log.Printf("Anonymous session of client %s refused, it created too many sessions\n", client.IP)
+		return models.Session{}, ErrTooManyAnonymousSessions
+	}
+	sessionID, err := newRandomString()
+	if err != nil {
+		return models.Session{}, err
+	}
+	userID, err := newRandomString()
+	if err != nil {
+		return models.Session{}, err
+	}
+	now := time.Now()
+	session := models.Session{
+		ID:         sessionID,
+		Type:       models.SessionTypeAnonymous,
+		ExpiresAt:  now.Add(m.config.AnonymousSessionTTL),
+		UserID:     anonymousUserIDPrefix + userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ClientIP:   client.IP,
+		UserAgent:  client.UserAgent,
+	}
+	err = m.store.Update(ctx, func(tx repository.Writer) error {
+		return tx.SetSession(ctx, session)
+	})
+	if err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+// UpgradeAnonymousSession replaces an anonymous session by the session of the user who logged in with it, like Login
+// does for a new session. The session gets a new ID so that an ID set by someone else before the login cannot be
+// used afterwards, and the anonymous session is removed. It returns the stored session, whose cookie replaces the one
+// of the anonymous session, and the device key like Login. It returns ErrNotAnonymous if the session already belongs
+// to a user and models.ErrNotFound if it does not exist.
+func (m *UserSessionManager) UpgradeAnonymousSession(
+	ctx context.Context,
+	anonymousSessionID string,
+	session models.Session,
+	grant models.LoginGrant,
+) (models.Session, string, error) {
+	anonymous, err := m.store.GetSession(ctx, anonymousSessionID)
+	if err != nil {
+		return models.Session{}, "", err
+	}
+	if anonymous.Type != models.SessionTypeAnonymous {
+		return models.Session{}, "", ErrNotAnonymous
+	}
+
+	session.ID = ""
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = anonymous.CreatedAt
+	}
+	session, deviceKey, err := m.login(ctx, session, grant, anonymous.ID)
+	if err != nil {
+		return models.Session{}, "", err
+	}
+	log.Printf(
+		"Anonymous session %s upgraded to session %s of user %s\n",
+		models.SessionHandle(anonymous.ID),
+		models.SessionHandle(session.ID),
+		session.UserID,
+	)
+	return session, deviceKey, nil
+}
+
+// ipLimiters keeps one token bucket per client IP. The buckets live in the memory of the gateway, every replica
+// applies the limit on its own. When there are too many IPs the buckets are dropped and start again full.
+type ipLimiters struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+}
+
+// newIPLimiters allows bursts of perHour requests per IP that refill over an hour
+func newIPLimiters(perHour int) *ipLimiters {
+	return &ipLimiters{
+		limit:    rate.Limit(float64(perHour) / time.Hour.Seconds()),
+		burst:    perHour,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// allow reports whether the IP can make another request now
+func (l *ipLimiters) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, found := l.limiters[ip]
+	if !found {
+		if len(l.limiters) >= maxAnonymousSessionLimiters {
+			l.limiters = map[string]*rate.Limiter{}
+		}
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[ip] = limiter
+	}
+	return limiter.Allow()
+}
@@ -0,0 +1,128 @@
+package sessionmgr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func TestNewAnonymousSession(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{AnonymousSessionTTL: time.Hour})
+
+	session, err := manager.NewAnonymousSession(ctx, models.SessionClient{IP: "192.0.2.1", UserAgent: "Firefox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := manager.NewAnonymousSession(ctx, models.SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Type != models.SessionTypeAnonymous || !strings.HasPrefix(session.UserID, "anon-") ||
+		len(session.TokenIDs) != 0 || session.UserAgent != "Firefox" || time.Until(session.ExpiresAt) > time.Hour {
+		t.Errorf("The anonymous session is NOT correct, got %+v\n", session)
+	}
+	if session.ID == other.ID || session.UserID == other.UserID {
+		t.Errorf("The anonymous sessions are NOT distinct, got %v and %v\n", session, other)
+	}
+	stored, err := store.GetSession(ctx, session.ID)
+	if err != nil || stored.UserID != session.UserID {
+		t.Errorf("The anonymous session was NOT stored, got %+v, %v\n", stored, err)
+	}
+}
+
+func TestNewAnonymousSessionRateLimited(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{AnonymousSessionsPerHour: 2})
+
+	for i := 0; i < 2; i++ {
+		_, err := manager.NewAnonymousSession(ctx, models.SessionClient{IP: "192.0.2.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := manager.NewAnonymousSession(ctx, models.SessionClient{IP: "192.0.2.1"})
+	if !errors.Is(err, ErrTooManyAnonymousSessions) || !errors.Is(err, models.ErrRateLimited) {
+		t.Errorf("The anonymous sessions above the rate were NOT refused, got %v\n", err)
+	}
+	_, err = manager.NewAnonymousSession(ctx, models.SessionClient{IP: "192.0.2.2"})
+	if err != nil {
+		t.Errorf("The anonymous session of another client was refused, got %v\n", err)
+	}
+}
+
+func TestAnonymousSessionExtendedOnUse(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{AnonymousSessionTTL: time.Hour})
+	anonymous, err := manager.NewAnonymousSession(ctx, models.SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session was last used two minutes ago and expires in 30 minutes
+	anonymous.LastSeenAt = time.Now().Add(-2 * time.Minute)
+	anonymous.ExpiresAt = time.Now().Add(30 * time.Minute)
+	err = store.SetSession(ctx, anonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := manager.Session(ctx, anonymous.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetSession(ctx, anonymous.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(session.ExpiresAt) < 59*time.Minute || time.Until(stored.ExpiresAt) < 59*time.Minute {
+		t.Errorf("The anonymous session was NOT extended, got %v and %v\n", session.ExpiresAt, stored.ExpiresAt)
+	}
+}
+
+func TestUpgradeAnonymousSession(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{})
+	anonymous, err := manager.NewAnonymousSession(ctx, models.SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgraded, _, err := manager.UpgradeAnonymousSession(ctx, anonymous.ID, models.Session{
+		UserID:    "jane",
+		ExpiresAt: time.Now().Add(time.Hour),
+		TokenIDs:  []string{"phone-gitlab"},
+	}, models.LoginGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upgraded session gets a new ID, the ID of the anonymous session is no longer valid
+	if upgraded.ID == "" || upgraded.ID == anonymous.ID {
+		t.Errorf("The upgraded session did NOT get a new ID, got %v\n", upgraded.ID)
+	}
+	if _, err = store.GetSession(ctx, anonymous.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The anonymous session was NOT removed, got %v\n", err)
+	}
+	session, err := store.GetSession(ctx, upgraded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Type != models.SessionTypeUser || session.UserID != "jane" ||
+		session.CreatedAt.Unix() != anonymous.CreatedAt.Unix() {
+		t.Errorf("The upgraded session is NOT correct, got %+v\n", session)
+	}
+	if sessions, _ := manager.ListSessions(ctx, "jane"); len(sessions) != 3 {
+		t.Errorf("The upgraded session is NOT listed with the sessions of the user, got %v\n", sessions)
+	}
+
+	_, _, err = manager.UpgradeAnonymousSession(ctx, "laptop", models.Session{UserID: "john"}, models.LoginGrant{})
+	if !errors.Is(err, ErrNotAnonymous) {
+		t.Errorf("Upgrading the session of a user was NOT refused, got %v\n", err)
+	}
+	_, _, err = manager.UpgradeAnonymousSession(ctx, "unknown", models.Session{UserID: "john"}, models.LoginGrant{})
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Upgrading a missing session was NOT refused, got %v\n", err)
+	}
+}
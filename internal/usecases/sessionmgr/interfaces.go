@@ -4,22 +4,44 @@ import (
 	"context"
 
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 )
 
-type SessionWriter interface {
-	WriteSession(context.Context, models.Session) error
+var (
+	_ SessionStatusReader      = repository.Repository(nil)
+	_ RefreshTokenExpiryReader = repository.Repository(nil)
+	_ UserSessionStore         = repository.Repository(nil)
+)
+
+type SessionStatusReader interface {
+	repository.SessionReader
+	repository.RefreshTokenReader
+}
+
+type RefreshTokenExpiryReader interface {
+	repository.SessionReader
+	repository.RefreshTokenReader
+	repository.ExpiringTokenIndex
+	repository.ReauthNoticeClaimer
+}
+
+type ReauthNotifier interface {
+	NotifyReauthRequired(context.Context, models.ReauthNotice) error
 }
 
-type SessionRemover interface {
-	RemoveSession(ctx context.Context, sessionID string) error
+type UserSessionStore interface {
+	repository.SessionReader
+	repository.AccessTokenReader
+	repository.RefreshTokenReader
+	repository.Transactor
+	repository.SessionToucher
 }
 
-type SessionReader interface {
-	Read(sessionID string) (models.Session, error)
+// ProviderTokenRevoker revokes a token at the provider whose token endpoint is tokenURL
+type ProviderTokenRevoker interface {
+	RevokeToken(ctx context.Context, tokenURL string, token string, tokenTypeHint string) error
 }
 
-type SessionReaderWriterRemover interface {
-	SessionReader
-	SessionWriter
-	SessionRemover
+type SecurityAuditor interface {
+	Audit(context.Context, models.AuditEvent) error
 }
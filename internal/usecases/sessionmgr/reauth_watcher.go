@@ -0,0 +1,132 @@
+package sessionmgr
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+const (
+	defaultReauthWarning  = 24 * time.Hour
+	defaultReauthInterval = 5 * time.Minute
+)
+
+// ReauthConfig contains the settings of the re-authentication notices
+type ReauthConfig struct {
+	// Warning is how long before a refresh token expires the notification is sent
+	Warning time.Duration
+	// Interval is how often the refresh token expiry index is checked
+	Interval time.Duration
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c ReauthConfig) withDefaults() ReauthConfig {
+	if c.Warning <= 0 {
+		c.Warning = defaultReauthWarning
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultReauthInterval
+	}
+	return c
+}
+
+// ReauthWatcher notifies users before the refresh tokens of their sessions expire, so that they can log in again
+// before losing access to the providers. The notices are claimed in the store, so several watchers can share it.
+type ReauthWatcher struct {
+	store    RefreshTokenExpiryReader
+	notifier ReauthNotifier
+	config   ReauthConfig
+}
+
+func NewReauthWatcher(store RefreshTokenExpiryReader, notifier ReauthNotifier, config ReauthConfig) *ReauthWatcher {
+	return &ReauthWatcher{store: store, notifier: notifier, config: config.withDefaults()}
+}
+
+// Run checks the refresh token expiry index at every interval until the context is done
+func (w *ReauthWatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		err := w.CheckExpiringRefreshTokens(ctx)
+		if err != nil {
+			log.Printf("Checking expiring refresh tokens failed: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckExpiringRefreshTokens sends a notification for every refresh token that expires within the warning, each
+// token expiration is notified once by all the watchers sharing the store
+func (w *ReauthWatcher) CheckExpiringRefreshTokens(ctx context.Context) error {
+	now := time.Now()
+	tokenIDs, err := w.store.GetExpiringRefreshTokenIDs(ctx, now, now.Add(w.config.Warning))
+	if err != nil {
+		return err
+	}
+
+	for _, tokenID := range tokenIDs {
+		refreshToken, err := w.store.GetRefreshToken(ctx, tokenID)
+		if err != nil {
+			log.Printf("GetRefreshToken failed for token %s: %s\n", tokenID, err)
+			continue
+		}
+		claimed, err := w.store.ClaimReauthNotice(ctx, tokenID, refreshToken.ExpiresAt)
+		if err != nil {
+			log.Printf("Claiming the re-authentication notice for token %s failed: %s\n", tokenID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		err = w.notify(ctx, refreshToken)
+		if err != nil {
+			log.Printf("Sending the re-authentication notice for token %s failed: %s\n", tokenID, err)
+			// The notice is claimed again at the next check
+			err = w.store.ReleaseReauthNotice(ctx, tokenID, refreshToken.ExpiresAt)
+			if err != nil {
+				log.Printf("Releasing the re-authentication notice for token %s failed: %s\n", tokenID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// notify sends the re-authentication notice of a refresh token
+func (w *ReauthWatcher) notify(ctx context.Context, refreshToken models.RefreshToken) error {
+	notice, err := w.reauthNotice(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	return w.notifier.NotifyReauthRequired(ctx, notice)
+}
+
+// reauthNotice returns the notice of a refresh token, it identifies the session by its user and its handle
+func (w *ReauthWatcher) reauthNotice(
+	ctx context.Context,
+	refreshToken models.RefreshToken,
+) (models.ReauthNotice, error) {
+	notice := models.ReauthNotice{TokenID: refreshToken.ID, ExpiresAt: refreshToken.ExpiresAt}
+	sessionID, err := w.store.GetTokenSessionID(ctx, refreshToken.ID)
+	if err != nil || sessionID == "" {
+		return notice, err
+	}
+	session, err := w.store.GetSession(ctx, sessionID)
+	// The session expired since the token was read, the notice still reaches the services that know the token
+	if errors.Is(err, models.ErrNotFound) {
+		return notice, nil
+	}
+	if err != nil {
+		return notice, err
+	}
+	notice.UserID = session.UserID
+	notice.SessionHandle = models.SessionHandle(sessionID)
+	return notice, nil
+}
@@ -0,0 +1,181 @@
+package sessionmgr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+var ctx = context.Background()
+
+// DummyExpiryStore implements the operations used by the session manager, the others are left to the nil repository
+type DummyExpiryStore struct {
+	repository.Repository
+	sessions      map[string]models.Session
+	refreshTokens map[string]models.RefreshToken
+	reauthNotices map[string]time.Time
+}
+
+func (d *DummyExpiryStore) GetSession(_ context.Context, sessionID string) (models.Session, error) {
+	return d.sessions[sessionID], nil
+}
+func (d *DummyExpiryStore) GetRefreshToken(_ context.Context, tokenID string) (models.RefreshToken, error) {
+	return d.refreshTokens[tokenID], nil
+}
+func (d *DummyExpiryStore) GetExpiringRefreshTokenIDs(_ context.Context, start, stop time.Time) ([]string, error) {
+	tokenIDs := []string{}
+	for tokenID, refreshToken := range d.refreshTokens {
+		if !refreshToken.ExpiresAt.Before(start) && !refreshToken.ExpiresAt.After(stop) {
+			tokenIDs = append(tokenIDs, tokenID)
+		}
+	}
+	return tokenIDs, nil
+}
+func (d *DummyExpiryStore) GetTokenSessionID(_ context.Context, tokenID string) (string, error) {
+	for sessionID, session := range d.sessions {
+		for _, sessionTokenID := range session.TokenIDs {
+			if sessionTokenID == tokenID {
+				return sessionID, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (d *DummyExpiryStore) ClaimReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	if claimed, found := d.reauthNotices[tokenID]; found && claimed.Equal(expiresAt) {
+		return false, nil
+	}
+	d.reauthNotices[tokenID] = expiresAt
+	return true, nil
+}
+func (d *DummyExpiryStore) ReleaseReauthNotice(_ context.Context, tokenID string, expiresAt time.Time) error {
+	delete(d.reauthNotices, tokenID)
+	return nil
+}
+
+type DummyNotifier struct {
+	notices []models.ReauthNotice
+	err     error
+}
+
+func (d *DummyNotifier) NotifyReauthRequired(_ context.Context, notice models.ReauthNotice) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.notices = append(d.notices, notice)
+	return nil
+}
+
+func newDummyExpiryStore() *DummyExpiryStore {
+	return &DummyExpiryStore{
+		sessions: map[string]models.Session{
+			"session-1": {
+				ID:        "session-1",
+				ExpiresAt: time.Now().Add(time.Hour),
+				TokenIDs:  []string{"gitlab", "keycloak"},
+				UserID:    "jane",
+			},
+		},
+		refreshTokens: map[string]models.RefreshToken{
+			"gitlab":   {ID: "gitlab", ExpiresAt: time.Unix(0, 0)},
+			"keycloak": {ID: "keycloak", ExpiresAt: time.Now().Add(10 * time.Minute)},
+		},
+		reauthNotices: map[string]time.Time{},
+	}
+}
+
+func TestCheckExpiringRefreshTokens(t *testing.T) {
+	notifier := DummyNotifier{}
+	watcher := NewReauthWatcher(newDummyExpiryStore(), &notifier, ReauthConfig{Warning: 15 * time.Minute})
+
+	// Every expiring refresh token is notified only once
+	for i := 0; i < 2; i++ {
+		err := watcher.CheckExpiringRefreshTokens(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(notifier.notices) != 1 {
+		t.Fatalf("The number of notices is NOT correct, got %v want %v\n", len(notifier.notices), 1)
+	}
+	notice := notifier.notices[0]
+	if notice.UserID != "jane" || notice.SessionHandle != models.SessionHandle("session-1") ||
+		notice.TokenID != "keycloak" {
+		t.Errorf("The notice is NOT correct, got %+v\n", notice)
+	}
+}
+
+func TestCheckExpiringRefreshTokensWithSharedStore(t *testing.T) {
+	store := newDummyExpiryStore()
+	notifier := DummyNotifier{}
+	config := ReauthConfig{Warning: 15 * time.Minute}
+
+	// The watchers of two gateway instances share the store
+	for _, watcher := range []*ReauthWatcher{
+		NewReauthWatcher(store, &notifier, config),
+		NewReauthWatcher(store, &notifier, config),
+	} {
+		err := watcher.CheckExpiringRefreshTokens(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(notifier.notices) != 1 {
+		t.Errorf("The number of notices is NOT correct, got %v want %v\n", len(notifier.notices), 1)
+	}
+}
+
+func TestCheckExpiringRefreshTokensRetriesFailedNotices(t *testing.T) {
+	notifier := DummyNotifier{err: errors.New("unavailable")}
+	watcher := NewReauthWatcher(newDummyExpiryStore(), &notifier, ReauthConfig{Warning: 15 * time.Minute})
+
+	err := watcher.CheckExpiringRefreshTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.err = nil
+	err = watcher.CheckExpiringRefreshTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notifier.notices) != 1 {
+		t.Errorf("The number of notices is NOT correct, got %v want %v\n", len(notifier.notices), 1)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	store := newDummyExpiryStore()
+
+	manager := SessionManager{StatusStore: store, ReauthWarning: 5 * time.Minute}
+	status, err := manager.Status(ctx, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ReauthRequired || !status.ReauthDeadline.Equal(store.refreshTokens["keycloak"].ExpiresAt) {
+		t.Errorf("The session status is NOT correct, got %+v\n", status)
+	}
+
+	manager.ReauthWarning = 15 * time.Minute
+	status, err = manager.Status(ctx, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ReauthRequired {
+		t.Errorf("The session status does NOT require re-authentication, got %+v\n", status)
+	}
+}
+
+func TestReauthConfigDefaults(t *testing.T) {
+	watcher := NewReauthWatcher(newDummyExpiryStore(), &DummyNotifier{}, ReauthConfig{})
+	if watcher.config.Interval != defaultReauthInterval || watcher.config.Warning != defaultReauthWarning {
+		t.Errorf("The default config is NOT correct, got %+v\n", watcher.config)
+	}
+}
@@ -0,0 +1,217 @@
+package sessionmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+// Modes of the session binding
+const (
+	// BindingModeOff does not compare the clients of the requests with the client that logged in
+	BindingModeOff = "off"
+	// BindingModeReport emits an audit event when the client of a request does not match but keeps the session
+	BindingModeReport = "report"
+	// BindingModeEnforce revokes the session and refuses the request when the client of a request does not match
+	BindingModeEnforce = "enforce"
+)
+
+// Default settings used when the corresponding BindingConfig fields are not set
+const (
+	defaultIPv4PrefixLength = 24
+	defaultIPv6PrefixLength = 64
+	// randomSize is the number of random bytes of the generated device keys and session IDs
+	randomSize = 32
+)
+
+// ErrSessionBindingMismatch wraps models.ErrForbidden so that the adapters can recognize it
+var ErrSessionBindingMismatch = fmt.Errorf("the client does not match the client the session is bound to: %w",
+	models.ErrForbidden)
+
+// BindingConfig selects the attributes of the client that logged in that the requests of a session must match.
+// Sessions that were created without an attribute are not checked for it.
+type BindingConfig struct {
+	// Mode is one of the BindingMode constants, it defaults to BindingModeOff
+	Mode string
+	// UserAgent binds the session to the user agent that logged in
+	UserAgent bool
+	// IPPrefix binds the session to the network of the IP address that logged in
+	IPPrefix bool
+	// IPv4PrefixLength and IPv6PrefixLength are the sizes in bits of the network of IPPrefix
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// DeviceKey binds the session to a random key that the client keeps in a device cookie
+	DeviceKey bool
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c BindingConfig) withDefaults() BindingConfig {
+	if c.Mode == "" {
+		c.Mode = BindingModeOff
+	}
+	if c.IPv4PrefixLength <= 0 {
+		c.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+	if c.IPv6PrefixLength <= 0 {
+		c.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+	return c
+}
+
+// NewBindingConfig returns the binding of a mode to a comma separated list of the attributes user-agent, ip-prefix
+// and device-key, like they are given on the command line
+func NewBindingConfig(mode string, attributes string) (BindingConfig, error) {
+	binding := BindingConfig{Mode: mode}
+	for _, attribute := range strings.Split(attributes, ",") {
+		switch strings.TrimSpace(attribute) {
+		case "user-agent":
+			binding.UserAgent = true
+		case "ip-prefix":
+			binding.IPPrefix = true
+		case "device-key":
+			binding.DeviceKey = true
+		case "":
+		default:
+			return BindingConfig{}, fmt.Errorf("unknown session binding attribute %q", attribute)
+		}
+	}
+	return binding, nil
+}
+
+// validate reports the settings that are not valid
+func (c BindingConfig) validate() error {
+	if c.Mode != BindingModeOff && c.Mode != BindingModeReport && c.Mode != BindingModeEnforce {
+		return fmt.Errorf("unknown session binding mode %q", c.Mode)
+	}
+	if c.IPv4PrefixLength > 8*net.IPv4len || c.IPv6PrefixLength > 8*net.IPv6len {
+		return fmt.Errorf("the IP prefix length is larger than the address")
+	}
+	return nil
+}
+
+// VerifyClient returns the session that a request is made with once its client matched the client that logged in,
+// and records that the session is used like Session.
+// On a mismatch an audit event is emitted and, when the binding is enforced, the session is revoked and
+// ErrSessionBindingMismatch is returned. It returns models.ErrNotFound if the session does not exist or has expired.
+func (m *UserSessionManager) VerifyClient(
+	ctx context.Context,
+	sessionID string,
+	client models.SessionClient,
+) (models.Session, error) {
+	session, err := m.store.GetSession(ctx, sessionID)
+	if err != nil {
+		return models.Session{}, err
+	}
+	if m.config.Binding.Mode == BindingModeOff {
+		return m.touch(ctx, session), nil
+	}
+	mismatches := m.bindingMismatches(session, client)
+	if len(mismatches) == 0 {
+		return m.touch(ctx, session), nil
+	}
+
+	enforced := m.config.Binding.Mode == BindingModeEnforce
+	message := "session used by another client, mismatched " + strings.Join(mismatches, ", ")
+	var revokeErr error
+	if enforced {
+		revokeErr = m.revoke(ctx, session)
+		message += ", session revoked"
+		if revokeErr != nil {
+			message = fmt.Sprintf("%s, revocation failed: %s", message, revokeErr)
+		}
+	}
+	err = m.auditor.Audit(ctx, models.AuditEvent{
+		Type:      models.AuditEventSessionBindingMismatch,
+		Time:      time.Now(),
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		TokenIDs:  session.TokenIDs,
+		Message:   message,
+	})
+	if err != nil {
+		log.Printf("Emitting the session binding audit event failed: %s\n", err)
+	}
+	if revokeErr != nil {
+		return models.Session{}, revokeErr
+	}
+	if enforced {
+		return models.Session{}, ErrSessionBindingMismatch
+	}
+	return m.touch(ctx, session), nil
+}
+
+// bindingMismatches returns the names of the bound attributes of a session that the client does not match
+func (m *UserSessionManager) bindingMismatches(session models.Session, client models.SessionClient) []string {
+	binding := m.config.Binding
+	var mismatches []string
+	if binding.UserAgent && session.UserAgent != "" && !sameHash(session.UserAgent, client.UserAgent) {
+		mismatches = append(mismatches, "user agent")
+	}
+	if binding.IPPrefix && session.ClientIP != "" && !m.sameNetwork(session.ClientIP, client.IP) {
+		mismatches = append(mismatches, "IP prefix")
+	}
+	if binding.DeviceKey && session.DeviceKeyHash != "" && !sameDeviceKey(session.DeviceKeyHash, client.DeviceKey) {
+		mismatches = append(mismatches, "device key")
+	}
+	return mismatches
+}
+
+// sameNetwork reports whether two IP addresses are in the same network of the configured prefix length
+func (m *UserSessionManager) sameNetwork(boundIP string, ip string) bool {
+	bound, current := net.ParseIP(boundIP), net.ParseIP(ip)
+	if bound == nil || current == nil {
+		return boundIP == ip
+	}
+	if bound.To4() != nil {
+		if current.To4() == nil {
+			return false
+		}
+		mask := net.CIDRMask(m.config.Binding.IPv4PrefixLength, 8*net.IPv4len)
+		return bound.To4().Mask(mask).Equal(current.To4().Mask(mask))
+	}
+	if current.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(m.config.Binding.IPv6PrefixLength, 8*net.IPv6len)
+	return bound.Mask(mask).Equal(current.Mask(mask))
+}
+
+// sameHash compares the hashes of two values in constant time
+func sameHash(bound string, value string) bool {
+	boundHash, valueHash := sha256.Sum256([]byte(bound)), sha256.Sum256([]byte(value))
+	return subtle.ConstantTimeCompare(boundHash[:], valueHash[:]) == 1
+}
+
+// sameDeviceKey reports whether a device key has the hash a session is bound to
+func sameDeviceKey(boundHash string, deviceKey string) bool {
+	if deviceKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(boundHash), []byte(DeviceKeyHash(deviceKey))) == 1
+}
+
+// DeviceKeyHash returns the hash of a device key that is stored in the session bound to it
+func DeviceKeyHash(deviceKey string) string {
+	hash := sha256.Sum256([]byte(deviceKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// newRandomString returns a random URL safe string, it is used for the device keys and the session IDs
+func newRandomString() (string, error) {
+	value := make([]byte, randomSize)
+	_, err := rand.Read(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
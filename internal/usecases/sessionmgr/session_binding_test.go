@@ -0,0 +1,129 @@
+package sessionmgr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/memoryadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+func newBoundSession(
+	t *testing.T,
+	binding BindingConfig,
+) (*UserSessionManager, *memoryadapters.MemoryAdapter, *DummyAuditor, string) {
+	store := memoryadapters.NewMemoryAdapter()
+	auditor := &DummyAuditor{}
+	manager, err := NewUserSessionManager(store, &DummyRevoker{}, auditor, Config{Binding: binding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, deviceKey, err := manager.Login(ctx, models.Session{
+		ID:        "laptop",
+		UserID:    "jane",
+		ExpiresAt: time.Now().Add(time.Hour),
+		ClientIP:  "192.0.2.10",
+		UserAgent: "Firefox",
+	}, models.LoginGrant{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, store, auditor, deviceKey
+}
+
+func TestVerifyClient(t *testing.T) {
+	binding := BindingConfig{Mode: BindingModeEnforce, UserAgent: true, IPPrefix: true, DeviceKey: true}
+	manager, _, auditor, deviceKey := newBoundSession(t, binding)
+	if deviceKey == "" {
+		t.Fatalf("The device key is NOT returned at login\n")
+	}
+
+	// Another address of the same network matches
+	session, err := manager.VerifyClient(ctx, "laptop", models.SessionClient{
+		IP:        "192.0.2.99",
+		UserAgent: "Firefox",
+		DeviceKey: deviceKey,
+	})
+	if err != nil || session.ID != "laptop" {
+		t.Errorf("The client that logged in was NOT accepted, got %v, %v\n", session.ID, err)
+	}
+	if len(auditor.events) != 0 {
+		t.Errorf("A matching client was audited, got %v\n", auditor.events)
+	}
+}
+
+func TestVerifyClientMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func(deviceKey string) models.SessionClient
+	}{
+		{"user agent", func(deviceKey string) models.SessionClient {
+			return models.SessionClient{IP: "192.0.2.10", UserAgent: "curl", DeviceKey: deviceKey}
+		}},
+		{"IP prefix", func(deviceKey string) models.SessionClient {
+			return models.SessionClient{IP: "198.51.100.10", UserAgent: "Firefox", DeviceKey: deviceKey}
+		}},
+		{"device key", func(string) models.SessionClient {
+			return models.SessionClient{IP: "192.0.2.10", UserAgent: "Firefox"}
+		}},
+	}
+	for _, tt := range tests {
+		binding := BindingConfig{Mode: BindingModeEnforce, UserAgent: true, IPPrefix: true, DeviceKey: true}
+		manager, store, auditor, deviceKey := newBoundSession(t, binding)
+
+		_, err := manager.VerifyClient(ctx, "laptop", tt.client(deviceKey))
+		if !errors.Is(err, ErrSessionBindingMismatch) {
+			t.Errorf("The %s mismatch was NOT refused, got %v\n", tt.name, err)
+		}
+		if _, err = store.GetSession(ctx, "laptop"); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("The session was NOT revoked on a %s mismatch, got %v\n", tt.name, err)
+		}
+		if len(auditor.events) != 1 || auditor.events[0].Type != models.AuditEventSessionBindingMismatch {
+			t.Errorf("The %s mismatch was NOT audited, got %+v\n", tt.name, auditor.events)
+		}
+	}
+}
+
+func TestVerifyClientReport(t *testing.T) {
+	manager, store, auditor, deviceKey := newBoundSession(t, BindingConfig{Mode: BindingModeReport, UserAgent: true})
+	if deviceKey != "" {
+		t.Errorf("A device key is returned without device binding, got %v\n", deviceKey)
+	}
+
+	session, err := manager.VerifyClient(ctx, "laptop", models.SessionClient{IP: "192.0.2.10", UserAgent: "curl"})
+	if err != nil || session.ID != "laptop" {
+		t.Errorf("The reported mismatch refused the request, got %v, %v\n", session.ID, err)
+	}
+	if _, err = store.GetSession(ctx, "laptop"); err != nil {
+		t.Errorf("The session was revoked on a reported mismatch, got %v\n", err)
+	}
+	if len(auditor.events) != 1 || auditor.events[0].SessionID != "laptop" {
+		t.Errorf("The mismatch was NOT audited, got %+v\n", auditor.events)
+	}
+
+	// Sessions created without a user agent are not checked
+	err = store.SetSession(ctx, models.Session{ID: "legacy", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.VerifyClient(ctx, "legacy", models.SessionClient{UserAgent: "curl"})
+	if err != nil || len(auditor.events) != 1 {
+		t.Errorf("A session without a user agent was checked, got %v, %v\n", auditor.events, err)
+	}
+}
+
+func TestNewBindingConfig(t *testing.T) {
+	binding, err := NewBindingConfig(BindingModeEnforce, "user-agent, device-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BindingConfig{Mode: BindingModeEnforce, UserAgent: true, DeviceKey: true}
+	if binding != want {
+		t.Errorf("binding is NOT correct, got %v want %v\n", binding, want)
+	}
+	_, err = NewBindingConfig(BindingModeEnforce, "user-agent,cookie")
+	if err == nil {
+		t.Errorf("unknown attribute is NOT rejected\n")
+	}
+}
@@ -2,16 +2,22 @@ package sessionmgr
 
 import (
 	"context"
+	"log"
+	"time"
 
 	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
 )
 
 type SessionManager struct {
-	Store SessionWriter
+	Store       repository.SessionWriter
+	StatusStore SessionStatusReader
+	// ReauthWarning is how long before a refresh token expires the session reports that re-authentication is needed
+	ReauthWarning time.Duration
 }
 
 func (s *SessionManager) Refresh(session models.Session) (newSession models.Session, err error) {
-	s.Store.WriteSession(context.Background(), session)
+	s.Store.SetSession(context.Background(), session)
 	return models.Session{}, nil
 }
 
@@ -19,3 +25,33 @@ func (s *SessionManager) Logout(sessionID string) (err error) {
 	//s.store.Remove(sessionID)
 	return nil
 }
+
+// Status reports when a session expires and whether the user has to re-authenticate soon because the earliest
+// expiring refresh token of the session lapses within the re-authentication warning
+func (s *SessionManager) Status(ctx context.Context, sessionID string) (models.SessionStatus, error) {
+	session, err := s.StatusStore.GetSession(ctx, sessionID)
+	if err != nil {
+		return models.SessionStatus{}, err
+	}
+
+	status := models.SessionStatus{
+		ID:        session.ID,
+		ExpiresAt: session.ExpiresAt,
+	}
+	for _, tokenID := range session.TokenIDs {
+		refreshToken, err := s.StatusStore.GetRefreshToken(ctx, tokenID)
+		if err != nil {
+			log.Printf("GetRefreshToken failed for token %s of session %s: %s\n", tokenID, models.SessionHandle(sessionID), err)
+			continue
+		}
+		// Refresh tokens without an expiration never require re-authentication
+		if refreshToken.ExpiresAt.Unix() <= 0 {
+			continue
+		}
+		if status.ReauthDeadline.IsZero() || refreshToken.ExpiresAt.Before(status.ReauthDeadline) {
+			status.ReauthDeadline = refreshToken.ExpiresAt
+		}
+	}
+	status.ReauthRequired = !status.ReauthDeadline.IsZero() && time.Until(status.ReauthDeadline) <= s.ReauthWarning
+	return status, nil
+}
@@ -0,0 +1,412 @@
+package sessionmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// Policies applied when a login exceeds the session limit of a user
+const (
+	// LimitPolicyEvictOldest revokes the sessions of the user that were created first
+	LimitPolicyEvictOldest = "evict_oldest"
+	// LimitPolicyReject refuses the login with ErrTooManySessions
+	LimitPolicyReject = "reject"
+)
+
+// lastSeenInterval is how often the last seen time of a session is written, the requests in between are not recorded
+const lastSeenInterval = time.Minute
+
+// ErrTooManySessions wraps models.ErrForbidden so that the adapters can recognize it
+var ErrTooManySessions = fmt.Errorf("the user has reached the maximum number of sessions: %w", models.ErrForbidden)
+
+// Config contains the settings of the user sessions
+type Config struct {
+	// MaxSessions is the number of sessions a user can have at the same time, there is no limit when it is 0. The
+	// limit is approximate: the sessions are counted before the new one is stored, so concurrent logins of the same
+	// user, possibly on different gateway replicas, can exceed it until the next login.
+	MaxSessions int
+	// LimitPolicy is one of the LimitPolicy constants, it defaults to LimitPolicyEvictOldest
+	LimitPolicy string
+	// Binding selects the attributes of the client that logged in that the requests of a session must match
+	Binding BindingConfig
+	// AnonymousSessionTTL is how long an anonymous session lasts without being used, every use extends it
+	AnonymousSessionTTL time.Duration
+	// AnonymousSessionsPerHour is the number of anonymous sessions a client IP can create per hour
+	AnonymousSessionsPerHour int
+}
+
+// withDefaults returns a copy of the config where unset values are replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.LimitPolicy == "" {
+		c.LimitPolicy = LimitPolicyEvictOldest
+	}
+	c.Binding = c.Binding.withDefaults()
+	if c.AnonymousSessionTTL <= 0 {
+		c.AnonymousSessionTTL = defaultAnonymousSessionTTL
+	}
+	if c.AnonymousSessionsPerHour <= 0 {
+		c.AnonymousSessionsPerHour = defaultAnonymousSessionsPerHour
+	}
+	return c
+}
+
+// UserSessionManager lists the sessions of a user and revokes them together with their tokens, both in the store and
+// at the providers that issued the tokens. It also enforces the maximum number of sessions of a user at login.
+type UserSessionManager struct {
+	store             UserSessionStore
+	revoker           ProviderTokenRevoker
+	auditor           SecurityAuditor
+	config            Config
+	anonymousLimiters *ipLimiters
+}
+
+func NewUserSessionManager(
+	store UserSessionStore,
+	revoker ProviderTokenRevoker,
+	auditor SecurityAuditor,
+	config Config,
+) (*UserSessionManager, error) {
+	config = config.withDefaults()
+	if config.MaxSessions < 0 {
+		return nil, fmt.Errorf("the maximum number of sessions cannot be negative")
+	}
+	if config.LimitPolicy != LimitPolicyEvictOldest && config.LimitPolicy != LimitPolicyReject {
+		return nil, fmt.Errorf("unknown session limit policy %q", config.LimitPolicy)
+	}
+	err := config.Binding.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &UserSessionManager{
+		store:             store,
+		revoker:           revoker,
+		auditor:           auditor,
+		config:            config,
+		anonymousLimiters: newIPLimiters(config.AnonymousSessionsPerHour),
+	}, nil
+}
+
+// Login stores the new session of a user together with the tokens the identity provider issued at login. The session
+// gets a random ID when it has none and the tokens get a random ID that is added to the token IDs of the session, the
+// session expires with the refresh token when no expiration is set. When the user already has the maximum number of
+// sessions, the oldest ones are revoked and audited or the login is refused with ErrTooManySessions, depending on the
+// limit policy, see Config.MaxSessions. It returns the session as stored and, when sessions are bound to a device,
+// the device key to set in the device cookie of the client.
+func (m *UserSessionManager) Login(
+	ctx context.Context,
+	session models.Session,
+	grant models.LoginGrant,
+) (models.Session, string, error) {
+	return m.login(ctx, session, grant, "")
+}
+
+// login stores the new session of a user like Login and removes the session it replaces, if any, in the same
+// transaction
+func (m *UserSessionManager) login(
+	ctx context.Context,
+	session models.Session,
+	grant models.LoginGrant,
+	replacedSessionID string,
+) (models.Session, string, error) {
+	session, grant, err := newLoginSession(session, grant)
+	if err != nil {
+		return models.Session{}, "", err
+	}
+	if m.config.MaxSessions > 0 && session.UserID != "" {
+		err := m.enforceLimit(ctx, session)
+		if err != nil {
+			return models.Session{}, "", err
+		}
+	}
+
+	deviceKey := ""
+	if m.config.Binding.Mode != BindingModeOff && m.config.Binding.DeviceKey {
+		deviceKey, err = newRandomString()
+		if err != nil {
+			return models.Session{}, "", err
+		}
+		session.DeviceKeyHash = DeviceKeyHash(deviceKey)
+	}
+	err = m.store.Update(ctx, func(tx repository.Writer) error {
+		if replacedSessionID != "" {
+			err := tx.RemoveSession(ctx, replacedSessionID)
+			if err != nil {
+				return err
+			}
+		}
+		if grant.AccessToken.ID != "" {
+			err := tx.SetAccessToken(ctx, grant.AccessToken)
+			if err != nil {
+				return err
+			}
+		}
+		if grant.RefreshToken.ID != "" {
+			err := tx.SetRefreshToken(ctx, grant.RefreshToken)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.SetSession(ctx, session)
+	})
+	if err != nil {
+		return models.Session{}, "", err
+	}
+	return session, deviceKey, nil
+}
+
+// newLoginSession fills in the session of a login and gives the tokens of the grant their ID
+func newLoginSession(session models.Session, grant models.LoginGrant) (models.Session, models.LoginGrant, error) {
+	var err error
+	if session.ID == "" {
+		session.ID, err = newRandomString()
+		if err != nil {
+			return models.Session{}, models.LoginGrant{}, err
+		}
+	}
+	if session.Type == "" {
+		session.Type = models.SessionTypeUser
+	}
+	now := time.Now()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+	}
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if grant.AccessToken.Value == "" {
+		return session, models.LoginGrant{}, nil
+	}
+
+	// The access token and its refresh token share their ID
+	tokenID, err := newRandomString()
+	if err != nil {
+		return models.Session{}, models.LoginGrant{}, err
+	}
+	grant.AccessToken.ID = tokenID
+	if grant.RefreshToken.Value != "" {
+		grant.RefreshToken.ID = tokenID
+	}
+	session.TokenIDs = append(append([]string{}, session.TokenIDs...), tokenID)
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = grant.RefreshToken.ExpiresAt
+		if grant.RefreshToken.Value == "" {
+			session.ExpiresAt = grant.AccessToken.ExpiresAt
+		}
+	}
+	return session, grant, nil
+}
+
+// enforceLimit makes room for a new session of a user
+func (m *UserSessionManager) enforceLimit(ctx context.Context, newSession models.Session) error {
+	sessions, err := m.ListSessions(ctx, newSession.UserID)
+	if err != nil {
+		return err
+	}
+	// A session that is stored again does not count twice
+	others := []models.Session{}
+	for _, session := range sessions {
+		if session.ID != newSession.ID {
+			others = append(others, session)
+		}
+	}
+	excess := len(others) - m.config.MaxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+	if m.config.LimitPolicy == LimitPolicyReject {
+		log.Printf("Login of user %s refused, the user has %d sessions\n", newSession.UserID, len(others))
+		return ErrTooManySessions
+	}
+
+	sort.SliceStable(others, func(i, j int) bool {
+		if !others[i].CreatedAt.Equal(others[j].CreatedAt) {
+			return others[i].CreatedAt.Before(others[j].CreatedAt)
+		}
+		return others[i].ID < others[j].ID
+	})
+	for _, session := range others[:excess] {
+		err = m.revoke(ctx, session)
+		if err != nil {
+			return err
+		}
+		err = m.auditor.Audit(ctx, models.AuditEvent{
+			Type:      models.AuditEventSessionEvicted,
+			Time:      time.Now(),
+			SessionID: session.ID,
+			UserID:    session.UserID,
+			TokenIDs:  session.TokenIDs,
+			Message:   fmt.Sprintf("session evicted by a new login, the limit is %d sessions", m.config.MaxSessions),
+		})
+		if err != nil {
+			log.Printf("Emitting the session eviction audit event failed: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// Session returns a session and records that it is used, it returns models.ErrNotFound if the session does not exist
+// or has expired
+func (m *UserSessionManager) Session(ctx context.Context, sessionID string) (models.Session, error) {
+	session, err := m.store.GetSession(ctx, sessionID)
+	if err != nil {
+		return models.Session{}, err
+	}
+	return m.touch(ctx, session), nil
+}
+
+// touch updates the last seen time of a session, at most once per lastSeenInterval, and returns the session as
+// stored. Anonymous sessions are extended to last the AnonymousSessionTTL from now. Failures are only logged since
+// the session can be used all the same.
+func (m *UserSessionManager) touch(ctx context.Context, session models.Session) models.Session {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < lastSeenInterval {
+		return session
+	}
+	expiresAt := time.Time{}
+	if session.Type == models.SessionTypeAnonymous {
+		expiresAt = now.Add(m.config.AnonymousSessionTTL)
+	}
+	touched, err := m.store.TouchSession(ctx, session.ID, now, expiresAt)
+	if err != nil {
+		log.Printf("Updating the last seen time of session %s failed: %s\n", models.SessionHandle(session.ID), err)
+		return session
+	}
+	if touched {
+		session.LastSeenAt = now
+		if !expiresAt.IsZero() {
+			session.ExpiresAt = expiresAt
+		}
+	}
+	return session
+}
+
+// ListSessions returns the active sessions of a user, the most recently seen first
+func (m *UserSessionManager) ListSessions(ctx context.Context, userID string) ([]models.Session, error) {
+	sessionIDs, err := m.store.GetUserSessionIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []models.Session{}
+	for _, sessionID := range sessionIDs {
+		session, err := m.store.GetSession(ctx, sessionID)
+		// The session expired since the index was read
+		if errors.Is(err, models.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of a user, it returns models.ErrNotFound if the user has no such session
+func (m *UserSessionManager) RevokeSession(ctx context.Context, userID string, sessionID string) error {
+	session, err := m.store.GetSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	// The sessions of other users are reported as missing so that their IDs cannot be probed
+	if userID == "" || session.UserID != userID {
+		return models.ErrNotFound
+	}
+	return m.revoke(ctx, session)
+}
+
+// RevokeAllSessions revokes every session of a user and returns the number of sessions revoked
+func (m *UserSessionManager) RevokeAllSessions(ctx context.Context, userID string) (int, error) {
+	sessions, err := m.ListSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	for i, session := range sessions {
+		err = m.revoke(ctx, session)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// sessionToken is a token of a session that is revoked at its provider once it is removed from the store
+type sessionToken struct {
+	url          string
+	accessToken  string
+	refreshToken string
+}
+
+// revoke removes a session with its tokens and their refresh token histories, then revokes the tokens at their
+// providers. Provider failures are only logged because the tokens can no longer be used through the gateway.
+func (m *UserSessionManager) revoke(ctx context.Context, session models.Session) error {
+	var tokens []sessionToken
+	for _, tokenID := range session.TokenIDs {
+		accessToken, err := m.store.GetAccessToken(ctx, tokenID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		refreshToken, err := m.store.GetRefreshToken(ctx, tokenID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return err
+		}
+		if accessToken.URL != "" {
+			tokens = append(tokens, sessionToken{
+				url:          accessToken.URL,
+				accessToken:  accessToken.Value,
+				refreshToken: refreshToken.Value,
+			})
+		}
+	}
+
+	err := m.store.Update(ctx, func(tx repository.Writer) error {
+		for _, tokenID := range session.TokenIDs {
+			err := tx.RemoveAccessToken(ctx, models.AccessToken{ID: tokenID})
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveRefreshToken(ctx, tokenID)
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveSupersededRefreshTokens(ctx, tokenID)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.RemoveSession(ctx, session.ID)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Session %s of user %s revoked\n", models.SessionHandle(session.ID), session.UserID)
+
+	handle := models.SessionHandle(session.ID)
+	for _, token := range tokens {
+		// Revoking the refresh token revokes the grant at most providers, the access token is revoked as well for
+		// the others
+		if token.refreshToken != "" {
+			err = m.revoker.RevokeToken(ctx, token.url, token.refreshToken, "refresh_token")
+			if err != nil {
+				log.Printf("Revoking a refresh token of session %s failed: %s\n", handle, err)
+			}
+		}
+		if token.accessToken != "" {
+			err = m.revoker.RevokeToken(ctx, token.url, token.accessToken, "access_token")
+			if err != nil {
+				log.Printf("Revoking an access token of session %s failed: %s\n", handle, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package sessionmgr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/adapters/memoryadapters"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+)
+
+type DummyRevoker struct {
+	revoked []string
+	err     error
+}
+
+func (d *DummyRevoker) RevokeToken(_ context.Context, tokenURL string, token string, tokenTypeHint string) error {
+	d.revoked = append(d.revoked, tokenURL+" "+tokenTypeHint+" "+token)
+	return d.err
+}
+
+type DummyAuditor struct {
+	events []models.AuditEvent
+}
+
+func (d *DummyAuditor) Audit(_ context.Context, event models.AuditEvent) error {
+	d.events = append(d.events, event)
+	return nil
+}
+
+func newUserSessionManager(
+	t *testing.T,
+	store UserSessionStore,
+	revoker ProviderTokenRevoker,
+	config Config,
+) *UserSessionManager {
+	manager, err := NewUserSessionManager(store, revoker, &DummyAuditor{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// newUserSessionStore stores two sessions of jane, created an hour and half an hour ago and seen two minutes and
+// one minute ago, and one session of john
+func newUserSessionStore(t *testing.T) *memoryadapters.MemoryAdapter {
+	store := memoryadapters.NewMemoryAdapter()
+	now := time.Now()
+	for _, session := range []models.Session{
+		{
+			ID:         "laptop",
+			UserID:     "jane",
+			CreatedAt:  now.Add(-time.Hour),
+			LastSeenAt: now.Add(-2 * time.Minute),
+			TokenIDs:   []string{"laptop-gitlab"},
+		},
+		{
+			ID:          "cli",
+			UserID:      "jane",
+			CreatedAt:   now.Add(-30 * time.Minute),
+			LastSeenAt:  now.Add(-time.Minute),
+			LoginMethod: models.SessionLoginCLI,
+		},
+		{ID: "other", UserID: "john", LastSeenAt: now, TokenIDs: []string{"other-gitlab"}},
+	} {
+		session.ExpiresAt = now.Add(time.Hour)
+		for _, tokenID := range session.TokenIDs {
+			err := store.SetAccessToken(ctx, models.AccessToken{
+				ID:        tokenID,
+				Value:     tokenID + "-access",
+				ExpiresAt: now.Add(time.Hour),
+				URL:       "https://gitlab.example.org/oauth/token",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SetRefreshToken(ctx, models.RefreshToken{ID: tokenID, Value: tokenID + "-refresh"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := store.SetSession(ctx, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestListSessions(t *testing.T) {
+	manager := newUserSessionManager(t, newUserSessionStore(t), &DummyRevoker{}, Config{})
+
+	sessions, err := manager.ListSessions(ctx, "jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "cli" || sessions[1].ID != "laptop" {
+		t.Errorf("The sessions of the user are NOT correct, got %v\n", sessions)
+	}
+}
+
+func TestSessionUpdatesLastSeen(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{})
+	before := time.Unix(time.Now().Unix(), 0)
+
+	// The laptop session was seen two minutes ago, using it moves it to the top of the list
+	session, err := manager.Session(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.LastSeenAt.Before(before) {
+		t.Errorf("The last seen time did NOT advance, got %v want at least %v\n", session.LastSeenAt, before)
+	}
+	stored, err := store.GetSession(ctx, "laptop")
+	if err != nil || stored.LastSeenAt.Before(before) {
+		t.Errorf("The stored last seen time did NOT advance, got %v, %v\n", stored.LastSeenAt, err)
+	}
+	sessions, err := manager.ListSessions(ctx, "jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "laptop" {
+		t.Errorf("The sessions of the user are NOT correct, got %v\n", sessions)
+	}
+
+	// The session is written at most once a minute
+	stored.LastSeenAt = stored.LastSeenAt.Add(-30 * time.Second)
+	err = store.SetSession(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err = manager.Session(ctx, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.LastSeenAt.Equal(stored.LastSeenAt) {
+		t.Errorf("The last seen time was NOT throttled, got %v want %v\n", session.LastSeenAt, stored.LastSeenAt)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	store := newUserSessionStore(t)
+	revoker := &DummyRevoker{err: errors.New("provider down")}
+	manager := newUserSessionManager(t, store, revoker, Config{})
+
+	err := manager.RevokeSession(ctx, "jane", "other")
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Revoking the session of another user was NOT refused, got %v\n", err)
+	}
+
+	// Provider failures do not keep the session from being revoked
+	err = manager.RevokeSession(ctx, "jane", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetSession(ctx, "laptop"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The revoked session was NOT removed, got %v\n", err)
+	}
+	if _, err = store.GetAccessToken(ctx, "laptop-gitlab"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The access token of the revoked session was NOT removed, got %v\n", err)
+	}
+	if _, err = store.GetRefreshToken(ctx, "laptop-gitlab"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The refresh token of the revoked session was NOT removed, got %v\n", err)
+	}
+	want := []string{
+		"https://gitlab.example.org/oauth/token refresh_token laptop-gitlab-refresh",
+		"https://gitlab.example.org/oauth/token access_token laptop-gitlab-access",
+	}
+	if len(revoker.revoked) != 2 || revoker.revoked[0] != want[0] || revoker.revoked[1] != want[1] {
+		t.Errorf("The tokens revoked at the provider are NOT correct, got %v want %v\n", revoker.revoked, want)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{})
+
+	revoked, err := manager.RevokeAllSessions(ctx, "jane")
+	if err != nil || revoked != 2 {
+		t.Errorf("The number of revoked sessions is NOT correct, got %v, %v want 2\n", revoked, err)
+	}
+	sessions, err := manager.ListSessions(ctx, "jane")
+	if err != nil || len(sessions) != 0 {
+		t.Errorf("Sessions of the user are left, got %v, %v\n", sessions, err)
+	}
+	if _, err = store.GetSession(ctx, "other"); err != nil {
+		t.Errorf("The session of another user was revoked, got %v\n", err)
+	}
+}
+
+func TestLoginEvictsOldestSession(t *testing.T) {
+	store := newUserSessionStore(t)
+	revoker := &DummyRevoker{}
+	auditor := &DummyAuditor{}
+	manager, err := NewUserSessionManager(store, revoker, auditor, Config{MaxSessions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing an existing session again evicts nothing
+	cli, err := store.GetSession(ctx, "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = manager.Login(ctx, cli, models.LoginGrant{})
+	if err != nil || len(auditor.events) != 0 {
+		t.Fatalf("Storing an existing session again evicted sessions, got %v, %v\n", auditor.events, err)
+	}
+
+	_, _, err = manager.Login(
+		ctx,
+		models.Session{ID: "phone", UserID: "jane", ExpiresAt: time.Now().Add(time.Hour)},
+		models.LoginGrant{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := manager.ListSessions(ctx, "jane")
+	if err != nil || len(sessions) != 2 || sessions[0].ID != "phone" || sessions[1].ID != "cli" {
+		t.Errorf("The sessions left are NOT correct, got %v, %v\n", sessions, err)
+	}
+	if _, err = store.GetAccessToken(ctx, "laptop-gitlab"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The access token of the evicted session was NOT removed, got %v\n", err)
+	}
+	if len(revoker.revoked) != 2 {
+		t.Errorf("The tokens of the evicted session were NOT revoked at the provider, got %v\n", revoker.revoked)
+	}
+	if len(auditor.events) != 1 || auditor.events[0].Type != models.AuditEventSessionEvicted ||
+		auditor.events[0].SessionID != "laptop" || auditor.events[0].UserID != "jane" {
+		t.Errorf("The eviction audit event is NOT correct, got %+v\n", auditor.events)
+	}
+}
+
+func TestLoginStoresTokens(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{})
+	expiresAt := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+
+	session, _, err := manager.Login(ctx, models.Session{UserID: "jane"}, models.LoginGrant{
+		AccessToken:  models.AccessToken{Value: "access", ExpiresAt: time.Now().Add(time.Minute)},
+		RefreshToken: models.RefreshToken{Value: "refresh", ExpiresAt: expiresAt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID == "" || len(session.TokenIDs) != 1 || !session.ExpiresAt.Equal(expiresAt) ||
+		session.Type != models.SessionTypeUser {
+		t.Fatalf("The session of the login is NOT correct, got %+v\n", session)
+	}
+	accessToken, err := store.GetAccessToken(ctx, session.TokenIDs[0])
+	if err != nil || accessToken.Value != "access" {
+		t.Errorf("The access token was NOT stored, got %+v, %v\n", accessToken, err)
+	}
+	refreshToken, err := store.GetRefreshToken(ctx, session.TokenIDs[0])
+	if err != nil || refreshToken.Value != "refresh" {
+		t.Errorf("The refresh token was NOT stored, got %+v, %v\n", refreshToken, err)
+	}
+	stored, err := store.GetSession(ctx, session.ID)
+	if err != nil || stored.UserID != "jane" {
+		t.Errorf("The session was NOT stored, got %+v, %v\n", stored, err)
+	}
+}
+
+func TestLoginRejectedAboveLimit(t *testing.T) {
+	store := newUserSessionStore(t)
+	manager := newUserSessionManager(t, store, &DummyRevoker{}, Config{MaxSessions: 2, LimitPolicy: LimitPolicyReject})
+
+	_, _, err := manager.Login(
+		ctx,
+		models.Session{ID: "phone", UserID: "jane", ExpiresAt: time.Now().Add(time.Hour)},
+		models.LoginGrant{},
+	)
+	if !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("The login above the limit was NOT rejected, got %v\n", err)
+	}
+	if _, err = store.GetSession(ctx, "phone"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("The rejected session was stored, got %v\n", err)
+	}
+	_, _, err = manager.Login(
+		ctx,
+		models.Session{ID: "phone", UserID: "john", ExpiresAt: time.Now().Add(time.Hour)},
+		models.LoginGrant{},
+	)
+	if err != nil {
+		t.Errorf("The login of a user below the limit was rejected, got %v\n", err)
+	}
+
+	_, err = NewUserSessionManager(store, &DummyRevoker{}, &DummyAuditor{}, Config{LimitPolicy: "random"})
+	if err == nil {
+		t.Errorf("An unknown limit policy was NOT refused\n")
+	}
+}
@@ -1,35 +1,23 @@
 package tokenmgr
 
-import "github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
-
-type AccessTokenReader interface {
-	Read(tokenID string) (models.AccessToken, error)
-}
-
-type AccessTokenWriter interface {
-	Write(models.AccessToken) error
-}
-
-type TokenRemover interface {
-	Remove(tokenID string) error
-}
-
-type RefreshTokenReader interface {
-	Read(tokenID string) (models.RefreshToken, error)
-}
-
-type RefreshTokenWriter interface {
-	Write(models.RefreshToken) error
-}
-
-type AccessTokenReaderWriterRemover interface {
-	AccessTokenReader
-	AccessTokenWriter
-	TokenRemover
+import (
+	"context"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+var _ TokenFamilyStore = repository.Repository(nil)
+
+// TokenFamilyStore contains the operations needed to detect the reuse of a rotated refresh token and to revoke the
+// tokens and the session that a compromised refresh token belongs to
+type TokenFamilyStore interface {
+	repository.SessionReader
+	repository.AccessTokenReader
+	repository.RefreshTokenReader
+	repository.Transactor
 }
 
-type RefreshTokenReaderWriterRemover interface {
-	RefreshTokenReader
-	RefreshTokenWriter
-	TokenRemover
+type SecurityAuditor interface {
+	Audit(context.Context, models.AuditEvent) error
 }
@@ -1,6 +1,137 @@
 package tokenmgr
 
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+// The refresh token errors wrap models.ErrForbidden so that the adapters can recognize them
+var (
+	ErrInvalidRefreshToken = fmt.Errorf("the refresh token is not valid: %w", models.ErrForbidden)
+	ErrRefreshTokenReused  = fmt.Errorf(
+		"a superseded refresh token was presented, the token family has been revoked: %w",
+		models.ErrForbidden,
+	)
+)
+
 type RefreshTokenManager struct {
-	refreshStore RefreshTokenReaderWriterRemover
-	accessStore  AccessTokenReaderWriterRemover
+	familyStore TokenFamilyStore
+	auditor     SecurityAuditor
+}
+
+func NewRefreshTokenManager(familyStore TokenFamilyStore, auditor SecurityAuditor) *RefreshTokenManager {
+	return &RefreshTokenManager{familyStore: familyStore, auditor: auditor}
+}
+
+// ExchangeRefreshToken verifies a presented refresh token like VerifyRefreshToken and returns the access token with
+// the same ID
+func (m *RefreshTokenManager) ExchangeRefreshToken(
+	ctx context.Context,
+	presented models.RefreshToken,
+) (models.AccessToken, error) {
+	err := m.VerifyRefreshToken(ctx, presented)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	return m.familyStore.GetAccessToken(ctx, presented.ID)
+}
+
+// VerifyRefreshToken checks that a presented refresh token is the current value for its ID. A value that was
+// superseded by a rotation means that the token leaked: the whole token family and the session the token belongs to
+// are revoked, a security audit event is emitted and ErrRefreshTokenReused is returned.
+func (m *RefreshTokenManager) VerifyRefreshToken(ctx context.Context, presented models.RefreshToken) error {
+	current, err := m.familyStore.GetRefreshToken(ctx, presented.ID)
+	// A superseded value can still be presented after the current token was removed
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+	if current.Value != "" && subtle.ConstantTimeCompare([]byte(current.Value), []byte(presented.Value)) == 1 {
+		return nil
+	}
+
+	reused, err := m.familyStore.IsSupersededRefreshToken(ctx, presented)
+	if err != nil {
+		return err
+	}
+	if !reused {
+		return ErrInvalidRefreshToken
+	}
+
+	// The session is the one the token belongs to, never one chosen by the caller
+	sessionID, err := m.familyStore.GetTokenSessionID(ctx, presented.ID)
+	if err != nil {
+		log.Printf("GetTokenSessionID failed, only revoking token %s: %s\n", presented.ID, err)
+		sessionID = ""
+	}
+	tokenIDs, revokeErr := m.revokeTokenFamily(ctx, sessionID, presented.ID)
+	message := "superseded refresh token presented, token family and session revoked"
+	if revokeErr != nil {
+		message = fmt.Sprintf("superseded refresh token presented, revocation failed: %s", revokeErr)
+	}
+	err = m.auditor.Audit(ctx, models.AuditEvent{
+		Type:      models.AuditEventRefreshTokenReuse,
+		Time:      time.Now(),
+		SessionID: sessionID,
+		TokenIDs:  tokenIDs,
+		Message:   message,
+	})
+	if err != nil {
+		log.Printf("Emitting the refresh token reuse audit event failed: %s\n", err)
+	}
+	if revokeErr != nil {
+		return revokeErr
+	}
+	return ErrRefreshTokenReused
+}
+
+// revokeTokenFamily removes the tokens of the session together with the reused token, their refresh token
+// histories and the session itself, it returns the IDs of the revoked tokens. Only the reused token is revoked when
+// it does not belong to a session.
+func (m *RefreshTokenManager) revokeTokenFamily(
+	ctx context.Context,
+	sessionID string,
+	tokenID string,
+) ([]string, error) {
+	tokenIDs := []string{tokenID}
+	if sessionID != "" {
+		session, err := m.familyStore.GetSession(ctx, sessionID)
+		if err != nil {
+			log.Printf("GetSession failed, only revoking token %s: %s\n", tokenID, err)
+		}
+		for _, sessionTokenID := range session.TokenIDs {
+			if sessionTokenID != tokenID {
+				tokenIDs = append(tokenIDs, sessionTokenID)
+			}
+		}
+	}
+
+	// Revoke everything at once so that a failure does not leave part of the family usable
+	err := m.familyStore.Update(ctx, func(tx repository.Writer) error {
+		for _, familyTokenID := range tokenIDs {
+			err := tx.RemoveAccessToken(ctx, models.AccessToken{ID: familyTokenID})
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveRefreshToken(ctx, familyTokenID)
+			if err != nil {
+				return err
+			}
+			err = tx.RemoveSupersededRefreshTokens(ctx, familyTokenID)
+			if err != nil {
+				return err
+			}
+		}
+		if sessionID == "" {
+			return nil
+		}
+		return tx.RemoveSession(ctx, sessionID)
+	})
+	return tokenIDs, err
 }
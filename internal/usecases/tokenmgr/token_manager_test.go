@@ -0,0 +1,188 @@
+package tokenmgr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/models"
+	"github.com/SwissDataScienceCenter/renku-gateway-v2/internal/repository"
+)
+
+var ctx = context.Background()
+
+// DummyFamilyStore implements the operations used by the token manager, the others are left to the nil repository
+type DummyFamilyStore struct {
+	repository.Repository
+	sessions      map[string]models.Session
+	accessTokens  map[string]models.AccessToken
+	refreshTokens map[string]models.RefreshToken
+	superseded    map[string][]string
+}
+
+func (d *DummyFamilyStore) IsSupersededRefreshToken(_ context.Context, refreshToken models.RefreshToken) (bool, error) {
+	for _, value := range d.superseded[refreshToken.ID] {
+		if value == refreshToken.Value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (d *DummyFamilyStore) RemoveSupersededRefreshTokens(_ context.Context, refreshTokenID string) error {
+	delete(d.superseded, refreshTokenID)
+	return nil
+}
+func (d *DummyFamilyStore) GetRefreshToken(_ context.Context, tokenID string) (models.RefreshToken, error) {
+	return d.refreshTokens[tokenID], nil
+}
+func (d *DummyFamilyStore) GetAccessToken(_ context.Context, tokenID string) (models.AccessToken, error) {
+	return d.accessTokens[tokenID], nil
+}
+func (d *DummyFamilyStore) RemoveRefreshToken(_ context.Context, refreshTokenID string) error {
+	delete(d.refreshTokens, refreshTokenID)
+	return nil
+}
+func (d *DummyFamilyStore) RemoveAccessToken(_ context.Context, accessToken models.AccessToken) error {
+	delete(d.accessTokens, accessToken.ID)
+	return nil
+}
+func (d *DummyFamilyStore) GetTokenSessionID(_ context.Context, tokenID string) (string, error) {
+	for _, session := range d.sessions {
+		for _, sessionTokenID := range session.TokenIDs {
+			if sessionTokenID == tokenID {
+				return session.ID, nil
+			}
+		}
+	}
+	return "", nil
+}
+func (d *DummyFamilyStore) GetSession(_ context.Context, sessionID string) (models.Session, error) {
+	return d.sessions[sessionID], nil
+}
+func (d *DummyFamilyStore) Update(_ context.Context, fn func(tx repository.Writer) error) error {
+	return fn(d)
+}
+func (d *DummyFamilyStore) RemoveSession(_ context.Context, sessionID string) error {
+	delete(d.sessions, sessionID)
+	return nil
+}
+
+type DummyAuditor struct {
+	events []models.AuditEvent
+}
+
+func (d *DummyAuditor) Audit(_ context.Context, event models.AuditEvent) error {
+	d.events = append(d.events, event)
+	return nil
+}
+
+func newDummyFamilyStore() *DummyFamilyStore {
+	return &DummyFamilyStore{
+		sessions: map[string]models.Session{
+			"session-1": {ID: "session-1", TokenIDs: []string{"gitlab", "keycloak"}},
+			"session-2": {ID: "session-2", TokenIDs: []string{"other"}},
+		},
+		accessTokens: map[string]models.AccessToken{
+			"gitlab":   {ID: "gitlab", Value: "gitlab-access"},
+			"keycloak": {ID: "keycloak", Value: "keycloak-access"},
+			"other":    {ID: "other", Value: "other-access"},
+		},
+		refreshTokens: map[string]models.RefreshToken{
+			"gitlab":   {ID: "gitlab", Value: "gitlab-refresh-3"},
+			"keycloak": {ID: "keycloak", Value: "keycloak-refresh"},
+			"other":    {ID: "other", Value: "other-refresh"},
+		},
+		superseded: map[string][]string{
+			"gitlab": {"gitlab-refresh-2", "gitlab-refresh-1"},
+		},
+	}
+}
+
+func TestVerifyRefreshTokenCurrent(t *testing.T) {
+	store := newDummyFamilyStore()
+	auditor := DummyAuditor{}
+	manager := NewRefreshTokenManager(store, &auditor)
+
+	err := manager.VerifyRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "gitlab-refresh-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auditor.events) != 0 || len(store.sessions) != 2 {
+		t.Errorf("Verifying the current refresh token had side effects, got %v audit events\n", len(auditor.events))
+	}
+}
+
+func TestVerifyRefreshTokenUnknown(t *testing.T) {
+	store := newDummyFamilyStore()
+	auditor := DummyAuditor{}
+	manager := NewRefreshTokenManager(store, &auditor)
+
+	err := manager.VerifyRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "made-up"})
+	if !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Verifying an unknown refresh token did NOT fail, got %v want %v\n", err, ErrInvalidRefreshToken)
+	}
+	if len(auditor.events) != 0 || len(store.sessions) != 2 {
+		t.Errorf("Verifying an unknown refresh token revoked the session\n")
+	}
+}
+
+func TestVerifyRefreshTokenReused(t *testing.T) {
+	store := newDummyFamilyStore()
+	auditor := DummyAuditor{}
+	manager := NewRefreshTokenManager(store, &auditor)
+
+	err := manager.VerifyRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "gitlab-refresh-1"})
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("Verifying a superseded refresh token did NOT fail, got %v want %v\n", err, ErrRefreshTokenReused)
+	}
+
+	if _, found := store.sessions["session-1"]; found {
+		t.Errorf("The session was NOT removed\n")
+	}
+	if _, found := store.sessions["session-2"]; !found {
+		t.Errorf("The session of another token family was removed\n")
+	}
+	if len(store.accessTokens) != 1 || len(store.refreshTokens) != 1 || len(store.superseded) != 0 {
+		t.Errorf("The token family was NOT revoked, %v access tokens and %v refresh tokens remain\n",
+			len(store.accessTokens), len(store.refreshTokens))
+	}
+	if len(auditor.events) != 1 || auditor.events[0].Type != models.AuditEventRefreshTokenReuse {
+		t.Errorf("The reuse audit event was NOT emitted, got %v\n", auditor.events)
+	}
+}
+
+func TestVerifyRefreshTokenReusedWithoutSession(t *testing.T) {
+	store := newDummyFamilyStore()
+	delete(store.sessions, "session-1")
+	auditor := DummyAuditor{}
+	manager := NewRefreshTokenManager(store, &auditor)
+
+	err := manager.VerifyRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "gitlab-refresh-2"})
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("Verifying a superseded refresh token did NOT fail, got %v want %v\n", err, ErrRefreshTokenReused)
+	}
+	if _, found := store.refreshTokens["gitlab"]; found {
+		t.Errorf("The reused token was NOT revoked\n")
+	}
+	if len(store.sessions) != 1 || len(store.refreshTokens) != 2 {
+		t.Errorf("Tokens of other families were revoked, %v refresh tokens remain\n", len(store.refreshTokens))
+	}
+}
+
+func TestExchangeRefreshToken(t *testing.T) {
+	store := newDummyFamilyStore()
+	manager := NewRefreshTokenManager(store, &DummyAuditor{})
+
+	accessToken, err := manager.ExchangeRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "gitlab-refresh-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken.Value != "gitlab-access" {
+		t.Errorf("The exchanged access token is NOT correct, got %v want %v\n", accessToken.Value, "gitlab-access")
+	}
+
+	_, err = manager.ExchangeRefreshToken(ctx, models.RefreshToken{ID: "gitlab", Value: "gitlab-refresh-1"})
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("Exchanging a superseded refresh token did NOT fail, got %v want %v\n", err, ErrRefreshTokenReused)
+	}
+}